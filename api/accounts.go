@@ -0,0 +1,405 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+)
+
+// AccountDeletionPolicy is how deleted accounts are purged
+type AccountDeletionPolicy struct {
+	// Grace is how long the user has to change their mind
+	Grace time.Duration
+	// Chirps is what happens to the chirps of a purged account
+	Chirps database.ChirpPolicy
+	// PurgeInterval is how often the server looks for accounts to purge
+	PurgeInterval time.Duration
+}
+
+// AccountDeletionPolicyFromEnv reads ACCOUNT_DELETION_GRACE,
+// DELETED_ACCOUNT_CHIRPS and ACCOUNT_PURGE_INTERVAL
+func AccountDeletionPolicyFromEnv() (AccountDeletionPolicy, error) {
+	policy := AccountDeletionPolicy{
+		Grace:         database.DefaultAccountDeletionGrace,
+		Chirps:        database.ChirpsDelete,
+		PurgeInterval: time.Hour,
+	}
+
+	if grace := os.Getenv("ACCOUNT_DELETION_GRACE"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil || d < 0 {
+			return AccountDeletionPolicy{}, fmt.Errorf("ACCOUNT_DELETION_GRACE: expected a duration of at least 0, got %q", grace)
+		}
+		policy.Grace = d
+	}
+
+	if chirps := os.Getenv("DELETED_ACCOUNT_CHIRPS"); chirps != "" {
+		var err error
+		policy.Chirps, err = database.ParseChirpPolicy(chirps)
+		if err != nil {
+			return AccountDeletionPolicy{}, fmt.Errorf("DELETED_ACCOUNT_CHIRPS: %w", err)
+		}
+	}
+
+	if interval := os.Getenv("ACCOUNT_PURGE_INTERVAL"); interval != "" {
+		d, err := time.ParseDuration(interval)
+		if err != nil || d <= 0 {
+			return AccountDeletionPolicy{}, fmt.Errorf("ACCOUNT_PURGE_INTERVAL: expected a positive duration, got %q", interval)
+		}
+		policy.PurgeInterval = d
+	}
+
+	return policy, nil
+}
+
+// accountExport is everything kept about a user, secrets and hashes
+// are left out
+type accountExport struct {
+	ExportedAt   time.Time             `json:"exported_at"`
+	Profile      exportedProfile       `json:"profile"`
+	Chirps       []database.Chirp      `json:"chirps"`
+	Sessions     []database.Session    `json:"sessions"`
+	APIKeys      []returnedAPIKey      `json:"api_keys"`
+	OAuthClients []returnedOAuthClient `json:"oauth_clients"`
+}
+
+type exportedProfile struct {
+	Id            int                       `json:"id"`
+	Email         string                    `json:"email"`
+	EmailVerified bool                      `json:"email_verified"`
+	IsChirpyRed   bool                      `json:"is_chirpy_red"`
+	Role          database.Role             `json:"role"`
+	MFAEnabled    bool                      `json:"mfa_enabled"`
+	Deletion      *database.AccountDeletion `json:"deletion,omitempty"`
+}
+
+// exportAccount gathers the data of the user
+func (cfg *ApiConfig) exportAccount(userId int, now time.Time) (accountExport, error) {
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		return accountExport{}, err
+	}
+
+	export := accountExport{
+		ExportedAt: now,
+		Profile: exportedProfile{
+			Id:            user.Id,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			IsChirpyRed:   user.IsChirpyRed,
+			Role:          user.Role,
+		},
+		Chirps:       []database.Chirp{},
+		APIKeys:      []returnedAPIKey{},
+		OAuthClients: []returnedOAuthClient{},
+	}
+
+	export.Profile.MFAEnabled, err = cfg.db.HasTOTP(userId)
+	if err != nil {
+		return accountExport{}, err
+	}
+
+	deletion, err := cfg.db.GetAccountDeletion(userId)
+	if err == nil {
+		export.Profile.Deletion = &deletion
+	} else if !errors.Is(err, database.ErrAccountDeletionNotFound) {
+		return accountExport{}, err
+	}
+
+	chirps, err := cfg.db.GetChirps()
+	if err != nil {
+		return accountExport{}, err
+	}
+	for _, chirp := range chirps {
+		if chirp.AutherId == userId {
+			export.Chirps = append(export.Chirps, chirp)
+		}
+	}
+
+	export.Sessions, err = cfg.db.GetSessions(userId, now)
+	if err != nil {
+		return accountExport{}, err
+	}
+
+	keys, err := cfg.db.GetAPIKeys(userId)
+	if err != nil {
+		return accountExport{}, err
+	}
+	for _, key := range keys {
+		export.APIKeys = append(export.APIKeys, newReturnedAPIKey(key))
+	}
+
+	clients, err := cfg.db.GetOAuthClients(userId)
+	if err != nil {
+		return accountExport{}, err
+	}
+	for _, client := range clients {
+		export.OAuthClients = append(export.OAuthClients, newReturnedOAuthClient(client))
+	}
+
+	return export, nil
+}
+
+// zipExport writes the export as an archive with a json file per part
+func zipExport(export accountExport) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	archive := zip.NewWriter(buf)
+
+	files := []struct {
+		name    string
+		content any
+	}{
+		{"profile.json", export.Profile},
+		{"chirps.json", export.Chirps},
+		{"sessions.json", export.Sessions},
+		{"api_keys.json", export.APIKeys},
+		{"oauth_clients.json", export.OAuthClients},
+	}
+	for _, file := range files {
+		f, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: export.ExportedAt})
+		if err != nil {
+			return nil, err
+		}
+
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(file.content)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.name, err)
+		}
+	}
+
+	err := archive.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// HandlerExportUser answers with the data of the user as json, or as a
+// zip archive with ?format=zip
+func (cfg *ApiConfig) HandlerExportUser(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "zip" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userId, _ := auth.UserIdFromContext(r.Context())
+	now := time.Now().UTC()
+
+	export, err := cfg.exportAccount(userId, now)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error exporting user: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	name := fmt.Sprintf("chirpy-%d-%s", userId, now.Format("20060102T150405Z"))
+
+	if format == "zip" {
+		archive, err := zipExport(export)
+		if err != nil {
+			fmt.Printf("Error archiving export: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/zip")
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.zip"`, name))
+		w.WriteHeader(http.StatusOK)
+		w.Write(archive)
+		return
+	}
+
+	json, err := json.Marshal(export)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s.json"`, name))
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// HandlerDeleteUser schedules the account of the user to be purged after
+// the grace period given the password of the user, logs it out everywhere
+// and revokes its api keys. Logging back in and cancelling keeps the account
+func (cfg *ApiConfig) HandlerDeleteUser(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	user, err := cfg.db.GetUserById(userId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error getting user: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the password is guessed at like a login
+	if wait := cfg.loginWait(user.Email, r); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+
+	_, err = cfg.db.GetUser(user.Email, params.Password)
+	if errors.Is(err, database.ErrWrongPassword) {
+		cfg.loginFailed(user.Email, r)
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error checking password: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	cfg.accountLimiter.Reset(accountKey(user.Email))
+
+	now := time.Now().UTC()
+	deletion, err := cfg.db.ScheduleAccountDeletion(userId, now, cfg.deletionPolicy.Grace)
+	if err != nil {
+		fmt.Printf("Error scheduling account deletion: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the store revokes the sessions, impersonations are only in the audit log
+	err = cfg.revokeImpersonations(userId, now)
+	if err != nil {
+		fmt.Printf("Error revoking impersonations: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(deletion)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(json)
+}
+
+// HandlerGetAccountDeletion answers with the pending deletion of the
+// account of the user
+func (cfg *ApiConfig) HandlerGetAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	deletion, err := cfg.db.GetAccountDeletion(userId)
+	if errors.Is(err, database.ErrAccountDeletionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error getting account deletion: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(deletion)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// HandlerCancelAccountDeletion keeps the account of the user
+func (cfg *ApiConfig) HandlerCancelAccountDeletion(w http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	err := cfg.db.CancelAccountDeletion(userId)
+	if errors.Is(err, database.ErrAccountDeletionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error cancelling account deletion: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PurgeAccounts deletes the accounts whose grace period is over and
+// returns their ids, along with the impersonations of them
+func (cfg *ApiConfig) PurgeAccounts(now time.Time) ([]int, error) {
+	purged, err := cfg.db.PurgeAccounts(now, cfg.deletionPolicy.Chirps)
+	if err != nil {
+		return purged, err
+	}
+
+	for _, userId := range purged {
+		err = cfg.revokeImpersonations(userId, now)
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// RunAccountPurge purges the accounts that are due every purge interval
+// until ctx is done
+func (cfg *ApiConfig) RunAccountPurge(ctx context.Context) {
+	ticker := time.NewTicker(cfg.deletionPolicy.PurgeInterval)
+	defer ticker.Stop()
+
+	for {
+		purged, err := cfg.PurgeAccounts(time.Now().UTC())
+		if err != nil {
+			fmt.Printf("Error purging accounts: %s\n", err)
+		}
+		for _, userId := range purged {
+			fmt.Printf("purged the account of user %d\n", userId)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package api
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/neet-007/chirpy/database"
+)
+
+func TestExportUser(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	user := login(t, handler)
+
+	_, err := cfg.db.CreateChirp(user.Id, "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := cfg.db.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.db.CreateChirp(other.Id, "theirs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handler, http.MethodGet, "/api/users/export?format=xml", user.Token, "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown format to be rejected, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodGet, "/api/users/export", user.Token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the export, got %d", w.Code)
+	}
+	export := accountExport{}
+	err = json.Unmarshal(w.Body.Bytes(), &export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if export.Profile.Email != "a@example.com" || len(export.Chirps) != 1 || export.Chirps[0].Body != "mine" || len(export.Sessions) != 1 {
+		t.Errorf("expected the profile, chirp and session of the user, got %+v", export)
+	}
+	if bytes.Contains(w.Body.Bytes(), []byte("$argon2id$")) {
+		t.Errorf("expected no password hash in the export")
+	}
+
+	w = serve(handler, http.MethodGet, "/api/users/export?format=zip", user.Token, "")
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("expected a zip archive, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	archive, err := zip.NewReader(bytes.NewReader(w.Body.Bytes()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{}
+	for _, file := range archive.File {
+		f, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name], err = io.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"profile.json", "chirps.json", "sessions.json", "api_keys.json", "oauth_clients.json"} {
+		if _, ok := files[name]; !ok {
+			t.Errorf("expected %s in the archive, got %d files", name, len(files))
+		}
+	}
+	chirps := []database.Chirp{}
+	err = json.Unmarshal(files["chirps.json"], &chirps)
+	if err != nil || len(chirps) != 1 {
+		t.Errorf("expected the chirp of the user in chirps.json, got %+v %v", chirps, err)
+	}
+}
+
+func TestDeleteUser(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	user := login(t, handler)
+
+	_, err := cfg.db.CreateChirp(user.Id, "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handler, http.MethodPost, "/api/keys", user.Token, `{"name":"bot","scopes":["chirps:write"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the key created, got %d", w.Code)
+	}
+	key := struct {
+		Key string `json:"key"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = serve(handler, http.MethodDelete, "/api/users", user.Token, `{"password":"wrong"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected a wrong password to be rejected, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodDelete, "/api/users", user.Token, `{"password":"password"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the password confirmation to back off like a login, got %d", w.Code)
+	}
+	cfg.accountLimiter.Reset(accountKey("a@example.com"))
+
+	w = serve(handler, http.MethodDelete, "/api/users", user.Token, `{"password":"password"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected the deletion scheduled, got %d", w.Code)
+	}
+	deletion := database.AccountDeletion{}
+	err = json.Unmarshal(w.Body.Bytes(), &deletion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deletion.PurgeAt.Sub(deletion.RequestedAt) != time.Hour {
+		t.Errorf("expected the grace period of the policy, got %+v", deletion)
+	}
+
+	// scheduling logs the user out, logging back in can cancel it
+	w = serve(handler, http.MethodGet, "/api/users/deletion", user.Token, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the old token revoked, got %d", w.Code)
+	}
+	w = serveWithKey(handler, http.MethodPost, "/api/chirps", key.Key, `{"body":"after asking"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the api key revoked, got %d", w.Code)
+	}
+	user = login(t, handler)
+	w = serve(handler, http.MethodGet, "/api/users/deletion", user.Token, "")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the pending deletion, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodDelete, "/api/users/deletion", user.Token, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the deletion cancelled, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/users/deletion", user.Token, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected no pending deletion, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodDelete, "/api/users", user.Token, `{"password":"password"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected the deletion scheduled again, got %d", w.Code)
+	}
+
+	purged, err := cfg.PurgeAccounts(time.Now().UTC())
+	if err != nil || len(purged) != 0 {
+		t.Fatalf("expected nothing purged during the grace period, got %v %v", purged, err)
+	}
+	purged, err = cfg.PurgeAccounts(time.Now().UTC().Add(time.Hour))
+	if err != nil || len(purged) != 1 || purged[0] != user.Id {
+		t.Fatalf("expected the user purged, got %v %v", purged, err)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/login", "", `{"email":"a@example.com","password":"password"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the purged user unable to log in, got %d", w.Code)
+	}
+	_, err = cfg.db.GetUserById(user.Id)
+	if !errors.Is(err, database.ErrUserNotFound) {
+		t.Errorf("expected the user gone, got %v", err)
+	}
+	chirps, err := cfg.db.GetChirps()
+	if err != nil || len(chirps) != 1 || chirps[0].AutherId != database.DeletedUserId {
+		t.Errorf("expected the chirp anonymized, got %+v %v", chirps, err)
+	}
+
+	// the email is free again
+	w = serve(handler, http.MethodPost, "/api/users", "", `{"email":"a@example.com","password":"new password"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected the email reusable, got %d", w.Code)
+	}
+}
+
+func TestDeleteUserRevokesImpersonations(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	user := login(t, handler)
+	admin := loginAdmin(t, cfg, handler)
+
+	revoked := func(tokenId string) bool {
+		t.Helper()
+		revoked, err := cfg.db.IsAccessTokenRevoked(tokenId)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return revoked
+	}
+
+	started := impersonate(t, handler, admin, user.Id, `{"reason":"ticket 1"}`)
+	w := serve(handler, http.MethodDelete, "/api/users", user.Token, `{"password":"password"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected the deletion scheduled, got %d", w.Code)
+	}
+	if !revoked(started.TokenId) {
+		t.Errorf("expected scheduling the deletion to revoke the impersonation")
+	}
+
+	// an impersonation started during the grace period ends with the purge
+	now := time.Now().UTC()
+	err := cfg.db.CancelAccountDeletion(user.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.db.ScheduleAccountDeletion(user.Id, now, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started = impersonate(t, handler, admin, user.Id, `{"reason":"ticket 2"}`)
+	purged, err := cfg.PurgeAccounts(now.Add(time.Minute))
+	if err != nil || len(purged) != 1 {
+		t.Fatalf("expected the user purged, got %v %v", purged, err)
+	}
+	if !revoked(started.TokenId) {
+		t.Errorf("expected the purge to revoke the impersonation")
+	}
+}
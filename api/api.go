@@ -2,36 +2,303 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/neet-007/chirpy/auth"
 	"github.com/neet-007/chirpy/database"
+	"github.com/neet-007/chirpy/mail"
+	"golang.org/x/crypto/bcrypt"
 )
 
-func NewApiConfig() (ApiConfig, error) {
-	db, err := database.NewDB("./database/database.json")
+const accessTokenExpiresIn = time.Hour
+
+// OptionsFromEnv reads DB_PERSIST, DB_FLUSH_INTERVAL_MS,
+// DB_COMPACT_THRESHOLD_BYTES, the encryption keys and the password hasher
+func OptionsFromEnv() (database.Options, error) {
+	options := database.Options{
+		Policy: database.PersistPolicy(os.Getenv("DB_PERSIST")),
+	}
+
+	if flushMs := os.Getenv("DB_FLUSH_INTERVAL_MS"); flushMs != "" {
+		ms, err := strconv.Atoi(flushMs)
+		if err != nil {
+			return database.Options{}, fmt.Errorf("DB_FLUSH_INTERVAL_MS: %w", err)
+		}
+		options.FlushInterval = time.Duration(ms) * time.Millisecond
+	}
+
+	if compactBytes := os.Getenv("DB_COMPACT_THRESHOLD_BYTES"); compactBytes != "" {
+		n, err := strconv.ParseInt(compactBytes, 10, 64)
+		if err != nil {
+			return database.Options{}, fmt.Errorf("DB_COMPACT_THRESHOLD_BYTES: %w", err)
+		}
+		options.CompactThreshold = n
+	}
+
+	keys, err := KeyringFromEnv()
+	if err != nil {
+		return database.Options{}, err
+	}
+	options.Keys = keys
+
+	hasher, err := PasswordHasherFromEnv()
+	if err != nil {
+		return database.Options{}, err
+	}
+	options.Hasher = hasher
+
+	return options, nil
+}
+
+// PasswordHasherFromEnv hashes new passwords with PASSWORD_HASHER, argon2id
+// by default tuned with ARGON2_TIME, ARGON2_MEMORY_KIB and ARGON2_THREADS,
+// or bcrypt at BCRYPT_COST. Passwords hashed otherwise are hashed again
+// when their user logs in
+func PasswordHasherFromEnv() (database.PasswordHasher, error) {
+	switch hasher := os.Getenv("PASSWORD_HASHER"); hasher {
+	case "", "argon2id":
+		argon2id := database.DefaultArgon2idHasher
+		for _, param := range []struct {
+			name  string
+			value *uint32
+		}{
+			{"ARGON2_TIME", &argon2id.Time},
+			{"ARGON2_MEMORY_KIB", &argon2id.Memory},
+		} {
+			if v := os.Getenv(param.name); v != "" {
+				n, err := strconv.ParseUint(v, 10, 32)
+				if err != nil || n < 1 {
+					return nil, fmt.Errorf("%s: expected a positive number, got %q", param.name, v)
+				}
+				*param.value = uint32(n)
+			}
+		}
+		if v := os.Getenv("ARGON2_THREADS"); v != "" {
+			n, err := strconv.ParseUint(v, 10, 8)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("ARGON2_THREADS: expected a number from 1 to 255, got %q", v)
+			}
+			argon2id.Threads = uint8(n)
+		}
+		return argon2id, nil
+	case "bcrypt":
+		cost := bcrypt.DefaultCost
+		if v := os.Getenv("BCRYPT_COST"); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < bcrypt.MinCost || n > bcrypt.MaxCost {
+				return nil, fmt.Errorf("BCRYPT_COST: expected a number from %d to %d, got %q", bcrypt.MinCost, bcrypt.MaxCost, v)
+			}
+			cost = n
+		}
+		return database.BcryptHasher{Cost: cost}, nil
+	default:
+		return nil, fmt.Errorf("PASSWORD_HASHER: expected argon2id or bcrypt, got %q", hasher)
+	}
+}
+
+// KeyringFromEnv reads the encryption keys from the file at
+// DB_ENCRYPTION_KEY_FILE or from DB_ENCRYPTION_KEYS, the database
+// isn't encrypted when neither is set
+func KeyringFromEnv() (*database.Keyring, error) {
+	keyFile := os.Getenv("DB_ENCRYPTION_KEY_FILE")
+	keys := os.Getenv("DB_ENCRYPTION_KEYS")
+
+	switch {
+	case keyFile != "" && keys != "":
+		return nil, fmt.Errorf("set only one of DB_ENCRYPTION_KEY_FILE and DB_ENCRYPTION_KEYS")
+	case keyFile != "":
+		return database.ReadKeyringFile(keyFile)
+	case keys != "":
+		keyring, err := database.ParseKeyring(keys)
+		if err != nil {
+			return nil, fmt.Errorf("DB_ENCRYPTION_KEYS: %w", err)
+		}
+		return keyring, nil
+	}
+
+	return nil, nil
+}
+
+// AuthenticatorFromEnv signs tokens with the first of the PEM key files
+// in JWT_KEY_FILES, the others only verify. Without key files tokens are
+// signed with JWT_SECRET, with them the secret only verifies old tokens
+func AuthenticatorFromEnv() (*auth.Authenticator, error) {
+	keys := []auth.Key{}
+	for _, path := range strings.Split(os.Getenv("JWT_KEY_FILES"), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+
+		key, err := auth.LoadKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_KEY_FILES: %w", err)
+		}
+		keys = append(keys, key)
+	}
+
+	authenticator, err := auth.NewAuthenticator([]byte(os.Getenv("JWT_SECRET")), keys...)
+	if err != nil {
+		return nil, fmt.Errorf("JWT_SECRET or JWT_KEY_FILES: %w", err)
+	}
+
+	return authenticator, nil
+}
+
+func NewApiConfig() (_ ApiConfig, err error) {
+	options, err := OptionsFromEnv()
+	if err != nil {
+		return ApiConfig{}, err
+	}
+
+	// the file server would hand out the database and the files next to it
+	dbPath := os.Getenv("DB_PATH")
+	if dbPath != "" {
+		served, err := insideDir(filepath.Dir(dbPath), FileserverRoot)
+		if err != nil {
+			return ApiConfig{}, fmt.Errorf("DB_PATH: %w", err)
+		}
+		if served {
+			return ApiConfig{}, fmt.Errorf("DB_PATH: %s is served under /app/", dbPath)
+		}
+	}
+
+	db, err := database.Open(os.Getenv("DB_DRIVER"), dbPath, options)
 
 	if err != nil {
 		return ApiConfig{}, err
 	}
+	// the store holds the lock of the database until it is closed
+	defer func() {
+		if err != nil {
+			db.Close()
+		}
+	}()
+
+	// wiping the database is opt in, meant for development
+	seedPath := os.Getenv("DB_SEED")
+	if os.Getenv("DB_RESET") == "true" || seedPath != "" {
+		err = db.Reset(seedPath)
+		if err != nil {
+			return ApiConfig{}, err
+		}
+	}
+
+	backupPolicy, err := BackupPolicyFromEnv()
+	if err != nil {
+		return ApiConfig{}, err
+	}
+
+	authenticator, err := AuthenticatorFromEnv()
+	if err != nil {
+		return ApiConfig{}, err
+	}
+
+	refreshTokenTTL := database.DefaultRefreshTokenTTL
+	if ttl := os.Getenv("REFRESH_TOKEN_TTL"); ttl != "" {
+		refreshTokenTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			return ApiConfig{}, fmt.Errorf("REFRESH_TOKEN_TTL: %w", err)
+		}
+	}
+	passwordResetTTL := database.DefaultPasswordResetTTL
+	if ttl := os.Getenv("PASSWORD_RESET_TTL"); ttl != "" {
+		passwordResetTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			return ApiConfig{}, fmt.Errorf("PASSWORD_RESET_TTL: %w", err)
+		}
+	}
+	impersonationTTL := defaultImpersonationTTL
+	if ttl := os.Getenv("IMPERSONATION_TTL"); ttl != "" {
+		impersonationTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			return ApiConfig{}, fmt.Errorf("IMPERSONATION_TTL: %w", err)
+		}
+	}
+	// ending an impersonation denies its token for an access token lifetime
+	if impersonationTTL <= 0 || impersonationTTL > accessTokenExpiresIn {
+		return ApiConfig{}, fmt.Errorf("IMPERSONATION_TTL: %s is not between 0 and the access token lifetime %s", impersonationTTL, accessTokenExpiresIn)
+	}
+	emailVerificationTTL := database.DefaultEmailVerificationTTL
+	if ttl := os.Getenv("EMAIL_VERIFICATION_TTL"); ttl != "" {
+		emailVerificationTTL, err = time.ParseDuration(ttl)
+		if err != nil {
+			return ApiConfig{}, fmt.Errorf("EMAIL_VERIFICATION_TTL: %w", err)
+		}
+	}
+
+	mailer, err := MailerFromEnv()
+	if err != nil {
+		return ApiConfig{}, err
+	}
+
+	accountPolicy, ipPolicy, err := LockoutPoliciesFromEnv()
+	if err != nil {
+		return ApiConfig{}, err
+	}
+
+	passwordPolicy, err := PasswordPolicyFromEnv()
+	if err != nil {
+		return ApiConfig{}, err
+	}
+
+	deletionPolicy, err := AccountDeletionPolicyFromEnv()
+	if err != nil {
+		return ApiConfig{}, err
+	}
+
+	// revoking a session denies the access tokens recorded with its
+	// refresh tokens, those records must outlive the access tokens
+	if refreshTokenTTL < accessTokenExpiresIn {
+		return ApiConfig{}, fmt.Errorf("REFRESH_TOKEN_TTL: %s is shorter than the access token lifetime %s", refreshTokenTTL, accessTokenExpiresIn)
+	}
 
 	return ApiConfig{
-		fileserverHits: 0,
-		db:             db,
-		jwtSecret:      []byte(os.Getenv("JWT_SECRET")),
-		polkaApiKey:    os.Getenv("POLKA_API_KEY"),
+		fileserverHits:       0,
+		db:                   db,
+		authenticator:        authenticator,
+		refreshTokenTTL:      refreshTokenTTL,
+		passwordResetTTL:     passwordResetTTL,
+		emailVerificationTTL: emailVerificationTTL,
+		impersonationTTL:     impersonationTTL,
+		mailer:               mailer,
+		accountLimiter:       auth.NewLimiter(accountPolicy, nil),
+		ipLimiter:            auth.NewLimiter(ipPolicy, nil),
+		passwordPolicy:       passwordPolicy,
+		deletionPolicy:       deletionPolicy,
+		polkaApiKey:          os.Getenv("POLKA_API_KEY"),
+		backupPolicy:         backupPolicy,
 	}, nil
 
 }
 
 type ApiConfig struct {
-	fileserverHits int
-	db             *database.DB
-	jwtSecret      []byte
-	polkaApiKey    string
+	fileserverHits       int
+	db                   database.Store
+	authenticator        *auth.Authenticator
+	refreshTokenTTL      time.Duration
+	passwordResetTTL     time.Duration
+	emailVerificationTTL time.Duration
+	impersonationTTL     time.Duration
+	mailer               mail.Mailer
+	accountLimiter       *auth.Limiter
+	ipLimiter            *auth.Limiter
+	passwordPolicy       auth.PasswordPolicy
+	deletionPolicy       AccountDeletionPolicy
+	polkaApiKey          string
+	backupPolicy         database.BackupPolicy
+}
+
+// Close flushes and closes the database
+func (cfg *ApiConfig) Close() error {
+	return cfg.db.Close()
 }
 
 func (cfg *ApiConfig) HandlerChirpRedWebHook(w http.ResponseWriter, r *http.Request) {
@@ -42,32 +309,20 @@ func (cfg *ApiConfig) HandlerChirpRedWebHook(w http.ResponseWriter, r *http.Requ
 		} `json:"data"`
 	}
 
-	tokenHeader := r.Header.Get("Authorization")
-
-	if tokenHeader == "" {
-		fmt.Printf("no auth token\n")
-		return
-	}
-
-	tokenFields := strings.Fields(tokenHeader)
-	if len(tokenFields) != 2 {
-		fmt.Printf("auth token length is not 2\n")
-		return
-	}
-
-	if tokenFields[0] != "ApiKey" {
-		fmt.Printf("wrong header\n")
+	apiKey, err := auth.ApiKey(r.Header)
+	if err != nil {
+		fmt.Printf("%s\n", err)
 		return
 	}
 
-	if tokenFields[1] != cfg.polkaApiKey {
-		fmt.Printf("wrong api key %s vs %s \n", tokenFields[1], cfg.polkaApiKey)
+	if apiKey != cfg.polkaApiKey {
+		fmt.Printf("wrong api key %s vs %s \n", apiKey, cfg.polkaApiKey)
 		return
 	}
 
 	decoder := json.NewDecoder(r.Body)
 	params := parammeter{}
-	err := decoder.Decode(&params)
+	err = decoder.Decode(&params)
 
 	if err != nil {
 		fmt.Printf("Error decoding parameters: %s", err)
@@ -135,20 +390,9 @@ func (cfg *ApiConfig) HandlerDeleteChirp(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	tokenHeader := r.Header.Get("Authorization")
+	userId, _ := auth.UserIdFromContext(r.Context())
 
-	if tokenHeader == "" {
-		fmt.Printf("no auth token")
-		return
-	}
-
-	tokenFields := strings.Fields(tokenHeader)
-	if len(tokenFields) != 2 {
-		fmt.Printf("auth token length is not 2")
-		return
-	}
-
-	err = cfg.db.DeleteChirp(id, tokenFields[1], cfg.jwtSecret)
+	err = cfg.db.DeleteChirp(id, userId)
 	if err != nil {
 		w.WriteHeader(http.StatusNetworkAuthenticationRequired)
 		return
@@ -216,20 +460,9 @@ func (cfg *ApiConfig) HandlerValidatePost(w http.ResponseWriter, r *http.Request
 
 	CleanedBody := cleanProfane(params.Body)
 
-	tokenHeader := r.Header.Get("Authorization")
-
-	if tokenHeader == "" {
-		fmt.Printf("no auth token")
-		return
-	}
+	userId, _ := auth.UserIdFromContext(r.Context())
 
-	tokenFields := strings.Fields(tokenHeader)
-	if len(tokenFields) != 2 {
-		fmt.Printf("auth token length is not 2")
-		return
-	}
-
-	newData, err := cfg.db.CreateChirp(CleanedBody, tokenFields[1], cfg.jwtSecret)
+	newData, err := cfg.db.CreateChirp(userId, CleanedBody)
 	fmt.Println(newData)
 	if err != nil {
 		fmt.Printf("Error creating chirp value: %s", err)
@@ -264,15 +497,78 @@ func (cfg *ApiConfig) HandlerLogUser(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-	expiresInSeconds := 3600
 
-	newData, err := cfg.db.GetUser(params.Email, params.Password, expiresInSeconds, cfg.jwtSecret)
+	// checked before the password so a locked out account can't be guessed at
+	if wait := cfg.loginWait(params.Email, r); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+
+	newData, err := cfg.db.GetUser(params.Email, params.Password)
+	if errors.Is(err, database.ErrUserNotFound) || errors.Is(err, database.ErrWrongPassword) {
+		cfg.loginFailed(params.Email, r)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
 	if err != nil {
 		fmt.Printf("Error creating chirp value: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	enrolled, err := cfg.db.HasTOTP(newData.Id)
+	if err != nil {
+		fmt.Printf("Error checking totp: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if enrolled {
+		cfg.challengeLogin(w, newData.Id)
+		return
+	}
+
+	cfg.logIn(w, r, newData)
+}
+
+// logIn starts a session for the user and answers with its tokens, the
+// user has passed every factor so its failed logins are forgotten
+func (cfg *ApiConfig) logIn(w http.ResponseWriter, r *http.Request, newData database.ReturnedUser) {
+	cfg.accountLimiter.Reset(accountKey(newData.Email))
+
+	var err error
+	newData.RefreshToken, err = auth.NewRefreshToken()
+	if err != nil {
+		fmt.Printf("Error issuing refresh token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	access, err := newAccessToken(now)
+	if err != nil {
+		fmt.Printf("Error issuing access token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	session, err := cfg.db.CreateSession(newData.RefreshToken, database.Session{
+		UserId:    newData.Id,
+		UserAgent: r.UserAgent(),
+		IP:        clientIP(r),
+	}, access, now, cfg.refreshTokenTTL)
+	if err != nil {
+		fmt.Printf("Error starting session: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	newData.Token, err = cfg.authenticator.IssueAccessToken(newData.Id, string(newData.Role), session.Id, access.Id, access.ExpiresAt)
+	if err != nil {
+		fmt.Printf("Error issuing access token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
 	json, err := json.Marshal(newData)
 	if err != nil {
 		fmt.Printf("Error encoding return value: %s", err)
@@ -286,23 +582,49 @@ func (cfg *ApiConfig) HandlerLogUser(w http.ResponseWriter, r *http.Request) {
 }
 
 func (cfg *ApiConfig) HandlerRefreshToken(w http.ResponseWriter, r *http.Request) {
-	tokenHeader := r.Header.Get("Authorization")
+	refreshToken, err := auth.BearerToken(r.Header)
+	if err != nil {
+		fmt.Printf("%s", err)
+		return
+	}
+
+	type returnVal struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	newData := returnVal{}
+	newData.RefreshToken, err = auth.NewRefreshToken()
+	if err != nil {
+		fmt.Printf("Error issuing refresh token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
 
-	if tokenHeader == "" {
-		fmt.Printf("no auth token")
+	now := time.Now().UTC()
+	access, err := newAccessToken(now)
+	if err != nil {
+		fmt.Printf("Error issuing access token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	tokenFields := strings.Fields(tokenHeader)
-	if len(tokenFields) != 2 {
-		fmt.Printf("auth token length is not 2")
+	// the old token is spent, reusing it revokes the session
+	session, err := cfg.db.RotateRefreshToken(refreshToken, newData.RefreshToken, access, now, cfg.refreshTokenTTL)
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenExpired) || errors.Is(err, database.ErrTokenReused) {
+		fmt.Printf("Error rotating refresh token: %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error rotating refresh token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	expiresInSeconds := 3600
-	newData, err := cfg.db.RefreshToken(tokenFields[1], cfg.jwtSecret, expiresInSeconds)
+	newData.Token, err = cfg.issueSessionToken(session, access)
 	if err != nil {
-		fmt.Printf("Error creating chirp value: %s", err)
+		fmt.Printf("Error issuing access token: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
@@ -320,20 +642,18 @@ func (cfg *ApiConfig) HandlerRefreshToken(w http.ResponseWriter, r *http.Request
 }
 
 func (cfg *ApiConfig) HandlerRevokeToken(w http.ResponseWriter, r *http.Request) {
-	tokenHeader := r.Header.Get("Authorization")
-
-	if tokenHeader == "" {
-		fmt.Printf("no auth token")
+	refreshToken, err := auth.BearerToken(r.Header)
+	if err != nil {
+		fmt.Printf("%s", err)
 		return
 	}
 
-	tokenFields := strings.Fields(tokenHeader)
-	if len(tokenFields) != 2 {
-		fmt.Printf("auth token length is not 2")
+	err = cfg.db.RevokeRefreshToken(refreshToken)
+	if errors.Is(err, database.ErrTokenNotFound) {
+		fmt.Printf("Error revoking refresh token: %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
-
-	err := cfg.db.RevokeToken(tokenFields[1])
 	if err != nil {
 		fmt.Printf("Error creating chirp value: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
@@ -343,6 +663,8 @@ func (cfg *ApiConfig) HandlerRevokeToken(w http.ResponseWriter, r *http.Request)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// HandlerUpdateUser changes the email or password of the user, only a
+// login of the user itself may, never an api key or an oauth client
 func (cfg *ApiConfig) HandlerUpdateUser(w http.ResponseWriter, r *http.Request) {
 	type parammeter struct {
 		Email    string `json:"email"`
@@ -359,26 +681,39 @@ func (cfg *ApiConfig) HandlerUpdateUser(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	tokenHeader := r.Header.Get("Authorization")
+	if params.Password != "" {
+		err = cfg.passwordPolicy.Check(params.Password)
+		if err != nil {
+			rejectPassword(w, err)
+			return
+		}
+	}
+
+	userId, _ := auth.UserIdFromContext(r.Context())
 
-	if tokenHeader == "" {
-		fmt.Printf("no auth token")
+	newData, err := cfg.db.UpdateUser(userId, params.Email, params.Password)
+	if errors.Is(err, database.ErrInvalidEmail) {
+		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
-
-	tokenFields := strings.Fields(tokenHeader)
-	if len(tokenFields) != 2 {
-		fmt.Printf("auth token length is not 2")
+	if errors.Is(err, database.ErrEmailTaken) {
+		w.WriteHeader(http.StatusConflict)
 		return
 	}
-
-	newData, err := cfg.db.UpdateUser(tokenFields[1], cfg.jwtSecret, params.Email, params.Password)
 	if err != nil {
 		fmt.Printf("Error creating chirp value: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// a changed email is unverified until the user confirms it
+	if params.Email != "" && !newData.EmailVerified {
+		err = cfg.sendEmailVerification(newData.Id)
+		if err != nil {
+			fmt.Printf("Error sending email verification: %s", err)
+		}
+	}
+
 	json, err := json.Marshal(newData)
 	if err != nil {
 		fmt.Printf("Error encoding return value: %s", err)
@@ -407,13 +742,33 @@ func (cfg *ApiConfig) HandlerCreateUser(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	err = cfg.passwordPolicy.Check(params.Password)
+	if err != nil {
+		rejectPassword(w, err)
+		return
+	}
+
 	newData, err := cfg.db.CreateUser(params.Email, params.Password)
+	if errors.Is(err, database.ErrInvalidEmail) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, database.ErrEmailTaken) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
 	if err != nil {
 		fmt.Printf("Error creating chirp value: %s", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
+	// the user is created either way, the mail can be sent again
+	err = cfg.sendEmailVerification(newData.Id)
+	if err != nil {
+		fmt.Printf("Error sending email verification: %s", err)
+	}
+
 	json, err := json.Marshal(newData)
 	if err != nil {
 		fmt.Printf("Error encoding return value: %s", err)
@@ -426,6 +781,44 @@ func (cfg *ApiConfig) HandlerCreateUser(w http.ResponseWriter, r *http.Request)
 	w.Write(json)
 }
 
+// HandlerJWKS serves the public keys that verify access tokens
+func (cfg *ApiConfig) HandlerJWKS(w http.ResponseWriter, r *http.Request) {
+	json, err := json.Marshal(cfg.authenticator.JWKS())
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// MiddlewareAuth only lets requests with a valid access token that
+// wasn't revoked through, tokens of oauth clients and impersonation
+// tokens are turned away with a 403 since they may only use the routes
+// their scopes allow
+func (cfg *ApiConfig) MiddlewareAuth(next http.Handler) http.Handler {
+	return cfg.middlewareToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := auth.ClaimsFromContext(r.Context())
+		if claims.ClientId != "" || claims.Impersonated() {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// middlewareToken lets requests with any valid access token that wasn't
+// revoked through, including those of oauth clients. Impersonated
+// requests are recorded in the audit log
+func (cfg *ApiConfig) middlewareToken(next http.Handler) http.Handler {
+	return cfg.authenticator.Middleware(cfg.middlewareAudit(next), cfg.checkAccessToken)
+}
+
 func (cfg *ApiConfig) MiddlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		cfg.fileserverHits++
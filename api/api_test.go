@@ -1,7 +1,12 @@
 package api
 
 import (
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+
+	"github.com/neet-007/chirpy/database"
 )
 
 func TestCleanProfane(t *testing.T) {
@@ -30,3 +35,54 @@ func TestCleanProfane(t *testing.T) {
 		}
 	}
 }
+
+func TestNewApiConfigClosesStoreOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	t.Setenv("DB_DRIVER", database.DriverJSON)
+	t.Setenv("DB_PATH", path)
+	t.Setenv("JWT_SECRET", "secret")
+	t.Setenv("REFRESH_TOKEN_TTL", "forever")
+
+	_, err := NewApiConfig()
+	if err == nil {
+		t.Fatal("expected a bad REFRESH_TOKEN_TTL to be rejected")
+	}
+
+	// the lock was released with the store
+	db, err := database.Open(database.DriverJSON, path, database.Options{})
+	if err != nil {
+		t.Fatalf("expected the database closed, got %v", err)
+	}
+	db.Close()
+}
+
+func TestNewApiConfigKeepsDatabaseOutOfServedTree(t *testing.T) {
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	t.Setenv("HOME", config)
+	t.Setenv("DB_DRIVER", database.DriverJSON)
+	t.Setenv("JWT_SECRET", "secret")
+
+	for _, path := range []string{"database.json", "./database/database.json", "oauth/database.json"} {
+		t.Setenv("DB_PATH", path)
+		_, err := NewApiConfig()
+		if err == nil || !strings.Contains(err.Error(), "DB_PATH") {
+			t.Errorf("expected %s to be refused, got %v", path, err)
+		}
+		if _, err := os.Stat(path); err == nil {
+			t.Errorf("expected %s not to be created", path)
+		}
+	}
+
+	// the default is opened in the config dir, the bad ttl fails after it
+	t.Setenv("DB_PATH", "")
+	t.Setenv("REFRESH_TOKEN_TTL", "forever")
+	_, err := NewApiConfig()
+	if err == nil {
+		t.Fatal("expected a bad REFRESH_TOKEN_TTL to be rejected")
+	}
+	_, err = os.Stat(filepath.Join(config, "chirpy", "database.json"))
+	if err != nil {
+		t.Errorf("expected the default database in the config dir, got %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+)
+
+// maxAPIKeyNameLength keeps key names short enough to list
+const maxAPIKeyNameLength = 100
+
+// returnedAPIKey is an api key without its hash, the key itself is only
+// returned once when it is created
+type returnedAPIKey struct {
+	Id         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	Key        string     `json:"key,omitempty"`
+}
+
+func newReturnedAPIKey(key database.APIKey) returnedAPIKey {
+	returned := returnedAPIKey{
+		Id:        key.Id,
+		Name:      key.Name,
+		Prefix:    key.Prefix,
+		Scopes:    key.Scopes,
+		CreatedAt: key.CreatedAt,
+	}
+	if !key.LastUsedAt.IsZero() {
+		returned.LastUsedAt = &key.LastUsedAt
+	}
+
+	return returned
+}
+
+// MiddlewareScope lets requests with an access token or with an api key
+// that has scope through, the claims of an api key carry its scopes.
+// Access tokens of oauth clients need scope too
+func (cfg *ApiConfig) MiddlewareScope(next http.Handler, scope string) http.Handler {
+	withToken := cfg.middlewareToken(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, _ := auth.ClaimsFromContext(r.Context())
+		if !claims.HasScope(scope) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	}))
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := auth.ApiKey(r.Header)
+		if err != nil {
+			withToken.ServeHTTP(w, r)
+			return
+		}
+
+		key, err := cfg.db.UseAPIKey(token, time.Now().UTC())
+		if errors.Is(err, database.ErrAPIKeyNotFound) {
+			fmt.Printf("Error authenticating request: %s\n", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error authenticating request: %s\n", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		claims := auth.Claims{UserId: key.UserId, APIKeyId: key.Id, Scopes: key.Scopes}
+		if !claims.HasScope(scope) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(auth.WithClaims(r.Context(), claims)))
+	})
+}
+
+// MiddlewareOptionalScope is MiddlewareScope for routes anyone may use,
+// requests without credentials go through as they are
+func (cfg *ApiConfig) MiddlewareOptionalScope(next http.Handler, scope string) http.Handler {
+	withCredentials := cfg.MiddlewareScope(next, scope)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		withCredentials.ServeHTTP(w, r)
+	})
+}
+
+// HandlerCreateAPIKey creates a named api key with scopes, the answer is
+// the only time the key is shown
+func (cfg *ApiConfig) HandlerCreateAPIKey(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		Name   string   `json:"name"`
+		Scopes []string `json:"scopes"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > maxAPIKeyNameLength {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	token, prefix, err := auth.NewAPIKey()
+	if err != nil {
+		fmt.Printf("Error issuing api key: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	id, err := auth.NewTokenId()
+	if err != nil {
+		fmt.Printf("Error issuing api key: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	key, err := cfg.db.CreateAPIKey(token, database.APIKey{
+		Id:        id,
+		UserId:    userId,
+		Name:      params.Name,
+		Prefix:    prefix,
+		Scopes:    params.Scopes,
+		CreatedAt: time.Now().UTC(),
+	})
+	if errors.Is(err, database.ErrInvalidScope) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error creating api key: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	returned := newReturnedAPIKey(key)
+	returned.Key = token
+
+	json, err := json.Marshal(returned)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+// HandlerGetAPIKeys lists the api keys of the user with when they were
+// last used
+func (cfg *ApiConfig) HandlerGetAPIKeys(w http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	keys, err := cfg.db.GetAPIKeys(userId)
+	if err != nil {
+		fmt.Printf("Error getting api keys: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	returnVals := make([]returnedAPIKey, 0, len(keys))
+	for _, key := range keys {
+		returnVals = append(returnVals, newReturnedAPIKey(key))
+	}
+
+	json, err := json.Marshal(returnVals)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// HandlerRevokeAPIKey deletes an api key of the user, it stops working
+// right away
+func (cfg *ApiConfig) HandlerRevokeAPIKey(w http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	err := cfg.db.RevokeAPIKey(userId, r.PathValue("key_id"))
+	if errors.Is(err, database.ErrAPIKeyNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error revoking api key: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,141 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveWithKey sends a request authenticated with an api key
+func serveWithKey(handler http.Handler, method string, target string, key string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("Authorization", "ApiKey "+key)
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+func TestAPIKeys(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	user := login(t, handler)
+
+	now := time.Now().UTC()
+	_, err := cfg.db.CreateEmailVerification(user.Id, "verify", now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.db.VerifyEmail("verify", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handler, http.MethodPost, "/api/keys", user.Token, `{"name":"bot","scopes":["everything"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown scope to be rejected, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/keys", user.Token, `{"name":" ","scopes":["chirps:write"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a key without a name to be rejected, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/keys", user.Token, `{"name":"bot","scopes":["chirps:write"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the key created, got %d", w.Code)
+	}
+	created := struct {
+		Id     string `json:"id"`
+		Prefix string `json:"prefix"`
+		Key    string `json:"key"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(created.Key, "chirpy_") || !strings.HasPrefix(created.Key, created.Prefix) || len(created.Prefix) >= len(created.Key) {
+		t.Fatalf("expected a key starting with its prefix, got %+v", created)
+	}
+
+	w = serveWithKey(handler, http.MethodPost, "/api/keys", created.Key, `{"name":"copy","scopes":["account"]}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected keys not to make keys, got %d", w.Code)
+	}
+	w = serveWithKey(handler, http.MethodPost, "/api/chirps", created.Key, `{"body":"from a bot"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the key to post a chirp, got %d", w.Code)
+	}
+	for _, request := range []struct{ method, target string }{
+		{http.MethodGet, "/api/sessions"},
+		{http.MethodDelete, "/api/sessions"},
+		{http.MethodDelete, "/api/sessions/1"},
+		{http.MethodPost, "/api/users/verification"},
+		{http.MethodGet, "/api/users/export"},
+	} {
+		w = serveWithKey(handler, request.method, request.target, created.Key, "")
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected the key to lack the account scope for %s %s, got %d", request.method, request.target, w.Code)
+		}
+	}
+	w = serveWithKey(handler, http.MethodGet, "/api/chirps", created.Key, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the key to lack the read scope, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/chirps", "", "")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected chirps to be public, got %d", w.Code)
+	}
+	w = serveWithKey(handler, http.MethodPost, "/api/chirps", "chirpy_guess", `{"body":"hi"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected an unknown key to be unauthorized, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodGet, "/api/keys", user.Token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the keys, got %d", w.Code)
+	}
+	keys := []struct {
+		Id         string     `json:"id"`
+		Key        string     `json:"key"`
+		LastUsedAt *time.Time `json:"last_used_at"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].Id != created.Id || keys[0].Key != "" || keys[0].LastUsedAt == nil {
+		t.Fatalf("expected the used key without its secret, got %s", w.Body)
+	}
+
+	w = serve(handler, http.MethodDelete, "/api/keys/"+created.Id, user.Token, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the key revoked, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodDelete, "/api/keys/"+created.Id, user.Token, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a revoked key to be not found, got %d", w.Code)
+	}
+	w = serveWithKey(handler, http.MethodPost, "/api/chirps", created.Key, `{"body":"from a bot"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a revoked key to be unauthorized, got %d", w.Code)
+	}
+
+	// even the account scope doesn't change the credentials
+	w = serve(handler, http.MethodPost, "/api/keys", user.Token, `{"name":"script","scopes":["account"]}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the key created, got %d", w.Code)
+	}
+	account := struct {
+		Key string `json:"key"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serveWithKey(handler, http.MethodPut, "/api/users", account.Key, `{"email":"c@example.com","password":"new password"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected keys unable to change the credentials, got %d", w.Code)
+	}
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neet-007/chirpy/database"
+)
+
+// BackupPolicyFromEnv reads BACKUP_DIR, BACKUP_KEEP, BACKUP_MAX_AGE
+// and the encryption keys that seal new archives. Backups go to the
+// user config dir by default, never under FileserverRoot where anyone
+// could download them
+func BackupPolicyFromEnv() (database.BackupPolicy, error) {
+	policy := database.BackupPolicy{
+		Dir:  os.Getenv("BACKUP_DIR"),
+		Keep: 7,
+	}
+
+	if policy.Dir == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return database.BackupPolicy{}, fmt.Errorf("BACKUP_DIR: %w", err)
+		}
+		policy.Dir = filepath.Join(configDir, "chirpy", "backups")
+	}
+
+	served, err := insideDir(policy.Dir, FileserverRoot)
+	if err != nil {
+		return database.BackupPolicy{}, fmt.Errorf("BACKUP_DIR: %w", err)
+	}
+	if served {
+		return database.BackupPolicy{}, fmt.Errorf("BACKUP_DIR: %s is served under /app/", policy.Dir)
+	}
+
+	if keep := os.Getenv("BACKUP_KEEP"); keep != "" {
+		n, err := strconv.Atoi(keep)
+		if err != nil {
+			return database.BackupPolicy{}, fmt.Errorf("BACKUP_KEEP: %w", err)
+		}
+		policy.Keep = n
+	}
+
+	if maxAge := os.Getenv("BACKUP_MAX_AGE"); maxAge != "" {
+		d, err := time.ParseDuration(maxAge)
+		if err != nil {
+			return database.BackupPolicy{}, fmt.Errorf("BACKUP_MAX_AGE: %w", err)
+		}
+		policy.MaxAge = d
+	}
+
+	keys, err := KeyringFromEnv()
+	if err != nil {
+		return database.BackupPolicy{}, err
+	}
+	policy.Keys = keys
+
+	return policy, nil
+}
+
+// insideDir reports whether dir is root or somewhere below it
+func insideDir(dir string, root string) (bool, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return false, err
+	}
+
+	rel, err := filepath.Rel(root, dir)
+	if err != nil {
+		return false, nil
+	}
+
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)), nil
+}
+
+func (cfg *ApiConfig) HandlerBackup(w http.ResponseWriter, r *http.Request) {
+	dbStructure, err := cfg.db.Snapshot()
+	if err != nil {
+		fmt.Printf("Error taking snapshot: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	manifest, err := database.Backup(dbStructure, cfg.backupPolicy)
+	if err != nil {
+		fmt.Printf("Error writing backup: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(manifest)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
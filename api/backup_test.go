@@ -0,0 +1,63 @@
+package api
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBackupPolicyFromEnv(t *testing.T) {
+	config := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", config)
+	t.Setenv("HOME", config)
+
+	t.Setenv("BACKUP_DIR", "")
+	policy, err := BackupPolicyFromEnv()
+	if err != nil {
+		t.Fatal(err)
+	}
+	served, err := insideDir(policy.Dir, FileserverRoot)
+	if err != nil || served || !strings.HasPrefix(policy.Dir, config) {
+		t.Errorf("expected the default dir outside the served tree, got %s %v", policy.Dir, err)
+	}
+
+	for _, dir := range []string{"./backups", ".", "database/backups"} {
+		t.Setenv("BACKUP_DIR", dir)
+		_, err = BackupPolicyFromEnv()
+		if err == nil {
+			t.Errorf("expected %s to be refused", dir)
+		}
+	}
+
+	t.Setenv("BACKUP_DIR", filepath.Join(t.TempDir(), "backups"))
+	_, err = BackupPolicyFromEnv()
+	if err != nil {
+		t.Errorf("expected a dir outside the served tree, got %v", err)
+	}
+}
+
+func TestBackupNeedsAdmin(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	user := login(t, handler)
+
+	w := serve(handler, http.MethodPost, "/admin/backups", "", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected backups to need a login, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/admin/backups", user.Token, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected backups forbidden to users, got %d", w.Code)
+	}
+
+	admin := loginAdmin(t, cfg, handler)
+	w = serve(handler, http.MethodPost, "/admin/backups", admin, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the admin to take a backup, got %d", w.Code)
+	}
+	entries, err := os.ReadDir(cfg.backupPolicy.Dir)
+	if err != nil || len(entries) == 0 {
+		t.Errorf("expected a backup written, got %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+	"github.com/neet-007/chirpy/mail"
+)
+
+// sendEmailVerification mails a new verification token to the current
+// email of the user
+func (cfg *ApiConfig) sendEmailVerification(userId int) error {
+	token, err := auth.NewEmailVerificationToken()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	email, err := cfg.db.CreateEmailVerification(userId, token, now, cfg.emailVerificationTTL)
+	if err != nil {
+		return err
+	}
+
+	return cfg.mailer.Send(mail.Message{
+		To:      email,
+		Subject: "Verify your Chirpy email",
+		Body: fmt.Sprintf("Confirm this is the email of your Chirpy account.\n\n"+
+			"Verify it with this token before %s:\n\n%s\n\n"+
+			"If you didn't sign up, ignore this email.\n",
+			now.Add(cfg.emailVerificationTTL).Format(time.RFC1123), token),
+	})
+}
+
+// MiddlewareVerified turns away users who haven't verified their email,
+// it goes after MiddlewareAuth
+func (cfg *ApiConfig) MiddlewareVerified(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userId, _ := auth.UserIdFromContext(r.Context())
+
+		user, err := cfg.db.GetUserById(userId)
+		if errors.Is(err, database.ErrUserNotFound) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error getting user: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		if !user.EmailVerified {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandlerSendEmailVerification mails the user a new verification token,
+// the ones sent before stop working
+func (cfg *ApiConfig) HandlerSendEmailVerification(w http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	err := cfg.sendEmailVerification(userId)
+	if errors.Is(err, database.ErrEmailVerified) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error sending email verification: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandlerVerifyEmail verifies the email a token from
+// HandlerSendEmailVerification was sent to
+func (cfg *ApiConfig) HandlerVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		Token string `json:"token"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = cfg.db.VerifyEmail(params.Token, time.Now().UTC())
+	if errors.Is(err, database.ErrVerificationTokenNotFound) || errors.Is(err, database.ErrVerificationTokenExpired) {
+		fmt.Printf("Error verifying email: %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error verifying email: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
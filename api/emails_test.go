@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/neet-007/chirpy/mail"
+)
+
+// lastToken returns the token in the last mail sent
+func lastToken(t *testing.T, cfg *ApiConfig) string {
+	t.Helper()
+
+	sent, err := os.ReadFile(cfg.mailer.(*mail.FileMailer).Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens := regexp.MustCompile(`[0-9a-f]{64}`).FindAll(sent, -1)
+	if len(tokens) == 0 {
+		t.Fatalf("expected a mail with a token, got %q", sent)
+	}
+
+	return string(tokens[len(tokens)-1])
+}
+
+func TestEmailVerificationFlow(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+
+	w := serve(handler, http.MethodPost, "/api/users", "", `{"email":" C@Example.com","password":"password"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the user created, got %d", w.Code)
+	}
+	created := struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &created)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.Email != "c@example.com" || created.EmailVerified {
+		t.Errorf("expected an unverified normalized email, got %+v", created)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/users", "", `{"email":"c@example.com","password":"password"}`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected a taken email to conflict, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/users", "", `{"email":"not an email","password":"password"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an invalid email to be rejected, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/login", "", `{"email":"C@example.com","password":"password"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected login to succeed, got %d", w.Code)
+	}
+	user := struct {
+		Token string `json:"token"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/chirps", user.Token, `{"body":"hello"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected an unverified user to be kept from chirping, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/users/verify", "", `{"token":"`+lastToken(t, cfg)+`"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the email verified, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/chirps", user.Token, `{"body":"hello"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected a verified user to chirp, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/users/verification", user.Token, "")
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected a verified email to conflict, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPut, "/api/users", user.Token, `{"email":"A@example.com"}`)
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected a taken email to conflict, got %d", w.Code)
+	}
+
+	// a new email has to be verified again
+	w = serve(handler, http.MethodPut, "/api/users", user.Token, `{"email":"d@example.com"}`)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the email changed, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/chirps", user.Token, `{"body":"hello"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the new email to be unverified, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/users/verification", user.Token, "")
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected the verification sent again, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/users/verify", "", `{"token":"`+lastToken(t, cfg)+`"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the new email verified, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/chirps", user.Token, `{"body":"hello"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected the user to chirp again, got %d", w.Code)
+	}
+}
@@ -0,0 +1,295 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+)
+
+const (
+	// defaultImpersonationTTL is how long an impersonation token lasts
+	defaultImpersonationTTL = 15 * time.Minute
+	// maxImpersonationReason keeps the reason short enough to list
+	maxImpersonationReason = 500
+	// defaultAuditLimit and maxAuditLimit page the audit log
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// middlewareAudit records every request made with an impersonation token
+// before it is served, requests that can't be recorded aren't served
+func (cfg *ApiConfig) middlewareAudit(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := auth.ClaimsFromContext(r.Context())
+		if !ok || !claims.Impersonated() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		_, err := cfg.db.RecordAuditEvent(database.AuditEvent{
+			Time:    time.Now().UTC(),
+			Action:  database.AuditImpersonatedRequest,
+			ActorId: claims.ActorId,
+			UserId:  claims.UserId,
+			TokenId: claims.ID,
+			Method:  r.Method,
+			Path:    r.URL.Path,
+		})
+		if err != nil {
+			fmt.Printf("Error recording audit event: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// HandlerImpersonateUser gives an admin a short lived token that acts as
+// a user, it names the admin in its act claim and only has chirp scopes
+// so the account of the user can't be changed with it. Admins can't be
+// impersonated and a reason is required for the audit log
+func (cfg *ApiConfig) HandlerImpersonateUser(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		Reason string   `json:"reason"`
+		Scopes []string `json:"scopes"`
+	}
+	type returnVal struct {
+		Token     string    `json:"token"`
+		TokenId   string    `json:"token_id"`
+		UserId    int       `json:"user_id"`
+		ActorId   int       `json:"actor_id"`
+		Scopes    []string  `json:"scopes"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}
+
+	userId, err := strconv.Atoi(r.PathValue("user_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	adminId, _ := auth.UserIdFromContext(r.Context())
+	if userId == adminId {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err = decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if params.Reason == "" || len(params.Reason) > maxImpersonationReason {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if len(params.Scopes) == 0 {
+		params.Scopes = []string{database.ScopeChirpsRead}
+	}
+	scopes, err := database.ValidateScopes(params.Scopes)
+	if err != nil {
+		fmt.Printf("Error validating scopes: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, scope := range scopes {
+		if scope != database.ScopeChirpsRead && scope != database.ScopeChirpsWrite {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error getting user: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if user.Role == database.RoleAdmin {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	tokenId, err := auth.NewTokenId()
+	if err != nil {
+		fmt.Printf("Error creating token id: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// the token is only handed out once the audit log has it
+	now := time.Now().UTC()
+	expiresAt := now.Add(cfg.impersonationTTL).Truncate(time.Second)
+	_, err = cfg.db.RecordAuditEvent(database.AuditEvent{
+		Time:    now,
+		Action:  database.AuditImpersonationStarted,
+		ActorId: adminId,
+		UserId:  userId,
+		TokenId: tokenId,
+		Reason:  params.Reason,
+	})
+	if err != nil {
+		fmt.Printf("Error recording audit event: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	token, err := cfg.authenticator.IssueImpersonationToken(userId, adminId, scopes, tokenId, expiresAt)
+	if err != nil {
+		fmt.Printf("Error issuing impersonation token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(returnVal{
+		Token:     token,
+		TokenId:   tokenId,
+		UserId:    userId,
+		ActorId:   adminId,
+		Scopes:    scopes,
+		ExpiresAt: expiresAt,
+	})
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+// HandlerEndImpersonation revokes an impersonation token before it
+// expires, any admin can end any impersonation
+func (cfg *ApiConfig) HandlerEndImpersonation(w http.ResponseWriter, r *http.Request) {
+	tokenId := r.PathValue("token_id")
+	adminId, _ := auth.UserIdFromContext(r.Context())
+
+	started, err := cfg.db.GetAuditEvents(database.AuditFilter{TokenId: tokenId, Action: database.AuditImpersonationStarted, Limit: 1})
+	if err != nil {
+		fmt.Printf("Error getting audit events: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(started) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	// no impersonation token outlives an access token
+	err = cfg.db.RevokeAccessToken(database.AccessToken{Id: tokenId, ExpiresAt: started[0].Time.Add(accessTokenExpiresIn)})
+	if err != nil {
+		fmt.Printf("Error revoking access token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	_, err = cfg.db.RecordAuditEvent(database.AuditEvent{
+		Time:    time.Now().UTC(),
+		Action:  database.AuditImpersonationEnded,
+		ActorId: adminId,
+		UserId:  started[0].UserId,
+		TokenId: tokenId,
+	})
+	if err != nil {
+		fmt.Printf("Error recording audit event: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// revokeImpersonations denies every impersonation token of the user that
+// may not have expired yet at now
+func (cfg *ApiConfig) revokeImpersonations(userId int, now time.Time) error {
+	started, err := cfg.db.GetAuditEvents(database.AuditFilter{UserId: userId, Action: database.AuditImpersonationStarted})
+	if err != nil {
+		return err
+	}
+
+	for _, event := range started {
+		// no impersonation token outlives an access token
+		expiresAt := event.Time.Add(accessTokenExpiresIn)
+		if !now.Before(expiresAt) {
+			continue
+		}
+
+		err = cfg.db.RevokeAccessToken(database.AccessToken{Id: event.TokenId, ExpiresAt: expiresAt})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HandlerGetAuditLog lists the audit log oldest first, it is filtered with
+// the user_id, actor_id, token_id and action query parameters and paged
+// with after and limit
+func (cfg *ApiConfig) HandlerGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	filter := database.AuditFilter{
+		TokenId: query.Get("token_id"),
+		Action:  query.Get("action"),
+		Limit:   defaultAuditLimit,
+	}
+
+	ints := map[string]*int{
+		"user_id":  &filter.UserId,
+		"actor_id": &filter.ActorId,
+		"after":    &filter.After,
+		"limit":    &filter.Limit,
+	}
+	for name, value := range ints {
+		if query.Get(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(query.Get(name))
+		if err != nil || n < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		*value = n
+	}
+	if filter.Limit < 1 || filter.Limit > maxAuditLimit {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	events, err := cfg.db.GetAuditEvents(filter)
+	if err != nil {
+		fmt.Printf("Error getting audit events: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(events)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
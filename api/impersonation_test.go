@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/neet-007/chirpy/database"
+)
+
+type impersonation struct {
+	Token   string   `json:"token"`
+	TokenId string   `json:"token_id"`
+	UserId  int      `json:"user_id"`
+	ActorId int      `json:"actor_id"`
+	Scopes  []string `json:"scopes"`
+}
+
+// impersonate starts impersonating userId as the admin
+func impersonate(t *testing.T, handler http.Handler, admin string, userId int, body string) impersonation {
+	t.Helper()
+
+	w := serve(handler, http.MethodPost, "/admin/users/"+strconv.Itoa(userId)+"/impersonate", admin, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the impersonation to start, got %d", w.Code)
+	}
+	started := impersonation{}
+	err := json.Unmarshal(w.Body.Bytes(), &started)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return started
+}
+
+func TestImpersonation(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	user := login(t, handler)
+	admin := loginAdmin(t, cfg, handler)
+
+	now := time.Now().UTC()
+	_, err := cfg.db.CreateEmailVerification(user.Id, "verify", now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.db.VerifyEmail("verify", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := "/admin/users/" + strconv.Itoa(user.Id) + "/impersonate"
+	w := serve(handler, http.MethodPost, target, user.Token, `{"reason":"ticket 1"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected users unable to impersonate, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, target, admin, `{}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a reason to be required, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, target, admin, `{"reason":"ticket 1","scopes":["account"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected the account scope to be refused, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/admin/users/99/impersonate", admin, `{"reason":"ticket 1"}`)
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown user, got %d", w.Code)
+	}
+
+	other, err := cfg.db.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.db.SetUserRole(other.Id, database.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(handler, http.MethodPost, "/admin/users/"+strconv.Itoa(other.Id)+"/impersonate", admin, `{"reason":"ticket 1"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected admins unable to be impersonated, got %d", w.Code)
+	}
+
+	started := impersonate(t, handler, admin, user.Id, `{"reason":"ticket 1","scopes":["chirps:read","chirps:write"]}`)
+	if started.UserId != user.Id || started.ActorId == user.Id || len(started.Scopes) != 2 {
+		t.Fatalf("expected a token acting for the user, got %+v", started)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/chirps", started.Token, `{"body":"as the user"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected the token to chirp as the user, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/chirps", started.Token, "")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the token to read chirps, got %d", w.Code)
+	}
+
+	// nothing that changes the account or needs an admin
+	for _, request := range []struct{ method, target, body string }{
+		{http.MethodPut, "/api/users", `{"email":"c@example.com","password":"new password"}`},
+		{http.MethodDelete, "/api/users", `{"password":"password"}`},
+		{http.MethodGet, "/api/users/export", ""},
+		{http.MethodPost, "/api/keys", `{"name":"bot","scopes":["chirps:read"]}`},
+		{http.MethodGet, "/api/sessions", ""},
+		{http.MethodDelete, "/api/sessions", ""},
+		{http.MethodPost, "/api/users/totp", ""},
+		{http.MethodGet, "/admin/metrics", ""},
+		{http.MethodPost, target, `{"reason":"ticket 1"}`},
+	} {
+		w = serve(handler, request.method, request.target, started.Token, request.body)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected %s %s forbidden while impersonating, got %d", request.method, request.target, w.Code)
+		}
+	}
+
+	w = serve(handler, http.MethodGet, "/admin/audit?limit=x", admin, "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a bad limit to be rejected, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/admin/audit?token_id="+started.TokenId, admin, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the audit log, got %d", w.Code)
+	}
+	events := []database.AuditEvent{}
+	err = json.Unmarshal(w.Body.Bytes(), &events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the start and every request made with the token
+	if len(events) != 12 || events[0].Action != database.AuditImpersonationStarted || events[0].Reason != "ticket 1" {
+		t.Fatalf("expected the impersonation audited, got %+v", events)
+	}
+	if events[1].Action != database.AuditImpersonatedRequest || events[1].Method != http.MethodPost || events[1].Path != "/api/chirps" || events[1].ActorId != started.ActorId {
+		t.Errorf("expected the chirp audited, got %+v", events[1])
+	}
+
+	w = serve(handler, http.MethodDelete, "/admin/impersonations/unknown", admin, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected an unknown impersonation, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodDelete, "/admin/impersonations/"+started.TokenId, admin, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the impersonation ended, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/chirps", started.Token, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the token revoked, got %d", w.Code)
+	}
+	events, err = cfg.db.GetAuditEvents(database.AuditFilter{TokenId: started.TokenId, Action: database.AuditImpersonationEnded})
+	if err != nil || len(events) != 1 {
+		t.Errorf("expected the end audited, got %+v %v", events, err)
+	}
+
+	// the token stops working once the admin isn't one anymore
+	started = impersonate(t, handler, admin, user.Id, `{"reason":"ticket 2"}`)
+	_, err = cfg.db.SetUserRole(started.ActorId, database.RoleUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(handler, http.MethodGet, "/api/chirps", started.Token, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the token of a demoted admin rejected, got %d", w.Code)
+	}
+}
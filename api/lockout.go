@@ -0,0 +1,117 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+)
+
+// LockoutPoliciesFromEnv reads how failed logins are backed off per
+// account and per ip from LOGIN_MAX_ATTEMPTS, LOGIN_IP_MAX_ATTEMPTS,
+// LOGIN_BACKOFF and LOGIN_LOCKOUT. Several users can share an ip so it
+// gets more attempts and no backoff, only the lockout
+func LockoutPoliciesFromEnv() (auth.LockoutPolicy, auth.LockoutPolicy, error) {
+	account := auth.LockoutPolicy{
+		Threshold: 5,
+		Backoff:   time.Second,
+		Lockout:   15 * time.Minute,
+	}
+
+	if backoff := os.Getenv("LOGIN_BACKOFF"); backoff != "" {
+		d, err := time.ParseDuration(backoff)
+		if err != nil {
+			return auth.LockoutPolicy{}, auth.LockoutPolicy{}, fmt.Errorf("LOGIN_BACKOFF: %w", err)
+		}
+		account.Backoff = d
+	}
+
+	if lockout := os.Getenv("LOGIN_LOCKOUT"); lockout != "" {
+		d, err := time.ParseDuration(lockout)
+		if err != nil {
+			return auth.LockoutPolicy{}, auth.LockoutPolicy{}, fmt.Errorf("LOGIN_LOCKOUT: %w", err)
+		}
+		account.Lockout = d
+	}
+
+	if maxAttempts := os.Getenv("LOGIN_MAX_ATTEMPTS"); maxAttempts != "" {
+		n, err := strconv.Atoi(maxAttempts)
+		if err != nil || n < 1 {
+			return auth.LockoutPolicy{}, auth.LockoutPolicy{}, fmt.Errorf("LOGIN_MAX_ATTEMPTS: expected a positive number, got %q", maxAttempts)
+		}
+		account.Threshold = n
+	}
+
+	ip := account
+	ip.Threshold = 10 * account.Threshold
+	ip.Backoff = 0
+	if maxAttempts := os.Getenv("LOGIN_IP_MAX_ATTEMPTS"); maxAttempts != "" {
+		n, err := strconv.Atoi(maxAttempts)
+		if err != nil || n < 1 {
+			return auth.LockoutPolicy{}, auth.LockoutPolicy{}, fmt.Errorf("LOGIN_IP_MAX_ATTEMPTS: expected a positive number, got %q", maxAttempts)
+		}
+		ip.Threshold = n
+	}
+
+	return account, ip, nil
+}
+
+// accountKey is the key failed logins of email are counted under, emails
+// that aren't valid count the same as unknown ones
+func accountKey(email string) string {
+	normalized, err := database.NormalizeEmail(email)
+	if err != nil {
+		return strings.ToLower(strings.TrimSpace(email))
+	}
+
+	return normalized
+}
+
+// loginWait is how long a login for email from r has to wait
+func (cfg *ApiConfig) loginWait(email string, r *http.Request) time.Duration {
+	return max(cfg.accountLimiter.Wait(accountKey(email)), cfg.ipLimiter.Wait(clientIP(r)))
+}
+
+// loginFailed counts a failed login for email against the account and the ip
+func (cfg *ApiConfig) loginFailed(email string, r *http.Request) {
+	cfg.accountLimiter.Fail(accountKey(email))
+	cfg.ipLimiter.Fail(clientIP(r))
+}
+
+// tooManyRequests answers 429 with the whole seconds to wait
+func tooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+}
+
+// HandlerUnlockUser forgets the failed logins of a user so it can log in
+// right away
+func (cfg *ApiConfig) HandlerUnlockUser(w http.ResponseWriter, r *http.Request) {
+	userId, err := strconv.Atoi(r.PathValue("user_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error getting user: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	cfg.accountLimiter.Reset(accountKey(user.Email))
+
+	w.WriteHeader(http.StatusNoContent)
+}
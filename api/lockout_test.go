@@ -0,0 +1,117 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+)
+
+// unlock calls the admin endpoint unlocking user with token
+func unlock(handler http.Handler, user string, token string) int {
+	return serve(handler, http.MethodPost, "/admin/users/"+user+"/unlock", token, "").Code
+}
+
+func TestLoginLockout(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	cfg.accountLimiter = auth.NewLimiter(auth.LockoutPolicy{Threshold: 3, Backoff: time.Second, Lockout: time.Hour}, clock)
+	cfg.ipLimiter = auth.NewLimiter(auth.LockoutPolicy{Threshold: 10, Lockout: time.Hour}, clock)
+
+	wrong := `{"email":"A@example.com","password":"wrong"}`
+	right := `{"email":"a@example.com","password":"password"}`
+
+	w := serve(handler, http.MethodPost, "/api/login", "", wrong)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong password to be unauthorized, got %d", w.Code)
+	}
+
+	// even the right password waits out the backoff
+	w = serve(handler, http.MethodPost, "/api/login", "", right)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected to retry after a second, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	now = now.Add(time.Second)
+	w = serve(handler, http.MethodPost, "/api/login", "", wrong)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong password to be unauthorized, got %d", w.Code)
+	}
+	now = now.Add(time.Second)
+	w = serve(handler, http.MethodPost, "/api/login", "", wrong)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "1" {
+		t.Errorf("expected the backoff to double, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	now = now.Add(time.Second)
+	w = serve(handler, http.MethodPost, "/api/login", "", wrong)
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected a wrong password to be unauthorized, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/login", "", right)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("expected the account locked for an hour, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	admin := loginAdmin(t, cfg, handler)
+	if code := unlock(handler, "1", ""); code != http.StatusUnauthorized {
+		t.Errorf("expected unlocking without a token to be unauthorized, got %d", code)
+	}
+	if code := unlock(handler, "99", admin); code != http.StatusNotFound {
+		t.Errorf("expected an unknown user to be not found, got %d", code)
+	}
+	if code := unlock(handler, "1", admin); code != http.StatusNoContent {
+		t.Fatalf("expected the account unlocked, got %d", code)
+	}
+
+	login(t, handler)
+}
+
+func TestLoginLockoutPerIP(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	cfg.ipLimiter = auth.NewLimiter(auth.LockoutPolicy{Threshold: 2, Lockout: time.Hour}, clock)
+
+	for _, email := range []string{"b@example.com", "c@example.com"} {
+		w := serve(handler, http.MethodPost, "/api/login", "", `{"email":"`+email+`","password":"wrong"}`)
+		if w.Code != http.StatusUnauthorized {
+			t.Fatalf("expected an unknown email to be unauthorized, got %d", w.Code)
+		}
+	}
+
+	w := serve(handler, http.MethodPost, "/api/login", "", `{"email":"a@example.com","password":"password"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("expected the ip locked out across emails, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	now = now.Add(time.Hour)
+	login(t, handler)
+}
+
+func TestForgotPasswordLimit(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	cfg.ipLimiter = auth.NewLimiter(auth.LockoutPolicy{Threshold: 2, Lockout: time.Hour}, clock)
+
+	for _, email := range []string{"a@example.com", "nobody@example.com"} {
+		w := serve(handler, http.MethodPost, "/api/password/forgot", "", `{"email":"`+email+`"}`)
+		if w.Code != http.StatusAccepted {
+			t.Fatalf("expected the reset to be accepted, got %d", w.Code)
+		}
+	}
+
+	w := serve(handler, http.MethodPost, "/api/password/forgot", "", `{"email":"a@example.com"}`)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("expected the ip to be limited, got %d %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	now = now.Add(time.Hour)
+	w = serve(handler, http.MethodPost, "/api/password/forgot", "", `{"email":"a@example.com"}`)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected the reset to be accepted after the lockout, got %d", w.Code)
+	}
+}
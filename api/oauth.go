@@ -0,0 +1,780 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+)
+
+const (
+	// authorizationCodeExpiresIn is how long a client has to exchange a code
+	authorizationCodeExpiresIn = time.Minute
+	// consentPage is where the file server serves the consent page
+	consentPage = "/app/oauth/consent.html"
+	// maxRedirectURIs keeps the redirect uris of a client short enough to list
+	maxRedirectURIs = 10
+)
+
+// oauthError is an error of the oauth endpoints, Code is one of the
+// error codes of RFC 6749
+type oauthError struct {
+	Code        string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+func (e oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+// writeOAuthError answers with err as the json body oauth clients expect
+func writeOAuthError(w http.ResponseWriter, status int, err oauthError) {
+	json, marshalErr := json.Marshal(err)
+	if marshalErr != nil {
+		fmt.Printf("Error encoding return value: %s", marshalErr)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	w.Write(json)
+}
+
+// returnedOAuthClient is an oauth client without the hash of its secret,
+// the secret itself is only returned once when the client is registered
+type returnedOAuthClient struct {
+	Id           string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+	Secret       string    `json:"client_secret,omitempty"`
+}
+
+func newReturnedOAuthClient(client database.OAuthClient) returnedOAuthClient {
+	return returnedOAuthClient{
+		Id:           client.Id,
+		Name:         client.Name,
+		RedirectURIs: client.RedirectURIs,
+		Scopes:       client.Scopes,
+		Confidential: client.Confidential(),
+		CreatedAt:    client.CreatedAt,
+	}
+}
+
+// validRedirectURI reports whether codes may be sent to uri, it has to be
+// https or plain http to the loopback interface without a fragment
+func validRedirectURI(uri string) bool {
+	if uri == "" || strings.ContainsAny(uri, " \t\r\n") {
+		return false
+	}
+
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" || u.User != nil {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		ip := net.ParseIP(host)
+		return host == "localhost" || (ip != nil && ip.IsLoopback())
+	default:
+		return false
+	}
+}
+
+// HandlerCreateOAuthClient registers an oauth client of the user,
+// confidential clients get a secret that is only shown in the answer
+func (cfg *ApiConfig) HandlerCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential bool     `json:"confidential"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	params.Name = strings.TrimSpace(params.Name)
+	if params.Name == "" || len(params.Name) > maxAPIKeyNameLength {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if len(params.RedirectURIs) == 0 || len(params.RedirectURIs) > maxRedirectURIs {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	for _, uri := range params.RedirectURIs {
+		if !validRedirectURI(uri) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	id, err := auth.NewClientId()
+	if err != nil {
+		fmt.Printf("Error issuing client id: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	secret := ""
+	if params.Confidential {
+		secret, err = auth.NewClientSecret()
+		if err != nil {
+			fmt.Printf("Error issuing client secret: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	}
+
+	client, err := cfg.db.CreateOAuthClient(secret, database.OAuthClient{
+		Id:           id,
+		OwnerId:      userId,
+		Name:         params.Name,
+		RedirectURIs: slices.Compact(params.RedirectURIs),
+		Scopes:       params.Scopes,
+		CreatedAt:    time.Now().UTC(),
+	})
+	if errors.Is(err, database.ErrInvalidScope) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error creating oauth client: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	returned := newReturnedOAuthClient(client)
+	returned.Secret = secret
+
+	json, err := json.Marshal(returned)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+// HandlerGetOAuthClients lists the oauth clients the user registered
+func (cfg *ApiConfig) HandlerGetOAuthClients(w http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	clients, err := cfg.db.GetOAuthClients(userId)
+	if err != nil {
+		fmt.Printf("Error getting oauth clients: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	returnVals := make([]returnedOAuthClient, 0, len(clients))
+	for _, client := range clients {
+		returnVals = append(returnVals, newReturnedOAuthClient(client))
+	}
+
+	json, err := json.Marshal(returnVals)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// HandlerDeleteOAuthClient deletes an oauth client of the user, every
+// session it started ends with it
+func (cfg *ApiConfig) HandlerDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	err := cfg.db.DeleteOAuthClient(userId, r.PathValue("client_id"))
+	if errors.Is(err, database.ErrOAuthClientNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error deleting oauth client: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authorizationParams are the parameters of an authorization request,
+// they come in the query of the consent page
+type authorizationParams struct {
+	ResponseType        string `json:"response_type"`
+	ClientId            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+func authorizationParamsFromQuery(query url.Values) authorizationParams {
+	return authorizationParams{
+		ResponseType:        query.Get("response_type"),
+		ClientId:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	}
+}
+
+// authorizationRequest is a checked authorization request
+type authorizationRequest struct {
+	Client        database.OAuthClient
+	RedirectURI   string
+	Scopes        []string
+	State         string
+	CodeChallenge string
+}
+
+// redirect returns the redirect uri with values and the state added
+func (req authorizationRequest) redirect(values url.Values) string {
+	u, _ := url.Parse(req.RedirectURI)
+	query := u.Query()
+	for key, value := range values {
+		query[key] = value
+	}
+	if req.State != "" {
+		query.Set("state", req.State)
+	}
+	u.RawQuery = query.Encode()
+
+	return u.String()
+}
+
+// checkAuthorization checks params against the client they name. The
+// redirect uri of the answer is only set once it is known to be one of
+// the client's, errors before that must not be sent to it
+func (cfg *ApiConfig) checkAuthorization(params authorizationParams) (authorizationRequest, error) {
+	req := authorizationRequest{State: params.State}
+
+	client, err := cfg.db.GetOAuthClient(params.ClientId)
+	if errors.Is(err, database.ErrOAuthClientNotFound) {
+		return req, oauthError{Code: "invalid_client", Description: "unknown client"}
+	}
+	if err != nil {
+		return req, err
+	}
+	req.Client = client
+
+	redirectURI := params.RedirectURI
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !slices.Contains(client.RedirectURIs, redirectURI) {
+		return req, oauthError{Code: "invalid_request", Description: "redirect_uri is not registered for the client"}
+	}
+	req.RedirectURI = redirectURI
+
+	if params.ResponseType != "code" {
+		return req, oauthError{Code: "unsupported_response_type", Description: "only the code response type is supported"}
+	}
+
+	// PKCE is required of every client, and only with S256
+	if params.CodeChallengeMethod != "S256" || len(params.CodeChallenge) != 43 {
+		return req, oauthError{Code: "invalid_request", Description: "a S256 code_challenge is required"}
+	}
+	req.CodeChallenge = params.CodeChallenge
+
+	req.Scopes = client.Scopes
+	if params.Scope != "" {
+		scopes, err := database.ValidateScopes(strings.Fields(params.Scope))
+		if err != nil {
+			return req, oauthError{Code: "invalid_scope", Description: err.Error()}
+		}
+		for _, scope := range scopes {
+			if !slices.Contains(client.Scopes, scope) {
+				return req, oauthError{Code: "invalid_scope", Description: fmt.Sprintf("the client may not ask for %s", scope)}
+			}
+		}
+		req.Scopes = scopes
+	}
+
+	return req, nil
+}
+
+// writeAuthorizationError answers a failed authorization request, the
+// client is sent the error when its redirect uri is known
+func writeAuthorizationError(w http.ResponseWriter, req authorizationRequest, err error) {
+	type returnVal struct {
+		oauthError
+		RedirectTo string `json:"redirect_to,omitempty"`
+	}
+
+	oauthErr := oauthError{}
+	if !errors.As(err, &oauthErr) {
+		fmt.Printf("Error checking authorization request: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	returned := returnVal{oauthError: oauthErr}
+	if req.RedirectURI != "" {
+		returned.RedirectTo = req.redirect(url.Values{"error": {oauthErr.Code}, "error_description": {oauthErr.Description}})
+	}
+
+	json, err := json.Marshal(returned)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(json)
+}
+
+// HandlerAuthorize is the authorization endpoint, it sends the user to
+// the consent page with the request
+func (cfg *ApiConfig) HandlerAuthorize(w http.ResponseWriter, r *http.Request) {
+	http.Redirect(w, r, consentPage+"?"+r.URL.RawQuery, http.StatusFound)
+}
+
+// HandlerGetAuthorization checks the authorization request in the query
+// and describes it for the consent page
+func (cfg *ApiConfig) HandlerGetAuthorization(w http.ResponseWriter, r *http.Request) {
+	type returnVal struct {
+		ClientId    string   `json:"client_id"`
+		ClientName  string   `json:"client_name"`
+		RedirectURI string   `json:"redirect_uri"`
+		Scopes      []string `json:"scopes"`
+	}
+
+	req, err := cfg.checkAuthorization(authorizationParamsFromQuery(r.URL.Query()))
+	if err != nil {
+		writeAuthorizationError(w, req, err)
+		return
+	}
+
+	json, err := json.Marshal(returnVal{
+		ClientId:    req.Client.Id,
+		ClientName:  req.Client.Name,
+		RedirectURI: req.RedirectURI,
+		Scopes:      req.Scopes,
+	})
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// HandlerDecideAuthorization records the user's answer to an
+// authorization request and tells the consent page where to send them,
+// an approval carries a code for the client
+func (cfg *ApiConfig) HandlerDecideAuthorization(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		authorizationParams
+		Approve bool `json:"approve"`
+	}
+	type returnVal struct {
+		RedirectTo string `json:"redirect_to"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	req, err := cfg.checkAuthorization(params.authorizationParams)
+	if err != nil {
+		writeAuthorizationError(w, req, err)
+		return
+	}
+
+	returned := returnVal{}
+	if !params.Approve {
+		returned.RedirectTo = req.redirect(url.Values{"error": {"access_denied"}})
+	} else {
+		code, err := auth.NewAuthorizationCode()
+		if err != nil {
+			fmt.Printf("Error issuing authorization code: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		userId, _ := auth.UserIdFromContext(r.Context())
+		now := time.Now().UTC()
+		err = cfg.db.CreateAuthorizationCode(code, database.AuthorizationCode{
+			ClientId:      req.Client.Id,
+			UserId:        userId,
+			RedirectURI:   req.RedirectURI,
+			Scopes:        req.Scopes,
+			CodeChallenge: req.CodeChallenge,
+			CreatedAt:     now,
+			ExpiresAt:     now.Add(authorizationCodeExpiresIn),
+		})
+		if err != nil {
+			fmt.Printf("Error saving authorization code: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		returned.RedirectTo = req.redirect(url.Values{"code": {code}})
+	}
+
+	json, err := json.Marshal(returned)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// authenticateClient reads the client of a request to the token,
+// introspection or revocation endpoints from basic auth or the form.
+// Confidential clients have to send their secret, public ones only
+// their id
+func (cfg *ApiConfig) authenticateClient(r *http.Request) (database.OAuthClient, error) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	client, err := cfg.db.GetOAuthClient(id)
+	if errors.Is(err, database.ErrOAuthClientNotFound) {
+		return database.OAuthClient{}, oauthError{Code: "invalid_client", Description: "unknown client"}
+	}
+	if err != nil {
+		return database.OAuthClient{}, err
+	}
+
+	if client.Confidential() && !client.CheckSecret(secret) {
+		return database.OAuthClient{}, oauthError{Code: "invalid_client", Description: "wrong client secret"}
+	}
+
+	return client, nil
+}
+
+// writeClientError answers a request whose client couldn't be authenticated
+func writeClientError(w http.ResponseWriter, err error) {
+	oauthErr := oauthError{}
+	if !errors.As(err, &oauthErr) {
+		fmt.Printf("Error authenticating client: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+	writeOAuthError(w, http.StatusUnauthorized, oauthErr)
+}
+
+// HandlerOAuthToken is the token endpoint, it exchanges authorization
+// codes and refresh tokens of a client for tokens limited to the scopes
+// the user granted
+func (cfg *ApiConfig) HandlerOAuthToken(w http.ResponseWriter, r *http.Request) {
+	type returnVal struct {
+		AccessToken  string `json:"access_token"`
+		TokenType    string `json:"token_type"`
+		ExpiresIn    int    `json:"expires_in"`
+		RefreshToken string `json:"refresh_token"`
+		Scope        string `json:"scope"`
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, oauthError{Code: "invalid_request", Description: "expected a form"})
+		return
+	}
+
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+
+	refreshToken, err := auth.NewRefreshToken()
+	if err != nil {
+		fmt.Printf("Error issuing refresh token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	access, err := newAccessToken(now)
+	if err != nil {
+		fmt.Printf("Error issuing access token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	session := database.Session{}
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		grant, err := cfg.db.UseAuthorizationCode(r.PostForm.Get("code"), now)
+		if errors.Is(err, database.ErrAuthorizationCodeNotFound) || errors.Is(err, database.ErrAuthorizationCodeExpired) {
+			writeOAuthError(w, http.StatusBadRequest, oauthError{Code: "invalid_grant", Description: err.Error()})
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error using authorization code: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		// the code was spent either way, a wrong exchange can't be retried
+		if grant.ClientId != client.Id || grant.RedirectURI != r.PostForm.Get("redirect_uri") {
+			writeOAuthError(w, http.StatusBadRequest, oauthError{Code: "invalid_grant", Description: "the code was issued to another client or redirect_uri"})
+			return
+		}
+		if !auth.VerifyPKCE(r.PostForm.Get("code_verifier"), grant.CodeChallenge) {
+			writeOAuthError(w, http.StatusBadRequest, oauthError{Code: "invalid_grant", Description: "code_verifier doesn't match the code_challenge"})
+			return
+		}
+
+		session, err = cfg.db.CreateSession(refreshToken, database.Session{
+			UserId:    grant.UserId,
+			UserAgent: r.UserAgent(),
+			IP:        clientIP(r),
+			ClientId:  client.Id,
+			Scopes:    grant.Scopes,
+		}, access, now, cfg.refreshTokenTTL)
+		if err != nil {
+			fmt.Printf("Error starting session: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	case "refresh_token":
+		token := r.PostForm.Get("refresh_token")
+
+		// checked before rotating so another client can't spend the token
+		current, err := cfg.db.GetRefreshSession(token, now)
+		if err == nil && current.ClientId != client.Id {
+			err = database.ErrTokenNotFound
+		}
+		if err == nil {
+			session, err = cfg.db.RotateRefreshToken(token, refreshToken, access, now, cfg.refreshTokenTTL)
+		}
+		if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenExpired) || errors.Is(err, database.ErrTokenReused) {
+			writeOAuthError(w, http.StatusBadRequest, oauthError{Code: "invalid_grant", Description: err.Error()})
+			return
+		}
+		if err != nil {
+			fmt.Printf("Error rotating refresh token: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+	default:
+		writeOAuthError(w, http.StatusBadRequest, oauthError{Code: "unsupported_grant_type", Description: "expected authorization_code or refresh_token"})
+		return
+	}
+
+	accessToken, err := cfg.issueSessionToken(session, access)
+	if err != nil {
+		fmt.Printf("Error issuing access token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(returnVal{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(time.Until(access.ExpiresAt).Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(session.Scopes, " "),
+	})
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// clientToken is what a token sent to the introspection or revocation
+// endpoints turned out to be
+type clientToken struct {
+	Type      string
+	UserId    int
+	SessionId string
+	Scopes    []string
+	ExpiresAt time.Time
+	IssuedAt  time.Time
+}
+
+// lookupClientToken reads token as an access token and then as a
+// refresh token of client, ok is false for tokens that aren't active or
+// belong to someone else
+func (cfg *ApiConfig) lookupClientToken(client database.OAuthClient, token string) (clientToken, bool, error) {
+	claims, err := cfg.authenticator.VerifyAccessToken(token)
+	if err == nil {
+		err = cfg.checkAccessToken(claims)
+		if err != nil || claims.ClientId != client.Id {
+			return clientToken{}, false, nil
+		}
+
+		return clientToken{
+			Type:      "access_token",
+			UserId:    claims.UserId,
+			SessionId: claims.SessionId,
+			Scopes:    claims.Scopes,
+			ExpiresAt: claims.ExpiresAt.Time,
+			IssuedAt:  claims.IssuedAt.Time,
+		}, true, nil
+	}
+
+	session, err := cfg.db.GetRefreshSession(token, time.Now().UTC())
+	if errors.Is(err, database.ErrTokenNotFound) || errors.Is(err, database.ErrTokenExpired) {
+		return clientToken{}, false, nil
+	}
+	if err != nil {
+		return clientToken{}, false, err
+	}
+	if session.ClientId != client.Id {
+		return clientToken{}, false, nil
+	}
+
+	return clientToken{
+		Type:      "refresh_token",
+		UserId:    session.UserId,
+		SessionId: session.Id,
+		Scopes:    session.Scopes,
+		ExpiresAt: session.ExpiresAt,
+		IssuedAt:  session.LastUsedAt,
+	}, true, nil
+}
+
+// HandlerIntrospect tells a confidential client whether one of its tokens
+// is active (RFC 7662), tokens of other clients are never active
+func (cfg *ApiConfig) HandlerIntrospect(w http.ResponseWriter, r *http.Request) {
+	type returnVal struct {
+		Active    bool   `json:"active"`
+		Scope     string `json:"scope,omitempty"`
+		ClientId  string `json:"client_id,omitempty"`
+		Subject   string `json:"sub,omitempty"`
+		TokenType string `json:"token_type,omitempty"`
+		ExpiresAt int64  `json:"exp,omitempty"`
+		IssuedAt  int64  `json:"iat,omitempty"`
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, oauthError{Code: "invalid_request", Description: "expected a form"})
+		return
+	}
+
+	client, err := cfg.authenticateClient(r)
+	if err == nil && !client.Confidential() {
+		err = oauthError{Code: "invalid_client", Description: "only confidential clients may introspect tokens"}
+	}
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+
+	token, active, err := cfg.lookupClientToken(client, r.PostForm.Get("token"))
+	if err != nil {
+		fmt.Printf("Error introspecting token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	returned := returnVal{Active: active}
+	if active {
+		returned.Scope = strings.Join(token.Scopes, " ")
+		returned.ClientId = client.Id
+		returned.Subject = fmt.Sprint(token.UserId)
+		returned.TokenType = token.Type
+		returned.ExpiresAt = token.ExpiresAt.Unix()
+		returned.IssuedAt = token.IssuedAt.Unix()
+	}
+
+	json, err := json.Marshal(returned)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// HandlerOAuthRevoke ends the session of a token of the client (RFC 7009),
+// unknown tokens are answered the same so nothing is learned from it
+func (cfg *ApiConfig) HandlerOAuthRevoke(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		writeOAuthError(w, http.StatusBadRequest, oauthError{Code: "invalid_request", Description: "expected a form"})
+		return
+	}
+
+	client, err := cfg.authenticateClient(r)
+	if err != nil {
+		writeClientError(w, err)
+		return
+	}
+
+	token, active, err := cfg.lookupClientToken(client, r.PostForm.Get("token"))
+	if err == nil && active {
+		err = cfg.db.RevokeSession(token.UserId, token.SessionId)
+	}
+	if err != nil && !errors.Is(err, database.ErrSessionNotFound) {
+		fmt.Printf("Error revoking token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,321 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+)
+
+// serveForm posts a form to an oauth endpoint, with basic auth when
+// clientSecret is set
+func serveForm(handler http.Handler, target string, clientId string, clientSecret string, form url.Values) *httptest.ResponseRecorder {
+	if clientSecret == "" {
+		form.Set("client_id", clientId)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientSecret != "" {
+		r.SetBasicAuth(clientId, clientSecret)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// registerClient registers an oauth client of the user behind token
+func registerClient(t *testing.T, handler http.Handler, token string, body string) (string, string) {
+	t.Helper()
+
+	w := serve(handler, http.MethodPost, "/api/oauth/clients", token, body)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the client registered, got %d", w.Code)
+	}
+	client := struct {
+		Id     string `json:"client_id"`
+		Secret string `json:"client_secret"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.Id, client.Secret
+}
+
+// authorize approves an authorization request and returns the code sent
+// to the redirect uri
+func authorize(t *testing.T, handler http.Handler, token string, clientId string, challenge string) string {
+	t.Helper()
+
+	w := serve(handler, http.MethodPost, "/api/oauth/authorize", token,
+		`{"response_type":"code","client_id":"`+clientId+`","state":"xyz","code_challenge":"`+challenge+`","code_challenge_method":"S256","approve":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the request approved, got %d %s", w.Code, w.Body)
+	}
+	redirect := struct {
+		RedirectTo string `json:"redirect_to"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(redirect.RedirectTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "app.example.com" || u.Query().Get("state") != "xyz" || u.Query().Get("code") == "" {
+		t.Fatalf("expected a code and the state sent to the client, got %s", redirect.RedirectTo)
+	}
+	return u.Query().Get("code")
+}
+
+type oauthTokens struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+	Error        string `json:"error"`
+}
+
+func decodeTokens(t *testing.T, w *httptest.ResponseRecorder) oauthTokens {
+	t.Helper()
+
+	tokens := oauthTokens{}
+	err := json.Unmarshal(w.Body.Bytes(), &tokens)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+// serveFromRoot gets path with the repository root as the working
+// directory, the file server serves it and the tests run in api/
+func serveFromRoot(t *testing.T, handler http.Handler, path string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir("..")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	return serve(handler, http.MethodGet, path, "", "")
+}
+
+func TestOAuthAuthorizationCodeFlow(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	user := login(t, handler)
+
+	now := time.Now().UTC()
+	_, err := cfg.db.CreateEmailVerification(user.Id, "verify", now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.db.VerifyEmail("verify", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handler, http.MethodPost, "/api/oauth/clients", user.Token, `{"name":"app","redirect_uris":["http://evil.example.com/cb"],"scopes":["chirps:read"]}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a plain http redirect uri to be rejected, got %d", w.Code)
+	}
+	clientId, secret := registerClient(t, handler, user.Token,
+		`{"name":"scheduler","redirect_uris":["https://app.example.com/cb"],"scopes":["chirps:read","chirps:write"],"confidential":true}`)
+	if secret == "" {
+		t.Fatalf("expected a confidential client to get a secret")
+	}
+
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := auth.PKCEChallenge(verifier)
+	query := "?response_type=code&client_id=" + clientId + "&state=xyz&code_challenge=" + challenge + "&code_challenge_method=S256"
+
+	w = serve(handler, http.MethodGet, "/oauth/authorize"+query, "", "")
+	if w.Code != http.StatusFound || w.Header().Get("Location") != consentPage+query {
+		t.Errorf("expected a redirect to the consent page, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	w = serveFromRoot(t, handler, w.Header().Get("Location"))
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the consent page to be served, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/oauth/authorize"+query, "", "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"client_name":"scheduler"`) {
+		t.Errorf("expected the request described, got %d %s", w.Code, w.Body)
+	}
+	w = serve(handler, http.MethodGet, "/api/oauth/authorize?response_type=code&client_id=nobody&code_challenge="+challenge+"&code_challenge_method=S256", "", "")
+	if w.Code != http.StatusBadRequest || strings.Contains(w.Body.String(), "redirect_to") {
+		t.Errorf("expected an unknown client not to be redirected to, got %d %s", w.Code, w.Body)
+	}
+	w = serve(handler, http.MethodGet, "/api/oauth/authorize"+query+"&scope=account", "", "")
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid_scope") || !strings.Contains(w.Body.String(), "redirect_to") {
+		t.Errorf("expected a scope the client lacks to be rejected, got %d %s", w.Code, w.Body)
+	}
+	w = serve(handler, http.MethodGet, "/api/oauth/authorize?response_type=code&client_id="+clientId, "", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a request without pkce to be rejected, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/oauth/authorize", user.Token,
+		`{"response_type":"code","client_id":"`+clientId+`","state":"xyz","code_challenge":"`+challenge+`","code_challenge_method":"S256","approve":false}`)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "error=access_denied") {
+		t.Errorf("expected a denial sent to the client, got %d %s", w.Code, w.Body)
+	}
+
+	code := authorize(t, handler, user.Token, clientId, challenge)
+	exchange := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://app.example.com/cb"}, "code_verifier": {verifier}}
+	w = serveForm(handler, "/api/oauth/token", clientId, "guess", exchange)
+	if w.Code != http.StatusUnauthorized || decodeTokens(t, w).Error != "invalid_client" {
+		t.Errorf("expected a wrong secret to be rejected, got %d %s", w.Code, w.Body)
+	}
+	w = serveForm(handler, "/api/oauth/token", clientId, secret, url.Values{"grant_type": {"authorization_code"}, "code": {code}, "redirect_uri": {"https://app.example.com/cb"}, "code_verifier": {strings.Repeat("a", 43)}})
+	if w.Code != http.StatusBadRequest || decodeTokens(t, w).Error != "invalid_grant" {
+		t.Errorf("expected a wrong verifier to be rejected, got %d %s", w.Code, w.Body)
+	}
+	w = serveForm(handler, "/api/oauth/token", clientId, secret, exchange)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a code to be spent by a failed exchange, got %d", w.Code)
+	}
+
+	code = authorize(t, handler, user.Token, clientId, challenge)
+	exchange.Set("code", code)
+	w = serveForm(handler, "/api/oauth/token", clientId, secret, exchange)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the code exchanged, got %d %s", w.Code, w.Body)
+	}
+	tokens := decodeTokens(t, w)
+	if tokens.TokenType != "Bearer" || tokens.Scope != "chirps:read chirps:write" || tokens.AccessToken == "" || tokens.RefreshToken == "" {
+		t.Fatalf("expected scoped tokens, got %+v", tokens)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/chirps", tokens.AccessToken, `{"body":"scheduled"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected the client to chirp for the user, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/sessions", tokens.AccessToken, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the client to lack the account scope, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/keys", tokens.AccessToken, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected client tokens to be kept off first party routes, got %d", w.Code)
+	}
+
+	w = serveForm(handler, "/api/oauth/introspect", clientId, secret, url.Values{"token": {tokens.AccessToken}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"active":true`) || !strings.Contains(w.Body.String(), `"scope":"chirps:read chirps:write"`) {
+		t.Errorf("expected the access token active, got %d %s", w.Code, w.Body)
+	}
+	otherId, otherSecret := registerClient(t, handler, user.Token, `{"name":"other","redirect_uris":["https://other.example.com/cb"],"scopes":["chirps:read"],"confidential":true}`)
+	w = serveForm(handler, "/api/oauth/introspect", otherId, otherSecret, url.Values{"token": {tokens.AccessToken}})
+	if w.Code != http.StatusOK || w.Body.String() != `{"active":false}` {
+		t.Errorf("expected the token of another client inactive, got %d %s", w.Code, w.Body)
+	}
+	w = serveForm(handler, "/api/oauth/token", otherId, otherSecret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	if w.Code != http.StatusBadRequest || decodeTokens(t, w).Error != "invalid_grant" {
+		t.Errorf("expected another client not to refresh the token, got %d %s", w.Code, w.Body)
+	}
+
+	w = serveForm(handler, "/api/oauth/token", clientId, secret, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tokens.RefreshToken}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the token refreshed, got %d %s", w.Code, w.Body)
+	}
+	refreshed := decodeTokens(t, w)
+	if refreshed.Scope != tokens.Scope || refreshed.RefreshToken == tokens.RefreshToken {
+		t.Errorf("expected a rotated token with the same scopes, got %+v", refreshed)
+	}
+
+	w = serveForm(handler, "/api/oauth/revoke", clientId, secret, url.Values{"token": {refreshed.RefreshToken}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the token revoked, got %d", w.Code)
+	}
+	w = serveForm(handler, "/api/oauth/revoke", clientId, secret, url.Values{"token": {"unknown"}})
+	if w.Code != http.StatusOK {
+		t.Errorf("expected unknown tokens to be answered the same, got %d", w.Code)
+	}
+	w = serveForm(handler, "/api/oauth/introspect", clientId, secret, url.Values{"token": {refreshed.AccessToken}})
+	if w.Body.String() != `{"active":false}` {
+		t.Errorf("expected the access token of a revoked session inactive, got %s", w.Body)
+	}
+	w = serve(handler, http.MethodPost, "/api/chirps", refreshed.AccessToken, `{"body":"late"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the revoked access token denied, got %d", w.Code)
+	}
+}
+
+func TestOAuthPublicClient(t *testing.T) {
+	_, handler := newTestConfig(t)
+	user := login(t, handler)
+
+	clientId, secret := registerClient(t, handler, user.Token, `{"name":"cli","redirect_uris":["https://app.example.com/cb","http://127.0.0.1:8000/cb"],"scopes":["account"]}`)
+	if secret != "" {
+		t.Fatalf("expected a public client without a secret")
+	}
+
+	w := serve(handler, http.MethodGet, "/api/oauth/authorize?response_type=code&client_id="+clientId+"&code_challenge="+auth.PKCEChallenge(strings.Repeat("v", 43))+"&code_challenge_method=S256", "", "")
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a redirect uri to be required with several registered, got %d", w.Code)
+	}
+
+	verifier := strings.Repeat("v", 43)
+	w = serve(handler, http.MethodPost, "/api/oauth/authorize", user.Token,
+		`{"response_type":"code","client_id":"`+clientId+`","redirect_uri":"http://127.0.0.1:8000/cb","code_challenge":"`+auth.PKCEChallenge(verifier)+`","code_challenge_method":"S256","approve":true}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the request approved, got %d %s", w.Code, w.Body)
+	}
+	redirect := struct {
+		RedirectTo string `json:"redirect_to"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(redirect.RedirectTo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w = serveForm(handler, "/api/oauth/token", clientId, "", url.Values{"grant_type": {"authorization_code"}, "code": {u.Query().Get("code")}, "redirect_uri": {"http://127.0.0.1:8000/cb"}, "code_verifier": {verifier}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a public client to exchange with pkce alone, got %d %s", w.Code, w.Body)
+	}
+	tokens := decodeTokens(t, w)
+
+	w = serveForm(handler, "/api/oauth/introspect", clientId, "", url.Values{"token": {tokens.AccessToken}})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a public client not to introspect, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodGet, "/api/sessions", tokens.AccessToken, "")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"client_id":"`+clientId+`"`) {
+		t.Errorf("expected the session of the client listed, got %d %s", w.Code, w.Body)
+	}
+
+	w = serve(handler, http.MethodPut, "/api/users", tokens.AccessToken, `{"email":"c@example.com","password":"new password"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the client unable to change the credentials, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodDelete, "/api/oauth/clients/"+clientId, user.Token, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the client deleted, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/sessions", tokens.AccessToken, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the tokens of a deleted client denied, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/oauth/clients", user.Token, "")
+	if w.Code != http.StatusOK || w.Body.String() != "[]" {
+		t.Errorf("expected no clients left, got %d %s", w.Code, w.Body)
+	}
+}
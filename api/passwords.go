@@ -0,0 +1,195 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+	"github.com/neet-007/chirpy/mail"
+)
+
+// MailerFromEnv sends mail through the SMTP server at SMTP_ADDR from
+// MAIL_FROM, logging in with SMTP_USERNAME and SMTP_PASSWORD when set.
+// Without a server mail is appended to MAIL_FILE or printed
+func MailerFromEnv() (mail.Mailer, error) {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return &mail.FileMailer{Path: os.Getenv("MAIL_FILE")}, nil
+	}
+
+	from := os.Getenv("MAIL_FROM")
+	if from == "" {
+		return nil, errors.New("MAIL_FROM: needed to send mail through SMTP_ADDR")
+	}
+
+	return &mail.SMTPMailer{
+		Addr:     addr,
+		From:     from,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+	}, nil
+}
+
+// PasswordPolicyFromEnv requires new passwords to be PASSWORD_MIN_LENGTH
+// to PASSWORD_MAX_LENGTH characters long and not on the list of breached
+// passwords in BREACHED_PASSWORDS_FILE when it is set
+func PasswordPolicyFromEnv() (auth.PasswordPolicy, error) {
+	policy := auth.PasswordPolicy{MinLength: 8, MaxLength: 128}
+
+	if minLength := os.Getenv("PASSWORD_MIN_LENGTH"); minLength != "" {
+		n, err := strconv.Atoi(minLength)
+		if err != nil || n < 1 {
+			return auth.PasswordPolicy{}, fmt.Errorf("PASSWORD_MIN_LENGTH: expected a positive number, got %q", minLength)
+		}
+		policy.MinLength = n
+	}
+
+	if maxLength := os.Getenv("PASSWORD_MAX_LENGTH"); maxLength != "" {
+		n, err := strconv.Atoi(maxLength)
+		if err != nil || n < policy.MinLength {
+			return auth.PasswordPolicy{}, fmt.Errorf("PASSWORD_MAX_LENGTH: expected a number of at least %d, got %q", policy.MinLength, maxLength)
+		}
+		policy.MaxLength = n
+	}
+
+	if path := os.Getenv("BREACHED_PASSWORDS_FILE"); path != "" {
+		breached, err := auth.LoadBreachedPasswords(path)
+		if err != nil {
+			return auth.PasswordPolicy{}, fmt.Errorf("BREACHED_PASSWORDS_FILE: %w", err)
+		}
+		policy.Breached = breached
+	}
+
+	return policy, nil
+}
+
+// rejectPassword answers a request with a password the policy rejected,
+// telling why
+func rejectPassword(w http.ResponseWriter, err error) {
+	type returnVal struct {
+		Error string `json:"error"`
+	}
+
+	json, err := json.Marshal(returnVal{Error: err.Error()})
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(json)
+}
+
+// HandlerForgotPassword mails a reset token to the user. It answers the
+// same whether or not the email belongs to a user so accounts can't be
+// discovered through it
+func (cfg *ApiConfig) HandlerForgotPassword(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		Email string `json:"email"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	// any request may send a mail, so each one counts against the ip
+	// like a failed login whether the email has an account or not
+	if wait := cfg.ipLimiter.Wait(clientIP(r)); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+	cfg.ipLimiter.Fail(clientIP(r))
+
+	email, err := database.NormalizeEmail(params.Email)
+	if err != nil {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+
+	token, err := auth.NewPasswordResetToken()
+	if err != nil {
+		fmt.Printf("Error issuing password reset token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().UTC()
+	err = cfg.db.CreatePasswordReset(email, token, now, cfg.passwordResetTTL)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error saving password reset token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = cfg.mailer.Send(mail.Message{
+		To:      email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Someone asked to reset the password of your Chirpy account.\n\n"+
+			"Reset it with this token before %s:\n\n%s\n\n"+
+			"If it wasn't you, ignore this email and your password stays the same.\n",
+			now.Add(cfg.passwordResetTTL).Format(time.RFC1123), token),
+	})
+	if err != nil {
+		// still accepted, failing here would tell the email has an account
+		fmt.Printf("Error mailing password reset token: %s", err)
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandlerResetPassword sets a new password with a token from
+// HandlerForgotPassword, the user is logged out everywhere
+func (cfg *ApiConfig) HandlerResetPassword(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	err = cfg.passwordPolicy.Check(params.Password)
+	if err != nil {
+		rejectPassword(w, err)
+		return
+	}
+
+	err = cfg.db.ResetPassword(params.Token, params.Password, time.Now().UTC())
+	if errors.Is(err, database.ErrResetTokenNotFound) || errors.Is(err, database.ErrResetTokenExpired) {
+		fmt.Printf("Error resetting password: %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error resetting password: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
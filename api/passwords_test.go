@@ -0,0 +1,91 @@
+package api
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/neet-007/chirpy/mail"
+)
+
+func TestPasswordResetFlow(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	user := login(t, handler)
+
+	w := serve(handler, http.MethodPost, "/api/password/forgot", "", `{"email":"nobody@example.com"}`)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected an unknown email to be accepted like any other, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/password/forgot", "", `{"email":"a@example.com"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("expected the reset to be accepted, got %d", w.Code)
+	}
+
+	sent, err := os.ReadFile(cfg.mailer.(*mail.FileMailer).Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := regexp.MustCompile(`[0-9a-f]{64}`).Find(sent)
+	if token == nil {
+		t.Fatalf("expected one mail with a token, got %q", sent)
+	}
+	if bytes.Contains(sent, []byte("To: nobody@example.com")) {
+		t.Errorf("expected no mail for an unknown email, got %q", sent)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/password/reset", "", `{"token":"`+string(token)+`","password":"new password"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the password reset, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/password/reset", "", `{"token":"`+string(token)+`","password":"again and again"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected a used token to be rejected, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodGet, "/api/sessions", user.Token, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the reset to log the old session out, got %d", w.Code)
+	}
+
+	loginWith(t, handler, "new password")
+}
+
+func TestPasswordPolicy(t *testing.T) {
+	_, handler := newTestConfig(t)
+	user := login(t, handler)
+
+	w := serve(handler, http.MethodPost, "/api/users", "", `{"email":"b@example.com","password":"short"}`)
+	if w.Code != http.StatusBadRequest || !bytes.Contains(w.Body.Bytes(), []byte("too short")) {
+		t.Errorf("expected a short password to be rejected, got %d %s", w.Code, w.Body)
+	}
+	w = serve(handler, http.MethodPost, "/api/users", "", `{"email":"b@example.com","password":"Password123"}`)
+	if w.Code != http.StatusBadRequest || !bytes.Contains(w.Body.Bytes(), []byte("breached")) {
+		t.Errorf("expected a breached password to be rejected, got %d %s", w.Code, w.Body)
+	}
+	w = serve(handler, http.MethodPost, "/api/users", "", `{"email":"b@example.com","password":"`+string(bytes.Repeat([]byte("a"), 129))+`"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a long password to be rejected, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/users", "", `{"email":"b@example.com","password":"a fine password"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected a good password to be accepted, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPut, "/api/users", user.Token, `{"email":"a@example.com","password":"password123"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an update to a breached password to be rejected, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPut, "/api/users", user.Token, `{"email":"a@example.com"}`)
+	if w.Code != http.StatusCreated {
+		t.Errorf("expected an update without a password to skip the policy, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPost, "/api/password/reset", "", `{"token":"whatever","password":"short"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a reset to a short password to be rejected, got %d", w.Code)
+	}
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+)
+
+// MiddlewareRole only lets users with one of roles through, it goes after
+// MiddlewareAuth and reads the role from the access token
+func (cfg *ApiConfig) MiddlewareRole(next http.Handler, roles ...database.Role) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		claims, ok := auth.ClaimsFromContext(r.Context())
+		if !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		if !slices.Contains(roles, database.Role(claims.Role)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// MiddlewareAdmin only lets admins through
+func (cfg *ApiConfig) MiddlewareAdmin(next http.Handler) http.Handler {
+	return cfg.MiddlewareAuth(cfg.MiddlewareRole(next, database.RoleAdmin))
+}
+
+// HandlerSetUserRole gives a user another role and ends its sessions so
+// no token keeps the old role, admins can't change their own role
+func (cfg *ApiConfig) HandlerSetUserRole(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		Role string `json:"role"`
+	}
+
+	userId, err := strconv.Atoi(r.PathValue("user_id"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	adminId, _ := auth.UserIdFromContext(r.Context())
+	if userId == adminId {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err = decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	user, err := cfg.db.SetUserRole(userId, database.Role(params.Role))
+	if errors.Is(err, database.ErrInvalidRole) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error setting role: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = cfg.db.RevokeSessions(userId)
+	if err != nil {
+		fmt.Printf("Error revoking sessions: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(user)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/neet-007/chirpy/database"
+)
+
+// loginAdmin creates the admin admin@example.com and returns its access token
+func loginAdmin(t *testing.T, cfg *ApiConfig, handler http.Handler) string {
+	t.Helper()
+
+	user, err := cfg.db.CreateUser("admin@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.db.SetUserRole(user.Id, database.RoleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := serve(handler, http.MethodPost, "/api/login", "", `{"email":"admin@example.com","password":"password"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the admin to log in, got %d", w.Code)
+	}
+	admin := database.ReturnedUser{}
+	err = json.Unmarshal(w.Body.Bytes(), &admin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if admin.Role != database.RoleAdmin {
+		t.Fatalf("expected the admin role, got %q", admin.Role)
+	}
+
+	return admin.Token
+}
+
+func TestAdminRoutes(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	user := login(t, handler)
+	if user.Role != database.RoleUser {
+		t.Errorf("expected a plain user, got %q", user.Role)
+	}
+
+	w := serve(handler, http.MethodGet, "/admin/metrics", "", "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the metrics to need a login, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/admin/metrics", user.Token, "")
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the metrics to be forbidden to users, got %d", w.Code)
+	}
+
+	admin := loginAdmin(t, cfg, handler)
+	w = serve(handler, http.MethodGet, "/admin/metrics", admin, "")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the admin to see the metrics, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodPut, "/admin/users/1/role", user.Token, `{"role":"admin"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected users not to promote themselves, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPut, "/admin/users/1/role", admin, `{"role":"owner"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected an unknown role to be rejected, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPut, "/admin/users/2/role", admin, `{"role":"user"}`)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("expected the admin not to demote itself, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPut, "/admin/users/1/role", admin, `{"role":"moderator"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the user made a moderator, got %d", w.Code)
+	}
+
+	// the old token had the old role so it is revoked with the sessions
+	w = serve(handler, http.MethodGet, "/api/sessions", user.Token, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the token from before the change revoked, got %d", w.Code)
+	}
+	if moderator := login(t, handler); moderator.Role != database.RoleModerator {
+		t.Errorf("expected the moderator role on the next login, got %q", moderator.Role)
+	}
+}
@@ -0,0 +1,68 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/neet-007/chirpy/database"
+)
+
+// FileserverRoot is the directory served under /app/
+const FileserverRoot = "."
+
+// Routes registers every endpoint of cfg on mux
+func Routes(mux *http.ServeMux, cfg *ApiConfig) {
+	mux.Handle("/app/", cfg.MiddlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(FileserverRoot)))))
+	mux.HandleFunc("GET /api/healthz", handlerReadiness)
+	mux.Handle("GET /api/chirps", cfg.MiddlewareOptionalScope(http.HandlerFunc(cfg.HandlerValidatePost), database.ScopeChirpsRead))
+	mux.Handle("GET /api/chirps/{chat_id}", cfg.MiddlewareOptionalScope(http.HandlerFunc(cfg.HandlerGetChirpById), database.ScopeChirpsRead))
+	mux.Handle("DELETE /api/chirps/{chat_id}", cfg.MiddlewareScope(http.HandlerFunc(cfg.HandlerDeleteChirp), database.ScopeChirpsWrite))
+	mux.Handle("POST /api/chirps", cfg.MiddlewareScope(cfg.MiddlewareVerified(http.HandlerFunc(cfg.HandlerValidatePost)), database.ScopeChirpsWrite))
+	mux.HandleFunc("POST /api/users", cfg.HandlerCreateUser)
+	mux.Handle("PUT /api/users", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerUpdateUser)))
+	mux.Handle("DELETE /api/users", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerDeleteUser)))
+	mux.Handle("GET /api/users/export", cfg.MiddlewareScope(http.HandlerFunc(cfg.HandlerExportUser), database.ScopeAccount))
+	mux.Handle("GET /api/users/deletion", cfg.MiddlewareScope(http.HandlerFunc(cfg.HandlerGetAccountDeletion), database.ScopeAccount))
+	mux.Handle("DELETE /api/users/deletion", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerCancelAccountDeletion)))
+	mux.Handle("POST /api/users/verification", cfg.MiddlewareScope(http.HandlerFunc(cfg.HandlerSendEmailVerification), database.ScopeAccount))
+	mux.HandleFunc("POST /api/users/verify", cfg.HandlerVerifyEmail)
+	mux.Handle("POST /api/users/totp", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerEnrollTOTP)))
+	mux.Handle("POST /api/users/totp/confirm", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerConfirmTOTP)))
+	mux.Handle("DELETE /api/users/totp", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerDisableTOTP)))
+	mux.HandleFunc("POST /api/login", cfg.HandlerLogUser)
+	mux.HandleFunc("POST /api/login/mfa", cfg.HandlerLogUserMFA)
+	mux.HandleFunc("POST /api/refresh", cfg.HandlerRefreshToken)
+	mux.HandleFunc("POST /api/revoke", cfg.HandlerRevokeToken)
+	mux.HandleFunc("POST /api/password/forgot", cfg.HandlerForgotPassword)
+	mux.HandleFunc("POST /api/password/reset", cfg.HandlerResetPassword)
+	mux.Handle("GET /api/sessions", cfg.MiddlewareScope(http.HandlerFunc(cfg.HandlerGetSessions), database.ScopeAccount))
+	mux.Handle("DELETE /api/sessions", cfg.MiddlewareScope(http.HandlerFunc(cfg.HandlerRevokeSessions), database.ScopeAccount))
+	mux.Handle("DELETE /api/sessions/{session_id}", cfg.MiddlewareScope(http.HandlerFunc(cfg.HandlerRevokeSession), database.ScopeAccount))
+	mux.Handle("POST /api/keys", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerCreateAPIKey)))
+	mux.Handle("GET /api/keys", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerGetAPIKeys)))
+	mux.Handle("DELETE /api/keys/{key_id}", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerRevokeAPIKey)))
+	mux.Handle("POST /api/oauth/clients", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerCreateOAuthClient)))
+	mux.Handle("GET /api/oauth/clients", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerGetOAuthClients)))
+	mux.Handle("DELETE /api/oauth/clients/{client_id}", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerDeleteOAuthClient)))
+	mux.HandleFunc("GET /oauth/authorize", cfg.HandlerAuthorize)
+	mux.HandleFunc("GET /api/oauth/authorize", cfg.HandlerGetAuthorization)
+	mux.Handle("POST /api/oauth/authorize", cfg.MiddlewareAuth(http.HandlerFunc(cfg.HandlerDecideAuthorization)))
+	mux.HandleFunc("POST /api/oauth/token", cfg.HandlerOAuthToken)
+	mux.HandleFunc("POST /api/oauth/introspect", cfg.HandlerIntrospect)
+	mux.HandleFunc("POST /api/oauth/revoke", cfg.HandlerOAuthRevoke)
+	mux.Handle("GET /admin/metrics", cfg.MiddlewareAdmin(http.HandlerFunc(cfg.HandlerMetrics)))
+	mux.Handle("GET /api/reset", cfg.MiddlewareAdmin(http.HandlerFunc(cfg.HandlerReset)))
+	mux.Handle("POST /admin/backups", cfg.MiddlewareAdmin(http.HandlerFunc(cfg.HandlerBackup)))
+	mux.Handle("POST /admin/users/{user_id}/unlock", cfg.MiddlewareAdmin(http.HandlerFunc(cfg.HandlerUnlockUser)))
+	mux.Handle("PUT /admin/users/{user_id}/role", cfg.MiddlewareAdmin(http.HandlerFunc(cfg.HandlerSetUserRole)))
+	mux.Handle("POST /admin/users/{user_id}/impersonate", cfg.MiddlewareAdmin(http.HandlerFunc(cfg.HandlerImpersonateUser)))
+	mux.Handle("DELETE /admin/impersonations/{token_id}", cfg.MiddlewareAdmin(http.HandlerFunc(cfg.HandlerEndImpersonation)))
+	mux.Handle("GET /admin/audit", cfg.MiddlewareAdmin(http.HandlerFunc(cfg.HandlerGetAuditLog)))
+	mux.HandleFunc("POST /api/polka/webhooks", cfg.HandlerChirpRedWebHook)
+	mux.HandleFunc("GET /.well-known/jwks.json", cfg.HandlerJWKS)
+}
+
+func handlerReadiness(w http.ResponseWriter, r *http.Request) {
+	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(http.StatusText(http.StatusOK)))
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+)
+
+// clientIP is the address the request came from, the port is dropped
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// checkAccessToken rejects access tokens on the denylist, revoking a
+// session puts its access tokens there so it is logged out without
+// waiting for them to expire
+func (cfg *ApiConfig) checkAccessToken(claims auth.Claims) error {
+	if claims.ID == "" {
+		return errors.New("access token has no jti")
+	}
+
+	revoked, err := cfg.db.IsAccessTokenRevoked(claims.ID)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return fmt.Errorf("access token %s was revoked", claims.ID)
+	}
+
+	// impersonation ends once the admin isn't an admin anymore
+	if claims.Impersonated() {
+		actor, err := cfg.db.GetUserById(claims.ActorId)
+		if errors.Is(err, database.ErrUserNotFound) || (err == nil && actor.Role != database.RoleAdmin) {
+			return fmt.Errorf("user %d acting for user %d is not an admin", claims.ActorId, claims.UserId)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newAccessToken picks the jti and expiry of the next access token, the
+// store records them with the refresh token before the token is signed
+func newAccessToken(now time.Time) (database.AccessToken, error) {
+	id, err := auth.NewTokenId()
+	if err != nil {
+		return database.AccessToken{}, err
+	}
+
+	// the jwt keeps whole seconds, the record must not expire before it
+	return database.AccessToken{Id: id, ExpiresAt: now.Add(accessTokenExpiresIn).Truncate(time.Second)}, nil
+}
+
+// issueSessionToken signs the access token of a refreshed session, the
+// role is read again so it is the current one. Sessions of an oauth
+// client only get the scopes the user granted it
+func (cfg *ApiConfig) issueSessionToken(session database.Session, access database.AccessToken) (string, error) {
+	if session.ClientId != "" {
+		return cfg.authenticator.IssueClientAccessToken(session.UserId, session.ClientId, session.Scopes, session.Id, access.Id, access.ExpiresAt)
+	}
+
+	user, err := cfg.db.GetUserById(session.UserId)
+	if err != nil {
+		return "", err
+	}
+
+	return cfg.authenticator.IssueAccessToken(session.UserId, string(user.Role), session.Id, access.Id, access.ExpiresAt)
+}
+
+// HandlerGetSessions lists the sessions of the user, marking the one
+// the request was made with
+func (cfg *ApiConfig) HandlerGetSessions(w http.ResponseWriter, r *http.Request) {
+	type returnVal struct {
+		database.Session
+		Current bool `json:"current"`
+	}
+
+	claims, _ := auth.ClaimsFromContext(r.Context())
+
+	sessions, err := cfg.db.GetSessions(claims.UserId, time.Now().UTC())
+	if err != nil {
+		fmt.Printf("Error getting sessions: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	returnVals := make([]returnVal, 0, len(sessions))
+	for _, session := range sessions {
+		returnVals = append(returnVals, returnVal{Session: session, Current: session.Id == claims.SessionId})
+	}
+
+	json, err := json.Marshal(returnVals)
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// HandlerRevokeSession logs one session of the user out
+func (cfg *ApiConfig) HandlerRevokeSession(w http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	err := cfg.db.RevokeSession(userId, r.PathValue("session_id"))
+	if errors.Is(err, database.ErrSessionNotFound) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error revoking session: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandlerRevokeSessions logs the user out everywhere, including the
+// session the request was made with
+func (cfg *ApiConfig) HandlerRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	err := cfg.db.RevokeSessions(userId)
+	if err != nil {
+		fmt.Printf("Error revoking sessions: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
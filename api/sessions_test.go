@@ -0,0 +1,195 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+	"github.com/neet-007/chirpy/mail"
+)
+
+// newTestConfig serves the account routes from a fresh json store
+// holding the user a@example.com, mail goes to mail.txt in a temp dir
+func newTestConfig(t *testing.T) (*ApiConfig, http.Handler) {
+	t.Helper()
+
+	db, err := database.Open(database.DriverJSON, filepath.Join(t.TempDir(), "database.json"), database.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	authenticator, err := auth.NewAuthenticator([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &ApiConfig{
+		db:                   db,
+		authenticator:        authenticator,
+		refreshTokenTTL:      time.Hour,
+		passwordResetTTL:     time.Hour,
+		emailVerificationTTL: time.Hour,
+		impersonationTTL:     15 * time.Minute,
+		mailer:               &mail.FileMailer{Path: filepath.Join(t.TempDir(), "mail.txt")},
+		accountLimiter:       auth.NewLimiter(auth.LockoutPolicy{Threshold: 5, Backoff: time.Second, Lockout: time.Hour}, nil),
+		ipLimiter:            auth.NewLimiter(auth.LockoutPolicy{Threshold: 50, Lockout: time.Hour}, nil),
+		passwordPolicy:       auth.PasswordPolicy{MinLength: 8, MaxLength: 128, Breached: map[string]struct{}{"password123": {}}},
+		deletionPolicy:       AccountDeletionPolicy{Grace: time.Hour, Chirps: database.ChirpsAnonymize, PurgeInterval: time.Hour},
+		backupPolicy:         database.BackupPolicy{Dir: filepath.Join(t.TempDir(), "backups"), Keep: 7},
+	}
+
+	mux := http.NewServeMux()
+	Routes(mux, cfg)
+
+	return cfg, mux
+}
+
+// serve sends a request with an optional bearer token
+func serve(handler http.Handler, method string, target string, token string, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, strings.NewReader(body))
+	r.Header.Set("User-Agent", "test")
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+// login signs a@example.com in
+func login(t *testing.T, handler http.Handler) database.ReturnedUser {
+	t.Helper()
+
+	return loginWith(t, handler, "password")
+}
+
+// loginWith signs a@example.com in with password
+func loginWith(t *testing.T, handler http.Handler, password string) database.ReturnedUser {
+	t.Helper()
+
+	w := serve(handler, http.MethodPost, "/api/login", "", `{"email":"a@example.com","password":"`+password+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected login to succeed, got %d", w.Code)
+	}
+
+	user := database.ReturnedUser{}
+	err := json.Unmarshal(w.Body.Bytes(), &user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+func TestSessionEndpoints(t *testing.T) {
+	_, handler := newTestConfig(t)
+
+	first := login(t, handler)
+	second := login(t, handler)
+
+	w := serve(handler, http.MethodGet, "/api/sessions", first.Token, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the sessions, got %d", w.Code)
+	}
+	sessions := []struct {
+		Id        string `json:"id"`
+		UserAgent string `json:"user_agent"`
+		IP        string `json:"ip"`
+		Current   bool   `json:"current"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &sessions)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 2 || sessions[0].UserAgent != "test" || sessions[0].IP == "" {
+		t.Fatalf("expected two sessions with the client, got %+v", sessions)
+	}
+
+	current := ""
+	for _, session := range sessions {
+		if session.Current {
+			current = session.Id
+		}
+	}
+	if current == "" {
+		t.Fatalf("expected the session of the request to be current, got %+v", sessions)
+	}
+
+	// revoking a session logs its access token out right away
+	w = serve(handler, http.MethodDelete, "/api/sessions/"+current, second.Token, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the session revoked, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/sessions", first.Token, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the access token of the revoked session to be rejected, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodDelete, "/api/sessions/"+current, second.Token, "")
+	if w.Code != http.StatusNotFound {
+		t.Errorf("expected a revoked session to be not found, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodDelete, "/api/sessions", second.Token, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected every session revoked, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodGet, "/api/sessions", second.Token, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the access token to be rejected after logging out everywhere, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/refresh", second.RefreshToken, "")
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the refresh token to be rejected after logging out everywhere, got %d", w.Code)
+	}
+}
+
+func TestRevokeDeniesAccessTokens(t *testing.T) {
+	_, handler := newTestConfig(t)
+
+	user := login(t, handler)
+
+	w := serve(handler, http.MethodPost, "/api/refresh", user.RefreshToken, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the refresh to succeed, got %d", w.Code)
+	}
+	refreshed := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &refreshed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, token := range []string{user.Token, refreshed.Token} {
+		w = serve(handler, http.MethodGet, "/api/sessions", token, "")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected the access token to work, got %d", w.Code)
+		}
+	}
+
+	w = serve(handler, http.MethodPost, "/api/revoke", refreshed.RefreshToken, "")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the refresh token revoked, got %d", w.Code)
+	}
+
+	// both access tokens of the session are denied before they expire
+	for _, token := range []string{user.Token, refreshed.Token} {
+		w = serve(handler, http.MethodGet, "/api/sessions", token, "")
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("expected the access token to be denied after revoking, got %d", w.Code)
+		}
+	}
+}
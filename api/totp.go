@@ -0,0 +1,268 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+	"github.com/neet-007/chirpy/database"
+)
+
+const (
+	// mfaChallengeExpiresIn is how long a login waits for its second factor
+	mfaChallengeExpiresIn = 5 * time.Minute
+	totpIssuer            = "Chirpy"
+	recoveryCodeCount     = 10
+)
+
+// challengeLogin answers a login with a correct password from a user with
+// an authenticator, the challenge token is exchanged for the tokens at
+// HandlerLogUserMFA
+func (cfg *ApiConfig) challengeLogin(w http.ResponseWriter, userId int) {
+	type returnVal struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+	}
+
+	token, err := auth.NewMFAChallengeToken()
+	if err != nil {
+		fmt.Printf("Error issuing mfa challenge: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = cfg.db.CreateMFAChallenge(token, userId, time.Now().UTC(), mfaChallengeExpiresIn)
+	if err != nil {
+		fmt.Printf("Error saving mfa challenge: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(returnVal{MFARequired: true, MFAToken: token})
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// HandlerLogUserMFA finishes a login with a code from the authenticator
+// or a recovery code, answering like HandlerLogUser. Wrong codes count as
+// failed logins of the account so new challenges don't give more guesses
+func (cfg *ApiConfig) HandlerLogUserMFA(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	if wait := cfg.ipLimiter.Wait(clientIP(r)); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+
+	userId, err := cfg.db.GetMFAChallengeUser(params.MFAToken)
+	if errors.Is(err, database.ErrMFAChallengeNotFound) {
+		cfg.ipLimiter.Fail(clientIP(r))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error getting mfa challenge: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	user, err := cfg.db.GetUserById(userId)
+	if errors.Is(err, database.ErrUserNotFound) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error getting user: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// checked before the code so a locked out account can't be guessed at
+	if wait := cfg.loginWait(user.Email, r); wait > 0 {
+		tooManyRequests(w, wait)
+		return
+	}
+
+	_, err = cfg.db.CompleteMFAChallenge(params.MFAToken, params.Code, time.Now().UTC(), auth.ValidateTOTP)
+	if errors.Is(err, database.ErrInvalidMFACode) {
+		cfg.loginFailed(user.Email, r)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if errors.Is(err, database.ErrMFAChallengeNotFound) || errors.Is(err, database.ErrMFAChallengeExpired) ||
+		errors.Is(err, database.ErrTOTPNotEnrolled) {
+		fmt.Printf("Error completing mfa challenge: %s", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error completing mfa challenge: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	cfg.logIn(w, r, user)
+}
+
+// HandlerEnrollTOTP starts enrolling a new authenticator, the user scans
+// the uri and confirms with a code at HandlerConfirmTOTP
+func (cfg *ApiConfig) HandlerEnrollTOTP(w http.ResponseWriter, r *http.Request) {
+	type returnVal struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}
+
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	user, err := cfg.db.GetUserById(userId)
+	if err != nil {
+		fmt.Printf("Error getting user: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	secret, err := auth.NewTOTPSecret()
+	if err != nil {
+		fmt.Printf("Error issuing totp secret: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = cfg.db.EnrollTOTP(user.Id, secret, time.Now().UTC())
+	if errors.Is(err, database.ErrTOTPEnrolled) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error enrolling totp: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(returnVal{Secret: secret, URI: auth.TOTPURI(totpIssuer, user.Email, secret)})
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	w.Write(json)
+}
+
+// HandlerConfirmTOTP turns the authenticator on and answers with the
+// recovery codes, they are only ever shown here
+func (cfg *ApiConfig) HandlerConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		Code string `json:"code"`
+	}
+	type returnVal struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	recoveryCodes, err := auth.NewRecoveryCodes(recoveryCodeCount)
+	if err != nil {
+		fmt.Printf("Error issuing recovery codes: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	err = cfg.db.ConfirmTOTP(userId, params.Code, recoveryCodes, time.Now().UTC(), auth.ValidateTOTP)
+	if errors.Is(err, database.ErrInvalidMFACode) || errors.Is(err, database.ErrTOTPNotEnrolled) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if errors.Is(err, database.ErrTOTPEnrolled) {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error confirming totp: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	json, err := json.Marshal(returnVal{RecoveryCodes: recoveryCodes})
+	if err != nil {
+		fmt.Printf("Error encoding return value: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(json)
+}
+
+// HandlerDisableTOTP removes the authenticator given a code from it or a
+// recovery code
+func (cfg *ApiConfig) HandlerDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	type parammeter struct {
+		Code string `json:"code"`
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	params := parammeter{}
+	err := decoder.Decode(&params)
+
+	if err != nil {
+		fmt.Printf("Error decoding parameters: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	userId, _ := auth.UserIdFromContext(r.Context())
+
+	err = cfg.db.DisableTOTP(userId, params.Code, time.Now().UTC(), auth.ValidateTOTP)
+	if errors.Is(err, database.ErrTOTPNotEnrolled) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, database.ErrInvalidMFACode) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Error disabling totp: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
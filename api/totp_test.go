@@ -0,0 +1,183 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/neet-007/chirpy/auth"
+)
+
+// challenge logs a@example.com in and returns the mfa token it answers with
+func challenge(t *testing.T, handler http.Handler) string {
+	t.Helper()
+
+	w := serve(handler, http.MethodPost, "/api/login", "", `{"email":"a@example.com","password":"password"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the password to be accepted, got %d", w.Code)
+	}
+
+	challenge := struct {
+		MFARequired bool   `json:"mfa_required"`
+		MFAToken    string `json:"mfa_token"`
+		Token       string `json:"token"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &challenge)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !challenge.MFARequired || challenge.MFAToken == "" || challenge.Token != "" {
+		t.Fatalf("expected an mfa challenge without tokens, got %s", w.Body)
+	}
+
+	return challenge.MFAToken
+}
+
+func TestTOTPLogin(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	user := login(t, handler)
+
+	w := serve(handler, http.MethodPost, "/api/users/totp", user.Token, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the enrollment started, got %d", w.Code)
+	}
+	enrollment := struct {
+		Secret string `json:"secret"`
+		URI    string `json:"uri"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &enrollment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if enrollment.URI != auth.TOTPURI("Chirpy", "a@example.com", enrollment.Secret) {
+		t.Errorf("expected the provisioning uri of the secret, got %s", enrollment.URI)
+	}
+
+	// an unconfirmed authenticator doesn't guard logins yet
+	login(t, handler)
+
+	now := time.Now()
+	code, err := auth.TOTPCode(enrollment.Secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(handler, http.MethodPost, "/api/users/totp/confirm", user.Token, `{"code":"000000x"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a wrong code to be rejected, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodPost, "/api/users/totp/confirm", user.Token, `{"code":"`+code+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the authenticator confirmed, got %d", w.Code)
+	}
+	confirmed := struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &confirmed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(confirmed.RecoveryCodes) != 10 {
+		t.Fatalf("expected 10 recovery codes, got %v", confirmed.RecoveryCodes)
+	}
+
+	token := challenge(t, handler)
+	w = serve(handler, http.MethodPost, "/api/login/mfa", "", `{"mfa_token":"`+token+`","code":"`+code+`"}`)
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("expected the confirming code not to be replayed, got %d", w.Code)
+	}
+	// the wrong code backs off the account like a wrong password
+	w = serve(handler, http.MethodPost, "/api/login/mfa", "", `{"mfa_token":"`+token+`","code":"`+code+`"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the code to back off like a login, got %d", w.Code)
+	}
+	cfg.accountLimiter.Reset(accountKey("a@example.com"))
+
+	// the code of the next period is still within the allowed skew
+	next, err := auth.TOTPCode(enrollment.Secret, now.Add(30*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(handler, http.MethodPost, "/api/login/mfa", "", `{"mfa_token":"`+token+`","code":"`+next+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the login finished, got %d", w.Code)
+	}
+	loggedIn := struct {
+		Token        string `json:"token"`
+		RefreshToken string `json:"refresh_token"`
+	}{}
+	err = json.Unmarshal(w.Body.Bytes(), &loggedIn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(handler, http.MethodGet, "/api/sessions", loggedIn.Token, "")
+	if w.Code != http.StatusOK {
+		t.Errorf("expected the access token to work, got %d", w.Code)
+	}
+
+	token = challenge(t, handler)
+	w = serve(handler, http.MethodPost, "/api/login/mfa", "", `{"mfa_token":"`+token+`","code":"`+confirmed.RecoveryCodes[0]+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected a recovery code to finish the login, got %d", w.Code)
+	}
+
+	w = serve(handler, http.MethodDelete, "/api/users/totp", user.Token, `{"code":"`+confirmed.RecoveryCodes[0]+`"}`)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("expected a used recovery code to be rejected, got %d", w.Code)
+	}
+	w = serve(handler, http.MethodDelete, "/api/users/totp", user.Token, `{"code":"`+confirmed.RecoveryCodes[1]+`"}`)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected the authenticator removed, got %d", w.Code)
+	}
+
+	login(t, handler)
+}
+
+func TestTOTPLoginLocksOut(t *testing.T) {
+	cfg, handler := newTestConfig(t)
+	cfg.accountLimiter = auth.NewLimiter(auth.LockoutPolicy{Threshold: 5, Lockout: time.Hour}, nil)
+	user := login(t, handler)
+
+	w := serve(handler, http.MethodPost, "/api/users/totp", user.Token, "")
+	if w.Code != http.StatusCreated {
+		t.Fatalf("expected the enrollment started, got %d", w.Code)
+	}
+	enrollment := struct {
+		Secret string `json:"secret"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &enrollment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := auth.TOTPCode(enrollment.Secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = serve(handler, http.MethodPost, "/api/users/totp/confirm", user.Token, `{"code":"`+code+`"}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the authenticator confirmed, got %d", w.Code)
+	}
+
+	// the password alone doesn't forget the wrong codes, so every new
+	// challenge shares the attempts of the account
+	attempts := 0
+	for range 3 {
+		token := challenge(t, handler)
+		for range 2 {
+			attempts++
+			expected := http.StatusUnauthorized
+			if attempts > 5 {
+				expected = http.StatusTooManyRequests
+			}
+			w = serve(handler, http.MethodPost, "/api/login/mfa", "", `{"mfa_token":"`+token+`","code":"wrong"}`)
+			if w.Code != expected {
+				t.Fatalf("expected code %d answered with %d, got %d", attempts, expected, w.Code)
+			}
+		}
+	}
+
+	w = serve(handler, http.MethodPost, "/api/login", "", `{"email":"a@example.com","password":"password"}`)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the account locked out, got %d", w.Code)
+	}
+}
@@ -0,0 +1,284 @@
+package auth
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const issuer = "chirpy"
+
+// ErrNoToken is returned when a request has no usable Authorization header
+var ErrNoToken = errors.New("no auth token")
+
+// Authenticator issues and verifies the jwt access tokens of users
+type Authenticator struct {
+	// signing is the key new tokens are signed with,
+	// nil when they are signed with the secret
+	signing *Key
+	keys    map[string]Key
+	secret  []byte
+}
+
+// NewAuthenticator signs tokens with the first key, or with secret using
+// HS256 when there are no keys. Every key verifies the tokens carrying its
+// id in the kid header, a secret next to keys keeps verifying the tokens
+// issued before switching to them so nobody is logged out
+func NewAuthenticator(secret []byte, keys ...Key) (*Authenticator, error) {
+	a := &Authenticator{keys: map[string]Key{}, secret: secret}
+
+	if len(keys) == 0 && len(secret) == 0 {
+		return nil, errors.New("empty jwt secret and no signing keys")
+	}
+
+	for i, key := range keys {
+		if _, ok := a.keys[key.Id]; ok {
+			return nil, fmt.Errorf("key id %q is used twice", key.Id)
+		}
+		a.keys[key.Id] = key
+
+		if i == 0 {
+			if !key.CanSign() {
+				return nil, fmt.Errorf("the first key %q signs tokens and needs a private key", key.Id)
+			}
+			a.signing = &key
+		}
+	}
+
+	return a, nil
+}
+
+// Claims are the claims of an access token, the session id ties the
+// token to the login it was issued for and the jti (ID) lets it be
+// revoked before it expires. The role is the one the user had when
+// the token was issued. Tokens issued to an oauth client carry its id
+// and the space separated scopes the user granted it instead of a role.
+// Impersonation tokens name the admin acting as the user in act and
+// carry scopes too, they have no session or role
+type Claims struct {
+	jwt.RegisteredClaims
+	SessionId string `json:"sid,omitempty"`
+	Role      string `json:"role,omitempty"`
+	ClientId  string `json:"client_id,omitempty"`
+	Scope     string `json:"scope,omitempty"`
+	Act       *Actor `json:"act,omitempty"`
+	// UserId is read from the subject
+	UserId int `json:"-"`
+	// ActorId is read from the subject of act, 0 when nobody acts for
+	// the user
+	ActorId int `json:"-"`
+	// APIKeyId is set for requests made with an api key instead of an
+	// access token, Scopes are those of the key or read from Scope
+	APIKeyId string   `json:"-"`
+	Scopes   []string `json:"-"`
+}
+
+// Actor is the act claim of RFC 8693, the subject is the user acting
+type Actor struct {
+	Subject string `json:"sub"`
+}
+
+// Impersonated reports whether someone else acts as the user
+func (c Claims) Impersonated() bool {
+	return c.Act != nil
+}
+
+// HasScope reports whether the request may do what scope allows, access
+// tokens from a login may do everything
+func (c Claims) HasScope(scope string) bool {
+	if c.APIKeyId == "" && c.ClientId == "" && !c.Impersonated() {
+		return true
+	}
+	return slices.Contains(c.Scopes, scope)
+}
+
+// IssueAccessToken signs a jwt for the user's session that expires at
+// expiresAt, tokenId is its jti and comes from NewTokenId
+func (a *Authenticator) IssueAccessToken(userId int, role string, sessionId string, tokenId string, expiresAt time.Time) (string, error) {
+	return a.issue(Claims{SessionId: sessionId, Role: role}, userId, tokenId, expiresAt)
+}
+
+// IssueClientAccessToken signs a jwt for a session the user granted
+// clientId with scopes, it is verified like any other access token
+func (a *Authenticator) IssueClientAccessToken(userId int, clientId string, scopes []string, sessionId string, tokenId string, expiresAt time.Time) (string, error) {
+	return a.issue(Claims{SessionId: sessionId, ClientId: clientId, Scope: strings.Join(scopes, " ")}, userId, tokenId, expiresAt)
+}
+
+// IssueImpersonationToken signs a jwt that lets actorId act as the user
+// with scopes, it has no session so it can only be revoked by its jti
+func (a *Authenticator) IssueImpersonationToken(userId int, actorId int, scopes []string, tokenId string, expiresAt time.Time) (string, error) {
+	return a.issue(Claims{Act: &Actor{Subject: strconv.Itoa(actorId)}, Scope: strings.Join(scopes, " ")}, userId, tokenId, expiresAt)
+}
+
+func (a *Authenticator) issue(claims Claims, userId int, tokenId string, expiresAt time.Time) (string, error) {
+	timeNow := time.Now().UTC()
+
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		Issuer:    issuer,
+		IssuedAt:  jwt.NewNumericDate(timeNow),
+		ExpiresAt: jwt.NewNumericDate(expiresAt),
+		Subject:   strconv.Itoa(userId),
+		ID:        tokenId,
+	}
+
+	if a.signing == nil {
+		return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(a.secret)
+	}
+
+	token := jwt.NewWithClaims(a.signing.method, claims)
+	token.Header["kid"] = a.signing.Id
+	return token.SignedString(a.signing.private)
+}
+
+// VerifyAccessToken validates the jwt and returns its claims
+func (a *Authenticator) VerifyAccessToken(token string) (Claims, error) {
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(token, &claims, a.verificationKey,
+		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg(), jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithIssuer(issuer), jwt.WithExpirationRequired())
+	if err != nil {
+		return Claims{}, err
+	}
+
+	claims.UserId, err = strconv.Atoi(claims.Subject)
+	if err != nil {
+		return Claims{}, fmt.Errorf("invalid token subject: %w", err)
+	}
+	if claims.Act != nil {
+		claims.ActorId, err = strconv.Atoi(claims.Act.Subject)
+		if err != nil || claims.ActorId == claims.UserId {
+			return Claims{}, fmt.Errorf("invalid token actor %q", claims.Act.Subject)
+		}
+	}
+	claims.Scopes = strings.Fields(claims.Scope)
+
+	return claims, nil
+}
+
+// verificationKey picks the key named by the kid header, tokens without
+// one were signed with the secret. The algorithm has to be the one of
+// the key so a public key is never used as an HMAC secret
+func (a *Authenticator) verificationKey(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	if kid == "" {
+		if len(a.secret) == 0 || t.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+			return nil, errors.New("token has no kid")
+		}
+		return a.secret, nil
+	}
+
+	key, ok := a.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown kid %q", kid)
+	}
+	if t.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("kid %q signs with %s, not %s", kid, key.method.Alg(), t.Method.Alg())
+	}
+
+	return key.public, nil
+}
+
+// JWKS returns the public keys that verify tokens, the signing key first
+func (a *Authenticator) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+	if a.signing != nil {
+		jwks.Keys = append(jwks.Keys, a.signing.jwk())
+	}
+
+	ids := make([]string, 0, len(a.keys))
+	for id := range a.keys {
+		if a.signing == nil || id != a.signing.Id {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		jwks.Keys = append(jwks.Keys, a.keys[id].jwk())
+	}
+
+	return jwks
+}
+
+// NewRefreshToken returns a random hex encoded refresh token
+func NewRefreshToken() (string, error) {
+	return randomHex(32)
+}
+
+// NewPasswordResetToken returns a random hex encoded password reset token
+func NewPasswordResetToken() (string, error) {
+	return randomHex(32)
+}
+
+// NewEmailVerificationToken returns a random hex encoded email
+// verification token
+func NewEmailVerificationToken() (string, error) {
+	return randomHex(32)
+}
+
+// apiKeyPrefix starts every api key so a leaked one is easy to spot
+const apiKeyPrefix = "chirpy_"
+
+// NewAPIKey returns a random api key and the start of it that is shown
+// to tell keys apart
+func NewAPIKey() (string, string, error) {
+	secret, err := randomHex(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	key := apiKeyPrefix + secret
+	return key, key[:len(apiKeyPrefix)+8], nil
+}
+
+// NewTokenId returns a random jti for an access token
+func NewTokenId() (string, error) {
+	return randomHex(16)
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// BearerToken returns the token of an "Authorization: Bearer <token>" header
+func BearerToken(header http.Header) (string, error) {
+	return authorization(header, "Bearer")
+}
+
+// ApiKey returns the key of an "Authorization: ApiKey <key>" header
+func ApiKey(header http.Header) (string, error) {
+	return authorization(header, "ApiKey")
+}
+
+func authorization(header http.Header, scheme string) (string, error) {
+	tokenHeader := header.Get("Authorization")
+	if tokenHeader == "" {
+		return "", ErrNoToken
+	}
+
+	tokenFields := strings.Fields(tokenHeader)
+	if len(tokenFields) != 2 {
+		return "", fmt.Errorf("%w: auth token length is not 2", ErrNoToken)
+	}
+
+	if !strings.EqualFold(tokenFields[0], scheme) {
+		return "", fmt.Errorf("%w: expected the %s scheme", ErrNoToken, scheme)
+	}
+
+	return tokenFields[1], nil
+}
@@ -0,0 +1,268 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestAccessToken(t *testing.T) {
+	authenticator, err := NewAuthenticator([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := authenticator.IssueAccessToken(7, "user", "s1", "t1", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := authenticator.VerifyAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserId != 7 || claims.Role != "user" || claims.SessionId != "s1" || claims.ID != "t1" {
+		t.Errorf("expected token t1 of user 7 in session s1, got %+v", claims)
+	}
+
+	other, err := NewAuthenticator([]byte("other secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.VerifyAccessToken(token)
+	if err == nil {
+		t.Errorf("expected a token signed with another secret to be rejected")
+	}
+
+	expired, err := authenticator.IssueAccessToken(7, "user", "s1", "t1", time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authenticator.VerifyAccessToken(expired)
+	if err == nil {
+		t.Errorf("expected an expired token to be rejected")
+	}
+}
+
+func TestImpersonationToken(t *testing.T) {
+	authenticator, err := NewAuthenticator([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := authenticator.IssueImpersonationToken(7, 1, []string{"chirps:read"}, "t1", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := authenticator.VerifyAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserId != 7 || claims.ActorId != 1 || !claims.Impersonated() || claims.Role != "" || claims.SessionId != "" {
+		t.Errorf("expected user 1 acting as user 7, got %+v", claims)
+	}
+	if !claims.HasScope("chirps:read") || claims.HasScope("account") {
+		t.Errorf("expected the token limited to its scopes, got %v", claims.Scopes)
+	}
+
+	self, err := authenticator.IssueImpersonationToken(7, 7, []string{"chirps:read"}, "t2", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = authenticator.VerifyAccessToken(self)
+	if err == nil {
+		t.Errorf("expected a user acting as itself to be rejected")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	authenticator, err := NewAuthenticator([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := authenticator.IssueAccessToken(7, "user", "s1", "t1", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	revoked, err := authenticator.IssueAccessToken(7, "user", "s1", "revoked", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := authenticator.Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userId, ok := UserIdFromContext(r.Context())
+		if !ok || userId != 7 {
+			t.Errorf("expected user 7 in the context, got %d %v", userId, ok)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}), func(claims Claims) error {
+		if claims.ID == "revoked" {
+			return errors.New("session revoked")
+		}
+		return nil
+	})
+
+	cases := []struct {
+		header string
+		status int
+	}{
+		{header: "", status: http.StatusUnauthorized},
+		{header: "Bearer", status: http.StatusUnauthorized},
+		{header: "ApiKey " + token, status: http.StatusUnauthorized},
+		{header: "Bearer not-a-jwt", status: http.StatusUnauthorized},
+		{header: "Bearer " + revoked, status: http.StatusUnauthorized},
+		{header: "Bearer " + token, status: http.StatusNoContent},
+	}
+
+	for _, case_ := range cases {
+		r := httptest.NewRequest(http.MethodPost, "/api/chirps", nil)
+		if case_.header != "" {
+			r.Header.Set("Authorization", case_.header)
+		}
+		w := httptest.NewRecorder()
+
+		handler.ServeHTTP(w, r)
+		if w.Code != case_.status {
+			t.Errorf("%q: expected status %d, got %d", case_.header, case_.status, w.Code)
+		}
+	}
+}
+
+// testKey generates a key of the given kind and reads it back from PEM
+func testKey(t *testing.T, id string, kind string) Key {
+	t.Helper()
+
+	var private crypto.Signer
+	var err error
+	switch kind {
+	case "rsa":
+		private, err = rsa.GenerateKey(rand.Reader, 2048)
+	case "ed25519":
+		_, private, err = ed25519.GenerateKey(rand.Reader)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := ParseKey(id, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return key
+}
+
+// publicKey keeps only the public half of key like a verification key file
+func publicKey(t *testing.T, key Key) Key {
+	t.Helper()
+
+	der, err := x509.MarshalPKIXPublicKey(key.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	public, err := ParseKey(key.Id, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if public.CanSign() {
+		t.Fatal("expected a public key to only verify")
+	}
+
+	return public
+}
+
+func TestKeyRotation(t *testing.T) {
+	secret := []byte("secret")
+
+	hs256, err := NewAuthenticator(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldKey := testKey(t, "old", "rsa")
+	old, err := NewAuthenticator(nil, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// signs with the new key and still verifies tokens of the old key
+	// and of the secret
+	rotated, err := NewAuthenticator(secret, testKey(t, "new", "ed25519"), publicKey(t, oldKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, issuing := range map[string]*Authenticator{"hs256": hs256, "old": old, "rotated": rotated} {
+		token, err := issuing.IssueAccessToken(7, "user", "s1", "t1", time.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		claims, err := rotated.VerifyAccessToken(token)
+		if err != nil || claims.UserId != 7 {
+			t.Errorf("%s: expected user 7, got %d %v", name, claims.UserId, err)
+		}
+	}
+
+	token, err := rotated.IssueAccessToken(7, "user", "s1", "t1", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = old.VerifyAccessToken(token)
+	if err == nil {
+		t.Errorf("expected a token of an unknown kid to be rejected")
+	}
+
+	jwks := rotated.JWKS()
+	if len(jwks.Keys) != 2 || jwks.Keys[0].Kid != "new" || jwks.Keys[0].Kty != "OKP" || jwks.Keys[1].Kty != "RSA" {
+		t.Errorf("expected the new Ed25519 key then the old RSA key, got %+v", jwks.Keys)
+	}
+}
+
+func TestRejectsAlgorithmConfusion(t *testing.T) {
+	key := testKey(t, "k1", "rsa")
+	authenticator, err := NewAuthenticator(nil, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	publicDER, err := x509.MarshalPKIXPublicKey(key.public)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an HS256 token using the public key as the secret
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
+		Issuer:    issuer,
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	})
+	forged.Header["kid"] = "k1"
+	token, err := forged.SignedString(publicDER)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = authenticator.VerifyAccessToken(token)
+	if err == nil {
+		t.Errorf("expected an HS256 token naming an RSA kid to be rejected")
+	}
+}
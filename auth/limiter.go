@@ -0,0 +1,109 @@
+package auth
+
+import (
+	"sync"
+	"time"
+)
+
+// LockoutPolicy is how a Limiter backs off the failures of a key
+type LockoutPolicy struct {
+	// Threshold is the number of failures that locks the key out
+	Threshold int
+	// Backoff is the wait after the first failure, it doubles with every
+	// failure after that until the key is locked out
+	Backoff time.Duration
+	// Lockout is how long a key stays locked out, failures older than it
+	// are forgotten
+	Lockout time.Duration
+}
+
+type failures struct {
+	count int
+	last  time.Time
+}
+
+// Limiter counts failures per key, like an email or an ip, and tells how
+// long a key has to wait before it may try again. It lives in memory so
+// a restart forgets every failure
+type Limiter struct {
+	policy LockoutPolicy
+	now    func() time.Time
+
+	mux       sync.Mutex
+	keys      map[string]failures
+	lastSweep time.Time
+}
+
+// NewLimiter returns a Limiter reading the time from now, time.Now when nil
+func NewLimiter(policy LockoutPolicy, now func() time.Time) *Limiter {
+	if now == nil {
+		now = time.Now
+	}
+
+	return &Limiter{
+		policy: policy,
+		now:    now,
+		keys:   map[string]failures{},
+	}
+}
+
+// Wait returns how long key has to wait before trying again,
+// 0 when it may try now
+func (l *Limiter) Wait(key string) time.Duration {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	f, ok := l.keys[key]
+	if !ok || f.count == 0 {
+		return 0
+	}
+
+	wait := l.policy.Lockout
+	if f.count < l.policy.Threshold {
+		wait = l.policy.Backoff
+		for i := 1; i < f.count && wait < l.policy.Lockout; i++ {
+			wait *= 2
+		}
+		wait = min(wait, l.policy.Lockout)
+	}
+
+	return max(f.last.Add(wait).Sub(l.now()), 0)
+}
+
+// Fail records a failure of key
+func (l *Limiter) Fail(key string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+
+	f := l.keys[key]
+	if !now.Before(f.last.Add(l.policy.Lockout)) {
+		f = failures{}
+	}
+	l.keys[key] = failures{count: f.count + 1, last: now}
+}
+
+// Reset forgets the failures of key, unlocking it
+func (l *Limiter) Reset(key string) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	delete(l.keys, key)
+}
+
+// sweep drops the keys whose failures are all forgotten, at most once
+// per lockout so failing stays cheap
+func (l *Limiter) sweep(now time.Time) {
+	if now.Before(l.lastSweep.Add(l.policy.Lockout)) {
+		return
+	}
+	l.lastSweep = now
+
+	for key, f := range l.keys {
+		if !now.Before(f.last.Add(l.policy.Lockout)) {
+			delete(l.keys, key)
+		}
+	}
+}
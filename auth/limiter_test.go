@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewLimiter(LockoutPolicy{Threshold: 4, Backoff: time.Second, Lockout: time.Hour}, func() time.Time { return now })
+
+	if wait := limiter.Wait("a"); wait != 0 {
+		t.Errorf("expected a new key to try right away, waited %s", wait)
+	}
+
+	// the wait doubles with every failure until the lockout
+	for i, expected := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, time.Hour} {
+		limiter.Fail("a")
+		if wait := limiter.Wait("a"); wait != expected {
+			t.Errorf("expected %s after %d failures, got %s", expected, i+1, wait)
+		}
+	}
+	if wait := limiter.Wait("b"); wait != 0 {
+		t.Errorf("expected other keys to be unaffected, waited %s", wait)
+	}
+
+	now = now.Add(45 * time.Minute)
+	if wait := limiter.Wait("a"); wait != 15*time.Minute {
+		t.Errorf("expected the lockout to run out in 15m, got %s", wait)
+	}
+
+	now = now.Add(15 * time.Minute)
+	if wait := limiter.Wait("a"); wait != 0 {
+		t.Errorf("expected the lockout over, waited %s", wait)
+	}
+	limiter.Fail("a")
+	if wait := limiter.Wait("a"); wait != time.Second {
+		t.Errorf("expected old failures to be forgotten, waited %s", wait)
+	}
+
+	limiter.Reset("a")
+	if wait := limiter.Wait("a"); wait != 0 {
+		t.Errorf("expected a reset key to try right away, waited %s", wait)
+	}
+}
+
+func TestLimiterSweepsForgottenKeys(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := NewLimiter(LockoutPolicy{Threshold: 4, Backoff: time.Second, Lockout: time.Hour}, func() time.Time { return now })
+
+	limiter.Fail("a")
+	now = now.Add(2 * time.Hour)
+	limiter.Fail("b")
+
+	if _, ok := limiter.keys["a"]; ok {
+		t.Errorf("expected the forgotten key to be swept")
+	}
+	if _, ok := limiter.keys["b"]; !ok {
+		t.Errorf("expected the failing key to be kept")
+	}
+}
@@ -0,0 +1,56 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+type contextKey struct{}
+
+// Check rejects a verified token with an error, it is how the server
+// turns away tokens that were revoked before they expired
+type Check func(claims Claims) error
+
+// Middleware authenticates the bearer access token of a request and
+// passes its claims on in the context, requests without a valid token
+// or that fail check get a 401. check may be nil
+func (a *Authenticator) Middleware(next http.Handler, check Check) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := BearerToken(r.Header)
+		if err != nil {
+			fmt.Printf("Error authenticating request: %s\n", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		claims, err := a.VerifyAccessToken(token)
+		if err == nil && check != nil {
+			err = check(claims)
+		}
+		if err != nil {
+			fmt.Printf("Error authenticating request: %s\n", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), claims)))
+	})
+}
+
+// WithClaims returns a copy of ctx carrying the claims of the authenticated token
+func WithClaims(ctx context.Context, claims Claims) context.Context {
+	return context.WithValue(ctx, contextKey{}, claims)
+}
+
+// ClaimsFromContext returns the claims Middleware put in ctx
+func ClaimsFromContext(ctx context.Context) (Claims, bool) {
+	claims, ok := ctx.Value(contextKey{}).(Claims)
+	return claims, ok
+}
+
+// UserIdFromContext returns the id of the user Middleware authenticated
+func UserIdFromContext(ctx context.Context) (int, bool) {
+	claims, ok := ClaimsFromContext(ctx)
+	return claims.UserId, ok
+}
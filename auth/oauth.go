@@ -0,0 +1,38 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+)
+
+// NewClientId returns a random id for an oauth client
+func NewClientId() (string, error) {
+	return randomHex(16)
+}
+
+// NewClientSecret returns a random hex encoded oauth client secret
+func NewClientSecret() (string, error) {
+	return randomHex(32)
+}
+
+// NewAuthorizationCode returns a random hex encoded oauth authorization code
+func NewAuthorizationCode() (string, error) {
+	return randomHex(32)
+}
+
+// PKCEChallenge is the S256 code challenge of verifier (RFC 7636)
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyPKCE reports whether verifier is the one challenge was made from,
+// verifiers have to be 43 to 128 characters long
+func VerifyPKCE(verifier string, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(PKCEChallenge(verifier)), []byte(challenge)) == 1
+}
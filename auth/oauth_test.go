@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPKCE(t *testing.T) {
+	// the example of RFC 7636 appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if got := PKCEChallenge(verifier); got != challenge {
+		t.Errorf("expected challenge %s, got %s", challenge, got)
+	}
+	if !VerifyPKCE(verifier, challenge) {
+		t.Errorf("expected the verifier to match its challenge")
+	}
+	if VerifyPKCE(verifier[:42]+"x", challenge) {
+		t.Errorf("expected another verifier to be rejected")
+	}
+	if VerifyPKCE("short", PKCEChallenge("short")) {
+		t.Errorf("expected a short verifier to be rejected")
+	}
+}
+
+func TestClientAccessToken(t *testing.T) {
+	authenticator, err := NewAuthenticator([]byte("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := authenticator.IssueClientAccessToken(7, "c1", []string{"chirps:read", "chirps:write"}, "s1", "t1", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := authenticator.VerifyAccessToken(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims.UserId != 7 || claims.ClientId != "c1" || claims.Role != "" || !slices.Equal(claims.Scopes, []string{"chirps:read", "chirps:write"}) {
+		t.Errorf("expected a token of client c1 for user 7, got %+v", claims)
+	}
+	if !claims.HasScope("chirps:write") || claims.HasScope("account") {
+		t.Errorf("expected the token limited to its scopes, got %v", claims.Scopes)
+	}
+
+	login, err := authenticator.IssueAccessToken(7, "user", "s2", "t2", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims, err = authenticator.VerifyAccessToken(login)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !claims.HasScope("account") {
+		t.Errorf("expected a login token to have every scope")
+	}
+}
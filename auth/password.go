@@ -0,0 +1,71 @@
+package auth
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// ErrPasswordTooShort is returned for passwords under the minimum length
+	ErrPasswordTooShort = errors.New("password is too short")
+	// ErrPasswordTooLong is returned for passwords over the maximum length
+	ErrPasswordTooLong = errors.New("password is too long")
+	// ErrPasswordBreached is returned for passwords on the breached list
+	ErrPasswordBreached = errors.New("password is on a list of breached passwords")
+)
+
+// PasswordPolicy is what a new password has to be like, lengths are in
+// characters
+type PasswordPolicy struct {
+	MinLength int
+	// MaxLength keeps hashing a password cheap, 0 means no maximum
+	MaxLength int
+	// Breached holds lowercased passwords known from breaches
+	Breached map[string]struct{}
+}
+
+// Check returns why password doesn't follow the policy, or nil
+func (p PasswordPolicy) Check(password string) error {
+	length := utf8.RuneCountInString(password)
+	if length < p.MinLength {
+		return fmt.Errorf("%w, expected at least %d characters", ErrPasswordTooShort, p.MinLength)
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return fmt.Errorf("%w, expected at most %d characters", ErrPasswordTooLong, p.MaxLength)
+	}
+
+	if _, ok := p.Breached[strings.ToLower(password)]; ok {
+		return ErrPasswordBreached
+	}
+
+	return nil
+}
+
+// LoadBreachedPasswords reads a list of breached passwords, one per
+// line. Blank lines and lines starting with # are skipped
+func LoadBreachedPasswords(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	breached := map[string]struct{}{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		breached[strings.ToLower(line)] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	return breached, nil
+}
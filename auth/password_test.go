@@ -0,0 +1,42 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPasswordPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	err := os.WriteFile(path, []byte("# common passwords\nPassword1\n\n  letmein  \n"), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	breached, err := LoadBreachedPasswords(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(breached) != 2 {
+		t.Fatalf("expected two passwords, got %v", breached)
+	}
+
+	policy := PasswordPolicy{MinLength: 7, MaxLength: 12, Breached: breached}
+	cases := []struct {
+		password string
+		err      error
+	}{
+		{"short", ErrPasswordTooShort},
+		{"far too long a password", ErrPasswordTooLong},
+		{"password1", ErrPasswordBreached},
+		{"LetMeIn", ErrPasswordBreached},
+		{"naïve pass", nil},
+	}
+	for _, case_ := range cases {
+		err := policy.Check(case_.password)
+		if !errors.Is(err, case_.err) || (case_.err == nil && err != nil) {
+			t.Errorf("expected %q to get %v, got %v", case_.password, case_.err, err)
+		}
+	}
+}
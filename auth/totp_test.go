@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"encoding/base32"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestTOTPCode(t *testing.T) {
+	// the sha1 test vectors of RFC 6238 cut to six digits
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{unix: 59, code: "287082"},
+		{unix: 1111111109, code: "081804"},
+		{unix: 1111111111, code: "050471"},
+		{unix: 1234567890, code: "005924"},
+		{unix: 2000000000, code: "279037"},
+	}
+
+	for _, case_ := range cases {
+		code, err := TOTPCode(secret, time.Unix(case_.unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != case_.code {
+			t.Errorf("expected %s at %d, got %s", case_.code, case_.unix, code)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2024, 1, 1, 0, 0, 10, 0, time.UTC)
+
+	code, err := TOTPCode(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	step, ok := ValidateTOTP(secret, code, now)
+	if !ok || step != totpStep(now) {
+		t.Fatalf("expected the code of now to be valid, got %d %v", step, ok)
+	}
+
+	_, ok = ValidateTOTP(secret, code, now.Add(totpPeriod))
+	if !ok {
+		t.Errorf("expected the code to be valid one period later")
+	}
+	_, ok = ValidateTOTP(secret, code, now.Add(2*totpPeriod))
+	if ok {
+		t.Errorf("expected the code to be invalid two periods later")
+	}
+	_, ok = ValidateTOTP(secret, "000000x", now)
+	if ok {
+		t.Errorf("expected a malformed code to be invalid")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri, err := url.Parse(TOTPURI("Chirpy", "a@example.com", "JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Path != "/Chirpy:a@example.com" {
+		t.Errorf("expected an otpauth totp uri, got %s", uri)
+	}
+	query := uri.Query()
+	if query.Get("secret") != "JBSWY3DPEHPK3PXP" || query.Get("issuer") != "Chirpy" || query.Get("digits") != "6" || query.Get("period") != "30" {
+		t.Errorf("expected the secret and parameters, got %s", uri.RawQuery)
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' || seen[code] {
+			t.Errorf("expected distinct codes like 1a2b3-c4d5e, got %v", codes)
+		}
+		seen[code] = true
+	}
+	if len(seen) != 10 {
+		t.Errorf("expected 10 codes, got %d", len(seen))
+	}
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/neet-007/chirpy/api"
+	"github.com/neet-007/chirpy/database"
+)
+
+// runCommand runs one of the maintenance subcommands
+// instead of starting the server
+func runCommand(name string, args []string) error {
+	switch name {
+	case "migrate":
+		return commandMigrate(args)
+	case "backup":
+		return commandBackup(args)
+	case "restore":
+		return commandRestore(args)
+	case "rekey":
+		return commandRekey(args)
+	case "keygen":
+		return commandKeygen(args)
+	case "promote":
+		return commandPromote(args)
+	case "purge-accounts":
+		return commandPurgeAccounts(args)
+	default:
+		return fmt.Errorf("unknown command, expected one of: migrate, backup, restore, rekey, keygen, promote, purge-accounts")
+	}
+}
+
+// jsonDBPath is the json database file the server would open
+func jsonDBPath() (string, error) {
+	driver := os.Getenv("DB_DRIVER")
+	if driver != "" && driver != database.DriverJSON {
+		return "", fmt.Errorf("only the %s driver keeps a versioned file, DB_DRIVER is %s", database.DriverJSON, driver)
+	}
+
+	path := os.Getenv("DB_PATH")
+	if path == "" {
+		return database.DefaultPath(database.DriverJSON)
+	}
+
+	return path, nil
+}
+
+func commandMigrate(args []string) error {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing the file")
+	flags.Parse(args)
+
+	path, err := jsonDBPath()
+	if err != nil {
+		return err
+	}
+
+	options, err := api.OptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	steps, err := database.PlanMigrations(path, options)
+	if err != nil {
+		return err
+	}
+
+	if len(steps) == 0 {
+		fmt.Printf("%s is at schema version %d\n", path, database.CurrentSchemaVersion)
+		return nil
+	}
+
+	for _, step := range steps {
+		fmt.Printf("schema version %d: %s\n", step.Version, step.Description)
+		for _, change := range step.Changes {
+			fmt.Printf("  %s\n", change)
+		}
+	}
+
+	if *dryRun {
+		return nil
+	}
+
+	// opening the database runs the migrations and writes the file
+	db, err := database.NewDBWithOptions(path, options)
+	if err != nil {
+		return err
+	}
+
+	return db.Close()
+}
+
+func commandBackup(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	list := flags.Bool("list", false, "list the backups instead of taking one")
+	flags.Parse(args)
+
+	policy, err := api.BackupPolicyFromEnv()
+	if err != nil {
+		return err
+	}
+
+	if *list {
+		names, err := database.ListBackups(policy.Dir)
+		if err != nil {
+			return err
+		}
+
+		for _, name := range names {
+			fmt.Println(filepath.Join(policy.Dir, name))
+		}
+		return nil
+	}
+
+	options, err := api.OptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	dbStructure, err := database.ReadSnapshot(os.Getenv("DB_DRIVER"), os.Getenv("DB_PATH"), options)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := database.Backup(dbStructure, policy)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("wrote %s (sha256 %s)\n", filepath.Join(policy.Dir, manifest.Name), manifest.SHA256)
+	return nil
+}
+
+func commandRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	until := flags.String("until", "", "replay the write ahead log up to this RFC 3339 time")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: chirpy restore [-until time] <backup archive>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected one backup archive")
+	}
+
+	untilTime := time.Time{}
+	if *until != "" {
+		t, err := time.Parse(time.RFC3339, *until)
+		if err != nil {
+			return fmt.Errorf("-until: %w", err)
+		}
+		untilTime = t
+	}
+
+	options, err := api.OptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	manifest, err := database.RestoreBackup(os.Getenv("DB_DRIVER"), os.Getenv("DB_PATH"), options, flags.Arg(0), untilTime)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("restored %s taken at %s\n", manifest.Name, manifest.CreatedAt.Format(time.RFC3339))
+	return nil
+}
+
+// commandRekey seals the database with the first key of the keyring.
+// To rotate keys put the new key first, keep the old one after it and
+// run rekey, the old key can be dropped once no backup needs it
+func commandRekey(args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ExitOnError)
+	flags.Parse(args)
+
+	path, err := jsonDBPath()
+	if err != nil {
+		return err
+	}
+
+	options, err := api.OptionsFromEnv()
+	if err != nil {
+		return err
+	}
+	if options.Keys == nil {
+		return fmt.Errorf("set DB_ENCRYPTION_KEY_FILE or DB_ENCRYPTION_KEYS to rekey")
+	}
+
+	err = database.Rekey(path, options)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("sealed %s with key %q\n", path, options.Keys.ActiveId())
+	return nil
+}
+
+func commandKeygen(args []string) error {
+	flags := flag.NewFlagSet("keygen", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: chirpy keygen <key id>\n")
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected a key id")
+	}
+
+	key, err := database.GenerateKey(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(key)
+	return nil
+}
+
+// commandPromote gives the user with an email a role, it is how the first
+// admin is made. The user's sessions end so it logs in again with the role
+func commandPromote(args []string) error {
+	flags := flag.NewFlagSet("promote", flag.ExitOnError)
+	role := flags.String("role", string(database.RoleAdmin), "the role to give, one of user, moderator or admin")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: chirpy promote [-role role] <email>\n")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		return fmt.Errorf("expected an email")
+	}
+
+	options, err := api.OptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	db, err := database.Open(os.Getenv("DB_DRIVER"), os.Getenv("DB_PATH"), options)
+	if err != nil {
+		return err
+	}
+
+	err = promote(db, flags.Arg(0), database.Role(*role))
+	closeErr := db.Close()
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// promote gives the user with email role
+func promote(db database.Store, email string, role database.Role) error {
+	user, err := db.GetUserByEmail(email)
+	if err != nil {
+		return fmt.Errorf("%s: %w", email, err)
+	}
+
+	updated, err := db.SetUserRole(user.Id, role)
+	if err != nil {
+		return err
+	}
+
+	err = db.RevokeSessions(user.Id)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("user %d (%s) is now %s\n", updated.Id, updated.Email, updated.Role)
+	return nil
+}
+
+func commandPurgeAccounts(args []string) error {
+	flags := flag.NewFlagSet("purge-accounts", flag.ExitOnError)
+	flags.Parse(args)
+
+	policy, err := api.AccountDeletionPolicyFromEnv()
+	if err != nil {
+		return err
+	}
+
+	options, err := api.OptionsFromEnv()
+	if err != nil {
+		return err
+	}
+
+	db, err := database.Open(os.Getenv("DB_DRIVER"), os.Getenv("DB_PATH"), options)
+	if err != nil {
+		return err
+	}
+
+	purged, err := db.PurgeAccounts(time.Now().UTC(), policy.Chirps)
+	closeErr := db.Close()
+	if err != nil {
+		return err
+	}
+
+	for _, userId := range purged {
+		fmt.Printf("purged the account of user %d\n", userId)
+	}
+	fmt.Printf("purged %d accounts\n", len(purged))
+
+	return closeErr
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+// what an api key may be used for, access tokens from a login may do all of it
+const (
+	ScopeChirpsRead  = "chirps:read"
+	ScopeChirpsWrite = "chirps:write"
+	ScopeAccount     = "account"
+)
+
+// APIKeyUseResolution is how stale the last use of an api key may get,
+// a key used more often is only written once per period
+const APIKeyUseResolution = time.Minute
+
+var (
+	// ErrAPIKeyNotFound is returned for api keys that were never created,
+	// were revoked or belong to another user
+	ErrAPIKeyNotFound = errors.New("api key not found")
+	// ErrInvalidScope is returned for scopes that aren't one of the scopes
+	ErrInvalidScope = errors.New("invalid scope")
+)
+
+// APIKey is a long lived credential of a user, only the hash of the key
+// is kept. Prefix is the start of the key so the user can tell keys apart
+type APIKey struct {
+	Id         string    `json:"id"`
+	Hash       string    `json:"hash"`
+	UserId     int       `json:"user_id"`
+	Name       string    `json:"name"`
+	Prefix     string    `json:"prefix"`
+	Scopes     []string  `json:"scopes"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+// ValidateScopes returns scopes sorted without duplicates, there has to
+// be at least one
+func ValidateScopes(scopes []string) ([]string, error) {
+	if len(scopes) == 0 {
+		return nil, fmt.Errorf("%w: expected at least one scope", ErrInvalidScope)
+	}
+
+	valid := make([]string, 0, len(scopes))
+	for _, scope := range scopes {
+		switch scope {
+		case ScopeChirpsRead, ScopeChirpsWrite, ScopeAccount:
+			valid = append(valid, scope)
+		default:
+			return nil, fmt.Errorf("%w %q, expected one of %s, %s or %s", ErrInvalidScope, scope, ScopeChirpsRead, ScopeChirpsWrite, ScopeAccount)
+		}
+	}
+	slices.Sort(valid)
+
+	return slices.Compact(valid), nil
+}
+
+// sortAPIKeys orders keys oldest first
+func sortAPIKeys(keys []APIKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].Id < keys[j].Id
+	})
+}
+
+// CreateAPIKey stores key under the hash of token, the caller sets the
+// id, user, name, prefix, scopes and creation time
+func (db *DB) CreateAPIKey(token string, key APIKey) (APIKey, error) {
+	scopes, err := ValidateScopes(key.Scopes)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.Scopes = scopes
+	key.Hash = hashToken(token)
+	key.LastUsedAt = time.Time{}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.UsersById[key.UserId]; !ok {
+		return APIKey{}, ErrUserNotFound
+	}
+
+	err = db.commit(walEntry{Op: opAPIKeyCreated, APIKey: &key})
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return key, nil
+}
+
+// GetAPIKeys returns the api keys of the user oldest first
+func (db *DB) GetAPIKeys(userId int) ([]APIKey, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	keys := []APIKey{}
+	for _, key := range db.data.APIKeys {
+		if key.UserId == userId {
+			key.Scopes = slices.Clone(key.Scopes)
+			keys = append(keys, key)
+		}
+	}
+	sortAPIKeys(keys)
+
+	return keys, nil
+}
+
+// RevokeAPIKey deletes the api key id of the user
+func (db *DB) RevokeAPIKey(userId int, id string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	for hash, key := range db.data.APIKeys {
+		if key.Id == id && key.UserId == userId {
+			return db.commit(walEntry{Op: opAPIKeyRevoked, Hash: hash})
+		}
+	}
+
+	return ErrAPIKeyNotFound
+}
+
+// UseAPIKey returns the api key token is for and records that it was used
+func (db *DB) UseAPIKey(token string, now time.Time) (APIKey, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	key, ok := db.data.APIKeys[hashToken(token)]
+	if !ok {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	key.Scopes = slices.Clone(key.Scopes)
+
+	if now.Sub(key.LastUsedAt) >= APIKeyUseResolution {
+		key.LastUsedAt = now
+		err := db.commit(walEntry{Op: opAPIKeyUsed, APIKey: &key})
+		if err != nil {
+			return APIKey{}, err
+		}
+	}
+
+	return key, nil
+}
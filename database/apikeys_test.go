@@ -0,0 +1,123 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestAPIKeys(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			_, err := store.CreateAPIKey("bad", APIKey{Id: "k0", UserId: 1, Scopes: []string{"everything"}, CreatedAt: now})
+			if !errors.Is(err, ErrInvalidScope) {
+				t.Errorf("expected an unknown scope to be rejected, got %v", err)
+			}
+			_, err = store.CreateAPIKey("none", APIKey{Id: "k0", UserId: 1, CreatedAt: now})
+			if !errors.Is(err, ErrInvalidScope) {
+				t.Errorf("expected a key without scopes to be rejected, got %v", err)
+			}
+
+			key, err := store.CreateAPIKey("first", APIKey{
+				Id:        "k1",
+				UserId:    1,
+				Name:      "bot",
+				Prefix:    "chirpy_fir",
+				Scopes:    []string{ScopeChirpsWrite, ScopeChirpsRead, ScopeChirpsWrite},
+				CreatedAt: now,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(key.Scopes, []string{ScopeChirpsRead, ScopeChirpsWrite}) || key.Hash == "first" {
+				t.Errorf("expected sorted scopes and a hashed key, got %+v", key)
+			}
+			_, err = store.CreateAPIKey("second", APIKey{Id: "k2", UserId: 1, Name: "script", Scopes: []string{ScopeAccount}, CreatedAt: now.Add(time.Second)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			used, err := store.UseAPIKey("first", now.Add(time.Hour))
+			if err != nil || used.Id != "k1" || used.UserId != 1 || !used.LastUsedAt.Equal(now.Add(time.Hour)) {
+				t.Fatalf("expected key k1 used now, got %+v %v", used, err)
+			}
+			// uses within the resolution aren't written
+			_, err = store.UseAPIKey("first", now.Add(time.Hour+time.Second))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys, err := store.GetAPIKeys(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(keys) != 2 || keys[0].Id != "k1" || keys[1].Id != "k2" {
+				t.Fatalf("expected both keys oldest first, got %+v", keys)
+			}
+			if !keys[0].LastUsedAt.Equal(now.Add(time.Hour)) || !keys[1].LastUsedAt.IsZero() {
+				t.Errorf("expected only the first key used, got %s and %s", keys[0].LastUsedAt, keys[1].LastUsedAt)
+			}
+
+			err = store.RevokeAPIKey(2, "k1")
+			if !errors.Is(err, ErrAPIKeyNotFound) {
+				t.Errorf("expected the key of another user to be not found, got %v", err)
+			}
+			err = store.RevokeAPIKey(1, "k1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.UseAPIKey("first", now.Add(2*time.Hour))
+			if !errors.Is(err, ErrAPIKeyNotFound) {
+				t.Errorf("expected a revoked key to be rejected, got %v", err)
+			}
+
+			snapshot, err := store.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshot.APIKeys) != 1 {
+				t.Errorf("expected the remaining key in the snapshot, got %+v", snapshot.APIKeys)
+			}
+			err = store.Restore(snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.UseAPIKey("second", now.Add(2*time.Hour))
+			if err != nil {
+				t.Errorf("expected the key restored, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAPIKeysSurviveLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	db, userId := newTestDB(t, path, options)
+	_, err := db.CreateAPIKey("first", APIKey{Id: "k1", UserId: userId, Scopes: []string{ScopeChirpsWrite}, CreatedAt: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UseAPIKey("first", now.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	keys, err := db.GetAPIKeys(userId)
+	if err != nil || len(keys) != 1 || !keys[0].LastUsedAt.Equal(now.Add(time.Hour)) {
+		t.Errorf("expected the used key replayed, got %+v %v", keys, err)
+	}
+}
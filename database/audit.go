@@ -0,0 +1,94 @@
+package database
+
+import (
+	"sort"
+	"time"
+)
+
+// actions of the audit log
+const (
+	AuditImpersonationStarted = "impersonation_started"
+	AuditImpersonationEnded   = "impersonation_ended"
+	AuditImpersonatedRequest  = "impersonated_request"
+)
+
+// AuditEvent is an entry of the audit log, ActorId is the admin that did
+// something to or as UserId. Entries are never changed or deleted, not
+// even when the user is purged
+type AuditEvent struct {
+	Id      int       `json:"id"`
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	ActorId int       `json:"actor_id"`
+	UserId  int       `json:"user_id"`
+	// TokenId is the jti of the impersonation token
+	TokenId string `json:"token_id,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+	Method  string `json:"method,omitempty"`
+	Path    string `json:"path,omitempty"`
+}
+
+// AuditFilter picks entries of the audit log, zero values match
+// everything. Entries come oldest first starting after the id After,
+// at most Limit of them when it is set
+type AuditFilter struct {
+	ActorId int
+	UserId  int
+	TokenId string
+	Action  string
+	After   int
+	Limit   int
+}
+
+func (f AuditFilter) matches(event AuditEvent) bool {
+	return (f.ActorId == 0 || event.ActorId == f.ActorId) &&
+		(f.UserId == 0 || event.UserId == f.UserId) &&
+		(f.TokenId == "" || event.TokenId == f.TokenId) &&
+		(f.Action == "" || event.Action == f.Action) &&
+		event.Id > f.After
+}
+
+// RecordAuditEvent appends event to the audit log, the caller sets
+// everything but the id
+func (db *DB) RecordAuditEvent(event AuditEvent) (AuditEvent, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	event.Id = db.data.Sequences.AuditEvents + 1
+	err := db.commit(walEntry{Op: opAuditEventRecorded, AuditEvent: &event})
+	if err != nil {
+		return AuditEvent{}, err
+	}
+
+	return event, nil
+}
+
+// GetAuditEvents returns the entries of the audit log filter picks
+func (db *DB) GetAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	events := []AuditEvent{}
+	for _, event := range db.data.AuditLog {
+		if filter.matches(event) {
+			events = append(events, event)
+		}
+	}
+	sort.Slice(events, func(i, j int) bool {
+		return events[i].Id < events[j].Id
+	})
+	if filter.Limit > 0 && len(events) > filter.Limit {
+		events = events[:filter.Limit]
+	}
+
+	return events, nil
+}
+
+// RevokeAccessToken denies the access token until it expires, for
+// tokens that have no session to revoke
+func (db *DB) RevokeAccessToken(token AccessToken) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	return db.commit(walEntry{Op: opAccessTokenRevoked, AccessToken: &token})
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			events := []AuditEvent{
+				{Time: now, Action: AuditImpersonationStarted, ActorId: 1, UserId: 2, TokenId: "t1", Reason: "ticket"},
+				{Time: now.Add(time.Second), Action: AuditImpersonatedRequest, ActorId: 1, UserId: 2, TokenId: "t1", Method: "GET", Path: "/api/chirps"},
+				{Time: now.Add(2 * time.Second), Action: AuditImpersonationStarted, ActorId: 1, UserId: 3, TokenId: "t2", Reason: "ticket"},
+			}
+			for i, event := range events {
+				recorded, err := store.RecordAuditEvent(event)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if recorded.Id != i+1 {
+					t.Errorf("expected audit event %d, got %d", i+1, recorded.Id)
+				}
+			}
+
+			got, err := store.GetAuditEvents(AuditFilter{})
+			if err != nil || len(got) != 3 || got[0].Id != 1 || got[2].Id != 3 {
+				t.Fatalf("expected every event oldest first, got %+v %v", got, err)
+			}
+			if got[1].Path != "/api/chirps" || !got[1].Time.Equal(now.Add(time.Second)) {
+				t.Errorf("expected the request kept as recorded, got %+v", got[1])
+			}
+			got, err = store.GetAuditEvents(AuditFilter{UserId: 2})
+			if err != nil || len(got) != 2 {
+				t.Errorf("expected the events of user 2, got %+v %v", got, err)
+			}
+			got, err = store.GetAuditEvents(AuditFilter{TokenId: "t1", Action: AuditImpersonatedRequest})
+			if err != nil || len(got) != 1 || got[0].Id != 2 {
+				t.Errorf("expected the request made with t1, got %+v %v", got, err)
+			}
+			got, err = store.GetAuditEvents(AuditFilter{After: 1, Limit: 1})
+			if err != nil || len(got) != 1 || got[0].Id != 2 {
+				t.Errorf("expected the page after event 1, got %+v %v", got, err)
+			}
+
+			err = store.RevokeAccessToken(AccessToken{Id: "t1", ExpiresAt: now.Add(time.Hour)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			revoked, err := store.IsAccessTokenRevoked("t1")
+			if err != nil || !revoked {
+				t.Errorf("expected the token revoked, got %v %v", revoked, err)
+			}
+
+			// restoring keeps ids from being handed out twice
+			snapshot, err := store.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshot.AuditLog) != 3 || snapshot.Sequences.AuditEvents != 3 {
+				t.Fatalf("expected the audit log in the snapshot, got %+v %+v", snapshot.AuditLog, snapshot.Sequences)
+			}
+			err = store.Restore(snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+			recorded, err := store.RecordAuditEvent(AuditEvent{Time: now, Action: AuditImpersonationEnded, ActorId: 1, UserId: 2, TokenId: "t1"})
+			if err != nil || recorded.Id != 4 {
+				t.Errorf("expected the next id after a restore, got %d %v", recorded.Id, err)
+			}
+		})
+	}
+}
+
+func TestAuditLogSurvivesLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	db, userId := newTestDB(t, path, options)
+	_, err := db.RecordAuditEvent(AuditEvent{Time: now, Action: AuditImpersonationStarted, ActorId: userId, UserId: 2, TokenId: "t1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	events, err := db.GetAuditEvents(AuditFilter{})
+	if err != nil || len(events) != 1 || events[0].TokenId != "t1" {
+		t.Errorf("expected the event replayed, got %+v %v", events, err)
+	}
+	recorded, err := db.RecordAuditEvent(AuditEvent{Time: now, Action: AuditImpersonationEnded, ActorId: userId, UserId: 2, TokenId: "t1"})
+	if err != nil || recorded.Id != 2 {
+		t.Errorf("expected the sequence replayed, got %d %v", recorded.Id, err)
+	}
+}
@@ -0,0 +1,351 @@
+package database
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrBackupChecksum is returned when the database inside a
+// backup archive doesn't match the checksum in its manifest
+var ErrBackupChecksum = errors.New("backup checksum mismatch")
+
+const (
+	backupPrefix     = "chirpy-"
+	backupExt        = ".tar.gz"
+	backupTimeFormat = "20060102T150405.000000000Z"
+
+	backupManifestName = "manifest.json"
+	backupDBName       = "database.json"
+)
+
+// BackupManifest describes the snapshot inside a backup archive
+type BackupManifest struct {
+	Name          string    `json:"name"`
+	CreatedAt     time.Time `json:"created_at"`
+	SchemaVersion int       `json:"schema_version"`
+	WalSeq        int64     `json:"wal_seq"`
+	Size          int64     `json:"size"`
+	SHA256        string    `json:"sha256"`
+	// KeyId is the key the database in the archive is sealed with,
+	// empty when it is stored as plain json
+	KeyId string `json:"key_id,omitempty"`
+}
+
+// BackupPolicy is where backups are written and how many are kept
+type BackupPolicy struct {
+	Dir string
+	// Keep is how many of the newest archives survive a prune, 0 keeps all
+	Keep int
+	// MaxAge removes archives older than it on a prune, 0 keeps all
+	MaxAge time.Duration
+	// Keys seals the database in new archives when set
+	Keys *Keyring
+}
+
+// ReadSnapshot reads the database without opening it for writing,
+// so it is safe to run next to a server using the same file
+func ReadSnapshot(driver string, path string, options Options) (DBStructure, error) {
+	switch driver {
+	case "", DriverJSON:
+		path, err := defaultPath(driver, path)
+		if err != nil {
+			return DBStructure{}, err
+		}
+
+		dbStructure := DBStructure{}
+		err = withSharedLock(path, func() error {
+			var err error
+			dbStructure, _, err = readDB(path, options.Keys)
+			if err != nil {
+				return err
+			}
+
+			return replayWALFile(walPath(path), &dbStructure, options.Keys, time.Time{})
+		})
+		if err != nil {
+			return DBStructure{}, err
+		}
+
+		return dbStructure, nil
+	default:
+		store, err := Open(driver, path, options)
+		if err != nil {
+			return DBStructure{}, err
+		}
+		defer store.Close()
+
+		return store.Snapshot()
+	}
+}
+
+// Backup writes dbStructure to a new archive in the policy's
+// directory and prunes the archives the policy no longer keeps
+func Backup(dbStructure DBStructure, policy BackupPolicy) (BackupManifest, error) {
+	now := time.Now().UTC()
+
+	manifest, err := writeBackup(policy.Dir, dbStructure, policy.Keys, now)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	_, err = PruneBackups(policy, now)
+	if err != nil {
+		return manifest, fmt.Errorf("pruning backups: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// writeBackup writes a tar.gz holding the database, sealed if keys is
+// set, and a manifest with its checksum, named after the time it was taken
+func writeBackup(dir string, dbStructure DBStructure, keys *Keyring, now time.Time) (BackupManifest, error) {
+	data, err := json.Marshal(dbStructure)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	data = sealBytes(keys, data)
+
+	sum := sha256.Sum256(data)
+	manifest := BackupManifest{
+		Name:          backupPrefix + now.Format(backupTimeFormat) + backupExt,
+		CreatedAt:     now,
+		SchemaVersion: dbStructure.SchemaVersion,
+		WalSeq:        dbStructure.WalSeq,
+		Size:          int64(len(data)),
+		SHA256:        hex.EncodeToString(sum[:]),
+	}
+	if keys != nil {
+		manifest.KeyId = keys.ActiveId()
+	}
+
+	manifestData, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	buf := &bytes.Buffer{}
+	gz := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gz)
+
+	for _, file := range []struct {
+		name string
+		data []byte
+	}{
+		{name: backupManifestName, data: manifestData},
+		{name: backupDBName, data: data},
+	} {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    file.name,
+			Mode:    0600,
+			Size:    int64(len(file.data)),
+			ModTime: now,
+		})
+		if err != nil {
+			return BackupManifest{}, err
+		}
+
+		_, err = tw.Write(file.data)
+		if err != nil {
+			return BackupManifest{}, err
+		}
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	err = gz.Close()
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	err = os.MkdirAll(dir, 0700)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	err = writeFileAtomic(filepath.Join(dir, manifest.Name), buf.Bytes(), 0600)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	return manifest, nil
+}
+
+// ReadBackup reads a backup archive, checks the database in it against
+// the manifest checksum, decrypts it with keys if it is sealed and
+// migrates it to the current schema version
+func ReadBackup(path string, keys *Keyring) (DBStructure, BackupManifest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return DBStructure{}, BackupManifest{}, err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return DBStructure{}, BackupManifest{}, fmt.Errorf("%s: %w", path, err)
+	}
+
+	var manifestData, data []byte
+	tr := tar.NewReader(gz)
+	for {
+		header, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return DBStructure{}, BackupManifest{}, fmt.Errorf("%s: %w", path, err)
+		}
+
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			return DBStructure{}, BackupManifest{}, fmt.Errorf("%s: %w", path, err)
+		}
+
+		switch header.Name {
+		case backupManifestName:
+			manifestData = content
+		case backupDBName:
+			data = content
+		}
+	}
+
+	if manifestData == nil || data == nil {
+		return DBStructure{}, BackupManifest{}, fmt.Errorf("%s: missing %s or %s", path, backupManifestName, backupDBName)
+	}
+
+	manifest := BackupManifest{}
+	err = json.Unmarshal(manifestData, &manifest)
+	if err != nil {
+		return DBStructure{}, BackupManifest{}, fmt.Errorf("%s: %s: %w", path, backupManifestName, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != manifest.SHA256 {
+		return DBStructure{}, manifest, fmt.Errorf("%w: %s", ErrBackupChecksum, path)
+	}
+
+	dbStructure, _, err := openDB(data, keys)
+	if err != nil {
+		return DBStructure{}, manifest, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return dbStructure, manifest, nil
+}
+
+// RestoreBackup swaps the database for the snapshot in archive. For the
+// json store a non zero until replays the log next to the database file
+// on top of the snapshot up to that time. The server must not be running
+func RestoreBackup(driver string, path string, options Options, archive string, until time.Time) (BackupManifest, error) {
+	dbStructure, manifest, err := ReadBackup(archive, options.Keys)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	switch driver {
+	case "", DriverJSON:
+		path, err = defaultPath(driver, path)
+		if err != nil {
+			return manifest, err
+		}
+
+		// not opened with NewDB, the file being replaced may be corrupt
+		db := &DB{path: path, mux: &sync.RWMutex{}, options: options}
+		err = db.openLocks()
+		if err != nil {
+			return manifest, err
+		}
+		defer db.closeLocks()
+
+		if !until.IsZero() {
+			err = replayWALFile(walPath(path), &dbStructure, options.Keys, until)
+			if err != nil {
+				return manifest, err
+			}
+		}
+
+		return manifest, db.Restore(dbStructure)
+	default:
+		if !until.IsZero() {
+			return manifest, fmt.Errorf("point in time restore needs the log of the %s driver", DriverJSON)
+		}
+
+		store, err := Open(driver, path, options)
+		if err != nil {
+			return manifest, err
+		}
+		defer store.Close()
+
+		return manifest, store.Restore(dbStructure)
+	}
+}
+
+// ListBackups returns the archive names in dir, oldest first
+func ListBackups(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.Type().IsRegular() && strings.HasPrefix(name, backupPrefix) && strings.HasSuffix(name, backupExt) {
+			names = append(names, name)
+		}
+	}
+
+	// the timestamp format sorts in time order
+	sort.Strings(names)
+	return names, nil
+}
+
+// PruneBackups removes the archives the policy no longer keeps and
+// returns their names. The newest archive is always kept
+func PruneBackups(policy BackupPolicy, now time.Time) ([]string, error) {
+	names, err := ListBackups(policy.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	for i, name := range names[:max(len(names)-1, 0)] {
+		expired := policy.Keep > 0 && len(names)-i > policy.Keep
+
+		if policy.MaxAge > 0 {
+			createdAt, err := time.Parse(backupTimeFormat, strings.TrimSuffix(strings.TrimPrefix(name, backupPrefix), backupExt))
+			if err == nil && now.Sub(createdAt) > policy.MaxAge {
+				expired = true
+			}
+		}
+
+		if !expired {
+			continue
+		}
+
+		err = os.Remove(filepath.Join(policy.Dir, name))
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, name)
+	}
+
+	return removed, nil
+}
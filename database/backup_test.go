@@ -0,0 +1,184 @@
+package database
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestBackupAndRestore(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.json")
+	policy := BackupPolicy{Dir: filepath.Join(dir, "backups")}
+
+	db, userId := newTestDB(t, path, Options{})
+	seedChirps(t, db, userId, 2)
+
+	snapshot, err := db.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := Backup(snapshot, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seedChirps(t, db, userId, 3)
+	db.Close()
+
+	_, err = RestoreBackup(DriverJSON, path, Options{}, filepath.Join(policy.Dir, manifest.Name), time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 {
+		t.Errorf("expected the 2 chirps in the backup, got %d", len(chirps))
+	}
+}
+
+func TestReadBackupDetectsTampering(t *testing.T) {
+	dir := t.TempDir()
+
+	dbStructure, err := parseDB(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := writeBackup(dir, dbStructure, nil, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, _, err = ReadBackup(filepath.Join(dir, manifest.Name), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := filepath.Join(dir, "tampered.tar.gz")
+	f, err := os.Create(tampered)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, data := range map[string][]byte{
+		backupManifestName: manifestData,
+		backupDBName:       []byte(`{"schema_version":1,"chirps":{}}`),
+	} {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(data))})
+		tw.Write(data)
+	}
+	tw.Close()
+	gz.Close()
+	f.Close()
+
+	_, _, err = ReadBackup(tampered, nil)
+	if !errors.Is(err, ErrBackupChecksum) {
+		t.Errorf("expected ErrBackupChecksum, got %v", err)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 1, 10, 0, 0, 0, 0, time.UTC)
+
+	dbStructure, err := parseDB(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for days := 5; days >= 0; days-- {
+		_, err = writeBackup(dir, dbStructure, nil, now.AddDate(0, 0, -days))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	removed, err := PruneBackups(BackupPolicy{Dir: dir, Keep: 4, MaxAge: 72 * time.Hour}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("expected 2 archives removed, got %v", removed)
+	}
+
+	names, err := ListBackups(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(names) != 4 {
+		t.Errorf("expected 4 archives left, got %v", names)
+	}
+}
+
+func TestRestoreBackupUntil(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "database.json")
+	policy := BackupPolicy{Dir: filepath.Join(dir, "backups")}
+	options := Options{Policy: PersistLog}
+
+	db, userId := newTestDB(t, path, options)
+	db.Close()
+
+	dbStructure, err := ReadSnapshot(DriverJSON, path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest, err := Backup(dbStructure, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seedChirps(t, db, userId, 2)
+	time.Sleep(10 * time.Millisecond)
+	until := time.Now().UTC()
+	time.Sleep(10 * time.Millisecond)
+	seedChirps(t, db, userId, 3)
+
+	// stop without folding the log into the file
+	crash(db)
+
+	_, err = RestoreBackup(DriverJSON, path, options, filepath.Join(policy.Dir, manifest.Name), until)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 2 {
+		t.Errorf("expected the 2 chirps before until, got %d", len(chirps))
+	}
+}
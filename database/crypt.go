@@ -0,0 +1,315 @@
+package database
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+// ErrEncrypted is returned when an encrypted file is read without
+// a keyring or with a keyring that doesn't hold its key
+var ErrEncrypted = errors.New("database file is encrypted with an unknown key")
+
+// sealedMagic starts every sealed file so plain json
+// files are still read as they are
+var sealedMagic = []byte("CHIRPYE1")
+
+// Keyring holds the keys used to encrypt the database at rest. The
+// active key seals everything written, the others are only kept to
+// open files sealed before a key rotation
+type Keyring struct {
+	activeId string
+	aeads    map[string]cipher.AEAD
+}
+
+// ParseKeyring reads keys written as id:base64 separated by commas or
+// newlines, the first key is the active one. Lines starting with # are
+// ignored so the same format works in a key file
+func ParseKeyring(spec string) (*Keyring, error) {
+	keyring := &Keyring{aeads: map[string]cipher.AEAD{}}
+
+	fields := strings.FieldsFunc(spec, func(r rune) bool { return r == ',' || r == '\n' })
+	for _, field := range fields {
+		field = strings.TrimSpace(field)
+		if field == "" || strings.HasPrefix(field, "#") {
+			continue
+		}
+
+		id, encoded, ok := strings.Cut(field, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("key %q: expected id:base64", field)
+		}
+		if len(id) > 255 {
+			return nil, fmt.Errorf("key id %q is longer than 255 bytes", id)
+		}
+		if _, ok := keyring.aeads[id]; ok {
+			return nil, fmt.Errorf("key id %q is used twice", id)
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q: expected 32 bytes, got %d", id, len(key))
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("key %q: %w", id, err)
+		}
+
+		if keyring.activeId == "" {
+			keyring.activeId = id
+		}
+		keyring.aeads[id] = aead
+	}
+
+	if keyring.activeId == "" {
+		return nil, errors.New("no keys in keyring")
+	}
+
+	return keyring, nil
+}
+
+// ReadKeyringFile is ParseKeyring on the contents of a key file
+func ReadKeyringFile(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring, err := ParseKeyring(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return keyring, nil
+}
+
+// GenerateKey returns a new random key for id in the format ParseKeyring reads
+func GenerateKey(id string) (string, error) {
+	key := make([]byte, 32)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", err
+	}
+
+	return id + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// ActiveId is the id of the key new data is sealed with
+func (k *Keyring) ActiveId() string {
+	return k.activeId
+}
+
+// seal encrypts data with the active key. The sealed form is the magic,
+// the key id and a fresh nonce followed by the ciphertext, the header is
+// authenticated along with the data so the key id can't be swapped
+func (k *Keyring) seal(data []byte) []byte {
+	aead := k.aeads[k.activeId]
+
+	header := make([]byte, 0, len(sealedMagic)+1+len(k.activeId))
+	header = append(header, sealedMagic...)
+	header = append(header, byte(len(k.activeId)))
+	header = append(header, k.activeId...)
+
+	nonce := make([]byte, aead.NonceSize())
+	// crypto/rand never fails on supported platforms
+	rand.Read(nonce)
+
+	sealed := append(header, nonce...)
+	return aead.Seal(sealed, nonce, data, header)
+}
+
+// open decrypts data sealed by any key in the keyring,
+// data that isn't sealed is returned as it is
+func (k *Keyring) open(data []byte) ([]byte, error) {
+	id, ok, err := sealedKeyId(data)
+	if err != nil || !ok {
+		return data, err
+	}
+
+	if k == nil {
+		return nil, fmt.Errorf("%w: sealed with key %q and no keyring is configured", ErrEncrypted, id)
+	}
+	aead, ok := k.aeads[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q is not in the keyring", ErrEncrypted, id)
+	}
+
+	headerLen := len(sealedMagic) + 1 + len(id)
+	if len(data) < headerLen+aead.NonceSize() {
+		return nil, fmt.Errorf("%w: sealed data is truncated", ErrCorruptDB)
+	}
+
+	nonce := data[headerLen : headerLen+aead.NonceSize()]
+	plain, err := aead.Open(nil, nonce, data[headerLen+aead.NonceSize():], data[:headerLen])
+	if err != nil {
+		return nil, fmt.Errorf("%w: decrypting with key %q: %v", ErrCorruptDB, id, err)
+	}
+
+	return plain, nil
+}
+
+// sealedKeyId returns the id of the key data was sealed with,
+// ok is false for data that isn't sealed
+func sealedKeyId(data []byte) (string, bool, error) {
+	if !bytes.HasPrefix(data, sealedMagic) {
+		return "", false, nil
+	}
+
+	rest := data[len(sealedMagic):]
+	if len(rest) == 0 || len(rest) < 1+int(rest[0]) {
+		return "", true, fmt.Errorf("%w: sealed header is truncated", ErrCorruptDB)
+	}
+
+	return string(rest[1 : 1+int(rest[0])]), true, nil
+}
+
+// sealBytes seals data when a keyring is set
+func sealBytes(keys *Keyring, data []byte) []byte {
+	if keys == nil {
+		return data
+	}
+
+	return keys.seal(data)
+}
+
+// sealLine seals one log line, sealed lines are base64 so they
+// never hold a newline
+func sealLine(keys *Keyring, line []byte) []byte {
+	if keys == nil {
+		return line
+	}
+
+	sealed := keys.seal(line)
+	encoded := make([]byte, base64.StdEncoding.EncodedLen(len(sealed)))
+	base64.StdEncoding.Encode(encoded, sealed)
+	return encoded
+}
+
+// openLine reverses sealLine, plain json lines are returned as they are
+func openLine(keys *Keyring, line []byte) ([]byte, error) {
+	line = bytes.TrimRight(line, "\n")
+	if len(line) == 0 || line[0] == '{' {
+		return line, nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(string(line))
+	if err != nil {
+		return nil, fmt.Errorf("%w: log line is neither json nor sealed: %v", ErrCorruptDB, err)
+	}
+
+	return keys.open(sealed)
+}
+
+// sealSecret seals a secret kept inside the database, like the seed of an
+// authenticator, so it stays sealed wherever the record is copied to
+func sealSecret(keys *Keyring, secret string) string {
+	return string(sealLine(keys, []byte(secret)))
+}
+
+// openSecret reverses sealSecret, secrets stored before a keyring was
+// configured are returned as they are
+func openSecret(keys *Keyring, stored string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(stored)
+	if err != nil || !bytes.HasPrefix(sealed, sealedMagic) {
+		return stored, nil
+	}
+
+	secret, err := keys.open(sealed)
+	if err != nil {
+		return "", err
+	}
+
+	return string(secret), nil
+}
+
+// needsReseal reports whether data isn't sealed with the active key
+// of keys, so writing it again would change how it is sealed
+func needsReseal(keys *Keyring, data []byte) bool {
+	if keys == nil {
+		return false
+	}
+
+	id, sealed, err := sealedKeyId(data)
+	if err != nil {
+		return false
+	}
+
+	return !sealed || id != keys.activeId
+}
+
+// resealLog seals every line of the log at path with the active key of
+// keys in place, no copy of the old lines is kept. A last line without a
+// newline is a write that never finished and is dropped
+func resealLog(path string, keys *Keyring) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	buf := []byte{}
+	for {
+		i := bytes.IndexByte(data, '\n')
+		if i < 0 {
+			break
+		}
+
+		line, err := openLine(keys, data[:i])
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		data = data[i+1:]
+
+		buf = append(buf, sealLine(keys, line)...)
+		buf = append(buf, '\n')
+	}
+
+	return replaceFile(path, buf, 0666, false)
+}
+
+// Rekey seals the json database file at path and its log with the active
+// key of options.Keys, along with the totp secrets inside it. The keyring
+// must still hold the key they are sealed with. The file is written twice
+// so its .bak generation is sealed with the active key as well. The server
+// must not be running
+func Rekey(path string, options Options) error {
+	if options.Keys == nil {
+		return errors.New("rekeying needs a keyring")
+	}
+
+	db, err := NewDBWithOptions(path, options)
+	if err != nil {
+		return err
+	}
+
+	db.mux.Lock()
+	err = resealTOTPSecrets(db.data, options.Keys)
+	for i := 0; i < 2 && err == nil; i++ {
+		err = db.writeSnapshot(db.data)
+	}
+	db.mux.Unlock()
+
+	if err != nil {
+		db.Close()
+		return err
+	}
+
+	return db.Close()
+}
@@ -0,0 +1,177 @@
+package database
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testKeyring parses keys made with GenerateKey for the ids,
+// the first id is the active key
+func testKeyring(t *testing.T, keys map[string]string, ids ...string) *Keyring {
+	t.Helper()
+
+	spec := ""
+	for _, id := range ids {
+		if _, ok := keys[id]; !ok {
+			key, err := GenerateKey(id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			keys[id] = key
+		}
+		spec += keys[id] + "\n"
+	}
+
+	keyring, err := ParseKeyring(spec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keyring
+}
+
+func TestEncryptedAtRest(t *testing.T) {
+	for _, policy := range []PersistPolicy{PersistSync, PersistLog} {
+		t.Run(string(policy), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			options := Options{Policy: policy, Keys: testKeyring(t, map[string]string{}, "k1")}
+			files := []string{path, backupPath(path), walPath(path), backupPath(walPath(path))}
+
+			// a plain database with its .bak generation or its log, and a
+			// log kept aside by an earlier restore
+			db, userId := newTestDB(t, path, Options{Policy: policy})
+			seedChirps(t, db, userId, 2)
+			crash(db)
+			err := os.WriteFile(backupPath(walPath(path)), []byte(`{"seq":1,"op":"user_created","user":{"email":"a@example.com"}}`+"\n"), 0666)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = NewDBWithOptions(path, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			crash(db)
+
+			for _, file := range files {
+				data, err := os.ReadFile(file)
+				if errors.Is(err, os.ErrNotExist) {
+					continue
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if bytes.Contains(data, []byte("a@example.com")) {
+					t.Errorf("%s holds the email in plain text", file)
+				}
+			}
+
+			_, err = NewDB(path)
+			if !errors.Is(err, ErrEncrypted) {
+				t.Fatalf("expected ErrEncrypted without a keyring, got %v", err)
+			}
+
+			db, err = NewDBWithOptions(path, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != 2 {
+				t.Errorf("expected 2 chirps, got %d", len(chirps))
+			}
+		})
+	}
+}
+
+func TestRekey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	keys := map[string]string{}
+
+	// a plain file is sealed the first time it is opened with a keyring
+	db, userId := newTestDB(t, path, Options{})
+	seedChirps(t, db, userId, 1)
+	err := db.EnrollTOTP(userId, "secret", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	err = Rekey(path, Options{Keys: testKeyring(t, keys, "old")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Rekey(path, Options{Keys: testKeyring(t, keys, "new", "old")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{path, backupPath(path)} {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, sealed, err := sealedKeyId(data)
+		if err != nil || !sealed || id != "new" {
+			t.Errorf("expected %s sealed with the new key, got %q %v %v", file, id, sealed, err)
+		}
+	}
+
+	db, err = NewDBWithOptions(path, Options{Keys: testKeyring(t, keys, "new")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 1 {
+		t.Errorf("expected 1 chirp, got %d", len(chirps))
+	}
+
+	// the totp secret was sealed and rekeyed along with the file
+	secret := db.data.TOTP[userId].Secret
+	opened, err := openSecret(db.options.Keys, secret)
+	if err != nil || secret == "secret" || opened != "secret" {
+		t.Errorf("expected the totp secret sealed with the new key, got %q %v", secret, err)
+	}
+}
+
+func TestEncryptedBackup(t *testing.T) {
+	dir := t.TempDir()
+	keys := testKeyring(t, map[string]string{}, "k1")
+
+	dbStructure, err := parseDB(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := writeBackup(dir, dbStructure, keys, time.Now().UTC())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if manifest.KeyId != "k1" {
+		t.Errorf("expected the manifest to name key k1, got %q", manifest.KeyId)
+	}
+
+	_, _, err = ReadBackup(filepath.Join(dir, manifest.Name), nil)
+	if !errors.Is(err, ErrEncrypted) {
+		t.Errorf("expected ErrEncrypted without a keyring, got %v", err)
+	}
+
+	_, _, err = ReadBackup(filepath.Join(dir, manifest.Name), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
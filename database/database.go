@@ -1,25 +1,37 @@
 package database
 
 import (
-	"crypto/rand"
-	"encoding/hex"
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io/fs"
+	"log"
 	"os"
+	"slices"
 	"sort"
-	"strconv"
 	"sync"
 	"time"
-
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
 )
 
 type DB struct {
 	path string
 	mux  *sync.RWMutex
+	data DBStructure
+
+	options    Options
+	dirty      bool
+	wal        *os.File
+	walSize    int64
+	compacting bool
+	// snapshotMux keeps a compaction from writing the file under a
+	// restore, it is taken before mux
+	snapshotMux sync.Mutex
+	done        chan struct{}
+	wg          sync.WaitGroup
+
+	owner  *fileLock
+	ioLock *fileLock
 }
 
 type Chirp struct {
@@ -29,91 +41,166 @@ type Chirp struct {
 }
 
 type User struct {
-	Id          int
-	Email       string
-	Password    string
-	IsChirpyRed bool
+	Id            int
+	Email         string
+	Password      string
+	IsChirpyRed   bool
+	EmailVerified bool
+	Role          Role
 }
 
 type ReturnedUser struct {
-	Id           int    `json:"id"`
-	Email        string `json:"email"`
-	Token        string `json:"token"`
-	RefreshToken string `json:"refresh_token"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	Id            int    `json:"id"`
+	Email         string `json:"email"`
+	Token         string `json:"token"`
+	RefreshToken  string `json:"refresh_token"`
+	IsChirpyRed   bool   `json:"is_chirpy_red"`
+	EmailVerified bool   `json:"email_verified"`
+	Role          Role   `json:"role"`
 }
 
 type ReturnedUserJwt struct {
-	Id    int    `json:"id"`
-	Email string `json:"email"`
+	Id            int    `json:"id"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Role          Role   `json:"role"`
 }
 type DBStructure struct {
-	Chirps    map[int]Chirp     `json:"chirps"`
-	Users     map[string]User   `json:"users"`
-	UsersById map[int]User      `json:"users_by_id"`
-	Tokens    map[string]string `json:"tokens"`
+	SchemaVersion int                     `json:"schema_version"`
+	Chirps        map[int]Chirp           `json:"chirps"`
+	Users         map[string]User         `json:"users"`
+	UsersById     map[int]User            `json:"users_by_id"`
+	RefreshTokens map[string]RefreshToken `json:"refresh_tokens"`
+	Sessions      map[string]Session      `json:"sessions"`
+	// RevokedAccessTokens maps the jti of denied access tokens to their expiry
+	RevokedAccessTokens map[string]time.Time         `json:"revoked_access_tokens"`
+	PasswordResets      map[string]PasswordReset     `json:"password_resets"`
+	EmailVerifications  map[string]EmailVerification `json:"email_verifications"`
+	TOTP                map[int]TOTP                 `json:"totp"`
+	MFAChallenges       map[string]MFAChallenge      `json:"mfa_challenges"`
+	APIKeys             map[string]APIKey            `json:"api_keys"`
+	OAuthClients        map[string]OAuthClient       `json:"oauth_clients"`
+	AuthorizationCodes  map[string]AuthorizationCode `json:"authorization_codes"`
+	AccountDeletions    map[int]AccountDeletion      `json:"account_deletions"`
+	AuditLog            map[int]AuditEvent           `json:"audit_log"`
+	Sequences           Sequences                    `json:"sequences"`
+	// WalSeq is the last log entry included in this snapshot
+	WalSeq int64 `json:"wal_seq,omitempty"`
+}
+
+// Sequences hold the last id handed out for each entity,
+// ids are never reused even after a delete
+type Sequences struct {
+	Chirps      int `json:"chirps"`
+	Users       int `json:"users"`
+	AuditEvents int `json:"audit_events"`
 }
 
 // NewDB creates a new database connection
 // and creates the database file if it doesn't exist
 func NewDB(path string) (*DB, error) {
+	return NewDBWithOptions(path, Options{})
+}
+
+// NewDBWithOptions is NewDB with a persistence policy
+// other than the default synchronous writes
+func NewDBWithOptions(path string, options Options) (*DB, error) {
+	options, err := options.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+
 	db := &DB{
-		path: path,
-		mux:  &sync.RWMutex{},
+		path:    path,
+		mux:     &sync.RWMutex{},
+		options: options,
+		done:    make(chan struct{}),
 	}
 
-	err := db.ensureDB()
+	err = db.openLocks()
 	if err != nil {
-		if err != fs.ErrExist {
-			return db, err
-		}
+		return nil, err
+	}
+
+	err = db.open()
+	if err != nil {
+		db.closeLocks()
+		return nil, err
 	}
 
 	return db, nil
 }
 
-// CreateChirp creates a new chirp and saves it to disk
-func (db *DB) CreateChirp(body string, token string, secret []byte) (Chirp, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
+// open loads the database file, migrates it and starts persistence
+func (db *DB) open() error {
+	err := db.ensureDB()
 	if err != nil {
-		return Chirp{}, err
+		return err
 	}
 
-	token_, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+	data, steps, err := readDB(db.path, db.options.Keys)
+	if err != nil {
+		return err
+	}
+	db.data = data
 
+	raw, err := os.ReadFile(db.path)
 	if err != nil {
-		return Chirp{}, err
+		return err
+	}
+	reseal := needsReseal(db.options.Keys, raw)
+
+	// the logs are sealed before they are replayed and the file is
+	// written twice so no generation is left in the clear or sealed
+	// with another key
+	writes := 0
+	if len(steps) != 0 {
+		writes = 1
+	}
+	if reseal {
+		for _, file := range []string{walPath(db.path), backupPath(walPath(db.path))} {
+			err = resealLog(file, db.options.Keys)
+			if err != nil {
+				return err
+			}
+		}
+		writes = 2
 	}
 
-	claims, ok := token_.Claims.(*jwt.RegisteredClaims)
-	if !ok || !token_.Valid {
-		return Chirp{}, errors.New("invalid token")
+	for range writes {
+		err = db.writeDB(db.data)
+		if err != nil {
+			return err
+		}
 	}
 
-	idStr := claims.Subject
-	id, err := strconv.Atoi(idStr)
-	if err != nil {
-		return Chirp{}, err
+	for _, step := range steps {
+		log.Printf("migrated %s to schema version %d: %s\n", db.path, step.Version, step.Description)
+	}
+	if reseal {
+		log.Printf("sealed %s with key %q\n", db.path, db.options.Keys.ActiveId())
 	}
 
-	user, ok := dbStructure.UsersById[id]
+	return db.startPersistence()
+}
+
+// CreateChirp creates a new chirp by the user and saves it to disk
+func (db *DB) CreateChirp(userId int, body string) (Chirp, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	user, ok := db.data.UsersById[userId]
 
 	if !ok {
-		return Chirp{}, errors.New("user not found")
+		return Chirp{}, ErrUserNotFound
 	}
 	chirp := Chirp{
-		Id:       len(dbStructure.Chirps) + 1,
+		Id:       db.data.Sequences.Chirps + 1,
 		Body:     body,
 		AutherId: user.Id,
 	}
 
-	dbStructure.Chirps[chirp.Id] = chirp
-	err = db.writeDB(dbStructure)
+	err := db.commit(walEntry{Op: opChirpCreated, Chirp: &chirp})
 	if err != nil {
 		return Chirp{}, fmt.Errorf("writing db error %w", err)
 	}
@@ -122,30 +209,33 @@ func (db *DB) CreateChirp(body string, token string, secret []byte) (Chirp, erro
 }
 
 func (db *DB) CreateUser(email string, password string) (ReturnedUser, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
+	email, err := NormalizeEmail(email)
 	if err != nil {
 		return ReturnedUser{}, err
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	hashedPassword, err := db.options.Hasher.Hash(password)
 
 	if err != nil {
 		return ReturnedUser{}, err
 	}
 
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.Users[email]; ok {
+		return ReturnedUser{}, ErrEmailTaken
+	}
+
 	user := User{
-		Id:          len(dbStructure.Users) + 1,
+		Id:          db.data.Sequences.Users + 1,
 		Email:       email,
 		Password:    string(hashedPassword),
 		IsChirpyRed: false,
+		Role:        RoleUser,
 	}
 
-	dbStructure.Users[user.Email] = user
-	dbStructure.UsersById[user.Id] = user
-	err = db.writeDB(dbStructure)
+	err = db.commit(walEntry{Op: opUserCreated, User: &user})
 	if err != nil {
 		return ReturnedUser{}, fmt.Errorf("writing db error %w", err)
 	}
@@ -154,371 +244,578 @@ func (db *DB) CreateUser(email string, password string) (ReturnedUser, error) {
 		Id:          user.Id,
 		Email:       user.Email,
 		IsChirpyRed: user.IsChirpyRed,
+		Role:        user.Role,
 	}, nil
 }
 
-func (db *DB) GetUser(email string, password string, expiresInSeconds int, secretKey []byte) (ReturnedUser, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
+// GetUser returns the user with email if password matches, a password
+// hashed with outdated parameters is hashed again
+func (db *DB) GetUser(email string, password string) (ReturnedUser, error) {
+	email, err := NormalizeEmail(email)
 	if err != nil {
-		return ReturnedUser{}, err
+		return ReturnedUser{}, ErrUserNotFound
 	}
 
-	returnUser, ok := dbStructure.Users[email]
+	db.mux.RLock()
+	returnUser, ok := db.data.Users[email]
+	db.mux.RUnlock()
 
 	if !ok {
-		return ReturnedUser{}, errors.New("user not found")
+		return ReturnedUser{}, ErrUserNotFound
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(returnUser.Password), []byte(password))
+	err = comparePassword(returnUser.Password, password)
 	if err != nil {
-		return ReturnedUser{}, fmt.Errorf("passwords don't match: %v", err)
+		return ReturnedUser{}, fmt.Errorf("%w: %v", ErrWrongPassword, err)
 	}
 
-	timeNow := time.Now().UTC()
-
-	expiresAt := timeNow.Add(time.Duration(expiresInSeconds) * time.Second)
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(timeNow),
-		ExpiresAt: jwt.NewNumericDate(expiresAt),
-		Subject:   strconv.Itoa(returnUser.Id),
-	})
-
-	retrunToken, err := token.SignedString(secretKey)
-
-	if err != nil {
-		return ReturnedUser{}, err
+	if db.options.Hasher.NeedsRehash(returnUser.Password) {
+		err = db.rehashPassword(returnUser, password)
+		if err != nil {
+			return ReturnedUser{}, fmt.Errorf("rehashing password error %w", err)
+		}
 	}
 
-	c := 32
-	b := make([]byte, c)
-	_, err = rand.Read(b)
+	return ReturnedUser{
+		Id:            returnUser.Id,
+		Email:         returnUser.Email,
+		IsChirpyRed:   returnUser.IsChirpyRed,
+		EmailVerified: returnUser.EmailVerified,
+		Role:          returnUser.Role,
+	}, nil
+}
+
+// rehashPassword stores password hashed with the current hasher, unless
+// the password of the user changed since it was checked
+func (db *DB) rehashPassword(user User, password string) error {
+	hashedPassword, err := db.options.Hasher.Hash(password)
 	if err != nil {
-		fmt.Println("error:", err)
-		return ReturnedUser{}, err
+		return err
 	}
 
-	refreshToken := hex.EncodeToString(b)
-
-	dbStructure.Tokens[refreshToken] = retrunToken
-
-	err = db.writeDB(dbStructure)
+	db.mux.Lock()
+	defer db.mux.Unlock()
 
-	if err != nil {
-		return ReturnedUser{}, nil
+	current, ok := db.data.UsersById[user.Id]
+	if !ok || current.Password != user.Password {
+		return nil
 	}
+	current.Password = hashedPassword
 
-	fmt.Printf("user %v\n", returnUser)
-	return ReturnedUser{
-		Id:           returnUser.Id,
-		Email:        returnUser.Email,
-		Token:        retrunToken,
-		RefreshToken: refreshToken,
-		IsChirpyRed:  returnUser.IsChirpyRed,
-	}, nil
+	return db.commit(walEntry{Op: opUserUpdated, User: &current})
 }
 
-func (db *DB) RefreshToken(refreshToken string, secret []byte, expiresInSeconds int) (string, error) {
+func (db *DB) UpdateUser(id int, email string, password string) (ReturnedUserJwt, error) {
+	hashedPassword := ""
+	if password != "" {
+		var err error
+		hashedPassword, err = db.options.Hasher.Hash(password)
+		if err != nil {
+			return ReturnedUserJwt{}, err
+		}
+	}
+
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return "", err
-	}
-
-	token, ok := dbStructure.Tokens[refreshToken]
+	returnUser, ok := db.data.UsersById[id]
 
 	if !ok {
-		return "", errors.New("token not found")
+		return ReturnedUserJwt{}, ErrUserNotFound
 	}
 
-	token_, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+	if email != "" {
+		email, err := NormalizeEmail(email)
+		if err != nil {
+			return ReturnedUserJwt{}, err
+		}
 
-	if err != nil {
-		return "", err
+		// a new email has to be verified again
+		if email != returnUser.Email {
+			if _, ok := db.data.Users[email]; ok {
+				return ReturnedUserJwt{}, ErrEmailTaken
+			}
+			returnUser.Email = email
+			returnUser.EmailVerified = false
+		}
 	}
-
-	claims, ok := token_.Claims.(*jwt.RegisteredClaims)
-	if !ok || !token_.Valid {
-		return "", errors.New("invalid token")
+	if hashedPassword != "" {
+		returnUser.Password = hashedPassword
 	}
 
-	idStr := claims.Subject
-	id, err := strconv.Atoi(idStr)
+	err := db.commit(walEntry{Op: opUserUpdated, User: &returnUser})
+
 	if err != nil {
-		return "", err
+		return ReturnedUserJwt{}, err
 	}
 
-	timeNow := time.Now().UTC()
-
-	expiresAt := timeNow.Add(time.Duration(expiresInSeconds) * time.Second)
+	return ReturnedUserJwt{
+		Id:            returnUser.Id,
+		Email:         returnUser.Email,
+		EmailVerified: returnUser.EmailVerified,
+		Role:          returnUser.Role,
+	}, nil
+}
 
-	newToken := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{
-		Issuer:    "chirpy",
-		IssuedAt:  jwt.NewNumericDate(timeNow),
-		ExpiresAt: jwt.NewNumericDate(expiresAt),
-		Subject:   strconv.Itoa(id),
-	})
+func (db *DB) GetChirps() ([]Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
 
-	retrunToken, err := newToken.SignedString(secret)
+	returnChirps := make([]Chirp, 0, len(db.data.Chirps))
 
-	if err != nil {
-		return "", err
+	for _, chirp := range db.data.Chirps {
+		returnChirps = append(returnChirps, chirp)
 	}
 
-	dbStructure.Tokens[refreshToken] = retrunToken
+	sort.Slice(returnChirps, func(i, j int) bool { return returnChirps[i].Id < returnChirps[j].Id })
 
-	err = db.writeDB(dbStructure)
+	return returnChirps, nil
+}
 
-	if err != nil {
-		return "", err
+func (db *DB) GetChirpById(id int) (Chirp, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	returnChirp, ok := db.data.Chirps[id]
+
+	if !ok {
+		return Chirp{}, nil
 	}
 
-	return retrunToken, nil
+	return returnChirp, nil
+
 }
 
-func (db *DB) RevokeToken(token string) error {
+func (db *DB) MakeUserRed(id int) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
-	}
-
-	_, ok := dbStructure.Tokens[token]
+	returnUser, ok := db.data.UsersById[id]
 
 	if !ok {
-		return errors.New("token not found")
+		return ErrUserNotFound
 	}
 
-	delete(dbStructure.Tokens, token)
-
-	err = db.writeDB(dbStructure)
+	err := db.commit(walEntry{Op: opUserUpgraded, Id: returnUser.Id})
 
 	if err != nil {
-		return errors.New("error writing db")
+		return err
 	}
 
 	return nil
+
 }
 
-func (db *DB) UpdateUser(token string, secret []byte, email string, password string) (ReturnedUserJwt, error) {
+func (db *DB) DeleteChirp(id int, userId int) error {
 	db.mux.Lock()
 	defer db.mux.Unlock()
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return ReturnedUserJwt{}, err
+	returnChirp, ok := db.data.Chirps[id]
+
+	if !ok {
+		return nil
 	}
 
-	token_, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+	if userId != returnChirp.AutherId {
+		return errors.New("user not authirized")
+	}
 
+	err := db.commit(walEntry{Op: opChirpDeleted, Id: returnChirp.Id})
 	if err != nil {
-		return ReturnedUserJwt{}, err
+		return err
 	}
 
-	claims, ok := token_.Claims.(*jwt.RegisteredClaims)
-	if !ok || !token_.Valid {
-		return ReturnedUserJwt{}, errors.New("invalid token")
-	}
+	return nil
+}
 
-	idStr := claims.Subject
-	id, err := strconv.Atoi(idStr)
+// Reset replaces everything in the database with the contents
+// of the seed file, or empties it when seedPath is empty
+func (db *DB) Reset(seedPath string) error {
+	dbStructure, err := loadSeed(seedPath)
 	if err != nil {
-		return ReturnedUserJwt{}, err
+		return err
 	}
 
-	returnUser, ok := dbStructure.UsersById[id]
+	return db.Restore(dbStructure)
+}
 
-	if !ok {
-		return ReturnedUserJwt{}, errors.New("user not found")
+// Snapshot returns a copy of everything in the database
+// as of the last committed mutation
+func (db *DB) Snapshot() (DBStructure, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	return copyDB(db.data), nil
+}
+
+// Restore replaces everything in the database with dbStructure.
+// The log is moved aside so its entries aren't replayed on top
+func (db *DB) Restore(dbStructure DBStructure) error {
+	db.snapshotMux.Lock()
+	defer db.snapshotMux.Unlock()
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	err := db.writeDB(dbStructure)
+	if err != nil {
+		return err
 	}
 
-	if email != "" {
-		returnUser.Email = email
+	if db.wal != nil {
+		err = db.truncateWAL()
+	} else {
+		err = db.moveWALAside()
 	}
-	if password != "" {
-		hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
-		if err != nil {
-			return ReturnedUserJwt{}, err
-		}
-		returnUser.Password = string(hashedPassword)
+	if err != nil {
+		return err
 	}
 
-	dbStructure.UsersById[id] = returnUser
-	dbStructure.Users[email] = returnUser
-
-	err = db.writeDB(dbStructure)
+	db.data = copyDB(dbStructure)
+	db.dirty = false
+	return nil
+}
 
-	if err != nil {
-		return ReturnedUserJwt{}, err
+// ensureDB creates a new database file if it doesn't exist
+func (db *DB) ensureDB() error {
+	_, err := os.Stat(db.path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return writeFileAtomic(db.path, []byte{}, 0666)
 	}
 
-	return ReturnedUserJwt{
-		Id:    returnUser.Id,
-		Email: returnUser.Email,
-	}, nil
+	return err
 }
 
-func (db *DB) GetChirps() ([]Chirp, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// loadDB reads the database file into memory,
+// falling back to the previous generation if the file is corrupt
+func (db *DB) loadDB() (DBStructure, error) {
+	dbStructure, _, err := readDB(db.path, db.options.Keys)
+	return dbStructure, err
+}
 
-	dbStructure, err := db.loadDB()
+// readDB reads, decrypts and migrates the database file at path, falling
+// back to the previous generation if the file is corrupt. It never writes,
+// the returned steps are the migrations that the file still needs on disk
+func readDB(path string, keys *Keyring) (DBStructure, []MigrationStep, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
-		return []Chirp{}, err
+		return DBStructure{}, nil, err
 	}
 
-	returnChirps := []Chirp{}
+	newData, steps, err := openDB(data, keys)
+	if err == nil || errors.Is(err, ErrNewerSchema) || errors.Is(err, ErrEncrypted) {
+		return newData, steps, err
+	}
 
-	for _, chirp := range dbStructure.Chirps {
-		returnChirps = append(returnChirps, chirp)
+	backupData, backupErr := os.ReadFile(backupPath(path))
+	if backupErr != nil {
+		return DBStructure{}, nil, fmt.Errorf("%w: %s: %v, no backup: %v", ErrCorruptDB, path, err, backupErr)
 	}
 
-	sort.Slice(returnChirps, func(i, j int) bool { return returnChirps[i].Id < returnChirps[j].Id })
+	newData, steps, backupErr = openDB(backupData, keys)
+	if backupErr != nil {
+		return DBStructure{}, nil, fmt.Errorf("%w: %s: %v, backup: %v", ErrCorruptDB, path, err, backupErr)
+	}
 
-	return returnChirps, nil
+	log.Printf("database file %s is corrupt (%v), using %s\n", path, err, backupPath(path))
+	return newData, steps, nil
 }
 
-func (db *DB) GetChirpById(id int) (Chirp, error) {
-	db.mux.Lock()
-	defer db.mux.Unlock()
-
-	dbStructure, err := db.loadDB()
+// openDB decrypts the contents of a database file if they are sealed
+// and decodes them
+func openDB(data []byte, keys *Keyring) (DBStructure, []MigrationStep, error) {
+	data, err := keys.open(data)
 	if err != nil {
-		return Chirp{}, err
+		return DBStructure{}, nil, err
 	}
 
-	returnChirp, ok := dbStructure.Chirps[id]
+	return decodeDB(data)
+}
 
-	if !ok {
-		return Chirp{}, nil
+// decodeDB migrates the contents of a database file
+// to the current schema version and parses it
+func decodeDB(data []byte) (DBStructure, []MigrationStep, error) {
+	data, steps, err := migrateDB(data)
+	if err != nil {
+		return DBStructure{}, nil, err
 	}
 
-	return returnChirp, nil
+	newData, err := parseDB(data)
+	if err != nil {
+		return DBStructure{}, nil, err
+	}
 
+	return newData, steps, nil
 }
 
-func (db *DB) MakeUserRed(id int) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// parseDB decodes and validates the contents of a database file
+// that is already at the current schema version
+func parseDB(data []byte) (DBStructure, error) {
+	newData := DBStructure{SchemaVersion: CurrentSchemaVersion}
 
-	fmt.Println("maker user red")
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		fmt.Println("load ed error")
-		return err
+	if len(data) != 0 {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields()
+		err := decoder.Decode(&newData)
+		if err != nil {
+			return DBStructure{}, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+		}
 	}
 
-	returnUser, ok := dbStructure.UsersById[id]
-
-	if !ok {
-		fmt.Println("user not foudn")
-		return errors.New("user not found")
+	if newData.Chirps == nil {
+		newData.Chirps = map[int]Chirp{}
+	}
+	if newData.Users == nil {
+		newData.Users = map[string]User{}
+	}
+	if newData.UsersById == nil {
+		newData.UsersById = map[int]User{}
+	}
+	if newData.RefreshTokens == nil {
+		newData.RefreshTokens = map[string]RefreshToken{}
+	}
+	if newData.Sessions == nil {
+		newData.Sessions = map[string]Session{}
+	}
+	if newData.RevokedAccessTokens == nil {
+		newData.RevokedAccessTokens = map[string]time.Time{}
+	}
+	if newData.PasswordResets == nil {
+		newData.PasswordResets = map[string]PasswordReset{}
+	}
+	if newData.EmailVerifications == nil {
+		newData.EmailVerifications = map[string]EmailVerification{}
+	}
+	if newData.TOTP == nil {
+		newData.TOTP = map[int]TOTP{}
+	}
+	if newData.MFAChallenges == nil {
+		newData.MFAChallenges = map[string]MFAChallenge{}
+	}
+	if newData.APIKeys == nil {
+		newData.APIKeys = map[string]APIKey{}
+	}
+	if newData.OAuthClients == nil {
+		newData.OAuthClients = map[string]OAuthClient{}
+	}
+	if newData.AuthorizationCodes == nil {
+		newData.AuthorizationCodes = map[string]AuthorizationCode{}
+	}
+	if newData.AccountDeletions == nil {
+		newData.AccountDeletions = map[int]AccountDeletion{}
+	}
+	if newData.AuditLog == nil {
+		newData.AuditLog = map[int]AuditEvent{}
 	}
 
-	returnUser.IsChirpyRed = true
-	dbStructure.Users[returnUser.Email] = returnUser
-	dbStructure.UsersById[returnUser.Id] = returnUser
-
-	err = db.writeDB(dbStructure)
-
+	err := validateDB(newData)
 	if err != nil {
-		fmt.Println("write error")
-		return err
+		return DBStructure{}, err
 	}
 
-	fmt.Printf("%v\n", returnUser)
-	return nil
-
+	return newData, nil
 }
 
-func (db *DB) DeleteChirp(id int, token string, secret []byte) error {
-	db.mux.Lock()
-	defer db.mux.Unlock()
+// copyDB returns a copy of dbStructure that shares no maps with it
+func copyDB(dbStructure DBStructure) DBStructure {
+	newData := dbStructure
+	newData.Chirps = make(map[int]Chirp, len(dbStructure.Chirps))
+	for id, chirp := range dbStructure.Chirps {
+		newData.Chirps[id] = chirp
+	}
+	newData.Users = make(map[string]User, len(dbStructure.Users))
+	for email, user := range dbStructure.Users {
+		newData.Users[email] = user
+	}
+	newData.UsersById = make(map[int]User, len(dbStructure.UsersById))
+	for id, user := range dbStructure.UsersById {
+		newData.UsersById[id] = user
+	}
+	newData.RefreshTokens = make(map[string]RefreshToken, len(dbStructure.RefreshTokens))
+	for hash, record := range dbStructure.RefreshTokens {
+		newData.RefreshTokens[hash] = record
+	}
+	newData.Sessions = make(map[string]Session, len(dbStructure.Sessions))
+	for id, session := range dbStructure.Sessions {
+		session.Scopes = slices.Clone(session.Scopes)
+		newData.Sessions[id] = session
+	}
+	newData.RevokedAccessTokens = make(map[string]time.Time, len(dbStructure.RevokedAccessTokens))
+	for id, expiresAt := range dbStructure.RevokedAccessTokens {
+		newData.RevokedAccessTokens[id] = expiresAt
+	}
+	newData.PasswordResets = make(map[string]PasswordReset, len(dbStructure.PasswordResets))
+	for hash, reset := range dbStructure.PasswordResets {
+		newData.PasswordResets[hash] = reset
+	}
+	newData.EmailVerifications = make(map[string]EmailVerification, len(dbStructure.EmailVerifications))
+	for hash, verification := range dbStructure.EmailVerifications {
+		newData.EmailVerifications[hash] = verification
+	}
+	newData.TOTP = make(map[int]TOTP, len(dbStructure.TOTP))
+	for userId, totp := range dbStructure.TOTP {
+		totp.RecoveryCodes = slices.Clone(totp.RecoveryCodes)
+		newData.TOTP[userId] = totp
+	}
+	newData.MFAChallenges = make(map[string]MFAChallenge, len(dbStructure.MFAChallenges))
+	for hash, challenge := range dbStructure.MFAChallenges {
+		newData.MFAChallenges[hash] = challenge
+	}
+	newData.APIKeys = make(map[string]APIKey, len(dbStructure.APIKeys))
+	for hash, key := range dbStructure.APIKeys {
+		key.Scopes = slices.Clone(key.Scopes)
+		newData.APIKeys[hash] = key
+	}
+	newData.OAuthClients = make(map[string]OAuthClient, len(dbStructure.OAuthClients))
+	for id, client := range dbStructure.OAuthClients {
+		client.RedirectURIs = slices.Clone(client.RedirectURIs)
+		client.Scopes = slices.Clone(client.Scopes)
+		newData.OAuthClients[id] = client
+	}
+	newData.AuthorizationCodes = make(map[string]AuthorizationCode, len(dbStructure.AuthorizationCodes))
+	for hash, code := range dbStructure.AuthorizationCodes {
+		code.Scopes = slices.Clone(code.Scopes)
+		newData.AuthorizationCodes[hash] = code
+	}
+	newData.AccountDeletions = make(map[int]AccountDeletion, len(dbStructure.AccountDeletions))
+	for userId, deletion := range dbStructure.AccountDeletions {
+		newData.AccountDeletions[userId] = deletion
+	}
+	newData.AuditLog = make(map[int]AuditEvent, len(dbStructure.AuditLog))
+	for id, event := range dbStructure.AuditLog {
+		newData.AuditLog[id] = event
+	}
+
+	return newData
+}
 
-	dbStructure, err := db.loadDB()
-	if err != nil {
-		return err
+// validateDB checks that every entity is stored under its own id
+// and that no id is ahead of its sequence
+func validateDB(dbStructure DBStructure) error {
+	if dbStructure.SchemaVersion != CurrentSchemaVersion {
+		return fmt.Errorf("%w: schema version %d, expected %d", ErrInvalidSchema, dbStructure.SchemaVersion, CurrentSchemaVersion)
 	}
 
-	returnChirp, ok := dbStructure.Chirps[id]
-
-	if !ok {
-		return nil
+	for id, chirp := range dbStructure.Chirps {
+		if id != chirp.Id {
+			return fmt.Errorf("%w: chirp %d stored under id %d", ErrInvalidSchema, chirp.Id, id)
+		}
+		if id > dbStructure.Sequences.Chirps {
+			return fmt.Errorf("%w: chirp %d is past the chirp sequence", ErrInvalidSchema, id)
+		}
 	}
 
-	token_, err := jwt.ParseWithClaims(token, &jwt.RegisteredClaims{}, func(t *jwt.Token) (interface{}, error) {
-		return []byte(secret), nil
-	})
+	for id, user := range dbStructure.UsersById {
+		if id != user.Id {
+			return fmt.Errorf("%w: user %d stored under id %d", ErrInvalidSchema, user.Id, id)
+		}
+		if id > dbStructure.Sequences.Users {
+			return fmt.Errorf("%w: user %d is past the user sequence", ErrInvalidSchema, id)
+		}
+		if _, err := ParseRole(string(user.Role)); err != nil {
+			return fmt.Errorf("%w: user %d: %v", ErrInvalidSchema, id, err)
+		}
+	}
 
-	if err != nil {
-		return err
+	for email, user := range dbStructure.Users {
+		if email != user.Email {
+			return fmt.Errorf("%w: user %d stored under email %s", ErrInvalidSchema, user.Id, email)
+		}
+		if _, ok := dbStructure.UsersById[user.Id]; !ok {
+			return fmt.Errorf("%w: email %s points at missing user %d", ErrInvalidSchema, email, user.Id)
+		}
 	}
 
-	claims, ok := token_.Claims.(*jwt.RegisteredClaims)
-	if !ok || !token_.Valid {
-		return errors.New("invalid token")
+	for hash, record := range dbStructure.RefreshTokens {
+		if hash != record.Hash {
+			return fmt.Errorf("%w: refresh token %s stored under %s", ErrInvalidSchema, record.Hash, hash)
+		}
+		if _, ok := dbStructure.Sessions[record.FamilyId]; !ok {
+			return fmt.Errorf("%w: refresh token %s has no session", ErrInvalidSchema, hash)
+		}
 	}
 
-	idStr := claims.Subject
-	id, err = strconv.Atoi(idStr)
-	if err != nil {
-		return err
+	for id, session := range dbStructure.Sessions {
+		if id != session.Id {
+			return fmt.Errorf("%w: session %s stored under %s", ErrInvalidSchema, session.Id, id)
+		}
 	}
 
-	if id != returnChirp.AutherId {
-		return errors.New("user not authirized")
+	for hash, reset := range dbStructure.PasswordResets {
+		if hash != reset.Hash {
+			return fmt.Errorf("%w: password reset %s stored under %s", ErrInvalidSchema, reset.Hash, hash)
+		}
 	}
 
-	delete(dbStructure.Chirps, returnChirp.Id)
+	for hash, verification := range dbStructure.EmailVerifications {
+		if hash != verification.Hash {
+			return fmt.Errorf("%w: email verification %s stored under %s", ErrInvalidSchema, verification.Hash, hash)
+		}
+	}
 
-	err = db.writeDB(dbStructure)
-	if err != nil {
-		return err
+	for userId, totp := range dbStructure.TOTP {
+		if userId != totp.UserId {
+			return fmt.Errorf("%w: totp of user %d stored under user %d", ErrInvalidSchema, totp.UserId, userId)
+		}
 	}
 
-	return nil
-}
+	for hash, challenge := range dbStructure.MFAChallenges {
+		if hash != challenge.Hash {
+			return fmt.Errorf("%w: mfa challenge %s stored under %s", ErrInvalidSchema, challenge.Hash, hash)
+		}
+	}
 
-// ensureDB creates a new database file if it doesn't exist
-func (db *DB) ensureDB() error {
-	return os.WriteFile(db.path, []byte{}, 0666)
-}
+	for hash, key := range dbStructure.APIKeys {
+		if hash != key.Hash {
+			return fmt.Errorf("%w: api key %s stored under %s", ErrInvalidSchema, key.Hash, hash)
+		}
+		if _, ok := dbStructure.UsersById[key.UserId]; !ok {
+			return fmt.Errorf("%w: api key %s points at missing user %d", ErrInvalidSchema, key.Id, key.UserId)
+		}
+		if _, err := ValidateScopes(key.Scopes); err != nil {
+			return fmt.Errorf("%w: api key %s: %v", ErrInvalidSchema, key.Id, err)
+		}
+	}
 
-// loadDB reads the database file into memory
-func (db *DB) loadDB() (DBStructure, error) {
-	data, err := os.ReadFile(db.path)
-	if err != nil {
-		return DBStructure{}, err
+	for id, client := range dbStructure.OAuthClients {
+		if id != client.Id {
+			return fmt.Errorf("%w: oauth client %s stored under %s", ErrInvalidSchema, client.Id, id)
+		}
+		if _, ok := dbStructure.UsersById[client.OwnerId]; !ok {
+			return fmt.Errorf("%w: oauth client %s points at missing user %d", ErrInvalidSchema, client.Id, client.OwnerId)
+		}
+		if _, err := ValidateScopes(client.Scopes); err != nil {
+			return fmt.Errorf("%w: oauth client %s: %v", ErrInvalidSchema, client.Id, err)
+		}
 	}
 
-	newData := DBStructure{}
+	for hash, code := range dbStructure.AuthorizationCodes {
+		if hash != code.Hash {
+			return fmt.Errorf("%w: authorization code %s stored under %s", ErrInvalidSchema, code.Hash, hash)
+		}
+		if _, ok := dbStructure.OAuthClients[code.ClientId]; !ok {
+			return fmt.Errorf("%w: authorization code %s points at missing client %s", ErrInvalidSchema, hash, code.ClientId)
+		}
+	}
 
-	if len(data) == 0 {
-		newData.Chirps = map[int]Chirp{}
-		newData.Users = map[string]User{}
-		newData.UsersById = map[int]User{}
-		newData.Tokens = map[string]string{}
-		return newData, nil
+	for userId, deletion := range dbStructure.AccountDeletions {
+		if userId != deletion.UserId {
+			return fmt.Errorf("%w: account deletion of user %d stored under user %d", ErrInvalidSchema, deletion.UserId, userId)
+		}
+		if _, ok := dbStructure.UsersById[userId]; !ok {
+			return fmt.Errorf("%w: account deletion points at missing user %d", ErrInvalidSchema, userId)
+		}
 	}
 
-	err = json.Unmarshal(data, &newData)
-	if err != nil {
-		return DBStructure{}, err
+	for id, event := range dbStructure.AuditLog {
+		if id != event.Id {
+			return fmt.Errorf("%w: audit event %d stored under id %d", ErrInvalidSchema, event.Id, id)
+		}
+		if id > dbStructure.Sequences.AuditEvents {
+			return fmt.Errorf("%w: audit event %d is past the audit event sequence", ErrInvalidSchema, id)
+		}
 	}
 
-	return newData, nil
+	return nil
 }
 
 // writeDB writes the database file to disk
@@ -528,7 +825,13 @@ func (db *DB) writeDB(dbStructure DBStructure) error {
 		return fmt.Errorf("writing this %v error %w", dbStructure.Chirps, err)
 	}
 
-	err = os.WriteFile(db.path, json_, 0666)
+	unlock, err := db.lockIO()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = writeFileAtomic(db.path, sealBytes(db.options.Keys, json_), 0666)
 
 	if err != nil {
 		return err
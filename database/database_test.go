@@ -0,0 +1,129 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewDBKeepsExistingData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.CreateUser("a@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbStructure.UsersById) != 1 {
+		t.Errorf("expected 1 user after reopening, got %d", len(dbStructure.UsersById))
+	}
+
+	defer db.Close()
+
+	err = db.Reset("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbStructure, err = db.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbStructure.UsersById) != 0 {
+		t.Errorf("expected no users after reset, got %d", len(dbStructure.UsersById))
+	}
+}
+
+func TestNewDBRejectsInvalidSchema(t *testing.T) {
+	cases := []string{
+		`{"chirps":[]}`,
+		`{"chirps":{"1":{"Id":2,"Body":"","AutherId":1}}}`,
+		`{"posts":{}}`,
+	}
+
+	for _, case_ := range cases {
+		path := filepath.Join(t.TempDir(), "database.json")
+		err := os.WriteFile(path, []byte(case_), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = NewDB(path)
+		if !errors.Is(err, ErrCorruptDB) {
+			t.Errorf("expected ErrCorruptDB for %s, got %v", case_, err)
+		}
+	}
+}
+
+func TestDeletedChirpIdsAreNotReused(t *testing.T) {
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			seedChirps(t, store, 1, 2)
+
+			err := store.DeleteChirp(1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// the newest id is not reused either
+			err = store.DeleteChirp(2, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			chirp, err := store.CreateChirp(1, "third")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if chirp.Id != 3 {
+				t.Errorf("expected id 3, got %d", chirp.Id)
+			}
+
+			chirp, err = store.GetChirpById(2)
+			if err != nil || chirp.Id != 0 {
+				t.Errorf("expected chirp 2 to stay deleted, got %+v %v", chirp, err)
+			}
+		})
+	}
+}
+
+func TestNewDBRepairsSequences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	legacy := `{"chirps":{"4":{"Id":4,"Body":"hi","AutherId":7}},"users":{},` +
+		`"users_by_id":{"7":{"Id":7,"Email":"a@example.com","Password":"","IsChirpyRed":false}},"tokens":{}}`
+	err := os.WriteFile(path, []byte(legacy), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Sequences{Chirps: 4, Users: 7}
+	if dbStructure.Sequences != expected {
+		t.Errorf("not matching %v vs %v", dbStructure.Sequences, expected)
+	}
+}
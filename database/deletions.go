@@ -0,0 +1,219 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// DefaultAccountDeletionGrace is how long an account waits to be purged
+// after the user asks for it to be deleted
+const DefaultAccountDeletionGrace = 30 * 24 * time.Hour
+
+// DeletedUserId is the author of chirps whose user was deleted
+// with ChirpsAnonymize, no user ever gets this id
+const DeletedUserId = 0
+
+// ErrAccountDeletionNotFound is returned for users that didn't ask
+// for their account to be deleted
+var ErrAccountDeletionNotFound = errors.New("account deletion not found")
+
+// ChirpPolicy is what happens to the chirps of a purged account
+type ChirpPolicy string
+
+const (
+	// ChirpsDelete deletes the chirps along with the account
+	ChirpsDelete ChirpPolicy = "delete"
+	// ChirpsAnonymize keeps the chirps with DeletedUserId as their author
+	ChirpsAnonymize ChirpPolicy = "anonymize"
+)
+
+// ParseChirpPolicy returns the chirp policy named s
+func ParseChirpPolicy(s string) (ChirpPolicy, error) {
+	switch policy := ChirpPolicy(s); policy {
+	case ChirpsDelete, ChirpsAnonymize:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("unknown chirp policy %q, expected %s or %s", s, ChirpsDelete, ChirpsAnonymize)
+	}
+}
+
+// AccountDeletion is a pending deletion of an account, the account is
+// purged once PurgeAt passes unless the user cancels it before
+type AccountDeletion struct {
+	UserId      int       `json:"user_id"`
+	RequestedAt time.Time `json:"requested_at"`
+	PurgeAt     time.Time `json:"purge_at"`
+}
+
+// ScheduleAccountDeletion schedules the account of the user to be purged
+// after grace, logs every session of the user out and revokes its api keys
+// and unused authorization codes so nothing acts for the user during the
+// grace period. Asking again keeps the deletion that is already pending
+func (db *DB) ScheduleAccountDeletion(userId int, now time.Time, grace time.Duration) (AccountDeletion, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.UsersById[userId]; !ok {
+		return AccountDeletion{}, ErrUserNotFound
+	}
+
+	entries := []walEntry{}
+	for id, session := range db.data.Sessions {
+		if session.UserId == userId {
+			entries = append(entries, db.revokeSessionEntries(id)...)
+		}
+	}
+	for hash, code := range db.data.AuthorizationCodes {
+		if code.UserId == userId {
+			entries = append(entries, walEntry{Op: opAuthorizationCodeUsed, Hash: hash})
+		}
+	}
+	for hash, key := range db.data.APIKeys {
+		if key.UserId == userId {
+			entries = append(entries, walEntry{Op: opAPIKeyRevoked, Hash: hash})
+		}
+	}
+
+	deletion, ok := db.data.AccountDeletions[userId]
+	if !ok {
+		deletion = AccountDeletion{UserId: userId, RequestedAt: now, PurgeAt: now.Add(grace)}
+		entries = append(entries, walEntry{Op: opAccountDeletionScheduled, AccountDeletion: &deletion})
+	}
+	if len(entries) == 0 {
+		return deletion, nil
+	}
+
+	err := db.commit(entries...)
+	if err != nil {
+		return AccountDeletion{}, err
+	}
+
+	return deletion, nil
+}
+
+// GetAccountDeletion returns the pending deletion of the account of the user
+func (db *DB) GetAccountDeletion(userId int) (AccountDeletion, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	deletion, ok := db.data.AccountDeletions[userId]
+	if !ok {
+		return AccountDeletion{}, ErrAccountDeletionNotFound
+	}
+
+	return deletion, nil
+}
+
+// CancelAccountDeletion keeps the account of the user
+func (db *DB) CancelAccountDeletion(userId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.AccountDeletions[userId]; !ok {
+		return ErrAccountDeletionNotFound
+	}
+
+	return db.commit(walEntry{Op: opAccountDeletionCancelled, Id: userId})
+}
+
+// PurgeAccounts deletes the accounts whose deletion is due along with
+// everything they own, chirps follow chirps. Sessions are revoked so the
+// access tokens issued with them stop working, that includes the
+// sessions other users started with oauth clients of a purged account.
+// It returns the ids of the purged users in order
+func (db *DB) PurgeAccounts(now time.Time, chirps ChirpPolicy) ([]int, error) {
+	chirps, err := ParseChirpPolicy(string(chirps))
+	if err != nil {
+		return nil, err
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	purged := []int{}
+	for userId, deletion := range db.data.AccountDeletions {
+		if !now.Before(deletion.PurgeAt) {
+			purged = append(purged, userId)
+		}
+	}
+	if len(purged) == 0 {
+		return purged, nil
+	}
+	sort.Ints(purged)
+
+	entries := []walEntry{}
+	for _, userId := range purged {
+		entries = append(entries, db.purgeAccountEntries(userId, chirps)...)
+	}
+
+	err = db.commit(entries...)
+	if err != nil {
+		return nil, err
+	}
+
+	return purged, nil
+}
+
+// purgeAccountEntries are the entries that delete the user and
+// everything that points at it
+func (db *DB) purgeAccountEntries(userId int, chirps ChirpPolicy) []walEntry {
+	clients := map[string]bool{}
+	for id, client := range db.data.OAuthClients {
+		if client.OwnerId == userId {
+			clients[id] = true
+		}
+	}
+
+	entries := []walEntry{}
+	for id, session := range db.data.Sessions {
+		if session.UserId == userId || clients[session.ClientId] {
+			entries = append(entries, db.revokeSessionEntries(id)...)
+		}
+	}
+	for hash, code := range db.data.AuthorizationCodes {
+		if code.UserId == userId || clients[code.ClientId] {
+			entries = append(entries, walEntry{Op: opAuthorizationCodeUsed, Hash: hash})
+		}
+	}
+	for id := range clients {
+		entries = append(entries, walEntry{Op: opOAuthClientDeleted, ClientId: id})
+	}
+	for hash, key := range db.data.APIKeys {
+		if key.UserId == userId {
+			entries = append(entries, walEntry{Op: opAPIKeyRevoked, Hash: hash})
+		}
+	}
+	for hash, reset := range db.data.PasswordResets {
+		if reset.UserId == userId {
+			entries = append(entries, walEntry{Op: opPasswordResetUsed, Hash: hash})
+		}
+	}
+	for hash, verification := range db.data.EmailVerifications {
+		if verification.UserId == userId {
+			entries = append(entries, walEntry{Op: opEmailVerificationUsed, Hash: hash})
+		}
+	}
+	for hash, challenge := range db.data.MFAChallenges {
+		if challenge.UserId == userId {
+			entries = append(entries, walEntry{Op: opMFAChallengeUsed, Hash: hash})
+		}
+	}
+	if _, ok := db.data.TOTP[userId]; ok {
+		entries = append(entries, walEntry{Op: opTOTPDisabled, Id: userId})
+	}
+	for id, chirp := range db.data.Chirps {
+		if chirp.AutherId != userId {
+			continue
+		}
+		if chirps == ChirpsAnonymize {
+			chirp.AutherId = DeletedUserId
+			entries = append(entries, walEntry{Op: opChirpUpdated, Chirp: &chirp})
+		} else {
+			entries = append(entries, walEntry{Op: opChirpDeleted, Id: id})
+		}
+	}
+
+	return append(entries, walEntry{Op: opUserDeleted, Id: userId})
+}
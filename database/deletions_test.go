@@ -0,0 +1,210 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestAccountDeletion(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	grace := 24 * time.Hour
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			other, err := store.CreateUser("b@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = store.CreateSession("mine", Session{UserId: 1}, AccessToken{Id: "a1", ExpiresAt: now.Add(time.Hour)}, now, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.GetAccountDeletion(1)
+			if !errors.Is(err, ErrAccountDeletionNotFound) {
+				t.Errorf("expected no pending deletion, got %v", err)
+			}
+			_, err = store.CreateAPIKey("early", APIKey{Id: "k0", UserId: 1, Scopes: []string{ScopeChirpsWrite}, CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateOAuthClient("", OAuthClient{Id: "c0", OwnerId: other.Id, Name: "their app", RedirectURIs: []string{"https://their.example.com"}, Scopes: []string{ScopeChirpsWrite}, CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.CreateAuthorizationCode("early", AuthorizationCode{ClientId: "c0", UserId: 1, RedirectURI: "https://their.example.com", Scopes: []string{ScopeChirpsWrite}, CreatedAt: now, ExpiresAt: now.Add(time.Minute)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			deletion, err := store.ScheduleAccountDeletion(1, now, grace)
+			if err != nil || !deletion.PurgeAt.Equal(now.Add(grace)) {
+				t.Fatalf("expected a deletion due after the grace period, got %+v %v", deletion, err)
+			}
+			revoked, err := store.IsAccessTokenRevoked("a1")
+			if err != nil || !revoked {
+				t.Errorf("expected scheduling to log the user out, got %v %v", revoked, err)
+			}
+			_, err = store.UseAPIKey("early", now)
+			if !errors.Is(err, ErrAPIKeyNotFound) {
+				t.Errorf("expected scheduling to revoke the api keys, got %v", err)
+			}
+			_, err = store.UseAuthorizationCode("early", now)
+			if !errors.Is(err, ErrAuthorizationCodeNotFound) {
+				t.Errorf("expected scheduling to drop the authorization codes, got %v", err)
+			}
+			// asking again keeps the first deadline
+			again, err := store.ScheduleAccountDeletion(1, now.Add(time.Hour), grace)
+			if err != nil || !again.PurgeAt.Equal(deletion.PurgeAt) {
+				t.Errorf("expected the pending deletion kept, got %+v %v", again, err)
+			}
+
+			err = store.CancelAccountDeletion(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.CancelAccountDeletion(1)
+			if !errors.Is(err, ErrAccountDeletionNotFound) {
+				t.Errorf("expected nothing left to cancel, got %v", err)
+			}
+			_, err = store.ScheduleAccountDeletion(1, now, grace)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// what the user owns, and a session of the other user through
+			// a client of the user
+			_, err = store.CreateChirp(1, "mine")
+			if err != nil {
+				t.Fatal(err)
+			}
+			theirs, err := store.CreateChirp(other.Id, "theirs")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateAPIKey("key", APIKey{Id: "k1", UserId: 1, Scopes: []string{ScopeChirpsRead}, CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateOAuthClient("", OAuthClient{Id: "c1", OwnerId: 1, Name: "app", RedirectURIs: []string{"https://app.example.com"}, Scopes: []string{ScopeChirpsRead}, CreatedAt: now})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateSession("through-client", Session{UserId: other.Id, ClientId: "c1", Scopes: []string{ScopeChirpsRead}}, AccessToken{Id: "a2", ExpiresAt: now.Add(time.Hour)}, now, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.EnrollTOTP(1, "JBSWY3DPEHPK3PXP", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.CreatePasswordReset("a@example.com", "reset", now, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			purged, err := store.PurgeAccounts(now.Add(grace-time.Second), ChirpsAnonymize)
+			if err != nil || len(purged) != 0 {
+				t.Fatalf("expected nothing purged before the deadline, got %v %v", purged, err)
+			}
+			purged, err = store.PurgeAccounts(now.Add(grace), ChirpsAnonymize)
+			if err != nil || len(purged) != 1 || purged[0] != 1 {
+				t.Fatalf("expected user 1 purged, got %v %v", purged, err)
+			}
+
+			_, err = store.GetUserByEmail("a@example.com")
+			if !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected the user gone, got %v", err)
+			}
+			_, err = store.GetAccountDeletion(1)
+			if !errors.Is(err, ErrAccountDeletionNotFound) {
+				t.Errorf("expected the deletion done, got %v", err)
+			}
+			revoked, err = store.IsAccessTokenRevoked("a2")
+			if err != nil || !revoked {
+				t.Errorf("expected sessions of the clients of the user revoked, got %v %v", revoked, err)
+			}
+			_, err = store.GetOAuthClient("c1")
+			if !errors.Is(err, ErrOAuthClientNotFound) {
+				t.Errorf("expected the client gone, got %v", err)
+			}
+			_, err = store.UseAPIKey("key", now.Add(grace))
+			if !errors.Is(err, ErrAPIKeyNotFound) {
+				t.Errorf("expected the api key gone, got %v", err)
+			}
+
+			snapshot, err := store.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshot.TOTP) != 0 || len(snapshot.PasswordResets) != 0 || len(snapshot.Sessions) != 0 {
+				t.Errorf("expected nothing of the user left, got %+v", snapshot)
+			}
+			if len(snapshot.Chirps) != 2 {
+				t.Fatalf("expected the chirps kept, got %+v", snapshot.Chirps)
+			}
+			for _, chirp := range snapshot.Chirps {
+				if chirp.Id == theirs.Id && chirp.AutherId != other.Id {
+					t.Errorf("expected the chirp of the other user untouched, got %+v", chirp)
+				}
+				if chirp.Id != theirs.Id && chirp.AutherId != DeletedUserId {
+					t.Errorf("expected the chirp anonymized, got %+v", chirp)
+				}
+			}
+			err = store.Restore(snapshot)
+			if err != nil {
+				t.Errorf("expected the purged snapshot to restore, got %v", err)
+			}
+		})
+	}
+}
+
+func TestAccountDeletionSurvivesLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	db, userId := newTestDB(t, path, options)
+	_, err := db.CreateChirp(userId, "mine")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ScheduleAccountDeletion(userId, now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := db.CreateUser("b@example.com", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.ScheduleAccountDeletion(other.Id, now, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.PurgeAccounts(now.Add(time.Hour), ChirpsDelete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.GetUserById(userId)
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected the purge replayed, got %v", err)
+	}
+	chirps, err := db.GetChirps()
+	if err != nil || len(chirps) != 0 {
+		t.Errorf("expected the chirps deleted, got %+v %v", chirps, err)
+	}
+	deletion, err := db.GetAccountDeletion(other.Id)
+	if err != nil || !deletion.PurgeAt.Equal(now.Add(2*time.Hour)) {
+		t.Errorf("expected the deletion still pending, got %+v %v", deletion, err)
+	}
+}
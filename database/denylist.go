@@ -0,0 +1,34 @@
+package database
+
+import "time"
+
+// AccessToken is the jti and expiry of an access token. It is recorded
+// with the refresh token issued next to it so revoking the session can
+// deny it until it expires
+type AccessToken struct {
+	Id        string    `json:"id"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// IsAccessTokenRevoked reports whether the access token with the jti id
+// was revoked, entries are pruned once the token expires
+func (db *DB) IsAccessTokenRevoked(id string) (bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	_, ok := db.data.RevokedAccessTokens[id]
+	return ok, nil
+}
+
+// revokeSessionEntries ends the session and denies the access tokens
+// issued with its refresh tokens
+func (db *DB) revokeSessionEntries(id string) []walEntry {
+	entries := []walEntry{}
+	for _, record := range db.data.RefreshTokens {
+		if record.FamilyId == id && record.AccessToken != nil {
+			entries = append(entries, walEntry{Op: opAccessTokenRevoked, AccessToken: record.AccessToken})
+		}
+	}
+
+	return append(entries, walEntry{Op: opSessionRevoked, SessionId: id})
+}
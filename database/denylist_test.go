@@ -0,0 +1,58 @@
+package database
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAccessTokenDenylist(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := time.Hour
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			_, err := store.CreateSession("first", Session{UserId: 1}, AccessToken{Id: "a1", ExpiresAt: now.Add(10 * time.Minute)}, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.RotateRefreshToken("first", "second", AccessToken{Id: "a2", ExpiresAt: now.Add(11 * time.Minute)}, now.Add(time.Minute), ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateSession("other", Session{UserId: 1}, AccessToken{Id: "b1", ExpiresAt: now.Add(10 * time.Minute)}, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = store.RevokeRefreshToken("second")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// every access token of the session is denied, not only the latest
+			for id, revoked := range map[string]bool{"a1": true, "a2": true, "b1": false} {
+				ok, err := store.IsAccessTokenRevoked(id)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if ok != revoked {
+					t.Errorf("expected %s revoked %v, got %v", id, revoked, ok)
+				}
+			}
+
+			// denied tokens are forgotten once they expire
+			_, err = store.CreateSession("later", Session{UserId: 1}, AccessToken{Id: "c1", ExpiresAt: now.Add(time.Hour)}, now.Add(10*time.Minute), ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			snapshot, err := store.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshot.RevokedAccessTokens) != 1 {
+				t.Errorf("expected only a2 left on the denylist, got %v", snapshot.RevokedAccessTokens)
+			}
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// DefaultEmailVerificationTTL is how long an email verification token is valid
+const DefaultEmailVerificationTTL = 24 * time.Hour
+
+var (
+	// ErrInvalidEmail is returned for emails that aren't a bare address
+	ErrInvalidEmail = errors.New("invalid email")
+	// ErrEmailTaken is returned when another user already has the email
+	ErrEmailTaken = errors.New("email already belongs to a user")
+	// ErrEmailVerified is returned when asking to verify a verified email
+	ErrEmailVerified = errors.New("email already verified")
+	// ErrVerificationTokenNotFound is returned for verification tokens that
+	// were never issued, were used, were replaced or are for an old email
+	ErrVerificationTokenNotFound = errors.New("email verification token not found")
+	// ErrVerificationTokenExpired is returned for verification tokens past
+	// their expiry
+	ErrVerificationTokenExpired = errors.New("email verification token expired")
+)
+
+// EmailVerification is the stored record of an email verification token,
+// it only verifies the email it was sent to
+type EmailVerification struct {
+	Hash      string    `json:"hash"`
+	UserId    int       `json:"user_id"`
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// NormalizeEmail trims and lowercases email so an address belongs to one
+// user however it is typed. Anything but a bare address is rejected
+func NormalizeEmail(email string) (string, error) {
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return "", fmt.Errorf("%w: %q", ErrInvalidEmail, email)
+	}
+
+	return email, nil
+}
+
+// duplicateEmail is the placeholder address migrations give a user whose
+// email was shared with a newer user, .invalid never resolves
+func duplicateEmail(id int) string {
+	return fmt.Sprintf("user-%d@duplicate.invalid", id)
+}
+
+// GetUserById returns the user without checking a password
+func (db *DB) GetUserById(id int) (ReturnedUser, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	user, ok := db.data.UsersById[id]
+	if !ok {
+		return ReturnedUser{}, ErrUserNotFound
+	}
+
+	return ReturnedUser{
+		Id:            user.Id,
+		Email:         user.Email,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+	}, nil
+}
+
+// CreateEmailVerification stores a verification token for the current
+// email of the user and returns that email, it replaces any token the
+// user was sent before
+func (db *DB) CreateEmailVerification(userId int, token string, now time.Time, ttl time.Duration) (string, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	user, ok := db.data.UsersById[userId]
+	if !ok {
+		return "", ErrUserNotFound
+	}
+	if user.EmailVerified {
+		return "", ErrEmailVerified
+	}
+
+	entries := []walEntry{}
+	for hash, verification := range db.data.EmailVerifications {
+		if verification.UserId == user.Id || !now.Before(verification.ExpiresAt) {
+			entries = append(entries, walEntry{Op: opEmailVerificationUsed, Hash: hash})
+		}
+	}
+
+	verification := EmailVerification{
+		Hash:      hashToken(token),
+		UserId:    user.Id,
+		Email:     user.Email,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	entries = append(entries, walEntry{Op: opEmailVerificationIssued, EmailVerification: &verification})
+
+	err := db.commit(entries...)
+	if err != nil {
+		return "", err
+	}
+
+	return user.Email, nil
+}
+
+// VerifyEmail marks the email token was sent to as verified and uses the
+// token up
+func (db *DB) VerifyEmail(token string, now time.Time) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	hash := hashToken(token)
+	verification, ok := db.data.EmailVerifications[hash]
+	if !ok {
+		return ErrVerificationTokenNotFound
+	}
+
+	user, ok := db.data.UsersById[verification.UserId]
+	var err error
+	switch {
+	case !now.Before(verification.ExpiresAt):
+		err = ErrVerificationTokenExpired
+	case !ok || user.Email != verification.Email:
+		// the user moved to another email since
+		err = ErrVerificationTokenNotFound
+	}
+	if err != nil {
+		commitErr := db.commit(walEntry{Op: opEmailVerificationUsed, Hash: hash})
+		if commitErr != nil {
+			return commitErr
+		}
+		return err
+	}
+
+	user.EmailVerified = true
+
+	return db.commit(
+		walEntry{Op: opEmailVerificationUsed, Hash: hash},
+		walEntry{Op: opUserUpdated, User: &user},
+	)
+}
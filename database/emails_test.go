@@ -0,0 +1,253 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUniqueEmails(t *testing.T) {
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			user, err := store.CreateUser(" B@Example.COM ", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if user.Email != "b@example.com" || user.EmailVerified {
+				t.Errorf("expected an unverified normalized email, got %+v", user)
+			}
+
+			_, err = store.CreateUser("b@EXAMPLE.com", "password")
+			if !errors.Is(err, ErrEmailTaken) {
+				t.Errorf("expected ErrEmailTaken, got %v", err)
+			}
+
+			for _, email := range []string{"", "not an email", "B <b2@example.com>", "b@example.com, c@example.com"} {
+				_, err = store.CreateUser(email, "password")
+				if !errors.Is(err, ErrInvalidEmail) {
+					t.Errorf("expected ErrInvalidEmail for %q, got %v", email, err)
+				}
+			}
+
+			_, err = store.GetUser("B@example.com", "password")
+			if err != nil {
+				t.Errorf("expected the email to match in any case, got %v", err)
+			}
+
+			_, err = store.UpdateUser(1, "b@example.com", "")
+			if !errors.Is(err, ErrEmailTaken) {
+				t.Errorf("expected ErrEmailTaken, got %v", err)
+			}
+
+			updated, err := store.UpdateUser(1, "New@Example.com", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if updated.Email != "new@example.com" || updated.EmailVerified {
+				t.Errorf("expected an unverified normalized email, got %+v", updated)
+			}
+
+			_, err = store.GetUser("a@example.com", "password")
+			if !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected the old email to be free, got %v", err)
+			}
+			_, err = store.CreateUser("a@example.com", "password")
+			if err != nil {
+				t.Errorf("expected the old email to be taken again, got %v", err)
+			}
+			_, err = store.GetUser("new@example.com", "password")
+			if err != nil {
+				t.Errorf("expected the new email to log in, got %v", err)
+			}
+		})
+	}
+}
+
+func TestEmailVerification(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := time.Hour
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			_, err := store.CreateEmailVerification(99, "nobody", now, ttl)
+			if !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected ErrUserNotFound, got %v", err)
+			}
+
+			email, err := store.CreateEmailVerification(1, "expiring", now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if email != "a@example.com" {
+				t.Errorf("expected the token for a@example.com, got %s", email)
+			}
+			err = store.VerifyEmail("expiring", now.Add(ttl))
+			if !errors.Is(err, ErrVerificationTokenExpired) {
+				t.Errorf("expected ErrVerificationTokenExpired, got %v", err)
+			}
+
+			// the token only verifies the email it was sent to
+			_, err = store.CreateEmailVerification(1, "old", now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.UpdateUser(1, "b@example.com", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.VerifyEmail("old", now)
+			if !errors.Is(err, ErrVerificationTokenNotFound) {
+				t.Errorf("expected a token of the old email to be not found, got %v", err)
+			}
+
+			_, err = store.CreateEmailVerification(1, "replaced", now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateEmailVerification(1, "verify", now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.VerifyEmail("replaced", now)
+			if !errors.Is(err, ErrVerificationTokenNotFound) {
+				t.Errorf("expected a newer token to replace the older one, got %v", err)
+			}
+
+			err = store.VerifyEmail("verify", now.Add(time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			user, err := store.GetUserById(1)
+			if err != nil || !user.EmailVerified || user.Email != "b@example.com" {
+				t.Errorf("expected b@example.com verified, got %+v %v", user, err)
+			}
+
+			err = store.VerifyEmail("verify", now.Add(time.Minute))
+			if !errors.Is(err, ErrVerificationTokenNotFound) {
+				t.Errorf("expected the token to be single use, got %v", err)
+			}
+			_, err = store.CreateEmailVerification(1, "again", now, ttl)
+			if !errors.Is(err, ErrEmailVerified) {
+				t.Errorf("expected ErrEmailVerified, got %v", err)
+			}
+		})
+	}
+}
+
+func TestEmailChangeSurvivesLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog}
+
+	db, userId := newTestDB(t, path, options)
+	_, err := db.UpdateUser(userId, "b@example.com", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.GetUser("a@example.com", "password")
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected the old email to be gone, got %v", err)
+	}
+	_, err = db.GetUser("b@example.com", "password")
+	if err != nil {
+		t.Errorf("expected the new email to log in, got %v", err)
+	}
+}
+
+func TestMigrateNormalizesEmails(t *testing.T) {
+	password := "$2a$10$4FrYb4a0oO9ZkxJr9Y9W6uWm6zRkGZ3Lx3V2s6F1kQ2qF3p6i7Xq2"
+	emails := map[int]string{1: "A@Example.com ", 2: "a@example.com", 3: "old@example.com"}
+
+	t.Run(DriverJSON, func(t *testing.T) {
+		user := func(id int, email string) string {
+			return fmt.Sprintf(`{"Id":%d,"Email":%q,"Password":%q,"IsChirpyRed":false}`, id, email, password)
+		}
+		// user 3 moved to c@example.com without the old key being dropped
+		doc := fmt.Sprintf(`{"schema_version":6,"chirps":{},`+
+			`"users":{%q:%s,%q:%s,%q:%s,"c@example.com":%s},`+
+			`"users_by_id":{"1":%s,"2":%s,"3":%s},`+
+			`"refresh_tokens":{},"sessions":{},"revoked_access_tokens":{},"password_resets":{},"sequences":{"chirps":0,"users":3}}`,
+			emails[1], user(1, emails[1]), emails[2], user(2, emails[2]), emails[3], user(3, emails[3]), user(3, "c@example.com"),
+			user(1, emails[1]), user(2, emails[2]), user(3, "c@example.com"))
+
+		path := filepath.Join(t.TempDir(), "database.json")
+		err := os.WriteFile(path, []byte(doc), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		db, err := NewDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		checkNormalizedEmails(t, db)
+	})
+
+	t.Run(DriverSQLite, func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "database.sqlite")
+		conn := openSQLiteAt(t, path, 6)
+		var err error
+		for id := 1; id <= 2; id++ {
+			_, err = conn.Exec(`INSERT INTO users (id, email, password) VALUES (?, ?, ?)`, id, emails[id], password)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = conn.Exec(`INSERT INTO users (id, email, password) VALUES (3, 'c@example.com', ?)`, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		db, err := NewSQLiteDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+
+		checkNormalizedEmails(t, db)
+	})
+}
+
+// checkNormalizedEmails checks the users of TestMigrateNormalizesEmails,
+// user 2 keeps the address it shares with user 1
+func checkNormalizedEmails(t *testing.T, store Store) {
+	t.Helper()
+
+	want := map[int]ReturnedUser{
+		1: {Id: 1, Email: "user-1@duplicate.invalid", Role: RoleUser},
+		2: {Id: 2, Email: "a@example.com", EmailVerified: true, Role: RoleUser},
+		3: {Id: 3, Email: "c@example.com", EmailVerified: true, Role: RoleUser},
+	}
+	for id, expected := range want {
+		user, err := store.GetUserById(id)
+		if err != nil || user != expected {
+			t.Errorf("expected %+v, got %+v %v", expected, user, err)
+		}
+	}
+
+	_, err := store.GetUser("old@example.com", "password")
+	if !errors.Is(err, ErrUserNotFound) {
+		t.Errorf("expected the stale email to be dropped, got %v", err)
+	}
+
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshot.Users) != 3 {
+		t.Errorf("expected one email per user, got %v", snapshot.Users)
+	}
+}
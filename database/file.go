@@ -0,0 +1,125 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// ErrCorruptDB is returned when neither the database file
+// nor its previous generation can be decoded
+var ErrCorruptDB = errors.New("database file is corrupt")
+
+// ErrInvalidSchema is returned when a database file decodes
+// but doesn't match DBStructure
+var ErrInvalidSchema = errors.New("database file has an invalid schema")
+
+// loadSeed reads a database file used to seed a reset,
+// an empty seedPath gives an empty database
+func loadSeed(seedPath string) (DBStructure, error) {
+	if seedPath == "" {
+		return parseDB(nil)
+	}
+
+	data, err := os.ReadFile(seedPath)
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	dbStructure, _, err := decodeDB(data)
+	if err != nil {
+		return DBStructure{}, fmt.Errorf("seed file %s: %w", seedPath, err)
+	}
+
+	return dbStructure, nil
+}
+
+// backupPath is where the previous generation of the file at path is kept
+func backupPath(path string) string {
+	return path + ".bak"
+}
+
+// writeFileAtomic writes data to a temp file next to path, syncs it
+// and renames it over path so readers never see a partial write.
+// The file being replaced is kept as the .bak generation
+func writeFileAtomic(path string, data []byte, perm fs.FileMode) error {
+	return replaceFile(path, data, perm, true)
+}
+
+// replaceFile is writeFileAtomic, keep says whether the file being
+// replaced is kept as the .bak generation
+func replaceFile(path string, data []byte, perm fs.FileMode, keep bool) error {
+	dir := filepath.Dir(path)
+
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+
+	// after a successful rename this fails harmlessly
+	defer os.Remove(tmpPath)
+
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmpPath, perm)
+	if err != nil {
+		return err
+	}
+
+	if keep {
+		err = keepBackup(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Rename(tmpPath, path)
+	if err != nil {
+		return err
+	}
+
+	return syncDir(dir)
+}
+
+// keepBackup hard links the current file at path to its .bak path,
+// so the rename that follows leaves the previous generation behind
+func keepBackup(path string) error {
+	_, err := os.Stat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	bak := backupPath(path)
+	err = os.Remove(bak)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return os.Link(path, bak)
+}
+
+// syncDir fsyncs a directory so a rename inside it is durable
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+
+	return d.Sync()
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestWriteFileAtomicKeepsBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	for _, data := range []string{"first", "second"} {
+		err := writeFileAtomic(path, []byte(data), 0666)
+		if err != nil {
+			t.Fatalf("writing %s: %v", data, err)
+		}
+	}
+
+	cases := []struct {
+		path     string
+		expected string
+	}{
+		{path: path, expected: "second"},
+		{path: backupPath(path), expected: "first"},
+	}
+
+	for _, case_ := range cases {
+		actual, err := os.ReadFile(case_.path)
+		if err != nil {
+			t.Fatalf("reading %s: %v", case_.path, err)
+		}
+		if string(actual) != case_.expected {
+			t.Errorf("not matching %s vs %s", actual, case_.expected)
+		}
+	}
+
+	matches, _ := filepath.Glob(path + ".tmp-*")
+	if len(matches) != 0 {
+		t.Errorf("temp files left behind %v", matches)
+	}
+}
+
+func TestLoadDBFallsBackToBackup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db := &DB{path: path, mux: &sync.RWMutex{}}
+
+	good := DBStructure{
+		Chirps:        map[int]Chirp{1: {Id: 1, Body: "hello", AutherId: 1}},
+		Users:         map[string]User{},
+		UsersById:     map[int]User{},
+		RefreshTokens: map[string]RefreshToken{},
+	}
+	err := db.writeDB(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.writeDB(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate a crash that left a truncated file behind
+	err = os.WriteFile(path, []byte(`{"chirps":{"1":`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dbStructure, err := db.loadDB()
+	if err != nil {
+		t.Fatalf("expected fallback to backup, got %v", err)
+	}
+	if dbStructure.Chirps[1].Body != "hello" {
+		t.Errorf("not matching %v vs %v", dbStructure.Chirps, good.Chirps)
+	}
+
+	err = os.WriteFile(backupPath(path), []byte("{"), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = db.loadDB()
+	if !errors.Is(err, ErrCorruptDB) {
+		t.Errorf("expected ErrCorruptDB, got %v", err)
+	}
+}
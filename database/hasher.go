@@ -0,0 +1,143 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ErrUnknownPasswordHash is returned for stored passwords no hasher can read
+var ErrUnknownPasswordHash = errors.New("unknown password hash")
+
+// PasswordHasher hashes new passwords. The parameters are encoded in the
+// hash so passwords hashed with older ones can still be checked, a login
+// with a password NeedsRehash reports on stores it hashed again
+type PasswordHasher interface {
+	Hash(password string) (string, error)
+	NeedsRehash(encoded string) bool
+}
+
+// DefaultPasswordHasher is the hasher of stores opened without one
+var DefaultPasswordHasher PasswordHasher = DefaultArgon2idHasher
+
+// BcryptHasher hashes passwords with bcrypt at Cost
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(password string) (string, error) {
+	hashed, err := bcrypt.GenerateFromPassword([]byte(password), h.Cost)
+	return string(hashed), err
+}
+
+func (h BcryptHasher) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	return err != nil || cost != h.Cost
+}
+
+// Argon2idHasher hashes passwords with argon2id, Memory is in KiB
+type Argon2idHasher struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+	KeyLen  uint32
+	SaltLen uint32
+}
+
+// DefaultArgon2idHasher uses the parameters RFC 9106 recommends when
+// memory is constrained
+var DefaultArgon2idHasher = Argon2idHasher{Time: 3, Memory: 64 * 1024, Threads: 4, KeyLen: 32, SaltLen: 16}
+
+const argon2idPrefix = "$argon2id$"
+
+// Hash encodes the hash like "$argon2id$v=19$m=65536,t=3,p=4$salt$key"
+// with unpadded base64
+func (h Argon2idHasher) Hash(password string) (string, error) {
+	salt := make([]byte, h.SaltLen)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return "", err
+	}
+
+	key := argon2.IDKey([]byte(password), salt, h.Time, h.Memory, h.Threads, h.KeyLen)
+
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s", argon2idPrefix, argon2.Version, h.Memory, h.Time, h.Threads,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key)), nil
+}
+
+func (h Argon2idHasher) NeedsRehash(encoded string) bool {
+	params, salt, key, err := decodeArgon2id(encoded)
+	if err != nil {
+		return true
+	}
+
+	return params.Time != h.Time || params.Memory != h.Memory || params.Threads != h.Threads ||
+		uint32(len(key)) != h.KeyLen || uint32(len(salt)) != h.SaltLen
+}
+
+// decodeArgon2id reads a hash written by Argon2idHasher.Hash
+func decodeArgon2id(encoded string) (Argon2idHasher, []byte, []byte, error) {
+	params := Argon2idHasher{}
+
+	parts := strings.Split(strings.TrimPrefix(encoded, argon2idPrefix), "$")
+	if !strings.HasPrefix(encoded, argon2idPrefix) || len(parts) != 4 {
+		return params, nil, nil, fmt.Errorf("%w: malformed argon2id hash", ErrUnknownPasswordHash)
+	}
+
+	var version int
+	_, err := fmt.Sscanf(parts[0], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("%w: argon2 version %q", ErrUnknownPasswordHash, parts[0])
+	}
+
+	_, err = fmt.Sscanf(parts[1], "m=%d,t=%d,p=%d", &params.Memory, &params.Time, &params.Threads)
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("%w: argon2id parameters %q", ErrUnknownPasswordHash, parts[1])
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("%w: argon2id salt: %v", ErrUnknownPasswordHash, err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(key) == 0 {
+		return params, nil, nil, fmt.Errorf("%w: argon2id key", ErrUnknownPasswordHash)
+	}
+	params.SaltLen = uint32(len(salt))
+	params.KeyLen = uint32(len(key))
+
+	return params, salt, key, nil
+}
+
+// comparePassword checks password against a hash of any hasher,
+// a mismatch is ErrWrongPassword
+func comparePassword(encoded string, password string) error {
+	if strings.HasPrefix(encoded, argon2idPrefix) {
+		params, salt, key, err := decodeArgon2id(encoded)
+		if err != nil {
+			return err
+		}
+
+		got := argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, params.KeyLen)
+		if subtle.ConstantTimeCompare(got, key) != 1 {
+			return ErrWrongPassword
+		}
+		return nil
+	}
+
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		return ErrWrongPassword
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUnknownPasswordHash, err)
+	}
+
+	return nil
+}
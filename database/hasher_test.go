@@ -0,0 +1,200 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testArgon2idHasher keeps the tests fast
+var testArgon2idHasher = Argon2idHasher{Time: 1, Memory: 64, Threads: 1, KeyLen: 32, SaltLen: 16}
+
+func TestPasswordHashers(t *testing.T) {
+	hashers := map[string]PasswordHasher{
+		"bcrypt":   BcryptHasher{Cost: 4},
+		"argon2id": testArgon2idHasher,
+	}
+
+	for name, hasher := range hashers {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := hasher.Hash("password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := comparePassword(encoded, "password"); err != nil {
+				t.Errorf("expected the password to match, got %v", err)
+			}
+			if err := comparePassword(encoded, "wrong"); !errors.Is(err, ErrWrongPassword) {
+				t.Errorf("expected a wrong password, got %v", err)
+			}
+			if hasher.NeedsRehash(encoded) {
+				t.Errorf("expected a fresh hash to be current")
+			}
+
+			other, err := hasher.Hash("password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if other == encoded {
+				t.Errorf("expected every hash to be salted")
+			}
+		})
+	}
+
+	bcrypted, err := BcryptHasher{Cost: 4}.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !testArgon2idHasher.NeedsRehash(bcrypted) || !(BcryptHasher{Cost: 5}).NeedsRehash(bcrypted) {
+		t.Errorf("expected another hasher or cost to need a rehash")
+	}
+
+	encoded, err := testArgon2idHasher.Hash("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=1$") {
+		t.Errorf("expected the parameters encoded in the hash, got %s", encoded)
+	}
+	stronger := testArgon2idHasher
+	stronger.Time = 2
+	if !stronger.NeedsRehash(encoded) || !(BcryptHasher{Cost: 4}).NeedsRehash(encoded) {
+		t.Errorf("expected other parameters to need a rehash")
+	}
+	if err := comparePassword("$argon2id$v=19$m=64$broken", "password"); !errors.Is(err, ErrUnknownPasswordHash) {
+		t.Errorf("expected a malformed hash to be rejected, got %v", err)
+	}
+}
+
+func TestRehashOnLogin(t *testing.T) {
+	for _, driver := range []string{DriverJSON, DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database")
+
+			store, err := Open(driver, path, Options{Hasher: BcryptHasher{Cost: 4}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateUser("a@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			store, err = Open(driver, path, Options{Hasher: testArgon2idHasher})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			stored := func() string {
+				snapshot, err := store.Snapshot()
+				if err != nil {
+					t.Fatal(err)
+				}
+				return snapshot.UsersById[1].Password
+			}
+
+			_, err = store.GetUser("a@example.com", "wrong")
+			if !errors.Is(err, ErrWrongPassword) {
+				t.Fatalf("expected a wrong password, got %v", err)
+			}
+			if !strings.HasPrefix(stored(), "$2a$") {
+				t.Errorf("expected a failed login to keep the old hash, got %s", stored())
+			}
+
+			_, err = store.GetUser("a@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			rehashed := stored()
+			if !strings.HasPrefix(rehashed, "$argon2id$") {
+				t.Fatalf("expected the password hashed again with argon2id, got %s", rehashed)
+			}
+
+			_, err = store.GetUser("a@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stored() != rehashed {
+				t.Errorf("expected a current hash to be kept")
+			}
+		})
+	}
+}
+
+// blockingHasher holds each hash until it is released
+type blockingHasher struct {
+	PasswordHasher
+	hashing chan struct{}
+	release chan struct{}
+}
+
+func (h blockingHasher) Hash(password string) (string, error) {
+	h.hashing <- struct{}{}
+	<-h.release
+	return h.PasswordHasher.Hash(password)
+}
+
+func TestHashingOutsideLock(t *testing.T) {
+	now := time.Now()
+
+	for _, driver := range []string{DriverJSON, DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database")
+
+			store, err := Open(driver, path, Options{Hasher: testArgon2idHasher})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateUser("a@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.CreatePasswordReset("a@example.com", "reset", now, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+
+			hasher := blockingHasher{testArgon2idHasher, make(chan struct{}), make(chan struct{})}
+			store, err = Open(driver, path, Options{Hasher: hasher})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			changes := map[string]func() error{
+				"update": func() error {
+					_, err := store.UpdateUser(1, "", "new password")
+					return err
+				},
+				"reset": func() error {
+					return store.ResetPassword("reset", "new password", now)
+				},
+			}
+			for name, change := range changes {
+				done := make(chan error)
+				go func() { done <- change() }()
+
+				// other writes go on while the password is hashed
+				<-hasher.hashing
+				_, err = store.CreateChirp(1, "hashing")
+				if err != nil {
+					t.Errorf("%s: expected a chirp while hashing, got %v", name, err)
+				}
+				hasher.release <- struct{}{}
+
+				err = <-done
+				if err != nil {
+					t.Errorf("%s: %v", name, err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// ErrLocked is returned when another process already
+// owns the database file for writing
+var ErrLocked = errors.New("database file is locked by another writer")
+
+// fileLock is an advisory lock on a file that is released
+// by the kernel if the process holding it dies
+type fileLock struct {
+	f *os.File
+}
+
+func openLock(path string) (*fileLock, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileLock{f: f}, nil
+}
+
+func (l *fileLock) close() error {
+	return l.f.Close()
+}
+
+// ioLockPath is locked shared while reading the database file and
+// its log from disk and exclusive while writing either
+func ioLockPath(path string) string {
+	return path + ".lock"
+}
+
+// ownerLockPath is locked exclusive by the one process allowed
+// to write the database file for as long as it has it open
+func ownerLockPath(path string) string {
+	return path + ".owner"
+}
+
+// acquireOwner makes this process the only writer of the database file
+// at path. A lock file with an owner written in it that can still be
+// locked was left behind by a process that died without closing
+func acquireOwner(path string) (*fileLock, error) {
+	l, err := openLock(ownerLockPath(path))
+	if err != nil {
+		return nil, err
+	}
+
+	err = l.tryLockExclusive()
+	if err != nil {
+		owner, _ := os.ReadFile(ownerLockPath(path))
+		l.close()
+		if errors.Is(err, errWouldBlock) {
+			return nil, fmt.Errorf("%w: %s is owned by %s", ErrLocked, path, strings.TrimSpace(string(owner)))
+		}
+		return nil, err
+	}
+
+	previous, err := os.ReadFile(ownerLockPath(path))
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+	if len(previous) != 0 {
+		log.Printf("taking over stale lock on %s left by %s\n", path, strings.TrimSpace(string(previous)))
+	}
+
+	hostname, _ := os.Hostname()
+	owner := fmt.Sprintf("pid %d on %s since %s\n", os.Getpid(), hostname, time.Now().UTC().Format(time.RFC3339))
+
+	err = l.f.Truncate(0)
+	if err == nil {
+		_, err = l.f.WriteAt([]byte(owner), 0)
+	}
+	if err != nil {
+		l.release()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// release clears the owner written in the lock file and unlocks it,
+// the file itself stays so other processes never lock a removed file
+func (l *fileLock) release() error {
+	l.f.Truncate(0)
+	l.unlock()
+	return l.close()
+}
+
+// lockIO takes the io lock of the database exclusively and returns
+// the func that releases it. A DB opened without locks gets a no-op
+func (db *DB) lockIO() (func(), error) {
+	if db.ioLock == nil {
+		return func() {}, nil
+	}
+
+	err := db.ioLock.lockExclusive()
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { db.ioLock.unlock() }, nil
+}
+
+// openLocks makes db the owner of its file and opens its io lock
+func (db *DB) openLocks() error {
+	owner, err := acquireOwner(db.path)
+	if err != nil {
+		return err
+	}
+
+	ioLock, err := openLock(ioLockPath(db.path))
+	if err != nil {
+		owner.release()
+		return err
+	}
+
+	db.owner = owner
+	db.ioLock = ioLock
+	return nil
+}
+
+// closeLocks gives up ownership of the file
+func (db *DB) closeLocks() error {
+	if db.owner == nil {
+		return nil
+	}
+
+	db.ioLock.close()
+	return db.owner.release()
+}
+
+// withSharedLock runs fn holding the io lock of the database file at
+// path shared, so a writer can't change the file or its log meanwhile
+func withSharedLock(path string, fn func() error) error {
+	l, err := openLock(ioLockPath(path))
+	if err != nil {
+		return err
+	}
+	defer l.close()
+
+	err = l.lockShared()
+	if err != nil {
+		return err
+	}
+	defer l.unlock()
+
+	return fn()
+}
@@ -0,0 +1,25 @@
+//go:build !unix
+
+package database
+
+import "errors"
+
+// there is no flock outside unix, locking is a no-op so the
+// server still runs but nothing stops a second writer
+var errWouldBlock = errors.New("lock would block")
+
+func (l *fileLock) lockShared() error {
+	return nil
+}
+
+func (l *fileLock) lockExclusive() error {
+	return nil
+}
+
+func (l *fileLock) tryLockExclusive() error {
+	return nil
+}
+
+func (l *fileLock) unlock() error {
+	return nil
+}
@@ -0,0 +1,79 @@
+//go:build unix
+
+package database
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSecondWriterIsRejected(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDB(path)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("expected ErrLocked, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "pid") {
+		t.Errorf("expected the owner in the error, got %v", err)
+	}
+
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("expected the lock to be free after Close, got %v", err)
+	}
+	db.Close()
+}
+
+func TestStaleLockIsTakenOver(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db, err := NewDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(db)
+
+	owner, err := os.ReadFile(ownerLockPath(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owner) == 0 {
+		t.Fatal("expected the dead owner to be left in the lock file")
+	}
+
+	db, err = NewDB(path)
+	if err != nil {
+		t.Fatalf("expected the stale lock to be taken over, got %v", err)
+	}
+	db.Close()
+}
+
+func TestReadSnapshotNextToWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+
+	db, userId := newTestDB(t, path, Options{Policy: PersistLog})
+	defer db.Close()
+	seedChirps(t, db, userId, 3)
+
+	dbStructure, err := ReadSnapshot(DriverJSON, path, Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dbStructure.Chirps) != 3 {
+		t.Errorf("expected 3 chirps, got %d", len(dbStructure.Chirps))
+	}
+}
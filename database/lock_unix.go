@@ -0,0 +1,35 @@
+//go:build unix
+
+package database
+
+import (
+	"errors"
+	"syscall"
+)
+
+var errWouldBlock = syscall.EWOULDBLOCK
+
+func (l *fileLock) lockShared() error {
+	return flock(l, syscall.LOCK_SH)
+}
+
+func (l *fileLock) lockExclusive() error {
+	return flock(l, syscall.LOCK_EX)
+}
+
+func (l *fileLock) tryLockExclusive() error {
+	return flock(l, syscall.LOCK_EX|syscall.LOCK_NB)
+}
+
+func (l *fileLock) unlock() error {
+	return flock(l, syscall.LOCK_UN)
+}
+
+func flock(l *fileLock, how int) error {
+	for {
+		err := syscall.Flock(int(l.f.Fd()), how)
+		if !errors.Is(err, syscall.EINTR) {
+			return err
+		}
+	}
+}
@@ -0,0 +1,491 @@
+package database
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CurrentSchemaVersion is the schema_version this build reads and writes
+const CurrentSchemaVersion = 13
+
+// ErrNewerSchema is returned for files written by a newer build
+var ErrNewerSchema = errors.New("database file has a newer schema version")
+
+// MigrationStep describes a migration that ran or would run on a file
+type MigrationStep struct {
+	Version     int      `json:"version"`
+	Description string   `json:"description"`
+	Changes     []string `json:"changes"`
+}
+
+// migration upgrades the raw json document of a database file to version.
+// Migrations work on the raw document rather than DBStructure so they keep
+// working after the structs change
+type migration struct {
+	version     int
+	description string
+	migrate     func(doc map[string]any) ([]string, error)
+}
+
+// migrations run in order on files older than their version,
+// add new ones to the end and bump CurrentSchemaVersion
+var migrations = []migration{
+	{
+		version:     1,
+		description: "add id sequences so deleted ids are never reused",
+		migrate:     migrateAddSequences,
+	},
+	{
+		version:     2,
+		description: "key refresh tokens to user ids instead of access tokens",
+		migrate:     migrateTokensToUserIds,
+	},
+	{
+		version:     3,
+		description: "store refresh tokens hashed with an expiry",
+		migrate:     migrateHashRefreshTokens,
+	},
+	{
+		version:     4,
+		description: "start a session for every refresh token family",
+		migrate:     migrateAddSessions,
+	},
+	{
+		version:     5,
+		description: "add the denylist of revoked access tokens",
+		migrate:     migrateAddAccessTokenDenylist,
+	},
+	{
+		version:     6,
+		description: "add password reset tokens",
+		migrate:     migrateAddPasswordResets,
+	},
+	{
+		version:     7,
+		description: "normalize emails, keep them unique and add email verification",
+		migrate:     migrateNormalizeEmails,
+	},
+	{
+		version:     8,
+		description: "add totp authenticators and login challenges",
+		migrate:     migrateAddTOTP,
+	},
+	{
+		version:     9,
+		description: "give every user a role",
+		migrate:     migrateAddRoles,
+	},
+	{
+		version:     10,
+		description: "add api keys",
+		migrate:     migrateAddAPIKeys,
+	},
+	{
+		version:     11,
+		description: "add oauth clients and authorization codes",
+		migrate:     migrateAddOAuth,
+	},
+	{
+		version:     12,
+		description: "add pending account deletions",
+		migrate:     migrateAddAccountDeletions,
+	},
+	{
+		version:     13,
+		description: "add the audit log",
+		migrate:     migrateAddAuditLog,
+	},
+}
+
+// PlanMigrations reports the migrations the database file at path
+// still needs without changing it
+func PlanMigrations(path string, options Options) ([]MigrationStep, error) {
+	steps := []MigrationStep{}
+	err := withSharedLock(path, func() error {
+		var err error
+		_, steps, err = readDB(path, options.Keys)
+		return err
+	})
+
+	return steps, err
+}
+
+// migrateDB runs every migration newer than the schema version of data
+func migrateDB(data []byte) ([]byte, []MigrationStep, error) {
+	if len(data) == 0 {
+		return data, nil, nil
+	}
+
+	doc := map[string]any{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	err := decoder.Decode(&doc)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %v", ErrInvalidSchema, err)
+	}
+
+	version, err := docInt(doc["schema_version"])
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: schema_version: %v", ErrInvalidSchema, err)
+	}
+
+	if version > CurrentSchemaVersion {
+		return nil, nil, fmt.Errorf("%w: %d, this build reads up to %d", ErrNewerSchema, version, CurrentSchemaVersion)
+	}
+	if version == CurrentSchemaVersion {
+		return data, nil, nil
+	}
+
+	steps := []MigrationStep{}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+
+		changes, err := m.migrate(doc)
+		if err != nil {
+			return nil, nil, fmt.Errorf("migrating to schema version %d: %w", m.version, err)
+		}
+
+		doc["schema_version"] = m.version
+		steps = append(steps, MigrationStep{
+			Version:     m.version,
+			Description: m.description,
+			Changes:     changes,
+		})
+	}
+
+	data, err = json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return data, steps, nil
+}
+
+// migrateAddSequences sets the sequences to the highest id in use,
+// files from before version 1 either have none or have them at zero
+func migrateAddSequences(doc map[string]any) ([]string, error) {
+	sequences, _ := doc["sequences"].(map[string]any)
+	if sequences == nil {
+		sequences = map[string]any{}
+	}
+
+	chirpSeq, err := docInt(sequences["chirps"])
+	if err != nil {
+		return nil, err
+	}
+	userSeq, err := docInt(sequences["users"])
+	if err != nil {
+		return nil, err
+	}
+
+	chirps, _ := doc["chirps"].(map[string]any)
+	for key := range chirps {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("chirp id %q: %w", key, err)
+		}
+		chirpSeq = max(chirpSeq, id)
+	}
+
+	usersById, _ := doc["users_by_id"].(map[string]any)
+	for key := range usersById {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("user id %q: %w", key, err)
+		}
+		userSeq = max(userSeq, id)
+	}
+
+	users, _ := doc["users"].(map[string]any)
+	for _, user := range users {
+		fields, _ := user.(map[string]any)
+		id, err := docInt(fields["Id"])
+		if err != nil {
+			return nil, err
+		}
+		userSeq = max(userSeq, id)
+	}
+
+	doc["sequences"] = map[string]any{
+		"chirps": chirpSeq,
+		"users":  userSeq,
+	}
+
+	return []string{
+		fmt.Sprintf("set the chirp sequence to %d", chirpSeq),
+		fmt.Sprintf("set the user sequence to %d", userSeq),
+	}, nil
+}
+
+// migrateTokensToUserIds drops the refresh tokens, before version 2 they
+// pointed at the last access token and the user id can't be read from it
+// without the signing secret. Their users have to sign in again
+func migrateTokensToUserIds(doc map[string]any) ([]string, error) {
+	tokens, _ := doc["tokens"].(map[string]any)
+	doc["tokens"] = map[string]any{}
+
+	return []string{
+		fmt.Sprintf("dropped %d refresh tokens, their users sign in again", len(tokens)),
+	}, nil
+}
+
+// migrateHashRefreshTokens turns every refresh token into a hashed record
+// of its own family, they expire DefaultRefreshTokenTTL after the migration
+func migrateHashRefreshTokens(doc map[string]any) ([]string, error) {
+	tokens, _ := doc["tokens"].(map[string]any)
+	delete(doc, "tokens")
+
+	now := time.Now().UTC()
+	records := map[string]any{}
+	for token, userId := range tokens {
+		id, err := docInt(userId)
+		if err != nil {
+			return nil, fmt.Errorf("refresh token user: %w", err)
+		}
+
+		hash := hashToken(token)
+		records[hash] = map[string]any{
+			"hash":       hash,
+			"user_id":    id,
+			"family_id":  hash,
+			"created_at": now,
+			"expires_at": now.Add(DefaultRefreshTokenTTL),
+		}
+	}
+	doc["refresh_tokens"] = records
+
+	return []string{
+		fmt.Sprintf("hashed %d refresh tokens, they expire at %s", len(records), now.Add(DefaultRefreshTokenTTL).Format(time.RFC3339)),
+	}, nil
+}
+
+// migrateAddSessions starts a session for each family of refresh tokens,
+// it was created with the oldest token and last used with the newest.
+// The user agent and ip of those logins are unknown
+func migrateAddSessions(doc map[string]any) ([]string, error) {
+	records, _ := doc["refresh_tokens"].(map[string]any)
+
+	sessions := map[string]map[string]any{}
+	for hash, r := range records {
+		record, ok := r.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("refresh token %s is not an object", hash)
+		}
+
+		familyId, _ := record["family_id"].(string)
+		userId, err := docInt(record["user_id"])
+		if err != nil {
+			return nil, fmt.Errorf("refresh token %s user: %w", hash, err)
+		}
+		createdAt, err := docTime(record["created_at"])
+		if err != nil {
+			return nil, fmt.Errorf("refresh token %s created_at: %w", hash, err)
+		}
+		expiresAt, err := docTime(record["expires_at"])
+		if err != nil {
+			return nil, fmt.Errorf("refresh token %s expires_at: %w", hash, err)
+		}
+
+		session, ok := sessions[familyId]
+		if !ok {
+			sessions[familyId] = map[string]any{
+				"id":           familyId,
+				"user_id":      userId,
+				"created_at":   createdAt,
+				"last_used_at": createdAt,
+				"expires_at":   expiresAt,
+				"user_agent":   "",
+				"ip":           "",
+			}
+			continue
+		}
+
+		if createdAt.Before(session["created_at"].(time.Time)) {
+			session["created_at"] = createdAt
+		}
+		if createdAt.After(session["last_used_at"].(time.Time)) {
+			session["last_used_at"] = createdAt
+		}
+		if expiresAt.After(session["expires_at"].(time.Time)) {
+			session["expires_at"] = expiresAt
+		}
+	}
+
+	doc["sessions"] = sessions
+
+	return []string{
+		fmt.Sprintf("started %d sessions for %d refresh tokens", len(sessions), len(records)),
+	}, nil
+}
+
+// migrateAddAccessTokenDenylist starts an empty denylist, access tokens
+// issued before it carry no jti and are turned away
+func migrateAddAccessTokenDenylist(doc map[string]any) ([]string, error) {
+	doc["revoked_access_tokens"] = map[string]any{}
+
+	return []string{"added an empty access token denylist, older access tokens are no longer accepted"}, nil
+}
+
+// migrateAddPasswordResets starts with no outstanding reset tokens
+func migrateAddPasswordResets(doc map[string]any) ([]string, error) {
+	doc["password_resets"] = map[string]any{}
+
+	return []string{"added an empty set of password reset tokens"}, nil
+}
+
+// migrateNormalizeEmails trims and lowercases every email and rebuilds the
+// email index from users_by_id, dropping keys left behind by email changes.
+// When users share an address the newest keeps it, logins already went to
+// that one, and the others move to a placeholder. Users from before
+// verification count as verified
+func migrateNormalizeEmails(doc map[string]any) ([]string, error) {
+	usersById, _ := doc["users_by_id"].(map[string]any)
+	oldUsers, _ := doc["users"].(map[string]any)
+
+	ids := make([]int, 0, len(usersById))
+	records := map[int]map[string]any{}
+	for key, u := range usersById {
+		id, err := strconv.Atoi(key)
+		if err != nil {
+			return nil, fmt.Errorf("user id %q: %w", key, err)
+		}
+		record, ok := u.(map[string]any)
+		if !ok {
+			return nil, fmt.Errorf("user %s is not an object", key)
+		}
+		ids = append(ids, id)
+		records[id] = record
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	changes := []string{}
+	users := map[string]any{}
+	moved := 0
+	for _, id := range ids {
+		record := records[id]
+		email, _ := record["Email"].(string)
+		email = strings.ToLower(strings.TrimSpace(email))
+
+		record["EmailVerified"] = true
+		if _, ok := users[email]; ok {
+			changes = append(changes, fmt.Sprintf("moved user %d to %s, a newer user has %s", id, duplicateEmail(id), email))
+			email = duplicateEmail(id)
+			record["EmailVerified"] = false
+			moved++
+		}
+
+		record["Email"] = email
+		users[email] = record
+	}
+
+	stale := 0
+	for email := range oldUsers {
+		if _, ok := users[email]; !ok {
+			stale++
+		}
+	}
+
+	doc["users"] = users
+	doc["email_verifications"] = map[string]any{}
+
+	return append(changes,
+		fmt.Sprintf("indexed %d users by normalized email, marked %d verified", len(users), len(users)-moved),
+		fmt.Sprintf("dropped %d emails no user has anymore", stale),
+	), nil
+}
+
+// migrateAddTOTP starts with no authenticators enrolled
+func migrateAddTOTP(doc map[string]any) ([]string, error) {
+	doc["totp"] = map[string]any{}
+	doc["mfa_challenges"] = map[string]any{}
+
+	return []string{"added empty sets of totp authenticators and login challenges"}, nil
+}
+
+// migrateAddRoles makes the users that exist plain users, admins are
+// promoted afterwards
+func migrateAddRoles(doc map[string]any) ([]string, error) {
+	for _, key := range []string{"users", "users_by_id"} {
+		users, _ := doc[key].(map[string]any)
+		for _, u := range users {
+			record, ok := u.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("%s: user is not an object", key)
+			}
+			record["Role"] = string(RoleUser)
+		}
+	}
+
+	usersById, _ := doc["users_by_id"].(map[string]any)
+	return []string{fmt.Sprintf("gave %d users the %s role", len(usersById), RoleUser)}, nil
+}
+
+// migrateAddAPIKeys starts with no api keys
+func migrateAddAPIKeys(doc map[string]any) ([]string, error) {
+	doc["api_keys"] = map[string]any{}
+
+	return []string{"added an empty set of api keys"}, nil
+}
+
+// migrateAddOAuth starts with no oauth clients or authorization codes,
+// sessions without a client_id stay first party sessions
+func migrateAddOAuth(doc map[string]any) ([]string, error) {
+	doc["oauth_clients"] = map[string]any{}
+	doc["authorization_codes"] = map[string]any{}
+
+	return []string{"added empty sets of oauth clients and authorization codes"}, nil
+}
+
+// migrateAddAccountDeletions starts with no account waiting to be deleted
+func migrateAddAccountDeletions(doc map[string]any) ([]string, error) {
+	doc["account_deletions"] = map[string]any{}
+
+	return []string{"added an empty set of account deletions"}, nil
+}
+
+// migrateAddAuditLog starts with an empty audit log and its sequence
+func migrateAddAuditLog(doc map[string]any) ([]string, error) {
+	sequences, ok := doc["sequences"].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("sequences is not an object")
+	}
+	sequences["audit_events"] = 0
+	doc["audit_log"] = map[string]any{}
+
+	return []string{"added an empty audit log"}, nil
+}
+
+// docTime reads a time written by a migration or decoded as a string
+func docTime(v any) (time.Time, error) {
+	switch t := v.(type) {
+	case time.Time:
+		return t, nil
+	case string:
+		return time.Parse(time.RFC3339Nano, t)
+	default:
+		return time.Time{}, fmt.Errorf("expected a time, got %v", v)
+	}
+}
+
+// docInt reads a number decoded with UseNumber, a missing value is 0
+func docInt(v any) (int, error) {
+	switch n := v.(type) {
+	case nil:
+		return 0, nil
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err
+	case int:
+		return n, nil
+	default:
+		return 0, fmt.Errorf("expected a number, got %v", v)
+	}
+}
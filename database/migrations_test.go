@@ -0,0 +1,234 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// copyFixture copies a file from testdata into a temp dir
+func copyFixture(t *testing.T, name string) string {
+	t.Helper()
+
+	data, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "database.json")
+	err = os.WriteFile(path, data, 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+// openSQLiteAt creates a sqlite file at path with the schema
+// of user_version, the connection has no foreign keys
+func openSQLiteAt(t *testing.T, path string, version int) *sql.DB {
+	t.Helper()
+
+	conn, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, migrate := range sqliteMigrations[:version] {
+		tx, err := conn.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = migrate(tx)
+		if err != nil {
+			t.Fatalf("migration %d: %v", i+1, err)
+		}
+		err = tx.Commit()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = conn.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, version))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return conn
+}
+
+func TestMigrateFixtures(t *testing.T) {
+	cases := []struct {
+		fixture       string
+		steps         int
+		chirps        int
+		users         int
+		sequences     Sequences
+		tokens        int
+		sessions      int
+		revoked       int
+		resets        int
+		verifications int
+		totp          int
+		challenges    int
+		apiKeys       int
+		oauthClients  int
+		codes         int
+		deletions     int
+		audit         int
+	}{
+		{fixture: "v0.json", steps: 13, chirps: 2, users: 2, sequences: Sequences{Chirps: 3, Users: 2}},
+		{fixture: "v0-sequences.json", steps: 13, chirps: 1, users: 1, sequences: Sequences{Chirps: 5, Users: 1}},
+		{fixture: "v1.json", steps: 12, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}},
+		{fixture: "v2.json", steps: 11, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1},
+		{fixture: "v3.json", steps: 10, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1},
+		{fixture: "v4.json", steps: 9, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1},
+		{fixture: "v5.json", steps: 8, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1, revoked: 1},
+		{fixture: "v6.json", steps: 7, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1, revoked: 1, resets: 1},
+		{fixture: "v7.json", steps: 6, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1, revoked: 1, resets: 1, verifications: 1},
+		{fixture: "v8.json", steps: 5, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1, revoked: 1, resets: 1, verifications: 1, totp: 1, challenges: 1},
+		{fixture: "v9.json", steps: 4, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1, revoked: 1, resets: 1, verifications: 1, totp: 1, challenges: 1},
+		{fixture: "v10.json", steps: 3, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1, revoked: 1, resets: 1, verifications: 1, totp: 1, challenges: 1, apiKeys: 1},
+		{fixture: "v11.json", steps: 2, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1, revoked: 1, resets: 1, verifications: 1, totp: 1, challenges: 1, apiKeys: 1, oauthClients: 1, codes: 1},
+		{fixture: "v12.json", steps: 1, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1}, tokens: 1, sessions: 1, revoked: 1, resets: 1, verifications: 1, totp: 1, challenges: 1, apiKeys: 1, oauthClients: 1, codes: 1, deletions: 1},
+		{fixture: "v13.json", steps: 0, chirps: 1, users: 1, sequences: Sequences{Chirps: 2, Users: 1, AuditEvents: 1}, tokens: 1, sessions: 1, revoked: 1, resets: 1, verifications: 1, totp: 1, challenges: 1, apiKeys: 1, oauthClients: 1, codes: 1, deletions: 1, audit: 1},
+	}
+
+	for _, case_ := range cases {
+		t.Run(case_.fixture, func(t *testing.T) {
+			path := copyFixture(t, case_.fixture)
+			before, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			steps, err := PlanMigrations(path, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(steps) != case_.steps {
+				t.Errorf("expected %d planned steps, got %v", case_.steps, steps)
+			}
+
+			after, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(before) != string(after) {
+				t.Errorf("planning changed the file")
+			}
+
+			db, err := NewDB(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			dbStructure, err := db.loadDB()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if dbStructure.SchemaVersion != CurrentSchemaVersion {
+				t.Errorf("expected schema version %d, got %d", CurrentSchemaVersion, dbStructure.SchemaVersion)
+			}
+			if len(dbStructure.Chirps) != case_.chirps || len(dbStructure.UsersById) != case_.users {
+				t.Errorf("expected %d chirps and %d users, got %d and %d",
+					case_.chirps, case_.users, len(dbStructure.Chirps), len(dbStructure.UsersById))
+			}
+			if dbStructure.Sequences != case_.sequences {
+				t.Errorf("not matching %v vs %v", dbStructure.Sequences, case_.sequences)
+			}
+			if len(dbStructure.RefreshTokens) != case_.tokens {
+				t.Errorf("expected %d refresh tokens, got %d", case_.tokens, len(dbStructure.RefreshTokens))
+			}
+			if len(dbStructure.Sessions) != case_.sessions {
+				t.Errorf("expected %d sessions, got %d", case_.sessions, len(dbStructure.Sessions))
+			}
+			if len(dbStructure.RevokedAccessTokens) != case_.revoked {
+				t.Errorf("expected %d revoked access tokens, got %d", case_.revoked, len(dbStructure.RevokedAccessTokens))
+			}
+			if len(dbStructure.PasswordResets) != case_.resets {
+				t.Errorf("expected %d password resets, got %d", case_.resets, len(dbStructure.PasswordResets))
+			}
+			if len(dbStructure.EmailVerifications) != case_.verifications {
+				t.Errorf("expected %d email verifications, got %d", case_.verifications, len(dbStructure.EmailVerifications))
+			}
+			if len(dbStructure.TOTP) != case_.totp || len(dbStructure.MFAChallenges) != case_.challenges {
+				t.Errorf("expected %d totp and %d mfa challenges, got %d and %d",
+					case_.totp, case_.challenges, len(dbStructure.TOTP), len(dbStructure.MFAChallenges))
+			}
+			if len(dbStructure.APIKeys) != case_.apiKeys {
+				t.Errorf("expected %d api keys, got %d", case_.apiKeys, len(dbStructure.APIKeys))
+			}
+			if len(dbStructure.OAuthClients) != case_.oauthClients {
+				t.Errorf("expected %d oauth clients, got %d", case_.oauthClients, len(dbStructure.OAuthClients))
+			}
+			if len(dbStructure.AuthorizationCodes) != case_.codes {
+				t.Errorf("expected %d authorization codes, got %d", case_.codes, len(dbStructure.AuthorizationCodes))
+			}
+			if len(dbStructure.AccountDeletions) != case_.deletions {
+				t.Errorf("expected %d account deletions, got %d", case_.deletions, len(dbStructure.AccountDeletions))
+			}
+			if len(dbStructure.AuditLog) != case_.audit {
+				t.Errorf("expected %d audit events, got %d", case_.audit, len(dbStructure.AuditLog))
+			}
+
+			steps, err = PlanMigrations(path, Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(steps) != 0 {
+				t.Errorf("expected no steps left after opening, got %v", steps)
+			}
+		})
+	}
+}
+
+func TestMigrateRejectsNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(`{"schema_version":999}`), 0666)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = NewDB(path)
+	if !errors.Is(err, ErrNewerSchema) {
+		t.Errorf("expected ErrNewerSchema, got %v", err)
+	}
+}
+
+func TestMigrateSQLiteChirpAuthors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.sqlite")
+	conn := openSQLiteAt(t, path, 13)
+	_, err := conn.Exec(`
+INSERT INTO users (id, email, password) VALUES (1, 'a@example.com', '');
+INSERT INTO chirps (id, body, auther_id) VALUES (1, 'kept', 1), (2, 'anonymized', 0), (3, 'deleted', 1);
+DELETE FROM chirps WHERE id = 3;
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	db, err := NewSQLiteDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	chirps, err := db.GetChirps()
+	if err != nil || len(chirps) != 2 || chirps[1].AutherId != DeletedUserId {
+		t.Errorf("expected the chirps copied, got %+v %v", chirps, err)
+	}
+	chirp, err := db.CreateChirp(1, "new")
+	if err != nil || chirp.Id != 4 {
+		t.Errorf("expected the id sequence kept, got %d %v", chirp.Id, err)
+	}
+
+	var foreignKeys bool
+	err = db.conn.QueryRow(`PRAGMA foreign_keys`).Scan(&foreignKeys)
+	if err != nil || !foreignKeys {
+		t.Errorf("expected foreign keys enforced, got %v %v", foreignKeys, err)
+	}
+}
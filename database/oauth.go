@@ -0,0 +1,206 @@
+package database
+
+import (
+	"crypto/subtle"
+	"errors"
+	"slices"
+	"sort"
+	"time"
+)
+
+var (
+	// ErrOAuthClientNotFound is returned for clients that were never
+	// registered, were deleted or belong to another user
+	ErrOAuthClientNotFound = errors.New("oauth client not found")
+	// ErrAuthorizationCodeNotFound is returned for codes that were never
+	// issued or were already exchanged
+	ErrAuthorizationCodeNotFound = errors.New("authorization code not found")
+	// ErrAuthorizationCodeExpired is returned for codes past their expiry
+	ErrAuthorizationCodeExpired = errors.New("authorization code expired")
+)
+
+// OAuthClient is an app a user registered to act on behalf of other
+// users. Confidential clients have a secret, only its hash is kept
+type OAuthClient struct {
+	Id           string    `json:"id"`
+	SecretHash   string    `json:"secret_hash,omitempty"`
+	OwnerId      int       `json:"owner_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// Confidential reports whether the client has to authenticate with a secret
+func (c OAuthClient) Confidential() bool {
+	return c.SecretHash != ""
+}
+
+// CheckSecret reports whether secret is the secret of a confidential client
+func (c OAuthClient) CheckSecret(secret string) bool {
+	return c.Confidential() && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretHash)) == 1
+}
+
+// AuthorizationCode is a consent of a user waiting to be exchanged for
+// tokens by the client, only its hash is kept. CodeChallenge is the PKCE
+// challenge the verifier sent with the exchange has to match
+type AuthorizationCode struct {
+	Hash          string    `json:"hash"`
+	ClientId      string    `json:"client_id"`
+	UserId        int       `json:"user_id"`
+	RedirectURI   string    `json:"redirect_uri"`
+	Scopes        []string  `json:"scopes"`
+	CodeChallenge string    `json:"code_challenge"`
+	CreatedAt     time.Time `json:"created_at"`
+	ExpiresAt     time.Time `json:"expires_at"`
+}
+
+// sortOAuthClients orders clients oldest first
+func sortOAuthClients(clients []OAuthClient) {
+	sort.Slice(clients, func(i, j int) bool {
+		if !clients[i].CreatedAt.Equal(clients[j].CreatedAt) {
+			return clients[i].CreatedAt.Before(clients[j].CreatedAt)
+		}
+		return clients[i].Id < clients[j].Id
+	})
+}
+
+// CreateOAuthClient registers client, a non empty secret makes it
+// confidential. The caller sets the id, owner, name, redirect uris,
+// scopes and creation time
+func (db *DB) CreateOAuthClient(secret string, client OAuthClient) (OAuthClient, error) {
+	scopes, err := ValidateScopes(client.Scopes)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	client.Scopes = scopes
+	client.SecretHash = ""
+	if secret != "" {
+		client.SecretHash = hashToken(secret)
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.UsersById[client.OwnerId]; !ok {
+		return OAuthClient{}, ErrUserNotFound
+	}
+
+	err = db.commit(walEntry{Op: opOAuthClientCreated, OAuthClient: &client})
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+// GetOAuthClient returns the client with id
+func (db *DB) GetOAuthClient(id string) (OAuthClient, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	client, ok := db.data.OAuthClients[id]
+	if !ok {
+		return OAuthClient{}, ErrOAuthClientNotFound
+	}
+	client.RedirectURIs = slices.Clone(client.RedirectURIs)
+	client.Scopes = slices.Clone(client.Scopes)
+
+	return client, nil
+}
+
+// GetOAuthClients returns the clients the user registered oldest first
+func (db *DB) GetOAuthClients(ownerId int) ([]OAuthClient, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	clients := []OAuthClient{}
+	for _, client := range db.data.OAuthClients {
+		if client.OwnerId == ownerId {
+			client.RedirectURIs = slices.Clone(client.RedirectURIs)
+			client.Scopes = slices.Clone(client.Scopes)
+			clients = append(clients, client)
+		}
+	}
+	sortOAuthClients(clients)
+
+	return clients, nil
+}
+
+// DeleteOAuthClient deletes a client of the user along with its codes
+// and the sessions it started
+func (db *DB) DeleteOAuthClient(ownerId int, id string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	client, ok := db.data.OAuthClients[id]
+	if !ok || client.OwnerId != ownerId {
+		return ErrOAuthClientNotFound
+	}
+
+	entries := []walEntry{}
+	for sessionId, session := range db.data.Sessions {
+		if session.ClientId == id {
+			entries = append(entries, db.revokeSessionEntries(sessionId)...)
+		}
+	}
+	for hash, code := range db.data.AuthorizationCodes {
+		if code.ClientId == id {
+			entries = append(entries, walEntry{Op: opAuthorizationCodeUsed, Hash: hash})
+		}
+	}
+	entries = append(entries, walEntry{Op: opOAuthClientDeleted, ClientId: id})
+
+	return db.commit(entries...)
+}
+
+// CreateAuthorizationCode stores grant under the hash of code, the
+// caller sets everything but the hash
+func (db *DB) CreateAuthorizationCode(code string, grant AuthorizationCode) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.OAuthClients[grant.ClientId]; !ok {
+		return ErrOAuthClientNotFound
+	}
+	if _, ok := db.data.UsersById[grant.UserId]; !ok {
+		return ErrUserNotFound
+	}
+
+	entries := []walEntry{}
+	for hash, expired := range db.data.AuthorizationCodes {
+		if !grant.CreatedAt.Before(expired.ExpiresAt) {
+			entries = append(entries, walEntry{Op: opAuthorizationCodeUsed, Hash: hash})
+		}
+	}
+
+	grant.Hash = hashToken(code)
+	grant.Scopes = slices.Clone(grant.Scopes)
+	entries = append(entries, walEntry{Op: opAuthorizationCodeIssued, AuthorizationCode: &grant})
+
+	return db.commit(entries...)
+}
+
+// UseAuthorizationCode returns the grant of code and deletes it, a code
+// can only be exchanged once whether the exchange succeeds or not
+func (db *DB) UseAuthorizationCode(code string, now time.Time) (AuthorizationCode, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	hash := hashToken(code)
+	grant, ok := db.data.AuthorizationCodes[hash]
+	if !ok {
+		return AuthorizationCode{}, ErrAuthorizationCodeNotFound
+	}
+
+	err := db.commit(walEntry{Op: opAuthorizationCodeUsed, Hash: hash})
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+
+	if !now.Before(grant.ExpiresAt) {
+		return AuthorizationCode{}, ErrAuthorizationCodeExpired
+	}
+
+	return grant, nil
+}
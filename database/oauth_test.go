@@ -0,0 +1,184 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestOAuthClients(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			_, err := store.CreateOAuthClient("", OAuthClient{Id: "c0", OwnerId: 1, Scopes: []string{"everything"}, CreatedAt: now})
+			if !errors.Is(err, ErrInvalidScope) {
+				t.Errorf("expected an unknown scope to be rejected, got %v", err)
+			}
+			_, err = store.CreateOAuthClient("", OAuthClient{Id: "c0", OwnerId: 99, Scopes: []string{ScopeChirpsRead}, CreatedAt: now})
+			if !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected a missing owner to be rejected, got %v", err)
+			}
+
+			client, err := store.CreateOAuthClient("secret", OAuthClient{
+				Id:           "c1",
+				OwnerId:      1,
+				Name:         "scheduler",
+				RedirectURIs: []string{"https://a.example.com/callback", "http://127.0.0.1:8080/callback"},
+				Scopes:       []string{ScopeChirpsWrite, ScopeChirpsRead},
+				CreatedAt:    now,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !client.Confidential() || !client.CheckSecret("secret") || client.CheckSecret("guess") {
+				t.Errorf("expected a confidential client checking its secret, got %+v", client)
+			}
+			public, err := store.CreateOAuthClient("", OAuthClient{Id: "c2", OwnerId: 1, Name: "app", RedirectURIs: []string{"http://localhost/cb"}, Scopes: []string{ScopeAccount}, CreatedAt: now.Add(time.Second)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if public.Confidential() || public.CheckSecret("") {
+				t.Errorf("expected a public client without a secret, got %+v", public)
+			}
+
+			got, err := store.GetOAuthClient("c1")
+			if err != nil || got.Name != "scheduler" || !slices.Equal(got.RedirectURIs, client.RedirectURIs) || !slices.Equal(got.Scopes, []string{ScopeChirpsRead, ScopeChirpsWrite}) {
+				t.Fatalf("expected client c1, got %+v %v", got, err)
+			}
+			clients, err := store.GetOAuthClients(1)
+			if err != nil || len(clients) != 2 || clients[0].Id != "c1" || clients[1].Id != "c2" {
+				t.Fatalf("expected both clients oldest first, got %+v %v", clients, err)
+			}
+
+			grant := AuthorizationCode{ClientId: "c1", UserId: 1, RedirectURI: "https://a.example.com/callback", Scopes: []string{ScopeChirpsRead}, CodeChallenge: "challenge", CreatedAt: now, ExpiresAt: now.Add(time.Minute)}
+			err = store.CreateAuthorizationCode("code", grant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.CreateAuthorizationCode("late", grant)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			used, err := store.UseAuthorizationCode("code", now.Add(time.Second))
+			if err != nil || used.ClientId != "c1" || used.UserId != 1 || used.CodeChallenge != "challenge" || !slices.Equal(used.Scopes, grant.Scopes) {
+				t.Fatalf("expected the grant of code, got %+v %v", used, err)
+			}
+			_, err = store.UseAuthorizationCode("code", now.Add(time.Second))
+			if !errors.Is(err, ErrAuthorizationCodeNotFound) {
+				t.Errorf("expected a code to be used once, got %v", err)
+			}
+			_, err = store.UseAuthorizationCode("late", now.Add(time.Minute))
+			if !errors.Is(err, ErrAuthorizationCodeExpired) {
+				t.Errorf("expected an expired code, got %v", err)
+			}
+			_, err = store.UseAuthorizationCode("late", now)
+			if !errors.Is(err, ErrAuthorizationCodeNotFound) {
+				t.Errorf("expected an expired code to be gone, got %v", err)
+			}
+
+			_, err = store.CreateSession("refresh", Session{UserId: 1, ClientId: "c1", Scopes: []string{ScopeChirpsRead}}, AccessToken{Id: "jti", ExpiresAt: now.Add(time.Hour)}, now, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			session, err := store.GetRefreshSession("refresh", now)
+			if err != nil || session.ClientId != "c1" || !slices.Equal(session.Scopes, []string{ScopeChirpsRead}) {
+				t.Fatalf("expected the client session, got %+v %v", session, err)
+			}
+			_, err = store.GetRefreshSession("refresh", now.Add(time.Hour))
+			if !errors.Is(err, ErrTokenExpired) {
+				t.Errorf("expected an expired token, got %v", err)
+			}
+
+			snapshot, err := store.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshot.OAuthClients) != 2 || snapshot.Sessions[session.Id].ClientId != "c1" {
+				t.Errorf("expected the clients and client session in the snapshot, got %+v", snapshot)
+			}
+			err = store.Restore(snapshot)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// a code never exchanged goes with the client
+			err = store.CreateAuthorizationCode("pending", grant)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.DeleteOAuthClient(2, "c1")
+			if !errors.Is(err, ErrOAuthClientNotFound) {
+				t.Errorf("expected the client of another user to be not found, got %v", err)
+			}
+			err = store.DeleteOAuthClient(1, "c1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.GetOAuthClient("c1")
+			if !errors.Is(err, ErrOAuthClientNotFound) {
+				t.Errorf("expected the client deleted, got %v", err)
+			}
+			_, err = store.UseAuthorizationCode("pending", now)
+			if !errors.Is(err, ErrAuthorizationCodeNotFound) {
+				t.Errorf("expected the codes of the client deleted, got %v", err)
+			}
+			_, err = store.GetRefreshSession("refresh", now)
+			if !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("expected the sessions of the client revoked, got %v", err)
+			}
+			revoked, err := store.IsAccessTokenRevoked("jti")
+			if err != nil || !revoked {
+				t.Errorf("expected the access token of the client denied, got %v %v", revoked, err)
+			}
+		})
+	}
+}
+
+func TestOAuthSurvivesLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	db, userId := newTestDB(t, path, options)
+	_, err := db.CreateOAuthClient("", OAuthClient{Id: "c1", OwnerId: userId, Name: "app", RedirectURIs: []string{"http://localhost/cb"}, Scopes: []string{ScopeChirpsRead}, CreatedAt: now})
+	if err != nil {
+		t.Fatal(err)
+	}
+	grant := AuthorizationCode{ClientId: "c1", UserId: userId, RedirectURI: "http://localhost/cb", Scopes: []string{ScopeChirpsRead}, CreatedAt: now, ExpiresAt: now.Add(time.Minute)}
+	err = db.CreateAuthorizationCode("used", grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.CreateAuthorizationCode("pending", grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.UseAuthorizationCode("used", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.GetOAuthClient("c1")
+	if err != nil {
+		t.Errorf("expected the client replayed, got %v", err)
+	}
+	_, err = db.UseAuthorizationCode("used", now)
+	if !errors.Is(err, ErrAuthorizationCodeNotFound) {
+		t.Errorf("expected the used code to stay used, got %v", err)
+	}
+	_, err = db.UseAuthorizationCode("pending", now)
+	if err != nil {
+		t.Errorf("expected the pending code replayed, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package database
+
+import (
+	"errors"
+	"time"
+)
+
+// DefaultPasswordResetTTL is how long a password reset token is valid
+const DefaultPasswordResetTTL = time.Hour
+
+var (
+	// ErrResetTokenNotFound is returned for reset tokens that were never
+	// issued, were already used or were replaced by a newer one
+	ErrResetTokenNotFound = errors.New("password reset token not found")
+	// ErrResetTokenExpired is returned for reset tokens past their expiry
+	ErrResetTokenExpired = errors.New("password reset token expired")
+)
+
+// PasswordReset is the stored record of a password reset token,
+// only the hash of the token is kept like for refresh tokens
+type PasswordReset struct {
+	Hash      string    `json:"hash"`
+	UserId    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// CreatePasswordReset stores a reset token for the user with email, it
+// replaces any token the user was sent before
+func (db *DB) CreatePasswordReset(email string, token string, now time.Time, ttl time.Duration) error {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return ErrUserNotFound
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	user, ok := db.data.Users[email]
+	if !ok {
+		return ErrUserNotFound
+	}
+
+	entries := []walEntry{}
+	for hash, reset := range db.data.PasswordResets {
+		if reset.UserId == user.Id || !now.Before(reset.ExpiresAt) {
+			entries = append(entries, walEntry{Op: opPasswordResetUsed, Hash: hash})
+		}
+	}
+
+	reset := PasswordReset{
+		Hash:      hashToken(token),
+		UserId:    user.Id,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	entries = append(entries, walEntry{Op: opPasswordResetIssued, PasswordReset: &reset})
+
+	return db.commit(entries...)
+}
+
+// ResetPassword sets the password of the user token was issued to and
+// uses the token up. Every session of the user ends with it
+func (db *DB) ResetPassword(token string, password string, now time.Time) error {
+	hashedPassword, err := db.options.Hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	hash := hashToken(token)
+	reset, ok := db.data.PasswordResets[hash]
+	if !ok {
+		return ErrResetTokenNotFound
+	}
+
+	if !now.Before(reset.ExpiresAt) {
+		err := db.commit(walEntry{Op: opPasswordResetUsed, Hash: hash})
+		if err != nil {
+			return err
+		}
+		return ErrResetTokenExpired
+	}
+
+	user, ok := db.data.UsersById[reset.UserId]
+	if !ok {
+		return ErrUserNotFound
+	}
+	user.Password = hashedPassword
+
+	entries := []walEntry{
+		{Op: opPasswordResetUsed, Hash: hash},
+		{Op: opUserUpdated, User: &user},
+	}
+	for id, session := range db.data.Sessions {
+		if session.UserId == user.Id {
+			entries = append(entries, db.revokeSessionEntries(id)...)
+		}
+	}
+
+	return db.commit(entries...)
+}
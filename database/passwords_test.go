@@ -0,0 +1,78 @@
+package database
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPasswordReset(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := time.Hour
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			err := store.CreatePasswordReset("nobody@example.com", "reset", now, ttl)
+			if !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected ErrUserNotFound, got %v", err)
+			}
+
+			_, err = store.CreateSession("refresh", Session{UserId: 1}, AccessToken{Id: "a1", ExpiresAt: now.Add(ttl)}, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = store.CreatePasswordReset("a@example.com", "replaced", now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.CreatePasswordReset("a@example.com", "reset", now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = store.ResetPassword("replaced", "new password", now)
+			if !errors.Is(err, ErrResetTokenNotFound) {
+				t.Errorf("expected a newer token to replace the older one, got %v", err)
+			}
+
+			err = store.ResetPassword("reset", "new password", now.Add(time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = store.ResetPassword("reset", "another password", now.Add(time.Minute))
+			if !errors.Is(err, ErrResetTokenNotFound) {
+				t.Errorf("expected the token to be single use, got %v", err)
+			}
+
+			_, err = store.GetUser("a@example.com", "password")
+			if err == nil {
+				t.Errorf("expected the old password to stop working")
+			}
+			_, err = store.GetUser("a@example.com", "new password")
+			if err != nil {
+				t.Errorf("expected the new password to work, got %v", err)
+			}
+
+			// the reset logs the user out everywhere
+			_, err = store.RotateRefreshToken("refresh", "next", AccessToken{}, now.Add(time.Minute), ttl)
+			if !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("expected the sessions to be revoked, got %v", err)
+			}
+			revoked, err := store.IsAccessTokenRevoked("a1")
+			if err != nil || !revoked {
+				t.Errorf("expected the access token to be denied, got %v %v", revoked, err)
+			}
+
+			err = store.CreatePasswordReset("a@example.com", "expiring", now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.ResetPassword("expiring", "new password", now.Add(ttl))
+			if !errors.Is(err, ErrResetTokenExpired) {
+				t.Errorf("expected ErrResetTokenExpired, got %v", err)
+			}
+		})
+	}
+}
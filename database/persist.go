@@ -0,0 +1,690 @@
+package database
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"time"
+)
+
+// PersistPolicy decides when mutations held in memory reach the disk
+type PersistPolicy string
+
+const (
+	// PersistSync rewrites the database file on every mutation
+	PersistSync PersistPolicy = "sync"
+	// PersistBatched rewrites the database file every FlushInterval
+	// if anything changed since the last flush
+	PersistBatched PersistPolicy = "batched"
+	// PersistLog appends every mutation to a write ahead log next to the
+	// database file, the log is compacted into a new snapshot of the file
+	// in the background once it grows past CompactThreshold
+	PersistLog PersistPolicy = "log"
+)
+
+const (
+	defaultFlushInterval    = 100 * time.Millisecond
+	defaultCompactThreshold = 1 << 20
+)
+
+type Options struct {
+	Policy        PersistPolicy
+	FlushInterval time.Duration
+	// CompactThreshold is the size in bytes of the log that
+	// triggers a compaction
+	CompactThreshold int64
+	// Keys encrypts the database file and its log at rest when set
+	Keys *Keyring
+	// Hasher hashes new passwords, DefaultPasswordHasher when nil
+	Hasher PasswordHasher
+}
+
+func (o Options) withDefaults() (Options, error) {
+	switch o.Policy {
+	case "":
+		o.Policy = PersistSync
+	case PersistSync, PersistBatched, PersistLog:
+	default:
+		return o, fmt.Errorf("unknown persist policy %q", o.Policy)
+	}
+
+	if o.FlushInterval <= 0 {
+		o.FlushInterval = defaultFlushInterval
+	}
+
+	if o.CompactThreshold <= 0 {
+		o.CompactThreshold = defaultCompactThreshold
+	}
+
+	if o.Hasher == nil {
+		o.Hasher = DefaultPasswordHasher
+	}
+
+	return o, nil
+}
+
+// ErrWALGap is returned when the log is missing entries
+// between a snapshot and the entries that follow it
+var ErrWALGap = errors.New("write ahead log does not continue the snapshot")
+
+const (
+	opChirpCreated = "chirp_created"
+	opChirpDeleted = "chirp_deleted"
+	opChirpUpdated = "chirp_updated"
+	opUserCreated  = "user_created"
+	opUserUpdated  = "user_updated"
+	opUserUpgraded = "user_upgraded"
+	opUserDeleted  = "user_deleted"
+	opTokenIssued  = "token_issued"
+	opTokenRotated = "token_rotated"
+	opTokenRevoked = "token_revoked"
+
+	opSessionCreated = "session_created"
+	opSessionRevoked = "session_revoked"
+
+	opAccessTokenRevoked = "access_token_revoked"
+	opAccessTokenExpired = "access_token_expired"
+
+	opPasswordResetIssued = "password_reset_issued"
+	opPasswordResetUsed   = "password_reset_used"
+
+	opEmailVerificationIssued = "email_verification_issued"
+	opEmailVerificationUsed   = "email_verification_used"
+
+	opTOTPEnrolled = "totp_enrolled"
+	opTOTPUpdated  = "totp_updated"
+	opTOTPDisabled = "totp_disabled"
+
+	opMFAChallengeIssued = "mfa_challenge_issued"
+	opMFAChallengeFailed = "mfa_challenge_failed"
+	opMFAChallengeUsed   = "mfa_challenge_used"
+
+	opAPIKeyCreated = "api_key_created"
+	opAPIKeyUsed    = "api_key_used"
+	opAPIKeyRevoked = "api_key_revoked"
+
+	opOAuthClientCreated = "oauth_client_created"
+	opOAuthClientDeleted = "oauth_client_deleted"
+
+	opAuthorizationCodeIssued = "authorization_code_issued"
+	opAuthorizationCodeUsed   = "authorization_code_used"
+
+	opAccountDeletionScheduled = "account_deletion_scheduled"
+	opAccountDeletionCancelled = "account_deletion_cancelled"
+
+	opAuditEventRecorded = "audit_event_recorded"
+)
+
+// walEntry is one mutation of the database,
+// only the fields its Op needs are set
+type walEntry struct {
+	Seq   int64         `json:"seq"`
+	Time  time.Time     `json:"time"`
+	Op    string        `json:"op"`
+	Id    int           `json:"id,omitempty"`
+	Chirp *Chirp        `json:"chirp,omitempty"`
+	User  *User         `json:"user,omitempty"`
+	Token *RefreshToken `json:"token,omitempty"`
+	Hash  string        `json:"hash,omitempty"`
+
+	Session   *Session `json:"session,omitempty"`
+	SessionId string   `json:"session_id,omitempty"`
+
+	AccessToken *AccessToken `json:"access_token,omitempty"`
+
+	PasswordReset *PasswordReset `json:"password_reset,omitempty"`
+
+	EmailVerification *EmailVerification `json:"email_verification,omitempty"`
+
+	TOTP         *TOTP         `json:"totp,omitempty"`
+	MFAChallenge *MFAChallenge `json:"mfa_challenge,omitempty"`
+
+	APIKey *APIKey `json:"api_key,omitempty"`
+
+	OAuthClient       *OAuthClient       `json:"oauth_client,omitempty"`
+	ClientId          string             `json:"client_id,omitempty"`
+	AuthorizationCode *AuthorizationCode `json:"authorization_code,omitempty"`
+
+	AccountDeletion *AccountDeletion `json:"account_deletion,omitempty"`
+
+	AuditEvent *AuditEvent `json:"audit_event,omitempty"`
+	// RefreshToken is the plain token of logs from before schema version 3
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+// checkEntry returns the error applying entry to dbStructure fails with,
+// so an entry that can't be applied is refused before it is logged
+func checkEntry(dbStructure *DBStructure, entry walEntry) error {
+	record := true
+	switch entry.Op {
+	case opChirpCreated, opChirpUpdated:
+		record = entry.Chirp != nil
+	case opUserCreated, opUserUpdated:
+		record = entry.User != nil
+	case opUserUpgraded:
+		if _, ok := dbStructure.UsersById[entry.Id]; !ok {
+			return fmt.Errorf("upgrading unknown user %d", entry.Id)
+		}
+	case opTokenRotated:
+		record = entry.Token != nil
+	case opSessionCreated:
+		record = entry.Session != nil
+	case opAccessTokenRevoked, opAccessTokenExpired:
+		record = entry.AccessToken != nil
+	case opPasswordResetIssued:
+		record = entry.PasswordReset != nil
+	case opEmailVerificationIssued:
+		record = entry.EmailVerification != nil
+	case opTOTPEnrolled, opTOTPUpdated:
+		record = entry.TOTP != nil
+	case opMFAChallengeIssued, opMFAChallengeFailed:
+		record = entry.MFAChallenge != nil
+	case opAPIKeyCreated, opAPIKeyUsed:
+		record = entry.APIKey != nil
+	case opOAuthClientCreated:
+		record = entry.OAuthClient != nil
+	case opAuthorizationCodeIssued:
+		record = entry.AuthorizationCode != nil
+	case opAccountDeletionScheduled:
+		record = entry.AccountDeletion != nil
+	case opAuditEventRecorded:
+		record = entry.AuditEvent != nil
+	// a token issued without a record is a legacy entry
+	case opChirpDeleted, opUserDeleted, opTokenIssued, opTokenRevoked, opSessionRevoked,
+		opPasswordResetUsed, opEmailVerificationUsed, opTOTPDisabled, opMFAChallengeUsed,
+		opAPIKeyRevoked, opOAuthClientDeleted, opAuthorizationCodeUsed, opAccountDeletionCancelled:
+	default:
+		return fmt.Errorf("unknown wal op %q", entry.Op)
+	}
+
+	if !record {
+		return fmt.Errorf("%w: wal op %q is missing its record", ErrCorruptDB, entry.Op)
+	}
+
+	return nil
+}
+
+// applyEntry applies a mutation to dbStructure, every entry sets
+// absolute values so applying one twice is harmless
+func applyEntry(dbStructure *DBStructure, entry walEntry) error {
+	err := checkEntry(dbStructure, entry)
+	if err != nil {
+		return err
+	}
+
+	if entry.Seq > dbStructure.WalSeq {
+		dbStructure.WalSeq = entry.Seq
+	}
+
+	switch entry.Op {
+	case opChirpCreated, opChirpUpdated:
+		dbStructure.Chirps[entry.Chirp.Id] = *entry.Chirp
+		dbStructure.Sequences.Chirps = max(dbStructure.Sequences.Chirps, entry.Chirp.Id)
+	case opChirpDeleted:
+		delete(dbStructure.Chirps, entry.Id)
+	case opUserCreated, opUserUpdated:
+		// a changed email moves the user to its new key
+		old, ok := dbStructure.UsersById[entry.User.Id]
+		if ok && old.Email != entry.User.Email && dbStructure.Users[old.Email].Id == old.Id {
+			delete(dbStructure.Users, old.Email)
+		}
+		dbStructure.Users[entry.User.Email] = *entry.User
+		dbStructure.UsersById[entry.User.Id] = *entry.User
+		dbStructure.Sequences.Users = max(dbStructure.Sequences.Users, entry.User.Id)
+	case opUserDeleted:
+		user, ok := dbStructure.UsersById[entry.Id]
+		if ok && dbStructure.Users[user.Email].Id == user.Id {
+			delete(dbStructure.Users, user.Email)
+		}
+		delete(dbStructure.UsersById, entry.Id)
+		delete(dbStructure.AccountDeletions, entry.Id)
+	case opUserUpgraded:
+		user := dbStructure.UsersById[entry.Id]
+		user.IsChirpyRed = true
+		dbStructure.Users[user.Email] = user
+		dbStructure.UsersById[user.Id] = user
+	case opTokenIssued:
+		if entry.Token == nil {
+			return applyLegacyToken(dbStructure, entry)
+		}
+		dbStructure.RefreshTokens[entry.Token.Hash] = *entry.Token
+		touchSession(dbStructure, *entry.Token)
+	case opTokenRotated:
+		dbStructure.RefreshTokens[entry.Token.Hash] = *entry.Token
+	case opTokenRevoked:
+		if entry.Hash == "" {
+			entry.Hash = hashToken(entry.RefreshToken)
+		}
+		delete(dbStructure.RefreshTokens, entry.Hash)
+	case opSessionCreated:
+		dbStructure.Sessions[entry.Session.Id] = *entry.Session
+	case opAccessTokenRevoked:
+		dbStructure.RevokedAccessTokens[entry.AccessToken.Id] = entry.AccessToken.ExpiresAt
+	case opAccessTokenExpired:
+		delete(dbStructure.RevokedAccessTokens, entry.AccessToken.Id)
+	case opPasswordResetIssued:
+		dbStructure.PasswordResets[entry.PasswordReset.Hash] = *entry.PasswordReset
+	case opPasswordResetUsed:
+		delete(dbStructure.PasswordResets, entry.Hash)
+	case opEmailVerificationIssued:
+		dbStructure.EmailVerifications[entry.EmailVerification.Hash] = *entry.EmailVerification
+	case opEmailVerificationUsed:
+		delete(dbStructure.EmailVerifications, entry.Hash)
+	case opTOTPEnrolled, opTOTPUpdated:
+		dbStructure.TOTP[entry.TOTP.UserId] = *entry.TOTP
+	case opTOTPDisabled:
+		delete(dbStructure.TOTP, entry.Id)
+	case opMFAChallengeIssued, opMFAChallengeFailed:
+		dbStructure.MFAChallenges[entry.MFAChallenge.Hash] = *entry.MFAChallenge
+	case opMFAChallengeUsed:
+		delete(dbStructure.MFAChallenges, entry.Hash)
+	case opAPIKeyCreated, opAPIKeyUsed:
+		dbStructure.APIKeys[entry.APIKey.Hash] = *entry.APIKey
+	case opAPIKeyRevoked:
+		delete(dbStructure.APIKeys, entry.Hash)
+	case opOAuthClientCreated:
+		dbStructure.OAuthClients[entry.OAuthClient.Id] = *entry.OAuthClient
+	case opOAuthClientDeleted:
+		delete(dbStructure.OAuthClients, entry.ClientId)
+	case opAuthorizationCodeIssued:
+		dbStructure.AuthorizationCodes[entry.AuthorizationCode.Hash] = *entry.AuthorizationCode
+	case opAuthorizationCodeUsed:
+		delete(dbStructure.AuthorizationCodes, entry.Hash)
+	case opAccountDeletionScheduled:
+		dbStructure.AccountDeletions[entry.AccountDeletion.UserId] = *entry.AccountDeletion
+	case opAccountDeletionCancelled:
+		delete(dbStructure.AccountDeletions, entry.Id)
+	case opAuditEventRecorded:
+		dbStructure.AuditLog[entry.AuditEvent.Id] = *entry.AuditEvent
+		dbStructure.Sequences.AuditEvents = max(dbStructure.Sequences.AuditEvents, entry.AuditEvent.Id)
+	case opSessionRevoked:
+		delete(dbStructure.Sessions, entry.SessionId)
+		for hash, record := range dbStructure.RefreshTokens {
+			if record.FamilyId == entry.SessionId {
+				delete(dbStructure.RefreshTokens, hash)
+			}
+		}
+	}
+
+	return nil
+}
+
+// applyLegacyToken applies a token issued by an older build the way the
+// migrations convert the tokens of the file. Before schema version 2 the
+// access token was stored instead of the user id and those are dropped,
+// before version 3 the plain token was stored with no expiry
+func applyLegacyToken(dbStructure *DBStructure, entry walEntry) error {
+	if entry.Id == 0 {
+		return nil
+	}
+
+	hash := hashToken(entry.RefreshToken)
+	record := RefreshToken{
+		Hash:      hash,
+		UserId:    entry.Id,
+		FamilyId:  hash,
+		CreatedAt: entry.Time,
+		ExpiresAt: entry.Time.Add(DefaultRefreshTokenTTL),
+	}
+	dbStructure.RefreshTokens[hash] = record
+	touchSession(dbStructure, record)
+
+	return nil
+}
+
+// commit applies the entries to the data in memory and persists
+// them according to the policy, callers must hold the write lock
+func (db *DB) commit(entries ...walEntry) error {
+	// only an upgrade depends on the data, and no commit
+	// upgrades a user it creates
+	for _, entry := range entries {
+		err := checkEntry(&db.data, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	if db.options.Policy == PersistLog {
+		now := time.Now().UTC()
+		for i := range entries {
+			entries[i].Seq = db.data.WalSeq + int64(i) + 1
+			entries[i].Time = now
+		}
+
+		err := db.appendWAL(entries)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range entries {
+		err := applyEntry(&db.data, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch db.options.Policy {
+	case PersistSync:
+		err := db.writeDB(db.data)
+		if err != nil {
+			// the file still holds the last good state
+			dbStructure, loadErr := db.loadDB()
+			if loadErr == nil {
+				db.data = dbStructure
+			}
+			return err
+		}
+	case PersistBatched:
+		db.dirty = true
+	case PersistLog:
+		db.maybeCompact()
+	}
+
+	return nil
+}
+
+// startPersistence replays the log or starts the flusher
+// depending on the policy
+func (db *DB) startPersistence() error {
+	switch db.options.Policy {
+	case PersistBatched:
+		db.wg.Add(1)
+		go db.flushLoop()
+	case PersistLog:
+		err := db.replayWAL()
+		if err != nil {
+			return err
+		}
+
+		db.wal, err = os.OpenFile(walPath(db.path), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+		if err != nil {
+			return err
+		}
+
+		info, err := db.wal.Stat()
+		if err != nil {
+			return err
+		}
+		db.walSize = info.Size()
+	}
+
+	return nil
+}
+
+func (db *DB) flushLoop() {
+	defer db.wg.Done()
+
+	ticker := time.NewTicker(db.options.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := db.flush()
+			if err != nil {
+				log.Printf("flushing database %s: %v\n", db.path, err)
+			}
+		case <-db.done:
+			return
+		}
+	}
+}
+
+// flush writes the database file if anything changed since the last flush
+func (db *DB) flush() error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if !db.dirty {
+		return nil
+	}
+
+	err := db.writeDB(db.data)
+	if err != nil {
+		return err
+	}
+
+	db.dirty = false
+	return nil
+}
+
+// Close persists anything still held only in memory
+// and gives up ownership of the file
+func (db *DB) Close() error {
+	close(db.done)
+	db.wg.Wait()
+
+	err := db.closePersistence()
+	if err != nil {
+		return err
+	}
+
+	return db.closeLocks()
+}
+
+func (db *DB) closePersistence() error {
+	switch db.options.Policy {
+	case PersistBatched:
+		return db.flush()
+	case PersistLog:
+		db.mux.Lock()
+		defer db.mux.Unlock()
+
+		err := db.writeSnapshot(db.data)
+		if err != nil {
+			return err
+		}
+
+		return db.wal.Close()
+	}
+
+	return nil
+}
+
+// writeSnapshot writes dbStructure as the database file
+// and drops the log entries it already contains
+func (db *DB) writeSnapshot(dbStructure DBStructure) error {
+	err := db.writeDB(dbStructure)
+	if err != nil {
+		return err
+	}
+
+	db.dirty = false
+
+	if db.wal == nil {
+		return nil
+	}
+
+	return db.truncateWAL()
+}
+
+// truncateWAL drops every entry in the log, callers must make sure
+// the database file already holds them
+func (db *DB) truncateWAL() error {
+	unlock, err := db.lockIO()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	err = db.wal.Truncate(0)
+	if err != nil {
+		return err
+	}
+
+	db.walSize = 0
+	return db.wal.Sync()
+}
+
+// maybeCompact starts a compaction if the log is over the threshold,
+// callers must hold the write lock
+func (db *DB) maybeCompact() {
+	if db.compacting || db.walSize < db.options.CompactThreshold {
+		return
+	}
+
+	db.compacting = true
+	db.wg.Add(1)
+	go func() {
+		defer db.wg.Done()
+
+		err := db.compact()
+		if err != nil {
+			log.Printf("compacting database %s: %v\n", db.path, err)
+		}
+	}()
+}
+
+// compact writes a new snapshot of the database file and empties the log.
+// Only the copy is taken under the lock, writers keep appending to the log
+// while the snapshot is written. The log is only emptied if nothing was
+// appended since the copy, otherwise another compaction is started and
+// replaying skips the entries the snapshot already holds until it is done
+func (db *DB) compact() error {
+	db.snapshotMux.Lock()
+	defer db.snapshotMux.Unlock()
+
+	db.mux.RLock()
+	dbStructure := copyDB(db.data)
+	db.mux.RUnlock()
+
+	err := db.writeDB(dbStructure)
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+	db.compacting = false
+
+	if err != nil {
+		return err
+	}
+	if db.data.WalSeq != dbStructure.WalSeq {
+		db.maybeCompact()
+		return nil
+	}
+
+	return db.truncateWAL()
+}
+
+func walPath(path string) string {
+	return path + ".wal"
+}
+
+// moveWALAside keeps the log of a database that isn't
+// using it as a .bak so it is never replayed again, sealed
+// when the database is
+func (db *DB) moveWALAside() error {
+	unlock, err := db.lockIO()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	if db.options.Keys != nil {
+		err = resealLog(walPath(db.path), db.options.Keys)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.Rename(walPath(db.path), backupPath(walPath(db.path)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// appendWAL writes the entries to the log and syncs it
+func (db *DB) appendWAL(entries []walEntry) error {
+	buf := []byte{}
+	for _, entry := range entries {
+		line, err := json.Marshal(entry)
+		if err != nil {
+			return err
+		}
+		buf = append(buf, sealLine(db.options.Keys, line)...)
+		buf = append(buf, '\n')
+	}
+
+	unlock, err := db.lockIO()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	_, err = db.wal.Write(buf)
+	if err == nil {
+		err = db.wal.Sync()
+	}
+	if err != nil {
+		// drop a partly written entry so later appends stay readable
+		db.wal.Truncate(db.walSize)
+		return err
+	}
+
+	db.walSize += int64(len(buf))
+	return nil
+}
+
+// replayWAL applies the entries in the log that are newer than the
+// loaded snapshot
+func (db *DB) replayWAL() error {
+	return replayWALFile(walPath(db.path), &db.data, db.options.Keys, time.Time{})
+}
+
+// replayWALFile applies the entries in the log at path that are newer than
+// dbStructure, stopping at the first entry after until unless it is zero.
+// A last line without a newline is a write that never finished and is ignored
+func replayWALFile(path string, dbStructure *DBStructure, keys *Keyring, until time.Time) error {
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		line, err = openLine(keys, line)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+
+		entry := walEntry{}
+		err = json.Unmarshal(line, &entry)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrCorruptDB, path, err)
+		}
+
+		if entry.Seq <= dbStructure.WalSeq {
+			continue
+		}
+		if !until.IsZero() && entry.Time.After(until) {
+			return nil
+		}
+		if entry.Seq != dbStructure.WalSeq+1 {
+			return fmt.Errorf("%w: %s jumps from entry %d to %d", ErrWALGap, path, dbStructure.WalSeq, entry.Seq)
+		}
+
+		err = applyEntry(dbStructure, entry)
+		if err != nil {
+			return err
+		}
+	}
+}
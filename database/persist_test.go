@@ -0,0 +1,295 @@
+package database
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestDB opens a database in a temp dir with one user
+// and returns it with the id of that user
+func newTestDB(tb testing.TB, path string, options Options) (*DB, int) {
+	tb.Helper()
+
+	db, err := NewDBWithOptions(path, options)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	user, err := db.CreateUser("a@example.com", "password")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	return db, user.Id
+}
+
+func TestPersistPolicies(t *testing.T) {
+	policies := []PersistPolicy{PersistSync, PersistBatched, PersistLog}
+
+	for _, policy := range policies {
+		t.Run(string(policy), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database.json")
+			options := Options{Policy: policy, FlushInterval: time.Millisecond}
+
+			db, userId := newTestDB(t, path, options)
+			for i := 0; i < 3; i++ {
+				_, err := db.CreateChirp(userId, fmt.Sprintf("chirp %d", i))
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := db.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = NewDBWithOptions(path, options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			chirps, err := db.GetChirps()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(chirps) != 3 {
+				t.Errorf("expected 3 chirps after reopening, got %d", len(chirps))
+			}
+		})
+	}
+}
+
+func TestPersistLogReplaysWithoutClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog}
+
+	db, userId := newTestDB(t, path, options)
+	_, err := db.CreateChirp(userId, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	chirp, err := db.GetChirpById(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if chirp.Body != "hello" {
+		t.Errorf("not matching %s vs %s", chirp.Body, "hello")
+	}
+}
+
+func TestPersistLogCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog, CompactThreshold: 512}
+
+	db, userId := newTestDB(t, path, options)
+	seedChirps(t, db, userId, 20)
+
+	// wait for the background compaction to finish
+	db.wg.Wait()
+
+	db.mux.RLock()
+	walSize := db.walSize
+	db.mux.RUnlock()
+	if walSize >= options.CompactThreshold {
+		t.Errorf("expected the log to be compacted, it is %d bytes", walSize)
+	}
+
+	snapshot, err := db.loadDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if snapshot.WalSeq == 0 {
+		t.Errorf("expected the snapshot to record the last log entry")
+	}
+
+	// the snapshot and what is left in the log must add up
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 20 {
+		t.Errorf("expected 20 chirps after reopening, got %d", len(chirps))
+	}
+}
+
+func TestPersistLogCompactsUnderWrites(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog, CompactThreshold: 256}
+
+	db, userId := newTestDB(t, path, options)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 25; j++ {
+				_, err := db.CreateChirp(userId, "hello")
+				if err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	db.wg.Wait()
+
+	// entries written while a snapshot was written are still in the log
+	crash(db)
+
+	db, err := NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chirps) != 100 {
+		t.Errorf("expected 100 chirps after reopening, got %d", len(chirps))
+	}
+}
+
+func TestPersistLogRefusesBadEntries(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog}
+
+	db, _ := newTestDB(t, path, options)
+	db.mux.Lock()
+	walSize := db.walSize
+	err := db.commit(walEntry{Op: opUserUpgraded, Id: 99})
+	if err == nil {
+		t.Errorf("expected upgrading an unknown user to fail")
+	}
+	err = db.commit(walEntry{Op: opChirpCreated})
+	if err == nil {
+		t.Errorf("expected a chirp entry without a chirp to fail")
+	}
+	if db.walSize != walSize {
+		t.Errorf("expected nothing logged, the log grew from %d to %d bytes", walSize, db.walSize)
+	}
+	db.mux.Unlock()
+
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatalf("expected the log to replay, got %v", err)
+	}
+	db.Close()
+}
+
+// crash closes the files of db without persisting or releasing
+// anything, as if the process died
+func crash(db *DB) {
+	close(db.done)
+	db.wg.Wait()
+
+	if db.wal != nil {
+		db.wal.Close()
+	}
+	db.ioLock.close()
+	db.owner.close()
+}
+
+func seedChirps(tb testing.TB, db Store, userId int, n int) {
+	tb.Helper()
+
+	for i := 0; i < n; i++ {
+		_, err := db.CreateChirp(userId, "hello")
+		if err != nil {
+			tb.Fatal(err)
+		}
+	}
+}
+
+// benchmarkLegacy is the behaviour before the in memory cache,
+// every call reads and parses the whole file
+func benchmarkLegacy(b *testing.B, write bool) {
+	path := filepath.Join(b.TempDir(), "database.json")
+	db, userId := newTestDB(b, path, Options{})
+	defer db.Close()
+	seedChirps(b, db, userId, 100)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		dbStructure, err := db.loadDB()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !write {
+			continue
+		}
+
+		chirp := Chirp{Id: len(dbStructure.Chirps) + 1, Body: "hello", AutherId: 1}
+		dbStructure.Chirps[chirp.Id] = chirp
+		err = db.writeDB(dbStructure)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCreateChirp(b *testing.B) {
+	b.Run("legacy", func(b *testing.B) { benchmarkLegacy(b, true) })
+
+	for _, policy := range []PersistPolicy{PersistSync, PersistBatched, PersistLog} {
+		b.Run(string(policy), func(b *testing.B) {
+			path := filepath.Join(b.TempDir(), "database.json")
+			db, userId := newTestDB(b, path, Options{Policy: policy})
+			defer db.Close()
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := db.CreateChirp(userId, "hello")
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkGetChirps(b *testing.B) {
+	b.Run("legacy", func(b *testing.B) { benchmarkLegacy(b, false) })
+
+	b.Run("cached", func(b *testing.B) {
+		path := filepath.Join(b.TempDir(), "database.json")
+		db, userId := newTestDB(b, path, Options{Policy: PersistBatched})
+		defer db.Close()
+		seedChirps(b, db, userId, 100)
+
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, err := db.GetChirps()
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	})
+}
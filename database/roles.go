@@ -0,0 +1,76 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Role is what a user is allowed to do, every user has exactly one
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// ErrInvalidRole is returned for role names that aren't one of the roles
+var ErrInvalidRole = errors.New("invalid role")
+
+// ParseRole returns the role named s
+func ParseRole(s string) (Role, error) {
+	switch role := Role(s); role {
+	case RoleUser, RoleModerator, RoleAdmin:
+		return role, nil
+	default:
+		return "", fmt.Errorf("%w %q, expected one of %s, %s or %s", ErrInvalidRole, s, RoleUser, RoleModerator, RoleAdmin)
+	}
+}
+
+// GetUserByEmail returns the user with email without checking a password
+func (db *DB) GetUserByEmail(email string) (ReturnedUser, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return ReturnedUser{}, ErrUserNotFound
+	}
+
+	db.mux.RLock()
+	user, ok := db.data.Users[email]
+	db.mux.RUnlock()
+
+	if !ok {
+		return ReturnedUser{}, ErrUserNotFound
+	}
+
+	return db.GetUserById(user.Id)
+}
+
+// SetUserRole gives the user role, tokens issued before keep the old
+// role until they expire so callers revoke the sessions of the user
+func (db *DB) SetUserRole(id int, role Role) (ReturnedUserJwt, error) {
+	role, err := ParseRole(string(role))
+	if err != nil {
+		return ReturnedUserJwt{}, err
+	}
+
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	user, ok := db.data.UsersById[id]
+	if !ok {
+		return ReturnedUserJwt{}, ErrUserNotFound
+	}
+
+	user.Role = role
+	err = db.commit(walEntry{Op: opUserUpdated, User: &user})
+	if err != nil {
+		return ReturnedUserJwt{}, err
+	}
+
+	return ReturnedUserJwt{
+		Id:            user.Id,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+	}, nil
+}
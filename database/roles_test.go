@@ -0,0 +1,66 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestUserRoles(t *testing.T) {
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			user, err := store.GetUserByEmail(" A@example.com")
+			if err != nil || user.Role != RoleUser {
+				t.Fatalf("expected a new user to be a plain user, got %+v %v", user, err)
+			}
+
+			_, err = store.SetUserRole(1, "owner")
+			if !errors.Is(err, ErrInvalidRole) {
+				t.Errorf("expected an unknown role to be rejected, got %v", err)
+			}
+			_, err = store.SetUserRole(99, RoleAdmin)
+			if !errors.Is(err, ErrUserNotFound) {
+				t.Errorf("expected an unknown user to be not found, got %v", err)
+			}
+
+			updated, err := store.SetUserRole(1, RoleAdmin)
+			if err != nil || updated.Role != RoleAdmin {
+				t.Fatalf("expected the user promoted, got %+v %v", updated, err)
+			}
+
+			loggedIn, err := store.GetUser("a@example.com", "password")
+			if err != nil || loggedIn.Role != RoleAdmin {
+				t.Errorf("expected the login to carry the role, got %+v %v", loggedIn, err)
+			}
+
+			// changing the email keeps the role
+			changed, err := store.UpdateUser(1, "b@example.com", "")
+			if err != nil || changed.Role != RoleAdmin {
+				t.Errorf("expected the role kept, got %+v %v", changed, err)
+			}
+		})
+	}
+}
+
+func TestRoleSurvivesLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog}
+
+	db, userId := newTestDB(t, path, options)
+	_, err := db.SetUserRole(userId, RoleModerator)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	user, err := db.GetUserById(userId)
+	if err != nil || user.Role != RoleModerator {
+		t.Errorf("expected the role replayed, got %+v %v", user, err)
+	}
+}
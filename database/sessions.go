@@ -0,0 +1,141 @@
+package database
+
+import (
+	"errors"
+	"sort"
+	"time"
+)
+
+// ErrSessionNotFound is returned for sessions that were never started,
+// expired or were revoked
+var ErrSessionNotFound = errors.New("session not found")
+
+// Session is one login of a user, it lives as long as the refresh tokens
+// rotated from that login. Its id is the family id of those tokens.
+// Sessions an oauth client started for the user have its id and the
+// scopes the user granted
+type Session struct {
+	Id         string    `json:"id"`
+	UserId     int       `json:"user_id"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	ClientId   string    `json:"client_id,omitempty"`
+	Scopes     []string  `json:"scopes,omitempty"`
+}
+
+// sortSessions orders sessions from the most recently used
+func sortSessions(sessions []Session) {
+	sort.Slice(sessions, func(i, j int) bool {
+		if !sessions[i].LastUsedAt.Equal(sessions[j].LastUsedAt) {
+			return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+		}
+		return sessions[i].Id < sessions[j].Id
+	})
+}
+
+// touchSession marks the session of a newly issued refresh token as used,
+// a token logged by a build from before sessions starts its own
+func touchSession(dbStructure *DBStructure, record RefreshToken) {
+	session, ok := dbStructure.Sessions[record.FamilyId]
+	if !ok {
+		session = Session{Id: record.FamilyId, UserId: record.UserId, CreatedAt: record.CreatedAt}
+	}
+
+	if record.CreatedAt.After(session.LastUsedAt) {
+		session.LastUsedAt = record.CreatedAt
+	}
+	if record.ExpiresAt.After(session.ExpiresAt) {
+		session.ExpiresAt = record.ExpiresAt
+	}
+	dbStructure.Sessions[session.Id] = session
+}
+
+// CreateSession starts a session for session.UserId with token as its
+// first refresh token issued along with access, the user agent and ip
+// are kept as given
+func (db *DB) CreateSession(token string, session Session, access AccessToken, now time.Time, ttl time.Duration) (Session, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	_, ok := db.data.UsersById[session.UserId]
+	if !ok {
+		return Session{}, ErrUserNotFound
+	}
+
+	hash := hashToken(token)
+	session.Id = hash
+	session.CreatedAt = now
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(ttl)
+
+	record := RefreshToken{
+		Hash:        hash,
+		UserId:      session.UserId,
+		FamilyId:    hash,
+		CreatedAt:   now,
+		ExpiresAt:   session.ExpiresAt,
+		AccessToken: &access,
+	}
+
+	entries := append(db.expiredTokenEntries(now),
+		walEntry{Op: opSessionCreated, Session: &session},
+		walEntry{Op: opTokenIssued, Token: &record},
+	)
+	err := db.commit(entries...)
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+// GetSessions returns the sessions of the user alive at now,
+// the most recently used first
+func (db *DB) GetSessions(userId int, now time.Time) ([]Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	sessions := []Session{}
+	for _, session := range db.data.Sessions {
+		if session.UserId == userId && now.Before(session.ExpiresAt) {
+			sessions = append(sessions, session)
+		}
+	}
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+// RevokeSession ends one session of the user along with its refresh tokens
+func (db *DB) RevokeSession(userId int, id string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	session, ok := db.data.Sessions[id]
+	if !ok || session.UserId != userId {
+		return ErrSessionNotFound
+	}
+
+	return db.commit(db.revokeSessionEntries(id)...)
+}
+
+// RevokeSessions ends every session of the user
+func (db *DB) RevokeSessions(userId int) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	entries := []walEntry{}
+	for id, session := range db.data.Sessions {
+		if session.UserId == userId {
+			entries = append(entries, db.revokeSessionEntries(id)...)
+		}
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+
+	return db.commit(entries...)
+}
@@ -0,0 +1,124 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSessions(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := time.Hour
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			other, err := store.CreateUser("b@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			phone, err := store.CreateSession("phone", Session{UserId: 1, UserAgent: "phone", IP: "10.0.0.1"}, AccessToken{}, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			laptop, err := store.CreateSession("laptop", Session{UserId: 1, UserAgent: "laptop", IP: "10.0.0.2"}, AccessToken{}, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateSession("elsewhere", Session{UserId: other.Id}, AccessToken{}, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rotated, err := store.RotateRefreshToken("phone", "phone-2", AccessToken{}, now.Add(time.Minute), ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rotated.Id != phone.Id || !rotated.LastUsedAt.Equal(now.Add(time.Minute)) || !rotated.ExpiresAt.Equal(now.Add(time.Minute+ttl)) {
+				t.Errorf("expected the phone session used and extended, got %+v", rotated)
+			}
+
+			sessions, err := store.GetSessions(1, now.Add(time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 2 || sessions[0].Id != phone.Id || sessions[0].UserAgent != "phone" || sessions[0].IP != "10.0.0.1" {
+				t.Fatalf("expected the phone session first, got %+v", sessions)
+			}
+
+			// the laptop session was never refreshed
+			sessions, err = store.GetSessions(1, now.Add(ttl))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 1 || sessions[0].Id != phone.Id {
+				t.Errorf("expected only the phone session alive, got %+v", sessions)
+			}
+
+			err = store.RevokeSession(other.Id, phone.Id)
+			if !errors.Is(err, ErrSessionNotFound) {
+				t.Errorf("expected another user's session to be not found, got %v", err)
+			}
+
+			err = store.RevokeSession(1, phone.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessions, err = store.GetSessions(1, now)
+			if err != nil || len(sessions) != 1 || sessions[0].Id != laptop.Id {
+				t.Errorf("expected only the laptop session left, got %+v %v", sessions, err)
+			}
+			_, err = store.RotateRefreshToken("phone-2", "phone-3", AccessToken{}, now, ttl)
+			if !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("expected the tokens of the revoked session to be gone, got %v", err)
+			}
+
+			err = store.RevokeSessions(1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessions, err = store.GetSessions(1, now)
+			if err != nil || len(sessions) != 0 {
+				t.Errorf("expected every session of the user to be gone, got %+v %v", sessions, err)
+			}
+
+			sessions, err = store.GetSessions(other.Id, now)
+			if err != nil || len(sessions) != 1 {
+				t.Errorf("expected the other user to stay signed in, got %+v %v", sessions, err)
+			}
+		})
+	}
+}
+
+func TestSessionsSurviveLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	db, userId := newTestDB(t, path, options)
+	session, err := db.CreateSession("first", Session{UserId: userId, UserAgent: "curl"}, AccessToken{}, now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RotateRefreshToken("first", "second", AccessToken{}, now.Add(time.Minute), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	sessions, err := db.GetSessions(userId, now)
+	if err != nil || len(sessions) != 1 {
+		t.Fatalf("expected the session back, got %+v %v", sessions, err)
+	}
+	replayed := sessions[0]
+	if replayed.Id != session.Id || replayed.UserAgent != "curl" || !replayed.LastUsedAt.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the session used after login, got %+v", replayed)
+	}
+}
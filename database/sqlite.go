@@ -0,0 +1,2435 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+type SQLiteDB struct {
+	conn   *sql.DB
+	hasher PasswordHasher
+	keys   *Keyring
+}
+
+// sqliteMigrations bring the schema to each version, a file at
+// user_version n runs the ones after the first n. Add new ones to the end
+var sqliteMigrations = []func(tx *sql.Tx) error{
+	sqliteExec(`
+CREATE TABLE IF NOT EXISTS users (
+	id            INTEGER PRIMARY KEY AUTOINCREMENT,
+	email         TEXT    NOT NULL,
+	password      TEXT    NOT NULL,
+	is_chirpy_red INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS users_email ON users (email);
+
+CREATE TABLE IF NOT EXISTS chirps (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	body      TEXT    NOT NULL,
+	auther_id INTEGER NOT NULL REFERENCES users (id)
+);
+
+CREATE TABLE IF NOT EXISTS tokens (
+	refresh_token TEXT PRIMARY KEY,
+	access_token  TEXT NOT NULL
+);
+`),
+	// refresh tokens point at the user they were issued to, the old
+	// ones can't be mapped to a user so they are dropped
+	sqliteExec(`
+DROP TABLE tokens;
+CREATE TABLE tokens (
+	refresh_token TEXT    PRIMARY KEY,
+	user_id       INTEGER NOT NULL REFERENCES users (id)
+);
+`),
+	migrateSQLiteHashRefreshTokens,
+	// every refresh token family becomes a session like the json
+	// migration to schema version 4
+	sqliteExec(`
+CREATE TABLE sessions (
+	id           TEXT    PRIMARY KEY,
+	user_id      INTEGER NOT NULL REFERENCES users (id),
+	created_at   INTEGER NOT NULL,
+	last_used_at INTEGER NOT NULL,
+	expires_at   INTEGER NOT NULL,
+	user_agent   TEXT    NOT NULL DEFAULT '',
+	ip           TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX sessions_user ON sessions (user_id);
+
+INSERT INTO sessions (id, user_id, created_at, last_used_at, expires_at)
+SELECT family_id, MIN(user_id), MIN(created_at), MAX(created_at), MAX(expires_at)
+FROM refresh_tokens GROUP BY family_id;
+`),
+	// refresh tokens remember the access token issued along with them so
+	// revoking a session can deny it
+	sqliteExec(`
+ALTER TABLE refresh_tokens ADD COLUMN access_token_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE refresh_tokens ADD COLUMN access_expires_at INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE revoked_access_tokens (
+	id         TEXT    PRIMARY KEY,
+	expires_at INTEGER NOT NULL
+);
+`),
+	sqliteExec(`
+CREATE TABLE password_resets (
+	hash       TEXT    PRIMARY KEY,
+	user_id    INTEGER NOT NULL REFERENCES users (id),
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX password_resets_user ON password_resets (user_id);
+`),
+	migrateSQLiteNormalizeEmails,
+	sqliteExec(`
+CREATE TABLE totp (
+	user_id    INTEGER PRIMARY KEY REFERENCES users (id),
+	secret     TEXT    NOT NULL,
+	confirmed  INTEGER NOT NULL DEFAULT 0,
+	created_at INTEGER NOT NULL,
+	last_step  INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE totp_recovery_codes (
+	user_id INTEGER NOT NULL REFERENCES users (id),
+	hash    TEXT    NOT NULL,
+	PRIMARY KEY (user_id, hash)
+);
+
+CREATE TABLE mfa_challenges (
+	hash       TEXT    PRIMARY KEY,
+	user_id    INTEGER NOT NULL REFERENCES users (id),
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL,
+	attempts   INTEGER NOT NULL DEFAULT 0
+);
+`),
+	sqliteExec(`
+ALTER TABLE users ADD COLUMN role TEXT NOT NULL DEFAULT 'user';
+`),
+	// scopes are separated by spaces, last_used_at is 0 for keys never used
+	sqliteExec(`
+CREATE TABLE api_keys (
+	id           TEXT    PRIMARY KEY,
+	hash         TEXT    NOT NULL UNIQUE,
+	user_id      INTEGER NOT NULL REFERENCES users (id),
+	name         TEXT    NOT NULL,
+	prefix       TEXT    NOT NULL,
+	scopes       TEXT    NOT NULL,
+	created_at   INTEGER NOT NULL,
+	last_used_at INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX api_keys_user ON api_keys (user_id);
+`),
+	// redirect uris are separated by newlines and scopes by spaces
+	sqliteExec(`
+CREATE TABLE oauth_clients (
+	id            TEXT    PRIMARY KEY,
+	secret_hash   TEXT    NOT NULL DEFAULT '',
+	owner_id      INTEGER NOT NULL REFERENCES users (id),
+	name          TEXT    NOT NULL,
+	redirect_uris TEXT    NOT NULL,
+	scopes        TEXT    NOT NULL,
+	created_at    INTEGER NOT NULL
+);
+CREATE INDEX oauth_clients_owner ON oauth_clients (owner_id);
+
+CREATE TABLE authorization_codes (
+	hash           TEXT    PRIMARY KEY,
+	client_id      TEXT    NOT NULL REFERENCES oauth_clients (id),
+	user_id        INTEGER NOT NULL REFERENCES users (id),
+	redirect_uri   TEXT    NOT NULL,
+	scopes         TEXT    NOT NULL,
+	code_challenge TEXT    NOT NULL,
+	created_at     INTEGER NOT NULL,
+	expires_at     INTEGER NOT NULL
+);
+
+ALTER TABLE sessions ADD COLUMN client_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE sessions ADD COLUMN scopes TEXT NOT NULL DEFAULT '';
+CREATE INDEX sessions_client ON sessions (client_id);
+`),
+	sqliteExec(`
+CREATE TABLE account_deletions (
+	user_id      INTEGER PRIMARY KEY REFERENCES users (id),
+	requested_at INTEGER NOT NULL,
+	purge_at     INTEGER NOT NULL
+);
+`),
+	sqliteExec(`
+CREATE TABLE audit_log (
+	id       INTEGER PRIMARY KEY AUTOINCREMENT,
+	time     INTEGER NOT NULL,
+	action   TEXT    NOT NULL,
+	actor_id INTEGER NOT NULL,
+	user_id  INTEGER NOT NULL,
+	token_id TEXT    NOT NULL DEFAULT '',
+	reason   TEXT    NOT NULL DEFAULT '',
+	method   TEXT    NOT NULL DEFAULT '',
+	path     TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX audit_log_actor ON audit_log (actor_id);
+CREATE INDEX audit_log_user ON audit_log (user_id);
+CREATE INDEX audit_log_token ON audit_log (token_id);
+`),
+	migrateSQLiteChirpAuthors,
+}
+
+// sqliteExec is a migration that only runs statements
+func sqliteExec(statements string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		_, err := tx.Exec(statements)
+		return err
+	}
+}
+
+// migrateSQLiteChirpAuthors drops the foreign key from the author of a
+// chirp, the chirps of a purged account are kept under DeletedUserId which
+// is no user. The table is copied as sqlite can't alter a column, keeping
+// the id sequence so deleted ids stay unused
+func migrateSQLiteChirpAuthors(tx *sql.Tx) error {
+	var seq int
+	err := tx.QueryRow(`SELECT COALESCE(MAX(seq), 0) FROM sqlite_sequence WHERE name = 'chirps'`).Scan(&seq)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+CREATE TABLE chirps_copy (
+	id        INTEGER PRIMARY KEY AUTOINCREMENT,
+	body      TEXT    NOT NULL,
+	auther_id INTEGER NOT NULL
+);
+INSERT INTO chirps_copy (id, body, auther_id) SELECT id, body, auther_id FROM chirps;
+DROP TABLE chirps;
+ALTER TABLE chirps_copy RENAME TO chirps;
+DELETE FROM sqlite_sequence WHERE name = 'chirps';
+`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES ('chirps', ?)`, seq)
+	return err
+}
+
+// migrateSQLiteHashRefreshTokens moves the refresh tokens to hashed records
+// with an expiry like the json migration to schema version 3. Times are
+// stored as unix nanoseconds
+func migrateSQLiteHashRefreshTokens(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE refresh_tokens (
+	hash        TEXT    PRIMARY KEY,
+	user_id     INTEGER NOT NULL REFERENCES users (id),
+	family_id   TEXT    NOT NULL,
+	created_at  INTEGER NOT NULL,
+	expires_at  INTEGER NOT NULL,
+	replaced_by TEXT    NOT NULL DEFAULT ''
+);
+CREATE INDEX refresh_tokens_family ON refresh_tokens (family_id);
+`)
+	if err != nil {
+		return err
+	}
+
+	tokens := map[string]int{}
+	err = queryRows(tx, `SELECT refresh_token, user_id FROM tokens`, func(rows *sql.Rows) error {
+		var token string
+		var userId int
+		err := rows.Scan(&token, &userId)
+		tokens[token] = userId
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	for token, userId := range tokens {
+		hash := hashToken(token)
+		_, err = tx.Exec(`INSERT INTO refresh_tokens (hash, user_id, family_id, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+			hash, userId, hash, now.UnixNano(), now.Add(DefaultRefreshTokenTTL).UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`DROP TABLE tokens`)
+	return err
+}
+
+// migrateSQLiteNormalizeEmails normalizes emails and makes them unique like
+// the json migration to schema version 7, the newest user keeps a shared
+// address and the users that exist count as verified
+func migrateSQLiteNormalizeEmails(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+ALTER TABLE users ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 0;
+UPDATE users SET email_verified = 1;
+DROP INDEX users_email;
+
+CREATE TABLE email_verifications (
+	hash       TEXT    PRIMARY KEY,
+	user_id    INTEGER NOT NULL REFERENCES users (id),
+	email      TEXT    NOT NULL,
+	created_at INTEGER NOT NULL,
+	expires_at INTEGER NOT NULL
+);
+CREATE INDEX email_verifications_user ON email_verifications (user_id);
+`)
+	if err != nil {
+		return err
+	}
+
+	type user struct {
+		id    int
+		email string
+	}
+	users := []user{}
+	err = queryRows(tx, `SELECT id, email FROM users ORDER BY id DESC`, func(rows *sql.Rows) error {
+		u := user{}
+		err := rows.Scan(&u.id, &u.email)
+		users = append(users, u)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	taken := map[string]bool{}
+	for _, u := range users {
+		email := strings.ToLower(strings.TrimSpace(u.email))
+		verified := true
+		if taken[email] {
+			email = duplicateEmail(u.id)
+			verified = false
+		}
+		taken[email] = true
+
+		_, err = tx.Exec(`UPDATE users SET email = ?, email_verified = ? WHERE id = ?`, email, verified, u.id)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(`CREATE UNIQUE INDEX users_email ON users (email)`)
+	return err
+}
+
+// NewSQLiteDB opens the sqlite database at path
+// and creates or migrates the tables
+func NewSQLiteDB(path string) (*SQLiteDB, error) {
+	// foreign keys are off by default and set per connection
+	conn, err := sql.Open("sqlite", path+"?_pragma=foreign_keys(1)")
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite only allows one writer at a time
+	conn.SetMaxOpenConns(1)
+
+	err = migrateSQLite(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("creating sqlite schema error %w", err)
+	}
+
+	return &SQLiteDB{conn: conn, hasher: DefaultPasswordHasher}, nil
+}
+
+// migrateSQLite runs the migrations newer than the user_version
+// of the file, each in its own transaction
+func migrateSQLite(conn *sql.DB) error {
+	var version int
+	err := conn.QueryRow(`PRAGMA user_version`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("%w: %d, this build reads up to %d", ErrNewerSchema, version, len(sqliteMigrations))
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := conn.Begin()
+		if err != nil {
+			return err
+		}
+
+		err = sqliteMigrations[i](tx)
+		if err == nil {
+			// pragmas can't take parameters
+			_, err = tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1))
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migrating to version %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// Close closes the underlying connection
+func (db *SQLiteDB) Close() error {
+	return db.conn.Close()
+}
+
+func (db *SQLiteDB) CreateChirp(userId int, body string) (Chirp, error) {
+	err := db.conn.QueryRow(`SELECT id FROM users WHERE id = ?`, userId).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, ErrUserNotFound
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	res, err := db.conn.Exec(`INSERT INTO chirps (body, auther_id) VALUES (?, ?)`, body, userId)
+	if err != nil {
+		return Chirp{}, fmt.Errorf("writing db error %w", err)
+	}
+
+	chirpId, err := res.LastInsertId()
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return Chirp{
+		Id:       int(chirpId),
+		Body:     body,
+		AutherId: userId,
+	}, nil
+}
+
+func (db *SQLiteDB) GetChirps() ([]Chirp, error) {
+	rows, err := db.conn.Query(`SELECT id, body, auther_id FROM chirps ORDER BY id`)
+	if err != nil {
+		return []Chirp{}, err
+	}
+	defer rows.Close()
+
+	returnChirps := []Chirp{}
+
+	for rows.Next() {
+		chirp := Chirp{}
+		err = rows.Scan(&chirp.Id, &chirp.Body, &chirp.AutherId)
+		if err != nil {
+			return []Chirp{}, err
+		}
+		returnChirps = append(returnChirps, chirp)
+	}
+
+	return returnChirps, rows.Err()
+}
+
+func (db *SQLiteDB) GetChirpById(id int) (Chirp, error) {
+	chirp := Chirp{}
+	err := db.conn.QueryRow(`SELECT id, body, auther_id FROM chirps WHERE id = ?`, id).Scan(&chirp.Id, &chirp.Body, &chirp.AutherId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Chirp{}, nil
+	}
+	if err != nil {
+		return Chirp{}, err
+	}
+
+	return chirp, nil
+}
+
+func (db *SQLiteDB) DeleteChirp(id int, userId int) error {
+	var autherId int
+	err := db.conn.QueryRow(`SELECT auther_id FROM chirps WHERE id = ?`, id).Scan(&autherId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if userId != autherId {
+		return errors.New("user not authirized")
+	}
+
+	_, err = db.conn.Exec(`DELETE FROM chirps WHERE id = ?`, id)
+	return err
+}
+
+func (db *SQLiteDB) CreateUser(email string, password string) (ReturnedUser, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return ReturnedUser{}, err
+	}
+
+	hashedPassword, err := db.hasher.Hash(password)
+	if err != nil {
+		return ReturnedUser{}, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return ReturnedUser{}, err
+	}
+	defer tx.Rollback()
+
+	err = checkSQLiteEmailFree(tx, email)
+	if err != nil {
+		return ReturnedUser{}, err
+	}
+
+	res, err := tx.Exec(`INSERT INTO users (email, password) VALUES (?, ?)`, email, string(hashedPassword))
+	if err != nil {
+		return ReturnedUser{}, fmt.Errorf("writing db error %w", err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return ReturnedUser{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return ReturnedUser{}, err
+	}
+
+	return ReturnedUser{
+		Id:          int(id),
+		Email:       email,
+		IsChirpyRed: false,
+		Role:        RoleUser,
+	}, nil
+}
+
+// checkSQLiteEmailFree returns ErrEmailTaken when a user has email
+func checkSQLiteEmailFree(tx *sql.Tx, email string) error {
+	var id int
+	err := tx.QueryRow(`SELECT id FROM users WHERE email = ?`, email).Scan(&id)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return ErrEmailTaken
+}
+
+func (db *SQLiteDB) GetUser(email string, password string) (ReturnedUser, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return ReturnedUser{}, ErrUserNotFound
+	}
+
+	user := User{}
+	err = db.conn.QueryRow(`SELECT id, email, password, is_chirpy_red, email_verified, role FROM users WHERE email = ?`, email).
+		Scan(&user.Id, &user.Email, &user.Password, &user.IsChirpyRed, &user.EmailVerified, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReturnedUser{}, ErrUserNotFound
+	}
+	if err != nil {
+		return ReturnedUser{}, err
+	}
+
+	err = comparePassword(user.Password, password)
+	if err != nil {
+		return ReturnedUser{}, fmt.Errorf("%w: %v", ErrWrongPassword, err)
+	}
+
+	// a password hashed with outdated parameters is hashed again, unless
+	// it changed since it was checked
+	if db.hasher.NeedsRehash(user.Password) {
+		hashedPassword, err := db.hasher.Hash(password)
+		if err == nil {
+			_, err = db.conn.Exec(`UPDATE users SET password = ? WHERE id = ? AND password = ?`, hashedPassword, user.Id, user.Password)
+		}
+		if err != nil {
+			return ReturnedUser{}, fmt.Errorf("rehashing password error %w", err)
+		}
+	}
+
+	return ReturnedUser{
+		Id:            user.Id,
+		Email:         user.Email,
+		IsChirpyRed:   user.IsChirpyRed,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+	}, nil
+}
+
+func (db *SQLiteDB) GetUserById(id int) (ReturnedUser, error) {
+	user := ReturnedUser{}
+	err := db.conn.QueryRow(`SELECT id, email, is_chirpy_red, email_verified, role FROM users WHERE id = ?`, id).
+		Scan(&user.Id, &user.Email, &user.IsChirpyRed, &user.EmailVerified, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReturnedUser{}, ErrUserNotFound
+	}
+	if err != nil {
+		return ReturnedUser{}, err
+	}
+
+	return user, nil
+}
+
+func (db *SQLiteDB) UpdateUser(id int, email string, password string) (ReturnedUserJwt, error) {
+	hashedPassword := ""
+	if password != "" {
+		var err error
+		hashedPassword, err = db.hasher.Hash(password)
+		if err != nil {
+			return ReturnedUserJwt{}, err
+		}
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return ReturnedUserJwt{}, err
+	}
+	defer tx.Rollback()
+
+	user := User{}
+	err = tx.QueryRow(`SELECT id, email, password, email_verified, role FROM users WHERE id = ?`, id).
+		Scan(&user.Id, &user.Email, &user.Password, &user.EmailVerified, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReturnedUserJwt{}, ErrUserNotFound
+	}
+	if err != nil {
+		return ReturnedUserJwt{}, err
+	}
+
+	if email != "" {
+		email, err := NormalizeEmail(email)
+		if err != nil {
+			return ReturnedUserJwt{}, err
+		}
+
+		// a new email has to be verified again
+		if email != user.Email {
+			err = checkSQLiteEmailFree(tx, email)
+			if err != nil {
+				return ReturnedUserJwt{}, err
+			}
+			user.Email = email
+			user.EmailVerified = false
+		}
+	}
+	if hashedPassword != "" {
+		user.Password = hashedPassword
+	}
+
+	_, err = tx.Exec(`UPDATE users SET email = ?, password = ?, email_verified = ? WHERE id = ?`, user.Email, user.Password, user.EmailVerified, user.Id)
+	if err != nil {
+		return ReturnedUserJwt{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return ReturnedUserJwt{}, err
+	}
+
+	return ReturnedUserJwt{
+		Id:            user.Id,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+	}, nil
+}
+
+func (db *SQLiteDB) GetUserByEmail(email string) (ReturnedUser, error) {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return ReturnedUser{}, ErrUserNotFound
+	}
+
+	user := ReturnedUser{}
+	err = db.conn.QueryRow(`SELECT id, email, is_chirpy_red, email_verified, role FROM users WHERE email = ?`, email).
+		Scan(&user.Id, &user.Email, &user.IsChirpyRed, &user.EmailVerified, &user.Role)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ReturnedUser{}, ErrUserNotFound
+	}
+	if err != nil {
+		return ReturnedUser{}, err
+	}
+
+	return user, nil
+}
+
+func (db *SQLiteDB) SetUserRole(id int, role Role) (ReturnedUserJwt, error) {
+	role, err := ParseRole(string(role))
+	if err != nil {
+		return ReturnedUserJwt{}, err
+	}
+
+	res, err := db.conn.Exec(`UPDATE users SET role = ? WHERE id = ?`, role, id)
+	if err != nil {
+		return ReturnedUserJwt{}, err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return ReturnedUserJwt{}, err
+	}
+	if n == 0 {
+		return ReturnedUserJwt{}, ErrUserNotFound
+	}
+
+	user, err := db.GetUserById(id)
+	if err != nil {
+		return ReturnedUserJwt{}, err
+	}
+
+	return ReturnedUserJwt{
+		Id:            user.Id,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		Role:          user.Role,
+	}, nil
+}
+
+func (db *SQLiteDB) MakeUserRed(id int) error {
+	res, err := db.conn.Exec(`UPDATE users SET is_chirpy_red = 1 WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) CreateSession(token string, session Session, access AccessToken, now time.Time, ttl time.Duration) (Session, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback()
+
+	// expired sessions and tokens are pruned as new sessions start
+	_, err = tx.Exec(`DELETE FROM refresh_tokens WHERE expires_at <= ? OR family_id IN (SELECT id FROM sessions WHERE expires_at <= ?)`,
+		now.UnixNano(), now.UnixNano())
+	if err != nil {
+		return Session{}, err
+	}
+	_, err = tx.Exec(`DELETE FROM sessions WHERE expires_at <= ?`, now.UnixNano())
+	if err != nil {
+		return Session{}, err
+	}
+	_, err = tx.Exec(`DELETE FROM revoked_access_tokens WHERE expires_at <= ?`, now.UnixNano())
+	if err != nil {
+		return Session{}, err
+	}
+
+	hash := hashToken(token)
+	session.Id = hash
+	session.CreatedAt = now
+	session.LastUsedAt = now
+	session.ExpiresAt = now.Add(ttl)
+
+	_, err = tx.Exec(`INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		session.Id, session.UserId, now.UnixNano(), now.UnixNano(), session.ExpiresAt.UnixNano(), session.UserAgent, session.IP,
+		session.ClientId, strings.Join(session.Scopes, " "))
+	if err != nil {
+		return Session{}, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (hash, user_id, family_id, created_at, expires_at, access_token_id, access_expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		hash, session.UserId, hash, now.UnixNano(), session.ExpiresAt.UnixNano(), access.Id, access.ExpiresAt.UnixNano())
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, tx.Commit()
+}
+
+func (db *SQLiteDB) RotateRefreshToken(token string, next string, access AccessToken, now time.Time, ttl time.Duration) (Session, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return Session{}, err
+	}
+	defer tx.Rollback()
+
+	hash := hashToken(token)
+	var userId int
+	var familyId, replacedBy string
+	var expiresAt int64
+	err = tx.QueryRow(`SELECT user_id, family_id, expires_at, replaced_by FROM refresh_tokens WHERE hash = ?`, hash).
+		Scan(&userId, &familyId, &expiresAt, &replacedBy)
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+
+	if replacedBy != "" {
+		err = revokeSQLiteSession(tx, familyId)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			return Session{}, err
+		}
+		return Session{}, ErrTokenReused
+	}
+
+	if now.UnixNano() >= expiresAt {
+		return Session{}, ErrTokenExpired
+	}
+
+	nextHash := hashToken(next)
+	_, err = tx.Exec(`UPDATE refresh_tokens SET replaced_by = ? WHERE hash = ?`, nextHash, hash)
+	if err != nil {
+		return Session{}, err
+	}
+
+	_, err = tx.Exec(`INSERT INTO refresh_tokens (hash, user_id, family_id, created_at, expires_at, access_token_id, access_expires_at) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		nextHash, userId, familyId, now.UnixNano(), now.Add(ttl).UnixNano(), access.Id, access.ExpiresAt.UnixNano())
+	if err != nil {
+		return Session{}, err
+	}
+
+	_, err = tx.Exec(`UPDATE sessions SET last_used_at = MAX(last_used_at, ?), expires_at = MAX(expires_at, ?) WHERE id = ?`,
+		now.UnixNano(), now.Add(ttl).UnixNano(), familyId)
+	if err != nil {
+		return Session{}, err
+	}
+
+	session, err := scanSession(tx.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, familyId))
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, tx.Commit()
+}
+
+func (db *SQLiteDB) RevokeRefreshToken(token string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var familyId string
+	err = tx.QueryRow(`SELECT family_id FROM refresh_tokens WHERE hash = ?`, hashToken(token)).Scan(&familyId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	err = revokeSQLiteSession(tx, familyId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) GetRefreshSession(token string, now time.Time) (Session, error) {
+	var familyId, replacedBy string
+	var expiresAt int64
+	err := db.conn.QueryRow(`SELECT family_id, expires_at, replaced_by FROM refresh_tokens WHERE hash = ?`, hashToken(token)).
+		Scan(&familyId, &expiresAt, &replacedBy)
+	if errors.Is(err, sql.ErrNoRows) || replacedBy != "" {
+		return Session{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+	if now.UnixNano() >= expiresAt {
+		return Session{}, ErrTokenExpired
+	}
+
+	session, err := scanSession(db.conn.QueryRow(`SELECT `+sessionColumns+` FROM sessions WHERE id = ?`, familyId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return Session{}, ErrTokenNotFound
+	}
+	if err != nil {
+		return Session{}, err
+	}
+
+	return session, nil
+}
+
+const sessionColumns = `id, user_id, created_at, last_used_at, expires_at, user_agent, ip, client_id, scopes`
+
+// scanSession reads a row of sessionColumns
+func scanSession(row interface{ Scan(dest ...any) error }) (Session, error) {
+	session := Session{}
+	var createdAt, lastUsedAt, expiresAt int64
+	var scopes string
+	err := row.Scan(&session.Id, &session.UserId, &createdAt, &lastUsedAt, &expiresAt, &session.UserAgent, &session.IP, &session.ClientId, &scopes)
+	if scopes != "" {
+		session.Scopes = strings.Fields(scopes)
+	}
+	session.CreatedAt = time.Unix(0, createdAt).UTC()
+	session.LastUsedAt = time.Unix(0, lastUsedAt).UTC()
+	session.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	return session, err
+}
+
+// revokeSQLiteSession deletes the session along with its refresh tokens
+// and denies the access tokens issued with them
+func revokeSQLiteSession(tx *sql.Tx, id string) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO revoked_access_tokens (id, expires_at)
+SELECT access_token_id, access_expires_at FROM refresh_tokens WHERE family_id = ? AND access_token_id != ''`, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM refresh_tokens WHERE family_id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM sessions WHERE id = ?`, id)
+	return err
+}
+
+func (db *SQLiteDB) IsAccessTokenRevoked(id string) (bool, error) {
+	var n int
+	err := db.conn.QueryRow(`SELECT COUNT(*) FROM revoked_access_tokens WHERE id = ?`, id).Scan(&n)
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+func (db *SQLiteDB) GetSessions(userId int, now time.Time) ([]Session, error) {
+	rows, err := db.conn.Query(`SELECT `+sessionColumns+` FROM sessions WHERE user_id = ? AND expires_at > ?`, userId, now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		session, err := scanSession(rows)
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, session)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+func (db *SQLiteDB) RevokeSession(userId int, id string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var owner int
+	err = tx.QueryRow(`SELECT user_id FROM sessions WHERE id = ?`, id).Scan(&owner)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && owner != userId) {
+		return ErrSessionNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	err = revokeSQLiteSession(tx, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) RevokeSessions(userId int) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = revokeSQLiteSessions(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// revokeSQLiteSessions ends every session of the user like revokeSQLiteSession
+func revokeSQLiteSessions(tx *sql.Tx, userId int) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO revoked_access_tokens (id, expires_at)
+SELECT access_token_id, access_expires_at FROM refresh_tokens
+WHERE family_id IN (SELECT id FROM sessions WHERE user_id = ?) AND access_token_id != ''`, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM refresh_tokens WHERE family_id IN (SELECT id FROM sessions WHERE user_id = ?)`, userId)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM sessions WHERE user_id = ?`, userId)
+	return err
+}
+
+func (db *SQLiteDB) CreatePasswordReset(email string, token string, now time.Time, ttl time.Duration) error {
+	email, err := NormalizeEmail(email)
+	if err != nil {
+		return ErrUserNotFound
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var userId int
+	err = tx.QueryRow(`SELECT id FROM users WHERE email = ?`, email).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// a new token replaces the ones sent before
+	_, err = tx.Exec(`DELETE FROM password_resets WHERE user_id = ? OR expires_at <= ?`, userId, now.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO password_resets (hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		hashToken(token), userId, now.UnixNano(), now.Add(ttl).UnixNano())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) ResetPassword(token string, password string, now time.Time) error {
+	hashedPassword, err := db.hasher.Hash(password)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hash := hashToken(token)
+	var userId int
+	var expiresAt int64
+	err = tx.QueryRow(`SELECT user_id, expires_at FROM password_resets WHERE hash = ?`, hash).Scan(&userId, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrResetTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM password_resets WHERE hash = ?`, hash)
+	if err != nil {
+		return err
+	}
+
+	if now.UnixNano() >= expiresAt {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		return ErrResetTokenExpired
+	}
+
+	res, err := tx.Exec(`UPDATE users SET password = ? WHERE id = ?`, hashedPassword, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrUserNotFound
+	}
+
+	err = revokeSQLiteSessions(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) CreateEmailVerification(userId int, token string, now time.Time, ttl time.Duration) (string, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var email string
+	var verified bool
+	err = tx.QueryRow(`SELECT email, email_verified FROM users WHERE id = ?`, userId).Scan(&email, &verified)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrUserNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if verified {
+		return "", ErrEmailVerified
+	}
+
+	// a new token replaces the ones sent before
+	_, err = tx.Exec(`DELETE FROM email_verifications WHERE user_id = ? OR expires_at <= ?`, userId, now.UnixNano())
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(`INSERT INTO email_verifications (hash, user_id, email, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+		hashToken(token), userId, email, now.UnixNano(), now.Add(ttl).UnixNano())
+	if err != nil {
+		return "", err
+	}
+
+	return email, tx.Commit()
+}
+
+func (db *SQLiteDB) VerifyEmail(token string, now time.Time) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	hash := hashToken(token)
+	var userId int
+	var email string
+	var expiresAt int64
+	err = tx.QueryRow(`SELECT user_id, email, expires_at FROM email_verifications WHERE hash = ?`, hash).Scan(&userId, &email, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrVerificationTokenNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM email_verifications WHERE hash = ?`, hash)
+	if err != nil {
+		return err
+	}
+
+	if now.UnixNano() >= expiresAt {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		return ErrVerificationTokenExpired
+	}
+
+	// the user may have moved to another email since
+	res, err := tx.Exec(`UPDATE users SET email_verified = 1 WHERE id = ? AND email = ?`, userId, email)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		return ErrVerificationTokenNotFound
+	}
+
+	return tx.Commit()
+}
+
+// loadSQLiteTOTP reads the authenticator of the user with its recovery codes
+func loadSQLiteTOTP(tx *sql.Tx, userId int) (TOTP, error) {
+	totp := TOTP{UserId: userId, RecoveryCodes: []string{}}
+	var createdAt int64
+	err := tx.QueryRow(`SELECT secret, confirmed, created_at, last_step FROM totp WHERE user_id = ?`, userId).
+		Scan(&totp.Secret, &totp.Confirmed, &createdAt, &totp.LastStep)
+	if errors.Is(err, sql.ErrNoRows) {
+		return TOTP{}, ErrTOTPNotEnrolled
+	}
+	if err != nil {
+		return TOTP{}, err
+	}
+	totp.CreatedAt = time.Unix(0, createdAt).UTC()
+
+	rows, err := tx.Query(`SELECT hash FROM totp_recovery_codes WHERE user_id = ?`, userId)
+	if err != nil {
+		return TOTP{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		err = rows.Scan(&hash)
+		if err != nil {
+			return TOTP{}, err
+		}
+		totp.RecoveryCodes = append(totp.RecoveryCodes, hash)
+	}
+
+	return totp, rows.Err()
+}
+
+// saveSQLiteTOTP writes the authenticator of a user with its recovery codes
+func saveSQLiteTOTP(tx *sql.Tx, totp TOTP) error {
+	_, err := tx.Exec(`INSERT OR REPLACE INTO totp (user_id, secret, confirmed, created_at, last_step) VALUES (?, ?, ?, ?, ?)`,
+		totp.UserId, totp.Secret, totp.Confirmed, totp.CreatedAt.UnixNano(), totp.LastStep)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = ?`, totp.UserId)
+	if err != nil {
+		return err
+	}
+
+	for _, hash := range totp.RecoveryCodes {
+		_, err = tx.Exec(`INSERT INTO totp_recovery_codes (user_id, hash) VALUES (?, ?)`, totp.UserId, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) HasTOTP(userId int) (bool, error) {
+	var confirmed bool
+	err := db.conn.QueryRow(`SELECT confirmed FROM totp WHERE user_id = ?`, userId).Scan(&confirmed)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, nil
+	}
+
+	return confirmed, err
+}
+
+func (db *SQLiteDB) EnrollTOTP(userId int, secret string, now time.Time) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT id FROM users WHERE id = ?`, userId).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	totp, err := loadSQLiteTOTP(tx, userId)
+	if err != nil && !errors.Is(err, ErrTOTPNotEnrolled) {
+		return err
+	}
+	if err == nil && totp.Confirmed {
+		return ErrTOTPEnrolled
+	}
+
+	err = saveSQLiteTOTP(tx, TOTP{UserId: userId, Secret: sealSecret(db.keys, secret), CreatedAt: now})
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) ConfirmTOTP(userId int, code string, recoveryCodes []string, now time.Time, check TOTPCheck) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	totp, err := loadSQLiteTOTP(tx, userId)
+	if err != nil {
+		return err
+	}
+	if totp.Confirmed {
+		return ErrTOTPEnrolled
+	}
+
+	totp, step, ok, err := checkSecret(db.keys, totp, code, now, check)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	totp.Confirmed = true
+	totp.LastStep = step
+	totp.RecoveryCodes = make([]string, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		totp.RecoveryCodes = append(totp.RecoveryCodes, hashRecoveryCode(code))
+	}
+
+	err = saveSQLiteTOTP(tx, totp)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) DisableTOTP(userId int, code string, now time.Time, check TOTPCheck) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	totp, err := loadSQLiteTOTP(tx, userId)
+	if err != nil {
+		return err
+	}
+	if !totp.Confirmed {
+		return ErrTOTPNotEnrolled
+	}
+
+	_, ok, err := matchCode(db.keys, totp, code, now, check)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	_, err = tx.Exec(`DELETE FROM totp_recovery_codes WHERE user_id = ?`, userId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM totp WHERE user_id = ?`, userId)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) CreateMFAChallenge(token string, userId int, now time.Time, ttl time.Duration) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT id FROM users WHERE id = ?`, userId).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM mfa_challenges WHERE expires_at <= ?`, now.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO mfa_challenges (hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		hashToken(token), userId, now.UnixNano(), now.Add(ttl).UnixNano())
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) GetMFAChallengeUser(token string) (int, error) {
+	var userId int
+	err := db.conn.QueryRow(`SELECT user_id FROM mfa_challenges WHERE hash = ?`, hashToken(token)).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrMFAChallengeNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return userId, nil
+}
+
+func (db *SQLiteDB) CompleteMFAChallenge(token string, code string, now time.Time, check TOTPCheck) (int, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	hash := hashToken(token)
+	var userId, attempts int
+	var expiresAt int64
+	err = tx.QueryRow(`SELECT user_id, expires_at, attempts FROM mfa_challenges WHERE hash = ?`, hash).Scan(&userId, &expiresAt, &attempts)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, ErrMFAChallengeNotFound
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	// useChallenge drops the challenge and returns failure once committed
+	useChallenge := func(failure error) (int, error) {
+		_, err := tx.Exec(`DELETE FROM mfa_challenges WHERE hash = ?`, hash)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			return 0, err
+		}
+		return 0, failure
+	}
+
+	if now.UnixNano() >= expiresAt {
+		return useChallenge(ErrMFAChallengeExpired)
+	}
+
+	totp, err := loadSQLiteTOTP(tx, userId)
+	if errors.Is(err, ErrTOTPNotEnrolled) || err == nil && !totp.Confirmed {
+		return useChallenge(ErrTOTPNotEnrolled)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	totp, ok, err := matchCode(db.keys, totp, code, now, check)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		if attempts+1 >= MaxMFAAttempts {
+			return useChallenge(ErrInvalidMFACode)
+		}
+		_, err = tx.Exec(`UPDATE mfa_challenges SET attempts = attempts + 1 WHERE hash = ?`, hash)
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			return 0, err
+		}
+		return 0, ErrInvalidMFACode
+	}
+
+	err = saveSQLiteTOTP(tx, totp)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(`DELETE FROM mfa_challenges WHERE hash = ?`, hash)
+	if err != nil {
+		return 0, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, err
+	}
+
+	return userId, nil
+}
+
+// Reset replaces everything in the database with the contents
+// of the seed file, or empties it when seedPath is empty
+const apiKeyColumns = `id, hash, user_id, name, prefix, scopes, created_at, last_used_at`
+
+// scanAPIKey reads a row of apiKeyColumns
+func scanAPIKey(row interface{ Scan(dest ...any) error }) (APIKey, error) {
+	key := APIKey{}
+	var scopes string
+	var createdAt, lastUsedAt int64
+	err := row.Scan(&key.Id, &key.Hash, &key.UserId, &key.Name, &key.Prefix, &scopes, &createdAt, &lastUsedAt)
+	key.Scopes = strings.Fields(scopes)
+	key.CreatedAt = time.Unix(0, createdAt).UTC()
+	if lastUsedAt != 0 {
+		key.LastUsedAt = time.Unix(0, lastUsedAt).UTC()
+	}
+	return key, err
+}
+
+// insertSQLiteAPIKey writes key, a zero last use is stored as 0
+func insertSQLiteAPIKey(tx *sql.Tx, key APIKey) error {
+	var lastUsedAt int64
+	if !key.LastUsedAt.IsZero() {
+		lastUsedAt = key.LastUsedAt.UnixNano()
+	}
+
+	_, err := tx.Exec(`INSERT INTO api_keys (`+apiKeyColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		key.Id, key.Hash, key.UserId, key.Name, key.Prefix, strings.Join(key.Scopes, " "), key.CreatedAt.UnixNano(), lastUsedAt)
+	return err
+}
+
+func (db *SQLiteDB) CreateAPIKey(token string, key APIKey) (APIKey, error) {
+	scopes, err := ValidateScopes(key.Scopes)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.Scopes = scopes
+	key.Hash = hashToken(token)
+	key.LastUsedAt = time.Time{}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return APIKey{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT id FROM users WHERE id = ?`, key.UserId).Scan(&key.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrUserNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	err = insertSQLiteAPIKey(tx, key)
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	return key, nil
+}
+
+func (db *SQLiteDB) GetAPIKeys(userId int) ([]APIKey, error) {
+	rows, err := db.conn.Query(`SELECT `+apiKeyColumns+` FROM api_keys WHERE user_id = ?`, userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortAPIKeys(keys)
+
+	return keys, nil
+}
+
+func (db *SQLiteDB) RevokeAPIKey(userId int, id string) error {
+	res, err := db.conn.Exec(`DELETE FROM api_keys WHERE id = ? AND user_id = ?`, id, userId)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) UseAPIKey(token string, now time.Time) (APIKey, error) {
+	key, err := scanAPIKey(db.conn.QueryRow(`SELECT `+apiKeyColumns+` FROM api_keys WHERE hash = ?`, hashToken(token)))
+	if errors.Is(err, sql.ErrNoRows) {
+		return APIKey{}, ErrAPIKeyNotFound
+	}
+	if err != nil {
+		return APIKey{}, err
+	}
+
+	if now.Sub(key.LastUsedAt) >= APIKeyUseResolution {
+		key.LastUsedAt = now
+		_, err = db.conn.Exec(`UPDATE api_keys SET last_used_at = ? WHERE hash = ?`, now.UnixNano(), key.Hash)
+		if err != nil {
+			return APIKey{}, err
+		}
+	}
+
+	return key, nil
+}
+
+const oauthClientColumns = `id, secret_hash, owner_id, name, redirect_uris, scopes, created_at`
+
+// scanOAuthClient reads a row of oauthClientColumns
+func scanOAuthClient(row interface{ Scan(dest ...any) error }) (OAuthClient, error) {
+	client := OAuthClient{}
+	var redirectURIs, scopes string
+	var createdAt int64
+	err := row.Scan(&client.Id, &client.SecretHash, &client.OwnerId, &client.Name, &redirectURIs, &scopes, &createdAt)
+	client.RedirectURIs = strings.Fields(redirectURIs)
+	client.Scopes = strings.Fields(scopes)
+	client.CreatedAt = time.Unix(0, createdAt).UTC()
+	return client, err
+}
+
+// insertSQLiteOAuthClient writes client, redirect uris can't hold
+// whitespace so they are joined with newlines
+func insertSQLiteOAuthClient(tx *sql.Tx, client OAuthClient) error {
+	_, err := tx.Exec(`INSERT INTO oauth_clients (`+oauthClientColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		client.Id, client.SecretHash, client.OwnerId, client.Name, strings.Join(client.RedirectURIs, "\n"), strings.Join(client.Scopes, " "), client.CreatedAt.UnixNano())
+	return err
+}
+
+const authorizationCodeColumns = `hash, client_id, user_id, redirect_uri, scopes, code_challenge, created_at, expires_at`
+
+// scanAuthorizationCode reads a row of authorizationCodeColumns
+func scanAuthorizationCode(row interface{ Scan(dest ...any) error }) (AuthorizationCode, error) {
+	code := AuthorizationCode{}
+	var scopes string
+	var createdAt, expiresAt int64
+	err := row.Scan(&code.Hash, &code.ClientId, &code.UserId, &code.RedirectURI, &scopes, &code.CodeChallenge, &createdAt, &expiresAt)
+	code.Scopes = strings.Fields(scopes)
+	code.CreatedAt = time.Unix(0, createdAt).UTC()
+	code.ExpiresAt = time.Unix(0, expiresAt).UTC()
+	return code, err
+}
+
+// insertSQLiteAuthorizationCode writes code
+func insertSQLiteAuthorizationCode(tx *sql.Tx, code AuthorizationCode) error {
+	_, err := tx.Exec(`INSERT INTO authorization_codes (`+authorizationCodeColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		code.Hash, code.ClientId, code.UserId, code.RedirectURI, strings.Join(code.Scopes, " "), code.CodeChallenge, code.CreatedAt.UnixNano(), code.ExpiresAt.UnixNano())
+	return err
+}
+
+func (db *SQLiteDB) CreateOAuthClient(secret string, client OAuthClient) (OAuthClient, error) {
+	scopes, err := ValidateScopes(client.Scopes)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	client.Scopes = scopes
+	client.SecretHash = ""
+	if secret != "" {
+		client.SecretHash = hashToken(secret)
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT id FROM users WHERE id = ?`, client.OwnerId).Scan(&client.OwnerId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return OAuthClient{}, ErrUserNotFound
+	}
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	err = insertSQLiteOAuthClient(tx, client)
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+func (db *SQLiteDB) GetOAuthClient(id string) (OAuthClient, error) {
+	client, err := scanOAuthClient(db.conn.QueryRow(`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE id = ?`, id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return OAuthClient{}, ErrOAuthClientNotFound
+	}
+	if err != nil {
+		return OAuthClient{}, err
+	}
+
+	return client, nil
+}
+
+func (db *SQLiteDB) GetOAuthClients(ownerId int) ([]OAuthClient, error) {
+	rows, err := db.conn.Query(`SELECT `+oauthClientColumns+` FROM oauth_clients WHERE owner_id = ?`, ownerId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []OAuthClient{}
+	for rows.Next() {
+		client, err := scanOAuthClient(rows)
+		if err != nil {
+			return nil, err
+		}
+		clients = append(clients, client)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sortOAuthClients(clients)
+
+	return clients, nil
+}
+
+func (db *SQLiteDB) DeleteOAuthClient(ownerId int, id string) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// the codes point at the client so they go first
+	_, err = tx.Exec(`DELETE FROM authorization_codes WHERE client_id IN (SELECT id FROM oauth_clients WHERE id = ? AND owner_id = ?)`, id, ownerId)
+	if err != nil {
+		return err
+	}
+
+	res, err := tx.Exec(`DELETE FROM oauth_clients WHERE id = ? AND owner_id = ?`, id, ownerId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrOAuthClientNotFound
+	}
+
+	_, err = tx.Exec(`INSERT OR REPLACE INTO revoked_access_tokens (id, expires_at)
+SELECT access_token_id, access_expires_at FROM refresh_tokens
+WHERE family_id IN (SELECT id FROM sessions WHERE client_id = ?) AND access_token_id != ''`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM refresh_tokens WHERE family_id IN (SELECT id FROM sessions WHERE client_id = ?)`, id)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM sessions WHERE client_id = ?`, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) CreateAuthorizationCode(code string, grant AuthorizationCode) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT id FROM oauth_clients WHERE id = ?`, grant.ClientId).Scan(&grant.ClientId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrOAuthClientNotFound
+	}
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(`SELECT id FROM users WHERE id = ?`, grant.UserId).Scan(&grant.UserId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ErrUserNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	// expired codes are pruned as new ones are issued
+	_, err = tx.Exec(`DELETE FROM authorization_codes WHERE expires_at <= ?`, grant.CreatedAt.UnixNano())
+	if err != nil {
+		return err
+	}
+
+	grant.Hash = hashToken(code)
+	err = insertSQLiteAuthorizationCode(tx, grant)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (db *SQLiteDB) UseAuthorizationCode(code string, now time.Time) (AuthorizationCode, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	defer tx.Rollback()
+
+	hash := hashToken(code)
+	grant, err := scanAuthorizationCode(tx.QueryRow(`SELECT `+authorizationCodeColumns+` FROM authorization_codes WHERE hash = ?`, hash))
+	if errors.Is(err, sql.ErrNoRows) {
+		return AuthorizationCode{}, ErrAuthorizationCodeNotFound
+	}
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+
+	_, err = tx.Exec(`DELETE FROM authorization_codes WHERE hash = ?`, hash)
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+	err = tx.Commit()
+	if err != nil {
+		return AuthorizationCode{}, err
+	}
+
+	if !now.Before(grant.ExpiresAt) {
+		return AuthorizationCode{}, ErrAuthorizationCodeExpired
+	}
+
+	return grant, nil
+}
+
+// scanAccountDeletion reads a row of user_id, requested_at and purge_at
+func scanAccountDeletion(row interface{ Scan(dest ...any) error }) (AccountDeletion, error) {
+	deletion := AccountDeletion{}
+	var requestedAt, purgeAt int64
+	err := row.Scan(&deletion.UserId, &requestedAt, &purgeAt)
+	deletion.RequestedAt = time.Unix(0, requestedAt).UTC()
+	deletion.PurgeAt = time.Unix(0, purgeAt).UTC()
+	return deletion, err
+}
+
+func (db *SQLiteDB) ScheduleAccountDeletion(userId int, now time.Time, grace time.Duration) (AccountDeletion, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return AccountDeletion{}, err
+	}
+	defer tx.Rollback()
+
+	err = tx.QueryRow(`SELECT id FROM users WHERE id = ?`, userId).Scan(&userId)
+	if errors.Is(err, sql.ErrNoRows) {
+		return AccountDeletion{}, ErrUserNotFound
+	}
+	if err != nil {
+		return AccountDeletion{}, err
+	}
+
+	err = revokeSQLiteSessions(tx, userId)
+	if err != nil {
+		return AccountDeletion{}, err
+	}
+
+	for _, statement := range []string{
+		`DELETE FROM authorization_codes WHERE user_id = ?`,
+		`DELETE FROM api_keys WHERE user_id = ?`,
+	} {
+		_, err = tx.Exec(statement, userId)
+		if err != nil {
+			return AccountDeletion{}, err
+		}
+	}
+
+	// a deletion that is already pending is kept
+	_, err = tx.Exec(`INSERT OR IGNORE INTO account_deletions (user_id, requested_at, purge_at) VALUES (?, ?, ?)`,
+		userId, now.UnixNano(), now.Add(grace).UnixNano())
+	if err != nil {
+		return AccountDeletion{}, err
+	}
+
+	deletion, err := scanAccountDeletion(tx.QueryRow(`SELECT user_id, requested_at, purge_at FROM account_deletions WHERE user_id = ?`, userId))
+	if err != nil {
+		return AccountDeletion{}, err
+	}
+
+	return deletion, tx.Commit()
+}
+
+func (db *SQLiteDB) GetAccountDeletion(userId int) (AccountDeletion, error) {
+	deletion, err := scanAccountDeletion(db.conn.QueryRow(`SELECT user_id, requested_at, purge_at FROM account_deletions WHERE user_id = ?`, userId))
+	if errors.Is(err, sql.ErrNoRows) {
+		return AccountDeletion{}, ErrAccountDeletionNotFound
+	}
+	if err != nil {
+		return AccountDeletion{}, err
+	}
+
+	return deletion, nil
+}
+
+func (db *SQLiteDB) CancelAccountDeletion(userId int) error {
+	res, err := db.conn.Exec(`DELETE FROM account_deletions WHERE user_id = ?`, userId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrAccountDeletionNotFound
+	}
+
+	return nil
+}
+
+func (db *SQLiteDB) PurgeAccounts(now time.Time, chirps ChirpPolicy) ([]int, error) {
+	chirps, err := ParseChirpPolicy(string(chirps))
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`SELECT user_id FROM account_deletions WHERE purge_at <= ? ORDER BY user_id`, now.UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	purged := []int{}
+	for rows.Next() {
+		var userId int
+		err = rows.Scan(&userId)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		purged = append(purged, userId)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, userId := range purged {
+		err = purgeSQLiteAccount(tx, userId, chirps)
+		if err != nil {
+			return nil, fmt.Errorf("purging user %d: %w", userId, err)
+		}
+	}
+
+	return purged, tx.Commit()
+}
+
+// purgeSQLiteAccount deletes the user and every row that points at it
+// like DB.PurgeAccounts
+func purgeSQLiteAccount(tx *sql.Tx, userId int, chirps ChirpPolicy) error {
+	err := revokeSQLiteSessions(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	// sessions other users started with the clients of the user
+	_, err = tx.Exec(`INSERT OR REPLACE INTO revoked_access_tokens (id, expires_at)
+SELECT access_token_id, access_expires_at FROM refresh_tokens
+WHERE family_id IN (SELECT id FROM sessions WHERE client_id IN (SELECT id FROM oauth_clients WHERE owner_id = ?)) AND access_token_id != ''`, userId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`DELETE FROM refresh_tokens
+WHERE family_id IN (SELECT id FROM sessions WHERE client_id IN (SELECT id FROM oauth_clients WHERE owner_id = ?))`, userId)
+	if err != nil {
+		return err
+	}
+
+	statements := []string{
+		`DELETE FROM sessions WHERE client_id IN (SELECT id FROM oauth_clients WHERE owner_id = ?)`,
+		`DELETE FROM authorization_codes WHERE user_id = ?1 OR client_id IN (SELECT id FROM oauth_clients WHERE owner_id = ?1)`,
+		`DELETE FROM oauth_clients WHERE owner_id = ?`,
+		`DELETE FROM api_keys WHERE user_id = ?`,
+		`DELETE FROM password_resets WHERE user_id = ?`,
+		`DELETE FROM email_verifications WHERE user_id = ?`,
+		`DELETE FROM mfa_challenges WHERE user_id = ?`,
+		`DELETE FROM totp_recovery_codes WHERE user_id = ?`,
+		`DELETE FROM totp WHERE user_id = ?`,
+		`DELETE FROM account_deletions WHERE user_id = ?`,
+		`DELETE FROM users WHERE id = ?`,
+	}
+	for _, statement := range statements {
+		_, err = tx.Exec(statement, userId)
+		if err != nil {
+			return err
+		}
+	}
+
+	if chirps == ChirpsAnonymize {
+		_, err = tx.Exec(`UPDATE chirps SET auther_id = ? WHERE auther_id = ?`, DeletedUserId, userId)
+		return err
+	}
+
+	_, err = tx.Exec(`DELETE FROM chirps WHERE auther_id = ?`, userId)
+	return err
+}
+
+const auditEventColumns = `id, time, action, actor_id, user_id, token_id, reason, method, path`
+
+// scanAuditEvent reads a row of auditEventColumns
+func scanAuditEvent(row interface{ Scan(dest ...any) error }) (AuditEvent, error) {
+	event := AuditEvent{}
+	var at int64
+	err := row.Scan(&event.Id, &at, &event.Action, &event.ActorId, &event.UserId, &event.TokenId, &event.Reason, &event.Method, &event.Path)
+	event.Time = time.Unix(0, at).UTC()
+	return event, err
+}
+
+func insertSQLiteAuditEvent(tx *sql.Tx, event AuditEvent) error {
+	_, err := tx.Exec(`INSERT INTO audit_log (`+auditEventColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.Id, event.Time.UnixNano(), event.Action, event.ActorId, event.UserId, event.TokenId, event.Reason, event.Method, event.Path)
+	return err
+}
+
+func (db *SQLiteDB) RecordAuditEvent(event AuditEvent) (AuditEvent, error) {
+	res, err := db.conn.Exec(`INSERT INTO audit_log (time, action, actor_id, user_id, token_id, reason, method, path) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		event.Time.UnixNano(), event.Action, event.ActorId, event.UserId, event.TokenId, event.Reason, event.Method, event.Path)
+	if err != nil {
+		return AuditEvent{}, err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return AuditEvent{}, err
+	}
+	event.Id = int(id)
+
+	return event, nil
+}
+
+func (db *SQLiteDB) GetAuditEvents(filter AuditFilter) ([]AuditEvent, error) {
+	query := `SELECT ` + auditEventColumns + ` FROM audit_log WHERE id > ?`
+	args := []any{filter.After}
+	if filter.ActorId != 0 {
+		query += ` AND actor_id = ?`
+		args = append(args, filter.ActorId)
+	}
+	if filter.UserId != 0 {
+		query += ` AND user_id = ?`
+		args = append(args, filter.UserId)
+	}
+	if filter.TokenId != "" {
+		query += ` AND token_id = ?`
+		args = append(args, filter.TokenId)
+	}
+	if filter.Action != "" {
+		query += ` AND action = ?`
+		args = append(args, filter.Action)
+	}
+	query += ` ORDER BY id`
+	if filter.Limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, filter.Limit)
+	}
+
+	rows, err := db.conn.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []AuditEvent{}
+	for rows.Next() {
+		event, err := scanAuditEvent(rows)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, event)
+	}
+
+	return events, rows.Err()
+}
+
+func (db *SQLiteDB) RevokeAccessToken(token AccessToken) error {
+	_, err := db.conn.Exec(`INSERT OR REPLACE INTO revoked_access_tokens (id, expires_at) VALUES (?, ?)`, token.Id, token.ExpiresAt.UnixNano())
+	return err
+}
+
+func (db *SQLiteDB) Reset(seedPath string) error {
+	dbStructure, err := loadSeed(seedPath)
+	if err != nil {
+		return err
+	}
+
+	return db.Restore(dbStructure)
+}
+
+// Snapshot reads every table inside one transaction
+func (db *SQLiteDB) Snapshot() (DBStructure, error) {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return DBStructure{}, err
+	}
+	defer tx.Rollback()
+
+	dbStructure, err := parseDB(nil)
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT id, email, password, is_chirpy_red, email_verified, role FROM users`, func(rows *sql.Rows) error {
+		user := User{}
+		err := rows.Scan(&user.Id, &user.Email, &user.Password, &user.IsChirpyRed, &user.EmailVerified, &user.Role)
+		dbStructure.Users[user.Email] = user
+		dbStructure.UsersById[user.Id] = user
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT id, body, auther_id FROM chirps`, func(rows *sql.Rows) error {
+		chirp := Chirp{}
+		err := rows.Scan(&chirp.Id, &chirp.Body, &chirp.AutherId)
+		dbStructure.Chirps[chirp.Id] = chirp
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT hash, user_id, family_id, created_at, expires_at, replaced_by, access_token_id, access_expires_at FROM refresh_tokens`, func(rows *sql.Rows) error {
+		record := RefreshToken{}
+		var createdAt, expiresAt, accessExpiresAt int64
+		var accessTokenId string
+		err := rows.Scan(&record.Hash, &record.UserId, &record.FamilyId, &createdAt, &expiresAt, &record.ReplacedBy, &accessTokenId, &accessExpiresAt)
+		record.CreatedAt = time.Unix(0, createdAt).UTC()
+		record.ExpiresAt = time.Unix(0, expiresAt).UTC()
+		if accessTokenId != "" {
+			record.AccessToken = &AccessToken{Id: accessTokenId, ExpiresAt: time.Unix(0, accessExpiresAt).UTC()}
+		}
+		dbStructure.RefreshTokens[record.Hash] = record
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT `+sessionColumns+` FROM sessions`, func(rows *sql.Rows) error {
+		session, err := scanSession(rows)
+		dbStructure.Sessions[session.Id] = session
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT id, expires_at FROM revoked_access_tokens`, func(rows *sql.Rows) error {
+		var id string
+		var expiresAt int64
+		err := rows.Scan(&id, &expiresAt)
+		dbStructure.RevokedAccessTokens[id] = time.Unix(0, expiresAt).UTC()
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT hash, user_id, created_at, expires_at FROM password_resets`, func(rows *sql.Rows) error {
+		reset := PasswordReset{}
+		var createdAt, expiresAt int64
+		err := rows.Scan(&reset.Hash, &reset.UserId, &createdAt, &expiresAt)
+		reset.CreatedAt = time.Unix(0, createdAt).UTC()
+		reset.ExpiresAt = time.Unix(0, expiresAt).UTC()
+		dbStructure.PasswordResets[reset.Hash] = reset
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT hash, user_id, email, created_at, expires_at FROM email_verifications`, func(rows *sql.Rows) error {
+		verification := EmailVerification{}
+		var createdAt, expiresAt int64
+		err := rows.Scan(&verification.Hash, &verification.UserId, &verification.Email, &createdAt, &expiresAt)
+		verification.CreatedAt = time.Unix(0, createdAt).UTC()
+		verification.ExpiresAt = time.Unix(0, expiresAt).UTC()
+		dbStructure.EmailVerifications[verification.Hash] = verification
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT user_id, secret, confirmed, created_at, last_step FROM totp`, func(rows *sql.Rows) error {
+		totp := TOTP{RecoveryCodes: []string{}}
+		var createdAt int64
+		err := rows.Scan(&totp.UserId, &totp.Secret, &totp.Confirmed, &createdAt, &totp.LastStep)
+		totp.CreatedAt = time.Unix(0, createdAt).UTC()
+		dbStructure.TOTP[totp.UserId] = totp
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT user_id, hash FROM totp_recovery_codes ORDER BY user_id, hash`, func(rows *sql.Rows) error {
+		var userId int
+		var hash string
+		err := rows.Scan(&userId, &hash)
+		totp := dbStructure.TOTP[userId]
+		totp.RecoveryCodes = append(totp.RecoveryCodes, hash)
+		dbStructure.TOTP[userId] = totp
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT hash, user_id, created_at, expires_at, attempts FROM mfa_challenges`, func(rows *sql.Rows) error {
+		challenge := MFAChallenge{}
+		var createdAt, expiresAt int64
+		err := rows.Scan(&challenge.Hash, &challenge.UserId, &createdAt, &expiresAt, &challenge.Attempts)
+		challenge.CreatedAt = time.Unix(0, createdAt).UTC()
+		challenge.ExpiresAt = time.Unix(0, expiresAt).UTC()
+		dbStructure.MFAChallenges[challenge.Hash] = challenge
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT `+apiKeyColumns+` FROM api_keys`, func(rows *sql.Rows) error {
+		key, err := scanAPIKey(rows)
+		dbStructure.APIKeys[key.Hash] = key
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT `+oauthClientColumns+` FROM oauth_clients`, func(rows *sql.Rows) error {
+		client, err := scanOAuthClient(rows)
+		dbStructure.OAuthClients[client.Id] = client
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT `+authorizationCodeColumns+` FROM authorization_codes`, func(rows *sql.Rows) error {
+		code, err := scanAuthorizationCode(rows)
+		dbStructure.AuthorizationCodes[code.Hash] = code
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT user_id, requested_at, purge_at FROM account_deletions`, func(rows *sql.Rows) error {
+		deletion, err := scanAccountDeletion(rows)
+		dbStructure.AccountDeletions[deletion.UserId] = deletion
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT `+auditEventColumns+` FROM audit_log`, func(rows *sql.Rows) error {
+		event, err := scanAuditEvent(rows)
+		dbStructure.AuditLog[event.Id] = event
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	err = queryRows(tx, `SELECT name, seq FROM sqlite_sequence`, func(rows *sql.Rows) error {
+		var name string
+		var seq int
+		err := rows.Scan(&name, &seq)
+		switch name {
+		case "users":
+			dbStructure.Sequences.Users = seq
+		case "chirps":
+			dbStructure.Sequences.Chirps = seq
+		case "audit_log":
+			dbStructure.Sequences.AuditEvents = seq
+		}
+		return err
+	})
+	if err != nil {
+		return DBStructure{}, err
+	}
+
+	return dbStructure, nil
+}
+
+// queryRows calls scan for every row the query returns
+func queryRows(tx *sql.Tx, query string, scan func(rows *sql.Rows) error) error {
+	rows, err := tx.Query(query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		err = scan(rows)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// Restore replaces everything in the database with dbStructure
+func (db *SQLiteDB) Restore(dbStructure DBStructure) error {
+	tx, err := db.conn.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"audit_log", "account_deletions", "authorization_codes", "oauth_clients", "api_keys", "mfa_challenges", "totp_recovery_codes", "totp", "email_verifications", "password_resets", "revoked_access_tokens", "refresh_tokens", "sessions", "chirps", "users"} {
+		_, err = tx.Exec(`DELETE FROM ` + table)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, user := range dbStructure.UsersById {
+		_, err = tx.Exec(`INSERT INTO users (id, email, password, is_chirpy_red, email_verified, role) VALUES (?, ?, ?, ?, ?, ?)`,
+			user.Id, user.Email, user.Password, user.IsChirpyRed, user.EmailVerified, user.Role)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, chirp := range dbStructure.Chirps {
+		_, err = tx.Exec(`INSERT INTO chirps (id, body, auther_id) VALUES (?, ?, ?)`, chirp.Id, chirp.Body, chirp.AutherId)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, record := range dbStructure.RefreshTokens {
+		var accessTokenId string
+		var accessExpiresAt int64
+		if record.AccessToken != nil {
+			accessTokenId, accessExpiresAt = record.AccessToken.Id, record.AccessToken.ExpiresAt.UnixNano()
+		}
+		_, err = tx.Exec(`INSERT INTO refresh_tokens (hash, user_id, family_id, created_at, expires_at, replaced_by, access_token_id, access_expires_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+			record.Hash, record.UserId, record.FamilyId, record.CreatedAt.UnixNano(), record.ExpiresAt.UnixNano(), record.ReplacedBy, accessTokenId, accessExpiresAt)
+		if err != nil {
+			return err
+		}
+	}
+
+	for id, expiresAt := range dbStructure.RevokedAccessTokens {
+		_, err = tx.Exec(`INSERT INTO revoked_access_tokens (id, expires_at) VALUES (?, ?)`, id, expiresAt.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, session := range dbStructure.Sessions {
+		_, err = tx.Exec(`INSERT INTO sessions (`+sessionColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+			session.Id, session.UserId, session.CreatedAt.UnixNano(), session.LastUsedAt.UnixNano(), session.ExpiresAt.UnixNano(), session.UserAgent, session.IP,
+			session.ClientId, strings.Join(session.Scopes, " "))
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, reset := range dbStructure.PasswordResets {
+		_, err = tx.Exec(`INSERT INTO password_resets (hash, user_id, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+			reset.Hash, reset.UserId, reset.CreatedAt.UnixNano(), reset.ExpiresAt.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, verification := range dbStructure.EmailVerifications {
+		_, err = tx.Exec(`INSERT INTO email_verifications (hash, user_id, email, created_at, expires_at) VALUES (?, ?, ?, ?, ?)`,
+			verification.Hash, verification.UserId, verification.Email, verification.CreatedAt.UnixNano(), verification.ExpiresAt.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, totp := range dbStructure.TOTP {
+		err = saveSQLiteTOTP(tx, totp)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, challenge := range dbStructure.MFAChallenges {
+		_, err = tx.Exec(`INSERT INTO mfa_challenges (hash, user_id, created_at, expires_at, attempts) VALUES (?, ?, ?, ?, ?)`,
+			challenge.Hash, challenge.UserId, challenge.CreatedAt.UnixNano(), challenge.ExpiresAt.UnixNano(), challenge.Attempts)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range dbStructure.APIKeys {
+		err = insertSQLiteAPIKey(tx, key)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, client := range dbStructure.OAuthClients {
+		err = insertSQLiteOAuthClient(tx, client)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, code := range dbStructure.AuthorizationCodes {
+		err = insertSQLiteAuthorizationCode(tx, code)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, deletion := range dbStructure.AccountDeletions {
+		_, err = tx.Exec(`INSERT INTO account_deletions (user_id, requested_at, purge_at) VALUES (?, ?, ?)`,
+			deletion.UserId, deletion.RequestedAt.UnixNano(), deletion.PurgeAt.UnixNano())
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, event := range dbStructure.AuditLog {
+		err = insertSQLiteAuditEvent(tx, event)
+		if err != nil {
+			return err
+		}
+	}
+
+	// carry over ids already handed out so deleted ones aren't reused
+	_, err = tx.Exec(`DELETE FROM sqlite_sequence`)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`INSERT INTO sqlite_sequence (name, seq) VALUES ('users', ?), ('chirps', ?), ('audit_log', ?)`,
+		dbStructure.Sequences.Users, dbStructure.Sequences.Chirps, dbStructure.Sequences.AuditEvents)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
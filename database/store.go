@@ -0,0 +1,151 @@
+package database
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var (
+	// ErrUserNotFound is returned for ids and emails no user has
+	ErrUserNotFound = errors.New("user not found")
+	// ErrWrongPassword is returned by GetUser for a password that doesn't
+	// match the one of the user
+	ErrWrongPassword = errors.New("passwords don't match")
+)
+
+// Store is the set of operations the api needs from a storage backend
+type Store interface {
+	CreateChirp(userId int, body string) (Chirp, error)
+	GetChirps() ([]Chirp, error)
+	GetChirpById(id int) (Chirp, error)
+	DeleteChirp(id int, userId int) error
+	CreateUser(email string, password string) (ReturnedUser, error)
+	GetUser(email string, password string) (ReturnedUser, error)
+	GetUserById(id int) (ReturnedUser, error)
+	GetUserByEmail(email string) (ReturnedUser, error)
+	UpdateUser(id int, email string, password string) (ReturnedUserJwt, error)
+	MakeUserRed(id int) error
+	SetUserRole(id int, role Role) (ReturnedUserJwt, error)
+	CreateSession(token string, session Session, access AccessToken, now time.Time, ttl time.Duration) (Session, error)
+	GetSessions(userId int, now time.Time) ([]Session, error)
+	RevokeSession(userId int, id string) error
+	RevokeSessions(userId int) error
+	RotateRefreshToken(token string, next string, access AccessToken, now time.Time, ttl time.Duration) (Session, error)
+	RevokeRefreshToken(token string) error
+	GetRefreshSession(token string, now time.Time) (Session, error)
+	IsAccessTokenRevoked(id string) (bool, error)
+	RevokeAccessToken(token AccessToken) error
+	CreatePasswordReset(email string, token string, now time.Time, ttl time.Duration) error
+	ResetPassword(token string, password string, now time.Time) error
+	CreateEmailVerification(userId int, token string, now time.Time, ttl time.Duration) (string, error)
+	VerifyEmail(token string, now time.Time) error
+	HasTOTP(userId int) (bool, error)
+	EnrollTOTP(userId int, secret string, now time.Time) error
+	ConfirmTOTP(userId int, code string, recoveryCodes []string, now time.Time, check TOTPCheck) error
+	DisableTOTP(userId int, code string, now time.Time, check TOTPCheck) error
+	CreateMFAChallenge(token string, userId int, now time.Time, ttl time.Duration) error
+	GetMFAChallengeUser(token string) (int, error)
+	CompleteMFAChallenge(token string, code string, now time.Time, check TOTPCheck) (int, error)
+	CreateAPIKey(token string, key APIKey) (APIKey, error)
+	GetAPIKeys(userId int) ([]APIKey, error)
+	RevokeAPIKey(userId int, id string) error
+	UseAPIKey(token string, now time.Time) (APIKey, error)
+	CreateOAuthClient(secret string, client OAuthClient) (OAuthClient, error)
+	GetOAuthClient(id string) (OAuthClient, error)
+	GetOAuthClients(ownerId int) ([]OAuthClient, error)
+	DeleteOAuthClient(ownerId int, id string) error
+	CreateAuthorizationCode(code string, grant AuthorizationCode) error
+	UseAuthorizationCode(code string, now time.Time) (AuthorizationCode, error)
+	ScheduleAccountDeletion(userId int, now time.Time, grace time.Duration) (AccountDeletion, error)
+	GetAccountDeletion(userId int) (AccountDeletion, error)
+	CancelAccountDeletion(userId int) error
+	PurgeAccounts(now time.Time, chirps ChirpPolicy) ([]int, error)
+	RecordAuditEvent(event AuditEvent) (AuditEvent, error)
+	GetAuditEvents(filter AuditFilter) ([]AuditEvent, error)
+	Reset(seedPath string) error
+	Snapshot() (DBStructure, error)
+	Restore(dbStructure DBStructure) error
+	Close() error
+}
+
+const (
+	DriverJSON   = "json"
+	DriverSQLite = "sqlite"
+)
+
+// Open returns the store for the given driver,
+// an empty driver means the json file store.
+// options only apply to the json file store, except for the hasher and
+// the keyring, which seals the totp secrets of both stores but only
+// encrypts the whole file of the json one
+func Open(driver string, path string, options Options) (Store, error) {
+	path, err := defaultPath(driver, path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch driver {
+	case "", DriverJSON:
+		db, err := NewDBWithOptions(path, options)
+		if err != nil {
+			return nil, err
+		}
+		return db, nil
+	case DriverSQLite:
+		db, err := NewSQLiteDB(path)
+		if err != nil {
+			return nil, err
+		}
+		if options.Hasher != nil {
+			db.hasher = options.Hasher
+		}
+		db.keys = options.Keys
+		return db, nil
+	default:
+		return nil, fmt.Errorf("unknown database driver %q", driver)
+	}
+}
+
+// DefaultPath is the file of the driver when no path is given, it is kept
+// in the user config dir so it is never next to the files the server serves
+func DefaultPath(driver string) (string, error) {
+	configDir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	name := "database.json"
+	if driver == DriverSQLite {
+		name = "database.sqlite"
+	}
+
+	return filepath.Join(configDir, "chirpy", name), nil
+}
+
+// defaultPath returns path, or the default file for the driver if it is
+// empty with its directory created
+func defaultPath(driver string, path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+
+	path, err := DefaultPath(driver)
+	if err != nil {
+		return "", err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return "", err
+	}
+
+	return path, nil
+}
+
+var (
+	_ Store = (*DB)(nil)
+	_ Store = (*SQLiteDB)(nil)
+)
@@ -0,0 +1,150 @@
+package database
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"slices"
+	"time"
+)
+
+// DefaultRefreshTokenTTL is how long a refresh token is valid after it is issued
+const DefaultRefreshTokenTTL = 60 * 24 * time.Hour
+
+var (
+	// ErrTokenNotFound is returned for refresh tokens that were never
+	// issued or whose session was revoked
+	ErrTokenNotFound = errors.New("refresh token not found")
+	// ErrTokenExpired is returned for refresh tokens past their expiry
+	ErrTokenExpired = errors.New("refresh token expired")
+	// ErrTokenReused is returned when a refresh token that was already
+	// rotated is used again, the whole session is revoked when it happens
+	ErrTokenReused = errors.New("refresh token reused")
+)
+
+// RefreshToken is the stored record of a refresh token, only the hash of
+// the token is kept. Every token rotated from the same login shares the
+// family id, which is the hash of the first one and the id of the session
+type RefreshToken struct {
+	Hash      string    `json:"hash"`
+	UserId    int       `json:"user_id"`
+	FamilyId  string    `json:"family_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	// ReplacedBy is the hash of the token this one was rotated to,
+	// rotated tokens are kept until they expire to detect reuse
+	ReplacedBy string `json:"replaced_by,omitempty"`
+	// AccessToken was issued along with this token
+	AccessToken *AccessToken `json:"access_token,omitempty"`
+}
+
+// hashToken is how refresh tokens are stored, they are random
+// enough that a plain sha256 can't be reversed
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RotateRefreshToken swaps token for next, issued along with access, and
+// returns the session both belong to. Using a token that was already
+// rotated revokes the session
+func (db *DB) RotateRefreshToken(token string, next string, access AccessToken, now time.Time, ttl time.Duration) (Session, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	record, ok := db.data.RefreshTokens[hashToken(token)]
+	if !ok {
+		return Session{}, ErrTokenNotFound
+	}
+
+	if record.ReplacedBy != "" {
+		err := db.commit(db.revokeSessionEntries(record.FamilyId)...)
+		if err != nil {
+			return Session{}, err
+		}
+		return Session{}, ErrTokenReused
+	}
+
+	if !now.Before(record.ExpiresAt) {
+		return Session{}, ErrTokenExpired
+	}
+
+	nextRecord := RefreshToken{
+		Hash:        hashToken(next),
+		UserId:      record.UserId,
+		FamilyId:    record.FamilyId,
+		CreatedAt:   now,
+		ExpiresAt:   now.Add(ttl),
+		AccessToken: &access,
+	}
+	record.ReplacedBy = nextRecord.Hash
+
+	err := db.commit(
+		walEntry{Op: opTokenRotated, Token: &record},
+		walEntry{Op: opTokenIssued, Token: &nextRecord},
+	)
+	if err != nil {
+		return Session{}, err
+	}
+
+	return db.data.Sessions[record.FamilyId], nil
+}
+
+// RevokeRefreshToken ends the session of token
+func (db *DB) RevokeRefreshToken(token string) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	record, ok := db.data.RefreshTokens[hashToken(token)]
+	if !ok {
+		return ErrTokenNotFound
+	}
+
+	return db.commit(db.revokeSessionEntries(record.FamilyId)...)
+}
+
+// GetRefreshSession returns the session of token without rotating it,
+// tokens that were already rotated are treated as not found
+func (db *DB) GetRefreshSession(token string, now time.Time) (Session, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	record, ok := db.data.RefreshTokens[hashToken(token)]
+	if !ok || record.ReplacedBy != "" {
+		return Session{}, ErrTokenNotFound
+	}
+	if !now.Before(record.ExpiresAt) {
+		return Session{}, ErrTokenExpired
+	}
+
+	session, ok := db.data.Sessions[record.FamilyId]
+	if !ok {
+		return Session{}, ErrTokenNotFound
+	}
+	session.Scopes = slices.Clone(session.Scopes)
+
+	return session, nil
+}
+
+// expiredTokenEntries drops the sessions, tokens and denied access
+// tokens that expired before now, they are pruned as new sessions start
+func (db *DB) expiredTokenEntries(now time.Time) []walEntry {
+	entries := []walEntry{}
+	for id, session := range db.data.Sessions {
+		if !now.Before(session.ExpiresAt) {
+			entries = append(entries, walEntry{Op: opSessionRevoked, SessionId: id})
+		}
+	}
+	for hash, record := range db.data.RefreshTokens {
+		if !now.Before(record.ExpiresAt) {
+			entries = append(entries, walEntry{Op: opTokenRevoked, Hash: hash})
+		}
+	}
+	for id, expiresAt := range db.data.RevokedAccessTokens {
+		if !now.Before(expiresAt) {
+			entries = append(entries, walEntry{Op: opAccessTokenExpired, AccessToken: &AccessToken{Id: id, ExpiresAt: expiresAt}})
+		}
+	}
+
+	return entries
+}
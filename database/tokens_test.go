@@ -0,0 +1,141 @@
+package database
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openTestStores opens an empty store of every driver with one user
+func openTestStores(t *testing.T) map[string]Store {
+	t.Helper()
+
+	stores := map[string]Store{}
+	for _, driver := range []string{DriverJSON, DriverSQLite} {
+		store, err := Open(driver, filepath.Join(t.TempDir(), "database"), Options{Policy: PersistLog})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { store.Close() })
+
+		_, err = store.CreateUser("a@example.com", "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stores[driver] = store
+	}
+
+	return stores
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := time.Hour
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			_, err := store.CreateSession("first", Session{UserId: 1}, AccessToken{}, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			session, err := store.RotateRefreshToken("first", "second", AccessToken{}, now.Add(time.Minute), ttl)
+			if err != nil || session.UserId != 1 {
+				t.Fatalf("expected user 1, got %d %v", session.UserId, err)
+			}
+
+			// the rotated token keeps the session alive past the first expiry
+			_, err = store.RotateRefreshToken("second", "third", AccessToken{}, now.Add(ttl+time.Second), ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = store.RotateRefreshToken("first", "stolen", AccessToken{}, now.Add(ttl+2*time.Second), ttl)
+			if !errors.Is(err, ErrTokenReused) {
+				t.Fatalf("expected ErrTokenReused, got %v", err)
+			}
+
+			_, err = store.RotateRefreshToken("third", "fourth", AccessToken{}, now.Add(ttl+3*time.Second), ttl)
+			if !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("expected the session to be revoked, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRefreshTokenExpiryAndRevoke(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := time.Hour
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			_, err := store.CreateSession("expiring", Session{UserId: 1}, AccessToken{}, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = store.RotateRefreshToken("expiring", "next", AccessToken{}, now.Add(ttl), ttl)
+			if !errors.Is(err, ErrTokenExpired) {
+				t.Errorf("expected ErrTokenExpired, got %v", err)
+			}
+
+			_, err = store.CreateSession("revoked", Session{UserId: 1}, AccessToken{}, now.Add(ttl), ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.RotateRefreshToken("revoked", "next", AccessToken{}, now.Add(ttl), ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// revoking the latest token of a session revokes the older ones too
+			err = store.RevokeRefreshToken("next")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			snapshot, err := store.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(snapshot.RefreshTokens) != 0 || len(snapshot.Sessions) != 0 {
+				t.Errorf("expected the expired session pruned and the other revoked, got %v %v", snapshot.RefreshTokens, snapshot.Sessions)
+			}
+
+			err = store.RevokeRefreshToken("next")
+			if !errors.Is(err, ErrTokenNotFound) {
+				t.Errorf("expected ErrTokenNotFound, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRefreshTokensSurviveLogReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	options := Options{Policy: PersistLog}
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	db, userId := newTestDB(t, path, options)
+	_, err := db.CreateSession("first", Session{UserId: userId}, AccessToken{}, now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.RotateRefreshToken("first", "second", AccessToken{}, now, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	crash(db)
+
+	db, err = NewDBWithOptions(path, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	_, err = db.RotateRefreshToken("first", "stolen", AccessToken{}, now, time.Hour)
+	if !errors.Is(err, ErrTokenReused) {
+		t.Errorf("expected ErrTokenReused after replay, got %v", err)
+	}
+}
@@ -0,0 +1,294 @@
+package database
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"time"
+)
+
+// MaxMFAAttempts is how many wrong codes a login challenge takes before
+// it is dropped and the user has to log in again
+const MaxMFAAttempts = 5
+
+var (
+	// ErrTOTPNotEnrolled is returned for users without an authenticator
+	// or with one that was never confirmed
+	ErrTOTPNotEnrolled = errors.New("totp not enrolled")
+	// ErrTOTPEnrolled is returned when enrolling a user that already
+	// has a confirmed authenticator
+	ErrTOTPEnrolled = errors.New("totp already enrolled")
+	// ErrInvalidMFACode is returned for wrong, reused or expired codes
+	ErrInvalidMFACode = errors.New("invalid mfa code")
+	// ErrMFAChallengeNotFound is returned for login challenges that were
+	// never issued, were used or took too many wrong codes
+	ErrMFAChallengeNotFound = errors.New("mfa challenge not found")
+	// ErrMFAChallengeExpired is returned for login challenges past their expiry
+	ErrMFAChallengeExpired = errors.New("mfa challenge expired")
+)
+
+// TOTPCheck validates a code against a totp secret at now and returns the
+// period it belongs to, the stores keep the crypto out and only track use
+type TOTPCheck func(secret string, code string, now time.Time) (int64, bool)
+
+// TOTP is the authenticator of a user, it only guards logins once
+// confirmed. LastStep is the period of the last code used so a code
+// can't be replayed, RecoveryCodes are hashed like refresh tokens
+type TOTP struct {
+	UserId        int       `json:"user_id"`
+	Secret        string    `json:"secret"`
+	Confirmed     bool      `json:"confirmed"`
+	CreatedAt     time.Time `json:"created_at"`
+	LastStep      int64     `json:"last_step"`
+	RecoveryCodes []string  `json:"recovery_codes"`
+}
+
+// MFAChallenge is a login that passed the password and waits for the
+// second factor, only the hash of its token is kept
+type MFAChallenge struct {
+	Hash      string    `json:"hash"`
+	UserId    int       `json:"user_id"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+	Attempts  int       `json:"attempts"`
+}
+
+// hashRecoveryCode hashes a recovery code however it was typed
+func hashRecoveryCode(code string) string {
+	code = strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashToken(code)
+}
+
+// checkSecret checks code against the secret of totp, which is sealed
+// when a keyring is configured. The returned record has the secret sealed
+// with the active key, so records are resealed as they are used
+func checkSecret(keys *Keyring, totp TOTP, code string, now time.Time, check TOTPCheck) (TOTP, int64, bool, error) {
+	secret, err := openSecret(keys, totp.Secret)
+	if err != nil {
+		return totp, 0, false, err
+	}
+	totp.Secret = sealSecret(keys, secret)
+
+	step, ok := check(secret, code, now)
+	return totp, step, ok, nil
+}
+
+// matchCode checks code as a totp code newer than the last one used and
+// then as a recovery code. It returns the updated record, without the
+// recovery code if one was used
+func matchCode(keys *Keyring, totp TOTP, code string, now time.Time, check TOTPCheck) (TOTP, bool, error) {
+	totp, step, ok, err := checkSecret(keys, totp, code, now, check)
+	if err != nil {
+		return totp, false, err
+	}
+	if ok && step > totp.LastStep {
+		totp.LastStep = step
+		return totp, true, nil
+	}
+
+	i := slices.Index(totp.RecoveryCodes, hashRecoveryCode(code))
+	if i < 0 {
+		return totp, false, nil
+	}
+	totp.RecoveryCodes = slices.Delete(slices.Clone(totp.RecoveryCodes), i, i+1)
+
+	return totp, true, nil
+}
+
+// resealTOTPSecrets seals every totp secret of dbStructure with the
+// active key of keys
+func resealTOTPSecrets(dbStructure DBStructure, keys *Keyring) error {
+	for userId, totp := range dbStructure.TOTP {
+		secret, err := openSecret(keys, totp.Secret)
+		if err != nil {
+			return err
+		}
+		totp.Secret = sealSecret(keys, secret)
+		dbStructure.TOTP[userId] = totp
+	}
+
+	return nil
+}
+
+// HasTOTP reports whether logins of the user need a second factor
+func (db *DB) HasTOTP(userId int) (bool, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	totp, ok := db.data.TOTP[userId]
+	return ok && totp.Confirmed, nil
+}
+
+// EnrollTOTP starts enrolling secret for the user, replacing an
+// enrollment that was never confirmed
+func (db *DB) EnrollTOTP(userId int, secret string, now time.Time) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.UsersById[userId]; !ok {
+		return ErrUserNotFound
+	}
+	if totp, ok := db.data.TOTP[userId]; ok && totp.Confirmed {
+		return ErrTOTPEnrolled
+	}
+
+	totp := TOTP{
+		UserId:        userId,
+		Secret:        sealSecret(db.options.Keys, secret),
+		CreatedAt:     now,
+		RecoveryCodes: []string{},
+	}
+
+	return db.commit(walEntry{Op: opTOTPEnrolled, TOTP: &totp})
+}
+
+// ConfirmTOTP turns the enrollment of the user on with a code from the
+// authenticator and stores recoveryCodes
+func (db *DB) ConfirmTOTP(userId int, code string, recoveryCodes []string, now time.Time, check TOTPCheck) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	totp, ok := db.data.TOTP[userId]
+	if !ok {
+		return ErrTOTPNotEnrolled
+	}
+	if totp.Confirmed {
+		return ErrTOTPEnrolled
+	}
+
+	totp, step, ok, err := checkSecret(db.options.Keys, totp, code, now, check)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	totp.Confirmed = true
+	totp.LastStep = step
+	totp.RecoveryCodes = make([]string, 0, len(recoveryCodes))
+	for _, code := range recoveryCodes {
+		totp.RecoveryCodes = append(totp.RecoveryCodes, hashRecoveryCode(code))
+	}
+
+	return db.commit(walEntry{Op: opTOTPUpdated, TOTP: &totp})
+}
+
+// DisableTOTP removes the authenticator of the user given a code from it
+// or a recovery code
+func (db *DB) DisableTOTP(userId int, code string, now time.Time, check TOTPCheck) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	totp, ok := db.data.TOTP[userId]
+	if !ok || !totp.Confirmed {
+		return ErrTOTPNotEnrolled
+	}
+
+	_, ok, err := matchCode(db.options.Keys, totp, code, now, check)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrInvalidMFACode
+	}
+
+	return db.commit(walEntry{Op: opTOTPDisabled, Id: userId})
+}
+
+// CreateMFAChallenge stores a login challenge for the user
+func (db *DB) CreateMFAChallenge(token string, userId int, now time.Time, ttl time.Duration) error {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	if _, ok := db.data.UsersById[userId]; !ok {
+		return ErrUserNotFound
+	}
+
+	entries := []walEntry{}
+	for hash, challenge := range db.data.MFAChallenges {
+		if !now.Before(challenge.ExpiresAt) {
+			entries = append(entries, walEntry{Op: opMFAChallengeUsed, Hash: hash})
+		}
+	}
+
+	challenge := MFAChallenge{
+		Hash:      hashToken(token),
+		UserId:    userId,
+		CreatedAt: now,
+		ExpiresAt: now.Add(ttl),
+	}
+	entries = append(entries, walEntry{Op: opMFAChallengeIssued, MFAChallenge: &challenge})
+
+	return db.commit(entries...)
+}
+
+// GetMFAChallengeUser returns the user a login challenge was issued to
+// without using it up
+func (db *DB) GetMFAChallengeUser(token string) (int, error) {
+	db.mux.RLock()
+	defer db.mux.RUnlock()
+
+	challenge, ok := db.data.MFAChallenges[hashToken(token)]
+	if !ok {
+		return 0, ErrMFAChallengeNotFound
+	}
+
+	return challenge.UserId, nil
+}
+
+// CompleteMFAChallenge uses the challenge up given a code from the
+// authenticator or a recovery code and returns the user that logged in.
+// A wrong code counts against the challenge
+func (db *DB) CompleteMFAChallenge(token string, code string, now time.Time, check TOTPCheck) (int, error) {
+	db.mux.Lock()
+	defer db.mux.Unlock()
+
+	hash := hashToken(token)
+	challenge, ok := db.data.MFAChallenges[hash]
+	if !ok {
+		return 0, ErrMFAChallengeNotFound
+	}
+
+	used := walEntry{Op: opMFAChallengeUsed, Hash: hash}
+	if !now.Before(challenge.ExpiresAt) {
+		err := db.commit(used)
+		if err != nil {
+			return 0, err
+		}
+		return 0, ErrMFAChallengeExpired
+	}
+
+	totp, ok := db.data.TOTP[challenge.UserId]
+	if !ok || !totp.Confirmed {
+		err := db.commit(used)
+		if err != nil {
+			return 0, err
+		}
+		return 0, ErrTOTPNotEnrolled
+	}
+
+	totp, ok, err := matchCode(db.options.Keys, totp, code, now, check)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		challenge.Attempts++
+		failed := walEntry{Op: opMFAChallengeFailed, MFAChallenge: &challenge}
+		if challenge.Attempts >= MaxMFAAttempts {
+			failed = used
+		}
+		err = db.commit(failed)
+		if err != nil {
+			return 0, err
+		}
+		return 0, ErrInvalidMFACode
+	}
+
+	err = db.commit(used, walEntry{Op: opTOTPUpdated, TOTP: &totp})
+	if err != nil {
+		return 0, err
+	}
+
+	return challenge.UserId, nil
+}
@@ -0,0 +1,196 @@
+package database
+
+import (
+	"encoding/base64"
+	"errors"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// fakeCheck takes the period as the code for the secret "secret"
+func fakeCheck(secret string, code string, now time.Time) (int64, bool) {
+	step, err := strconv.ParseInt(code, 10, 64)
+	return step, err == nil && secret == "secret"
+}
+
+func TestTOTP(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	ttl := 5 * time.Minute
+
+	for driver, store := range openTestStores(t) {
+		t.Run(driver, func(t *testing.T) {
+			err := store.ConfirmTOTP(1, "10", nil, now, fakeCheck)
+			if !errors.Is(err, ErrTOTPNotEnrolled) {
+				t.Errorf("expected ErrTOTPNotEnrolled, got %v", err)
+			}
+
+			err = store.EnrollTOTP(1, "replaced", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.EnrollTOTP(1, "secret", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			enrolled, err := store.HasTOTP(1)
+			if err != nil || enrolled {
+				t.Errorf("expected an unconfirmed authenticator not to count, got %v %v", enrolled, err)
+			}
+
+			err = store.ConfirmTOTP(1, "wrong", nil, now, fakeCheck)
+			if !errors.Is(err, ErrInvalidMFACode) {
+				t.Errorf("expected ErrInvalidMFACode, got %v", err)
+			}
+			err = store.ConfirmTOTP(1, "10", []string{"aaaaa-bbbbb", "ccccc-ddddd"}, now, fakeCheck)
+			if err != nil {
+				t.Fatal(err)
+			}
+			enrolled, err = store.HasTOTP(1)
+			if err != nil || !enrolled {
+				t.Errorf("expected the authenticator confirmed, got %v %v", enrolled, err)
+			}
+			err = store.EnrollTOTP(1, "secret", now)
+			if !errors.Is(err, ErrTOTPEnrolled) {
+				t.Errorf("expected ErrTOTPEnrolled, got %v", err)
+			}
+
+			err = store.CreateMFAChallenge("totp", 1, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CompleteMFAChallenge("totp", "10", now, fakeCheck)
+			if !errors.Is(err, ErrInvalidMFACode) {
+				t.Errorf("expected the confirming code not to be replayed, got %v", err)
+			}
+			userId, err := store.CompleteMFAChallenge("totp", "11", now, fakeCheck)
+			if err != nil || userId != 1 {
+				t.Fatalf("expected user 1 logged in, got %d %v", userId, err)
+			}
+			_, err = store.CompleteMFAChallenge("totp", "12", now, fakeCheck)
+			if !errors.Is(err, ErrMFAChallengeNotFound) {
+				t.Errorf("expected the challenge to be single use, got %v", err)
+			}
+
+			for _, token := range []string{"recovery", "recovery-again"} {
+				err = store.CreateMFAChallenge(token, 1, now, ttl)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, err = store.CompleteMFAChallenge("recovery", "AAAAA BBBBB", now, fakeCheck)
+			if err != nil {
+				t.Errorf("expected the recovery code however it is typed, got %v", err)
+			}
+			_, err = store.CompleteMFAChallenge("recovery-again", "aaaaa-bbbbb", now, fakeCheck)
+			if !errors.Is(err, ErrInvalidMFACode) {
+				t.Errorf("expected the recovery code to be single use, got %v", err)
+			}
+
+			err = store.CreateMFAChallenge("guessed", 1, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < MaxMFAAttempts; i++ {
+				_, err = store.CompleteMFAChallenge("guessed", "wrong", now, fakeCheck)
+				if !errors.Is(err, ErrInvalidMFACode) {
+					t.Errorf("expected ErrInvalidMFACode, got %v", err)
+				}
+			}
+			_, err = store.CompleteMFAChallenge("guessed", "20", now, fakeCheck)
+			if !errors.Is(err, ErrMFAChallengeNotFound) {
+				t.Errorf("expected the challenge dropped after %d wrong codes, got %v", MaxMFAAttempts, err)
+			}
+
+			err = store.CreateMFAChallenge("expiring", 1, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CompleteMFAChallenge("expiring", "20", now.Add(ttl), fakeCheck)
+			if !errors.Is(err, ErrMFAChallengeExpired) {
+				t.Errorf("expected ErrMFAChallengeExpired, got %v", err)
+			}
+
+			err = store.CreateMFAChallenge("disabled", 1, now, ttl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.DisableTOTP(1, "wrong", now, fakeCheck)
+			if !errors.Is(err, ErrInvalidMFACode) {
+				t.Errorf("expected ErrInvalidMFACode, got %v", err)
+			}
+			err = store.DisableTOTP(1, "ccccc-ddddd", now, fakeCheck)
+			if err != nil {
+				t.Fatal(err)
+			}
+			enrolled, err = store.HasTOTP(1)
+			if err != nil || enrolled {
+				t.Errorf("expected the authenticator removed, got %v %v", enrolled, err)
+			}
+			_, err = store.CompleteMFAChallenge("disabled", "30", now, fakeCheck)
+			if !errors.Is(err, ErrTOTPNotEnrolled) {
+				t.Errorf("expected ErrTOTPNotEnrolled, got %v", err)
+			}
+		})
+	}
+}
+
+func TestTOTPSecretSealed(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	keys := map[string]string{}
+
+	for _, driver := range []string{DriverJSON, DriverSQLite} {
+		t.Run(driver, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "database")
+
+			store, err := Open(driver, path, Options{Keys: testKeyring(t, keys, "old")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CreateUser("a@example.com", "password")
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = store.EnrollTOTP(1, "secret", now)
+			if err != nil {
+				t.Fatal(err)
+			}
+			store.Close()
+
+			// the secret is resealed with the active key once it is used
+			store, err = Open(driver, path, Options{Keys: testKeyring(t, keys, "new", "old")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer store.Close()
+
+			err = store.ConfirmTOTP(1, "10", nil, now, fakeCheck)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dbStructure, err := store.Snapshot()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored := dbStructure.TOTP[1].Secret
+			sealed, err := base64.StdEncoding.DecodeString(stored)
+			if err != nil {
+				t.Fatalf("expected the secret sealed, got %q", stored)
+			}
+			id, ok, err := sealedKeyId(sealed)
+			if err != nil || !ok || id != "new" {
+				t.Errorf("expected the secret sealed with the new key, got %q %v %v", id, ok, err)
+			}
+
+			err = store.CreateMFAChallenge("totp", 1, now, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = store.CompleteMFAChallenge("totp", "11", now, fakeCheck)
+			if err != nil {
+				t.Errorf("expected the sealed secret to check codes, got %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileMailer appends messages to a file instead of sending them, or
+// prints them when Path is empty. It is meant for tests and local
+// development
+type FileMailer struct {
+	Path string
+	mux  sync.Mutex
+}
+
+const fileMailerFrom = "chirpy@localhost"
+
+func (m *FileMailer) Send(msg Message) error {
+	data, err := format(fileMailerFrom, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var w io.Writer = os.Stdout
+	if m.Path != "" {
+		f, err := os.OpenFile(m.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	_, err = w.Write(append(data, "\r\n"...))
+	return err
+}
@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFileMailer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mail.txt")
+	mailer := &FileMailer{Path: path}
+
+	for _, to := range []string{"a@example.com", "b@example.com"} {
+		err := mailer.Send(Message{To: to, Subject: "Hello", Body: "first line\nsecond line"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"To: a@example.com\r\n", "To: b@example.com\r\n", "Subject: Hello\r\n", "\r\n\r\nfirst line\r\nsecond line\r\n"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("expected %q in %q", want, data)
+		}
+	}
+}
+
+func TestRejectsHeaderInjection(t *testing.T) {
+	mailer := &FileMailer{Path: filepath.Join(t.TempDir(), "mail.txt")}
+
+	err := mailer.Send(Message{To: "a@example.com\r\nBcc: b@example.com", Subject: "Hello"})
+	if !errors.Is(err, ErrInvalidHeader) {
+		t.Errorf("expected ErrInvalidHeader, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package mail
+
+import (
+	"errors"
+	"net"
+	"net/smtp"
+	"time"
+)
+
+// SMTPMailer sends messages through an SMTP server, the connection is
+// upgraded with STARTTLS when the server offers it
+type SMTPMailer struct {
+	// Addr is the host:port of the server
+	Addr string
+	From string
+	// Username and Password log in with PLAIN auth when set
+	Username string
+	Password string
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	if m.From == "" {
+		return errors.New("smtp mailer has no from address")
+	}
+
+	data, err := format(m.From, msg, time.Now())
+	if err != nil {
+		return err
+	}
+
+	var auth smtp.Auth
+	if m.Username != "" {
+		host, _, err := net.SplitHostPort(m.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", m.Username, m.Password, host)
+	}
+
+	return smtp.SendMail(m.Addr, auth, m.From, []string{msg.To}, data)
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/joho/godotenv"
 	"github.com/neet-007/chirpy/api"
@@ -11,7 +15,20 @@ import (
 
 func main() {
 	godotenv.Load()
-	const filepathRoot = "."
+
+	if len(os.Args) > 1 {
+		err := runCommand(os.Args[1], os.Args[2:])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	serve()
+}
+
+func serve() {
 	const port = "8080"
 
 	apiCfg, err := api.NewApiConfig()
@@ -22,32 +39,39 @@ func main() {
 	}
 
 	mux := http.NewServeMux()
-	mux.Handle("/app/*", apiCfg.MiddlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(filepathRoot)))))
-	mux.HandleFunc("GET /api/healthz", handlerReadiness)
-	mux.HandleFunc("GET /api/chirps", apiCfg.HandlerValidatePost)
-	mux.HandleFunc("GET /api/chirps/{chat_id}", apiCfg.HandlerGetChirpById)
-	mux.HandleFunc("DELETE /api/chirps/{chat_id}", apiCfg.HandlerDeleteChirp)
-	mux.HandleFunc("POST /api/chirps", apiCfg.HandlerValidatePost)
-	mux.HandleFunc("POST /api/users", apiCfg.HandlerCreateUser)
-	mux.HandleFunc("PUT /api/users", apiCfg.HandlerUpdateUser)
-	mux.HandleFunc("POST /api/login", apiCfg.HandlerLogUser)
-	mux.HandleFunc("POST /api/refresh", apiCfg.HandlerRefreshToken)
-	mux.HandleFunc("POST /api/revoke", apiCfg.HandlerRevokeToken)
-	mux.HandleFunc("GET /admin/metrics", apiCfg.HandlerMetrics)
-	mux.HandleFunc("GET /api/reset", apiCfg.HandlerReset)
-	mux.HandleFunc("POST /api/polka/webhooks", apiCfg.HandlerChirpRedWebHook)
+	api.Routes(mux, &apiCfg)
 
 	srv := &http.Server{
 		Addr:    ":" + port,
 		Handler: mux,
 	}
 
-	log.Printf("Serving files from %s on port: %s\n", filepathRoot, port)
-	log.Fatal(srv.ListenAndServe())
-}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-func handlerReadiness(w http.ResponseWriter, r *http.Request) {
-	w.Header().Add("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte(http.StatusText(http.StatusOK)))
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	purged := make(chan struct{})
+	go func() {
+		apiCfg.RunAccountPurge(ctx)
+		close(purged)
+	}()
+
+	log.Printf("Serving files from %s on port: %s\n", api.FileserverRoot, port)
+	err = srv.ListenAndServe()
+	if err != nil && err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+
+	// a purge that is running finishes before the database closes
+	stop()
+	<-purged
+
+	err = apiCfg.Close()
+	if err != nil {
+		log.Fatalf("closing database: %s", err)
+	}
 }